@@ -3,12 +3,67 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
+	"strings"
 
 	"srv.exe.dev/srv"
 )
 
-var flagListenAddr = flag.String("listen", ":8000", "address to listen on")
+var (
+	flagListenAddr            = flag.String("listen", ":8000", "address to listen on")
+	flagCORSOrigins           = flag.String("cors-origins", "", "comma-separated origins allowed to call the /api routes (\"*\" for any)")
+	flagEmbedAncestors        = flag.String("embed-ancestors", "", "comma-separated origins allowed to frame the /embed widget and job pages (\"*\" for any; default same-origin only)")
+	flagLogFormat             = flag.String("log-format", "text", "log output format: text or json")
+	flagLogLevel              = flag.String("log-level", "info", "minimum log level: debug, info, warn, or error")
+	flagPublicURL             = flag.String("public-url", "", "externally visible base URL used in job callbacks (default http://$HOSTNAME)")
+	flagAllowPrivateCallbacks = flag.Bool("allow-private-callbacks", false, "allow job callbackURLs on private and loopback addresses")
+	flagWorkDir               = flag.String("work-dir", "", "scratch directory for intermediate files, e.g. a tmpfs (default $WORK_DIR or the system temp dir)")
+	flagDefaultPrompt         = flag.String("default-prompt", "", "AI prompt used when a job gives none (default $DEFAULT_AI_PROMPT or the built-in prompt)")
+	flagMaxPromptLen          = flag.Int("max-prompt-length", srv.DefaultMaxPromptLen, "maximum AI prompt length in characters")
+	flagAllowedTypes          = flag.String("allowed-types", "", "comma-separated image MIME types accepted for upload, e.g. image/png,image/jpeg (default any image)")
+	flagMaxUploadFiles        = flag.Int("max-upload-files", srv.DefaultMaxUploadFiles, "maximum number of images accepted in one upload request")
+	flagNormalizeAIOutput     = flag.Bool("normalize-ai-output", true, "re-encode AI results as PNG before caching, whatever format Gemini returned")
+	flagAIModalities          = flag.String("ai-modalities", "text,image", `Gemini response modalities: "text,image" to also get the model's description, or "image" to skip the text where the model supports it`)
+	flagMaxAIConcurrent       = flag.Int("max-ai-concurrent", srv.DefaultMaxAIConcurrent, "most Gemini API calls in flight at once across all jobs; others wait for a slot (0 for no limit)")
+	flagMaxJobs               = flag.Int("max-jobs", srv.DefaultMaxJobs, "most jobs kept in memory; the oldest finished jobs are evicted beyond this (0 for no limit)")
+	flagEvictJobFiles         = flag.Bool("evict-job-files", false, "also delete the upload directory of jobs evicted by -max-jobs")
+	flagRequireApproval       = flag.Bool("require-approval", false, "hold each job's downloads until its toolpath preview is approved on the status page")
+	flagNameLinks             = flag.Bool("name-links", false, "link each job directory as uploads/by-name/<filename>-<id> for browsing on disk")
+	flagToolRetries           = flag.Int("tool-retries", 0, fmt.Sprintf("times to requeue a job whose autotrace or svg2gcode run crashed (killed or out of memory), at most %d", srv.MaxToolRetries))
+	flagToolRetryDelay        = flag.Duration("tool-retry-delay", srv.DefaultToolRetryDelay, "wait before the first tool crash retry, doubling for each further retry")
+	flagUploadDebounce        = flag.Duration("upload-debounce", srv.DefaultUploadDebounce, "attach an upload to an identical one made within this window that is still processing (0 disables)")
+	flagTraceCache            = flag.Bool("trace-cache", false, "reuse the SVG of an image traced before with the same autotrace arguments instead of tracing it again")
+	flagMaxFeed               = flag.Float64("max-feed", 0, "clamp every job's feedrates to this many mm/min, whatever the job asks for (0 for no limit)")
+	flagAdminToken            = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token enabling the /admin routes (default $ADMIN_TOKEN)")
+
+	flagAlertWebhook      = flag.String("alert-webhook", "", "URL POSTed a JSON alert when a job fails")
+	flagAlertSMTP         = flag.String("alert-smtp", "", "host:port of an SMTP server to email failure alerts through")
+	flagAlertSMTPUser     = flag.String("alert-smtp-user", "", "SMTP user name for PLAIN auth (default no auth)")
+	flagAlertSMTPPassword = flag.String("alert-smtp-password", os.Getenv("ALERT_SMTP_PASSWORD"), "SMTP password for PLAIN auth (default $ALERT_SMTP_PASSWORD)")
+	flagAlertFrom         = flag.String("alert-from", "", "sender address of failure alert emails")
+	flagAlertTo           = flag.String("alert-to", "", "comma-separated recipients of failure alert emails")
+	flagAlertDebounce     = flag.Duration("alert-debounce", srv.DefaultAlertDebounce, "send one alert for identical failures within this window, counting the repeats")
+
+	flagReadHeaderTimeout = flag.Duration("read-header-timeout", srv.DefaultHTTPTimeouts.ReadHeader, "maximum time to read request headers (0 for none)")
+	flagReadTimeout       = flag.Duration("read-timeout", srv.DefaultHTTPTimeouts.Read, "maximum time to read a request including uploads (0 for none)")
+	flagWriteTimeout      = flag.Duration("write-timeout", srv.DefaultHTTPTimeouts.Write, "maximum time to write a response (0 for none)")
+	flagIdleTimeout       = flag.Duration("idle-timeout", srv.DefaultHTTPTimeouts.Idle, "maximum time a keep-alive connection may stay idle (0 for none)")
+
+	flagWarnPaths  = flag.Int("warn-paths", srv.DefaultComplexityThresholds.MaxPaths, "warn when a job's SVG has more paths than this (0 to disable)")
+	flagWarnMoves  = flag.Int("warn-moves", srv.DefaultComplexityThresholds.MaxMoves, "warn when a job's G-code has more moves than this (0 to disable)")
+	flagWarnSizeKB = flag.Int64("warn-size-kb", srv.DefaultComplexityThresholds.MaxFileBytes>>10, "warn when a job's G-code is larger than this many KB (0 to disable)")
+
+	flagMinDPI = flag.Float64("min-dpi", srv.DefaultDPILimits.Min, "lowest DPI passed to svg2gcode; lower calculated values are clamped (0 for no limit)")
+	flagMaxDPI = flag.Float64("max-dpi", srv.DefaultDPILimits.Max, "highest DPI passed to svg2gcode; higher calculated values are clamped (0 for no limit)")
+
+	flagMinOutputSize = flag.Float64("min-output-size", srv.DefaultOutputSizeLimits.Min, "smallest max width or height in mm a job may request; smaller requests are raised to it with a warning (0 for no limit)")
+	flagMaxOutputSize = flag.Float64("max-output-size", srv.DefaultOutputSizeLimits.Max, "largest max width or height in mm a job may request; larger requests are lowered to it with a warning (0 for no limit)")
+
+	flagKeepOut     = flag.String("keep-out", "", "semicolon-separated keep-out rectangles in mm, each [name=]x1,y1,x2,y2")
+	flagKeepOutFail = flag.Bool("keep-out-fail", false, "fail jobs whose cutting moves enter a keep-out region instead of warning")
+)
 
 func main() {
 	if err := run(); err != nil {
@@ -18,6 +73,14 @@ func main() {
 
 func run() error {
 	flag.Parse()
+
+	// Configure logging before anything else logs
+	handler, err := srv.NewLogHandler(os.Stderr, *flagLogFormat, *flagLogLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+
 	hostname := os.Getenv("HOSTNAME")
 	if hostname == "" {
 		hostname = "localhost:8000"
@@ -26,5 +89,121 @@ func run() error {
 	if err != nil {
 		return fmt.Errorf("create server: %w", err)
 	}
+	server.CORSOrigins = srv.ParseCORSOrigins(*flagCORSOrigins)
+	if server.EmbedAncestors, err = srv.ParseFrameAncestors(*flagEmbedAncestors); err != nil {
+		return err
+	}
+	server.AdminToken = *flagAdminToken
+	server.MaxPromptLen = *flagMaxPromptLen
+	if p := strings.TrimSpace(*flagDefaultPrompt); p != "" {
+		server.DefaultPrompt = p
+	}
+	if err := server.CheckDefaultPrompt(); err != nil {
+		return err
+	}
+	server.MaxUploadFiles = *flagMaxUploadFiles
+	if server.AllowedTypes, err = srv.ParseAllowedTypes(*flagAllowedTypes); err != nil {
+		return err
+	}
+	server.MaxJobs = *flagMaxJobs
+	server.EvictJobFiles = *flagEvictJobFiles
+	server.RequireApproval = *flagRequireApproval
+	server.NameLinks = *flagNameLinks
+	if *flagToolRetries < 0 || *flagToolRetries > srv.MaxToolRetries {
+		return fmt.Errorf("-tool-retries must be between 0 and %d", srv.MaxToolRetries)
+	}
+	if *flagToolRetryDelay <= 0 {
+		return fmt.Errorf("-tool-retry-delay must be positive")
+	}
+	server.ToolRetries = *flagToolRetries
+	server.ToolRetryDelay = *flagToolRetryDelay
+	if *flagUploadDebounce < 0 {
+		return fmt.Errorf("-upload-debounce must not be negative")
+	}
+	server.UploadDebounce = *flagUploadDebounce
+	if *flagMaxFeed < 0 {
+		return fmt.Errorf("-max-feed must not be negative")
+	}
+	server.MaxFeed = *flagMaxFeed
+	server.CacheTraces = *flagTraceCache
+	if *flagPublicURL != "" {
+		server.PublicURL = strings.TrimSuffix(*flagPublicURL, "/")
+	}
+	server.AllowPrivateCallbacks = *flagAllowPrivateCallbacks
+	server.NormalizeAIOutput = *flagNormalizeAIOutput
+	if *flagMaxAIConcurrent < 0 {
+		return fmt.Errorf("-max-ai-concurrent must not be negative")
+	}
+	server.MaxAIConcurrent = *flagMaxAIConcurrent
+	if server.AIModalities, err = srv.ParseAIModalities(*flagAIModalities); err != nil {
+		return err
+	}
+	if server.Alerts, err = parseAlerts(); err != nil {
+		return err
+	}
+	if *flagWorkDir != "" {
+		server.WorkDir = *flagWorkDir
+	}
+	server.Timeouts = srv.HTTPTimeouts{
+		ReadHeader: *flagReadHeaderTimeout,
+		Read:       *flagReadTimeout,
+		Write:      *flagWriteTimeout,
+		Idle:       *flagIdleTimeout,
+	}
+	if server.KeepOut, err = srv.ParseKeepOutRegions(*flagKeepOut); err != nil {
+		return err
+	}
+	server.KeepOutFail = *flagKeepOutFail
+	server.Complexity = srv.ComplexityThresholds{
+		MaxPaths:     *flagWarnPaths,
+		MaxMoves:     *flagWarnMoves,
+		MaxFileBytes: *flagWarnSizeKB << 10,
+	}
+	server.DPI = srv.DPILimits{Min: *flagMinDPI, Max: *flagMaxDPI}
+	if server.DPI.Min > 0 && server.DPI.Max > 0 && server.DPI.Min > server.DPI.Max {
+		return fmt.Errorf("-min-dpi %g is greater than -max-dpi %g", server.DPI.Min, server.DPI.Max)
+	}
+	server.OutputSize = srv.OutputSizeLimits{Min: *flagMinOutputSize, Max: *flagMaxOutputSize}
+	if server.OutputSize.Min < 0 || server.OutputSize.Max < 0 {
+		return fmt.Errorf("-min-output-size and -max-output-size must not be negative")
+	}
+	if server.OutputSize.Min > 0 && server.OutputSize.Max > 0 && server.OutputSize.Min > server.OutputSize.Max {
+		return fmt.Errorf("-min-output-size %g is greater than -max-output-size %g", server.OutputSize.Min, server.OutputSize.Max)
+	}
 	return server.Serve(*flagListenAddr)
 }
+
+// parseAlerts builds the failure alert settings from the -alert flags
+func parseAlerts() (srv.FailureAlerts, error) {
+	alerts := srv.FailureAlerts{
+		WebhookURL:   strings.TrimSpace(*flagAlertWebhook),
+		SMTPAddr:     strings.TrimSpace(*flagAlertSMTP),
+		SMTPUser:     *flagAlertSMTPUser,
+		SMTPPassword: *flagAlertSMTPPassword,
+		From:         strings.TrimSpace(*flagAlertFrom),
+		Debounce:     *flagAlertDebounce,
+	}
+	for _, to := range strings.Split(*flagAlertTo, ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			alerts.To = append(alerts.To, to)
+		}
+	}
+	if alerts.WebhookURL != "" {
+		u, err := url.Parse(alerts.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return alerts, fmt.Errorf("-alert-webhook must be an http or https URL")
+		}
+	}
+	if alerts.SMTPAddr != "" {
+		if !strings.Contains(alerts.SMTPAddr, ":") {
+			return alerts, fmt.Errorf("-alert-smtp must be host:port")
+		}
+		if alerts.From == "" || len(alerts.To) == 0 {
+			return alerts, fmt.Errorf("-alert-smtp needs -alert-from and -alert-to")
+		}
+	}
+	if alerts.Debounce < 0 {
+		return alerts, fmt.Errorf("-alert-debounce must not be negative")
+	}
+	return alerts, nil
+}
@@ -0,0 +1,164 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Adaptive feed defaults and limits
+const (
+	defaultMinFeed            = 300.0 // mm/min
+	defaultCurvatureThreshold = 30.0  // degrees
+	// Turns this sharp or sharper get the full slowdown to minFeed
+	fullSlowdownAngle = 90.0
+)
+
+// feedWordRegex matches an F word outside a ';' comment
+var feedWordRegex = regexp.MustCompile(`(?i)\s*F\s*[-+]?[0-9]*\.?[0-9]+`)
+
+// parseAdaptiveFeed validates the minFeed and curvatureThreshold options,
+// which only apply when adaptiveFeed is on. An empty value takes the
+// default.
+func parseAdaptiveFeed(enabled bool, minFeed, threshold string) (float64, float64, error) {
+	if !enabled {
+		return 0, 0, nil
+	}
+	feed, angle := defaultMinFeed, defaultCurvatureThreshold
+	if minFeed != "" {
+		n, err := strconv.ParseFloat(minFeed, 64)
+		if err != nil || n <= 0 || math.IsInf(n, 0) {
+			return 0, 0, fmt.Errorf("minFeed must be a positive number of mm/min")
+		}
+		feed = n
+	}
+	if threshold != "" {
+		n, err := strconv.ParseFloat(threshold, 64)
+		if err != nil || !(n > 0 && n < 180) {
+			return 0, 0, fmt.Errorf("curvatureThreshold must be a turn angle in degrees greater than 0 and less than 180")
+		}
+		angle = n
+	}
+	return feed, angle, nil
+}
+
+// cornerFeed returns the feed for a cut that starts or ends at a turn of
+// angle degrees. Turns up to threshold keep the full feed; sharper ones
+// slow linearly to minFeed at a right angle.
+func cornerFeed(feed, minFeed, angle, threshold float64) float64 {
+	if angle <= threshold || minFeed >= feed {
+		return feed
+	}
+	t := 1.0
+	if threshold < fullSlowdownAngle {
+		t = min((angle-threshold)/(fullSlowdownAngle-threshold), 1)
+	}
+	return feed - (feed-minFeed)*t
+}
+
+// turnAngle returns the change of direction in degrees between two moves
+func turnAngle(in, out point) float64 {
+	dot := in.X*out.X + in.Y*out.Y
+	cross := in.X*out.Y - in.Y*out.X
+	return math.Abs(math.Atan2(cross, dot)) * 180 / math.Pi
+}
+
+// setFeedWord replaces a line's F word, or adds one before any comment
+func setFeedWord(line string, feed float64) string {
+	code, comment := line, ""
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		code, comment = line[:i], line[i:]
+	}
+	code = strings.TrimRight(feedWordRegex.ReplaceAllString(code, ""), " ")
+	code += " F" + strconv.FormatFloat(math.Round(feed), 'f', -1, 64)
+	if comment != "" {
+		code += " " + comment
+	}
+	return code
+}
+
+// adaptFeedrates slows cutting moves on either side of sharp turns, where
+// a pen tends to skip at full speed. Curves reach svg2gcode flattened into
+// straight segments, and the tighter the curve the larger the turn between
+// neighbouring segments, so the turn angle stands in for curvature. Each
+// slowed move gets an F word and the program's own feed is restored on the
+// next move that is not slowed. It returns the new lines and the number of
+// moves slowed.
+func adaptFeedrates(lines []string, minFeed, threshold float64) ([]string, int, error) {
+	for _, line := range lines {
+		for _, w := range parseGCodeWords(line) {
+			if w.Letter == 'G' && w.Value == 20 {
+				return lines, 0, fmt.Errorf("inch programs (G20) are not supported")
+			}
+		}
+	}
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return lines, 0, err
+	}
+
+	// Each line's cut as one step: its entry and exit directions, the feed
+	// it was programmed with, and the sharpest turn at either end
+	type cut struct {
+		line      int // 0-based
+		in, out   point
+		from, to  point
+		feed      float64
+		sharpness float64
+	}
+	var cuts []cut
+	for _, m := range moves {
+		d := point{m.To.X - m.From.X, m.To.Y - m.From.Y}
+		if !m.Cut || (d.X == 0 && d.Y == 0) {
+			continue
+		}
+		if n := len(cuts); n > 0 && cuts[n-1].line == m.Line-1 {
+			cuts[n-1].out, cuts[n-1].to = d, m.To // another segment of a flattened arc
+			continue
+		}
+		cuts = append(cuts, cut{line: m.Line - 1, in: d, out: d, from: m.From, to: m.To, feed: m.Feed})
+	}
+	for i := 1; i < len(cuts); i++ {
+		prev, c := &cuts[i-1], &cuts[i]
+		if prev.to != c.from {
+			continue // the tool lifted or travelled in between
+		}
+		angle := turnAngle(prev.out, c.in)
+		prev.sharpness = max(prev.sharpness, angle)
+		c.sharpness = max(c.sharpness, angle)
+	}
+
+	targets := make(map[int]float64) // line -> feed it must run at
+	slowed := 0
+	for _, c := range cuts {
+		if c.feed <= 0 {
+			continue // no feed to scale down
+		}
+		target := cornerFeed(c.feed, minFeed, c.sharpness, threshold)
+		if target < c.feed {
+			slowed++
+		}
+		targets[c.line] = target
+	}
+	if slowed == 0 {
+		return lines, 0, nil
+	}
+
+	out := make([]string, len(lines))
+	copy(out, lines)
+	current := 0.0 // the F in effect in the rewritten program
+	for i, line := range lines {
+		for _, w := range parseGCodeWords(line) {
+			if w.Letter == 'F' {
+				current = w.Value
+			}
+		}
+		if target, isCut := targets[i]; isCut && math.Round(target) != math.Round(current) {
+			out[i] = setFeedWord(line, target)
+			current = math.Round(target)
+		}
+	}
+	return out, slowed, nil
+}
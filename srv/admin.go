@@ -0,0 +1,138 @@
+package srv
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// withAdminAuth restricts a handler to requests bearing the admin token.
+// Admin routes do not exist unless AdminToken is set.
+func (s *Server) withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{Error: "invalid or missing admin token"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleAdminCacheMaintenance runs integrity checks, pending migrations, and
+// VACUUM against the AI cache database
+func (s *Server) HandleAdminCacheMaintenance(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.AICache.Maintain()
+	if err != nil {
+		slog.Error("cache maintenance", "error", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	slog.Info("cache maintenance", "integrity_ok", rep.IntegrityOK, "migrated", rep.Migrated,
+		"entries", rep.Entries, "size_before", rep.SizeBefore, "size_after", rep.SizeAfter)
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// HandleAdminCachePurge deletes every cached AI result, its rows and files,
+// and compacts the AI cache database
+func (s *Server) HandleAdminCachePurge(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.AICache.Purge()
+	if err != nil {
+		slog.Error("cache purge", "error", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	slog.Info("cache purge", "entries", rep.Entries, "files", rep.Files, "bytes", rep.Bytes,
+		"size_before", rep.SizeBefore, "size_after", rep.SizeAfter)
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// jobDeleteReport is returned by POST /admin/jobs/delete
+type jobDeleteReport struct {
+	Deleted []string        `json:"deleted"`
+	Skipped []jobDeleteSkip `json:"skipped"`
+}
+
+type jobDeleteSkip struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// HandleAdminDeleteJobs deletes jobs and their files. It takes the jobs to
+// delete as repeated id fields, or as a status ("done" or "error") and an
+// olderThan age such as 24h, either of which may be combined. Jobs still
+// processing or waiting for an API key are skipped, as are unknown IDs.
+func (s *Server) HandleAdminDeleteJobs(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	ids := r.Form["id"]
+	status := r.FormValue("status")
+	if status != "" && status != "done" && status != "error" {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: `status must be "done" or "error"`})
+		return
+	}
+	var olderThan time.Duration
+	if v := r.FormValue("olderThan"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "olderThan must be a positive duration such as 24h"})
+			return
+		}
+		olderThan = d
+	}
+	if len(ids) == 0 && status == "" && olderThan == 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "give job ids, a status, or olderThan"})
+		return
+	}
+	if len(ids) > 0 && (status != "" || olderThan > 0) {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "give either job ids or a status/olderThan selector, not both"})
+		return
+	}
+
+	rep := jobDeleteReport{Deleted: []string{}, Skipped: []jobDeleteSkip{}}
+	cutoff := time.Now().Add(-olderThan)
+	s.mu.Lock()
+	if len(ids) == 0 {
+		for id, job := range s.jobs {
+			if (status == "" || job.Status == status) && (olderThan == 0 || job.CreatedAt.Before(cutoff)) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+	}
+	for _, id := range ids {
+		job, ok := s.jobs[id]
+		switch {
+		case !ok:
+			rep.Skipped = append(rep.Skipped, jobDeleteSkip{id, "not found"})
+		case job.Status != "done" && job.Status != "error":
+			rep.Skipped = append(rep.Skipped, jobDeleteSkip{id, fmt.Sprintf("job is %s", job.Status)})
+		default:
+			delete(s.jobs, id)
+			rep.Deleted = append(rep.Deleted, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range rep.Deleted {
+		if err := os.RemoveAll(filepath.Join(s.UploadsDir, id)); err != nil {
+			slog.Warn("remove deleted job files", "job", id, "error", err)
+		}
+	}
+	s.unlinkJobNames(rep.Deleted)
+	slog.Info("deleted jobs", "deleted", len(rep.Deleted), "skipped", len(rep.Skipped))
+	writeJSON(w, http.StatusOK, rep)
+}
@@ -0,0 +1,98 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultMaxAIConcurrent is how many Gemini calls may be in flight at once.
+// Jobs beyond it wait their turn rather than tripping the API's rate limits.
+const DefaultMaxAIConcurrent = 2
+
+// acquireAISlot blocks until the job may call Gemini, noting in its log if
+// it had to wait, and returns the function that frees the slot. With
+// MaxAIConcurrent at 0 calls are not limited.
+func (s *Server) acquireAISlot(job *Job) (release func()) {
+	s.aiSlotsOnce.Do(func() {
+		if s.MaxAIConcurrent > 0 {
+			s.aiSlots = make(chan struct{}, s.MaxAIConcurrent)
+		}
+	})
+	if s.aiSlots == nil {
+		return func() {}
+	}
+	select {
+	case s.aiSlots <- struct{}{}:
+	default:
+		job.Log.WriteString(fmt.Sprintf("Waiting for an AI slot (%d Gemini calls already in progress)...\n", cap(s.aiSlots)))
+		start := time.Now()
+		s.aiSlots <- struct{}{}
+		job.Log.WriteString(fmt.Sprintf("Got an AI slot after %s\n", time.Since(start).Round(time.Millisecond)))
+	}
+	return func() { <-s.aiSlots }
+}
+
+// Gemini responseModalities choices. Text alongside the image costs output
+// tokens but gets the model's description of what it drew; image-only
+// skips it on models that support that.
+var (
+	AIModalitiesTextImage = []string{"text", "image"}
+	AIModalitiesImage     = []string{"image"}
+)
+
+// ParseAIModalities parses the -ai-modalities flag: "text,image" or "image"
+func ParseAIModalities(v string) ([]string, error) {
+	switch strings.ReplaceAll(strings.ToLower(v), " ", "") {
+	case "", "text,image", "image,text":
+		return AIModalitiesTextImage, nil
+	case "image":
+		return AIModalitiesImage, nil
+	}
+	return nil, fmt.Errorf(`-ai-modalities must be "text,image" or "image"`)
+}
+
+// geminiAPIError is an error response from the Gemini API
+type geminiAPIError struct {
+	Status  int
+	Message string // The API's own message, if it gave one
+}
+
+func (e *geminiAPIError) Error() string {
+	if e.Message != "" {
+		return "API error: " + e.Message
+	}
+	return fmt.Sprintf("API error (status %d)", e.Status)
+}
+
+// isModalityError reports whether Gemini refused a request because the model
+// cannot answer with the requested response modalities
+func isModalityError(err error) bool {
+	var apiErr *geminiAPIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusBadRequest &&
+		strings.Contains(strings.ToLower(apiErr.Message), "modalit")
+}
+
+// normalizeAIImage re-encodes an AI result as PNG, whatever Gemini returned
+// and whatever MIME type it claimed, so the cache, autotrace, and the
+// browser always see a file whose contents match its extension. PNG output
+// is lossless, so nothing in the decoded image is lost.
+func normalizeAIImage(data []byte) ([]byte, error) {
+	if http.DetectContentType(data) == "image/png" {
+		return data, nil
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode AI image: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode %s as png: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+package srv
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"strconv"
+)
+
+// defaultFlattenBackground is the color transparent pixels are composited
+// onto: the paper color the rest of the pipeline assumes
+const defaultFlattenBackground = "FFFFFF"
+
+// hexRGBA converts a color normalized by parseHexColor to color.RGBA
+func hexRGBA(hex string) color.RGBA {
+	v, _ := strconv.ParseUint(hex, 16, 32)
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+// hasAlphaChannel reports whether the image at path is stored in a color
+// model that can carry transparency, going by its header alone. Formats Go
+// can't decode, such as BMP and WebP, report false and are left to
+// autotrace as they are.
+func hasAlphaChannel(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return false
+	}
+	if p, ok := cfg.ColorModel.(color.Palette); ok {
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+		return false
+	}
+	switch cfg.ColorModel {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+	return false
+}
+
+// hasTransparency reports whether any pixel of img is not fully opaque
+func hasTransparency(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flattenAlpha composites img over an opaque background, so semi-transparent
+// edges blend into the background instead of reaching autotrace as noise
+func flattenAlpha(img image.Image, bg color.Color) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// flattenAlphaFile writes the image at inPath, flattened onto the background
+// color hex, to outPath as a PNG. It returns false without writing anything
+// when the image is already opaque.
+func flattenAlphaFile(inPath, outPath, hex string) (bool, error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return false, fmt.Errorf("decode image: %w", err)
+	}
+	if !hasTransparency(img) {
+		return false, nil
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return false, err
+	}
+	if err := png.Encode(out, flattenAlpha(img, hexRGBA(hex))); err != nil {
+		out.Close()
+		return false, err
+	}
+	return true, out.Close()
+}
@@ -0,0 +1,152 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Animated toolpath durations in seconds
+const (
+	defaultAnimationDuration = 20
+	maxAnimationDuration     = 600
+)
+
+// animationTravelSpeedup is how much faster than cuts travel moves are
+// drawn, as rapids outrun cutting feeds on the machine
+const animationTravelSpeedup = 4
+
+// animationRun is a stretch of connected moves of one kind, drawn as one
+// path
+type animationRun struct {
+	d      string
+	cut    bool
+	length float64 // in mm
+}
+
+// animationRuns splits moves into runs in execution order: consecutive
+// cuts that join up, and consecutive travels
+func animationRuns(moves []gcodeMove) []animationRun {
+	var runs []animationRun
+	var cur strings.Builder
+	var run animationRun
+	var last point
+	flush := func() {
+		if cur.Len() > 0 && run.length > 0 {
+			run.d = cur.String()
+			runs = append(runs, run)
+		}
+		cur.Reset()
+		run = animationRun{}
+	}
+	for _, m := range moves {
+		if cur.Len() == 0 || m.Cut != run.cut || m.From != last {
+			flush()
+			run.cut = m.Cut
+			fmt.Fprintf(&cur, "M%.3f,%.3f", m.From.X, -m.From.Y)
+		}
+		fmt.Fprintf(&cur, " L%.3f,%.3f", m.To.X, -m.To.Y)
+		run.length += math.Hypot(m.To.X-m.From.X, m.To.Y-m.From.Y)
+		last = m.To
+	}
+	flush()
+	return runs
+}
+
+// encodeToolpathAnimation writes an SVG that draws the toolpath in the
+// order the machine moves, over duration seconds, and returns the number
+// of paths it animates. Each run of moves is a path revealed along its
+// length with a SMIL animation of its dash offset, taking time in
+// proportion to its length; travel is drawn faint and dashed, and
+// animationTravelSpeedup times faster. Coordinates are machine millimetres
+// with Y negated, as in the plot SVG.
+func encodeToolpathAnimation(w io.Writer, moves []gcodeMove, duration float64) int {
+	b, ok := movesBounds(moves, false)
+	if !ok {
+		b = bounds{}
+	}
+	size := math.Max(math.Max(b.Width(), b.Height()), 1)
+	margin := size * 0.02
+	stroke := size / 400
+
+	runs := animationRuns(moves)
+	var total float64
+	for _, r := range runs {
+		if r.cut {
+			total += r.length
+		} else {
+			total += r.length / animationTravelSpeedup
+		}
+	}
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>`+"\n")
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="%.3f %.3f %.3f %.3f">`+"\n",
+		b.MinX-margin, -b.MaxY-margin, b.Width()+2*margin, b.Height()+2*margin)
+	fmt.Fprintf(w, `<rect x="%.3f" y="%.3f" width="%.3f" height="%.3f" fill="#ffffff"/>`+"\n",
+		b.MinX-margin, -b.MaxY-margin, b.Width()+2*margin, b.Height()+2*margin)
+	var at float64
+	for _, r := range runs {
+		t := r.length
+		style := fmt.Sprintf("fill:none;stroke:#000000;stroke-width:%.3f;stroke-linecap:round", stroke)
+		if !r.cut {
+			t /= animationTravelSpeedup
+			style = fmt.Sprintf("fill:none;stroke:#4682b4;stroke-opacity:0.35;stroke-width:%.3f", stroke/2)
+		}
+		dur := duration * t / total
+		fmt.Fprintf(w, `<path d="%s" style="%s" pathLength="1" stroke-dasharray="1 1" stroke-dashoffset="1">`, r.d, style)
+		fmt.Fprintf(w, `<animate attributeName="stroke-dashoffset" from="1" to="0" begin="%.3fs" dur="%.3fs" fill="freeze"/></path>`+"\n",
+			duration*at/total, math.Max(dur, 0.001))
+		at += t
+	}
+	fmt.Fprint(w, "</svg>\n")
+	return len(runs)
+}
+
+// parseAnimationDuration reads the duration query parameter in seconds
+func parseAnimationDuration(r *http.Request) (float64, error) {
+	v := r.URL.Query().Get("duration")
+	if v == "" {
+		return defaultAnimationDuration, nil
+	}
+	d, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(d >= 1 && d <= maxAnimationDuration) {
+		return 0, fmt.Errorf("duration must be a number of seconds from 1 to %d", maxAnimationDuration)
+	}
+	return d, nil
+}
+
+// HandleToolpathAnimation serves the job's G-code toolpath as an animated
+// SVG that draws it in execution order, to judge ordering and travel
+func (s *Server) HandleToolpathAnimation(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists || s.jobStatus(job) != "done" || job.GCodePath == "" {
+		http.Error(w, "Toolpath not available", http.StatusNotFound)
+		return
+	}
+
+	duration, err := parseAnimationDuration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	moves, err := readGCodeMoves(job.GCodePath)
+	if err != nil {
+		http.Error(w, "Failed to read G-Code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	encodeToolpathAnimation(&buf, moves, duration)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	http.ServeContent(w, r, "", jobModTime(job), bytes.NewReader(buf.Bytes()))
+}
@@ -0,0 +1,116 @@
+package srv
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// apiJob is the JSON representation of a job returned by the /api routes
+type apiJob struct {
+	ID            string    `json:"id"`
+	Status        string    `json:"status"`
+	Name          string    `json:"name,omitempty"`
+	OriginalName  string    `json:"originalName"`
+	CreatedAt     time.Time `json:"createdAt"`
+	AIImageCached bool      `json:"aiImageCached"`
+	AIText        string    `json:"aiText,omitempty"`
+	Approved      bool      `json:"approved"`
+	StatusURL     string    `json:"statusURL"`
+	DownloadURL   string    `json:"downloadURL,omitempty"`
+	Log           string    `json:"log"`
+	Warnings      []string  `json:"warnings"`
+
+	DimensionsDefaulted bool              `json:"dimensionsDefaulted"`
+	Rotated             bool              `json:"rotated"`
+	ToolFailure         *toolFailure      `json:"toolFailure,omitempty"`
+	Callback            *callbackDelivery `json:"callback,omitempty"`
+	JobOptions
+}
+
+// newAPIJob describes a job whose status, read under s.mu, is status. The
+// processing goroutine is still writing a processing job's results, so
+// apart from its log and warnings those are only reported once it has
+// published another status. name is the job's name, also read under s.mu.
+func newAPIJob(job *Job, status, name string) apiJob {
+	resp := apiJob{
+		ID:           job.ID,
+		Status:       status,
+		Name:         name,
+		OriginalName: job.OriginalName,
+		CreatedAt:    job.CreatedAt,
+		Approved:     job.Approved,
+		JobOptions:   job.JobOptions,
+		StatusURL:    "/api/jobs/" + job.ID,
+		Log:          job.Log.String(),
+		Warnings:     job.warnings(),
+		Callback:     job.callbackStatus(),
+	}
+	if status != "processing" {
+		resp.AIImageCached, resp.AIText = job.AIImageCached, job.AIText
+		resp.DimensionsDefaulted, resp.Rotated, resp.ToolFailure = job.DimensionsDefaulted, job.Rotated, job.ToolFailure
+	}
+	if status == "done" {
+		resp.DownloadURL = "/api/jobs/" + job.ID + "/download"
+	}
+	return resp
+}
+
+// apiError is the JSON body returned for failed /api requests
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("write json", "error", err)
+	}
+}
+
+// HandleAPICreateJob accepts the same multipart form as /upload and returns the
+// new job, or the existing one when the Idempotency-Key was already used
+func (s *Server) HandleAPICreateJob(w http.ResponseWriter, r *http.Request) {
+	job, status, err := s.startJob(r)
+	if err != nil {
+		writeJSON(w, status, apiError{Error: err.Error()})
+		return
+	}
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	writeJSON(w, status, newAPIJob(job, s.jobStatus(job), s.jobName(job)))
+}
+
+// HandleAPIJobStatus returns the current state of a job
+func (s *Server) HandleAPIJobStatus(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "Job not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIJob(job, s.jobStatus(job), s.jobName(job)))
+}
+
+// HandleOpenAPI serves the OpenAPI description of the /api routes
+func (s *Server) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// HandleAPIDocs serves a Swagger UI page for the OpenAPI document
+func (s *Server) HandleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.renderTemplate(w, "api_docs.html", nil); err != nil {
+		slog.Warn("render template", "url", r.URL.Path, "error", err)
+	}
+}
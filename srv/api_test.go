@@ -0,0 +1,924 @@
+package srv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPI(t *testing.T) {
+	server := newTestServer(t)
+	handler := server.Handler()
+
+	server.mu.Lock()
+	server.jobs["42"] = &Job{ID: "42", Status: "processing", OriginalName: "cat.png"}
+	server.mu.Unlock()
+
+	t.Run("job status returns JSON", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/jobs/42", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		var got apiJob
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if got.ID != "42" || got.Status != "processing" || got.DownloadURL != "" {
+			t.Errorf("unexpected job response: %+v", got)
+		}
+	})
+
+	t.Run("unknown job returns JSON 404", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/jobs/nope", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected JSON content type, got %q", ct)
+		}
+	})
+
+	t.Run("create job without image is rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/jobs", strings.NewReader(""))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("openapi document describes every API route", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var spec struct {
+			Paths map[string]map[string]any `json:"paths"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+			t.Fatalf("invalid OpenAPI JSON: %v", err)
+		}
+		for path, method := range map[string]string{
+			"/api/jobs":               "post",
+			"/api/jobs/{id}":          "get",
+			"/api/jobs/{id}/download": "get",
+		} {
+			if _, ok := spec.Paths[path][method]; !ok {
+				t.Errorf("OpenAPI document missing %s %s", strings.ToUpper(method), path)
+			}
+		}
+	})
+}
+
+func TestCORS(t *testing.T) {
+	server := newTestServer(t)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/api/jobs", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("no headers by default", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/jobs/nope", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("expected no CORS headers, got Access-Control-Allow-Origin %q", got)
+		}
+	})
+
+	server.CORSOrigins = ParseCORSOrigins("https://app.example.com/, https://other.example.com")
+
+	t.Run("preflight from allowed origin", func(t *testing.T) {
+		w := preflight("https://app.example.com")
+		if w.Code != http.StatusNoContent {
+			t.Errorf("expected status 204, got %d", w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+			t.Errorf("Access-Control-Allow-Origin = %q", got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+			t.Errorf("Access-Control-Allow-Methods = %q", got)
+		}
+	})
+
+	t.Run("preflight from other origin", func(t *testing.T) {
+		w := preflight("https://evil.example.com")
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("expected no Access-Control-Allow-Origin, got %q", got)
+		}
+	})
+
+	t.Run("HTML routes never get CORS headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("expected no CORS headers on /, got %q", got)
+		}
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	server := newTestServer(t)
+	server.UploadDebounce = 0 // identical uploads would attach to the first (see TestUploadDebounce)
+	handler := server.Handler()
+
+	upload := func(key string) (*httptest.ResponseRecorder, apiJob) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("image", "line.png")
+		fw.Write([]byte("\x89PNG\r\n\x1a\n but not really a png"))
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/jobs", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var job apiJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		return w, job
+	}
+
+	w1, first := upload("retry-123")
+	if w1.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", w1.Code, w1.Body.String())
+	}
+	w2, second := upload("retry-123")
+	if w2.Code != http.StatusOK {
+		t.Errorf("expected status 200 for replayed key, got %d", w2.Code)
+	}
+	if second.ID != first.ID {
+		t.Errorf("expected replay to return job %s, got %s", first.ID, second.ID)
+	}
+
+	_, third := upload("")
+	if third.ID == first.ID {
+		t.Error("expected a request without a key to create a new job")
+	}
+
+	if w, _ := upload(strings.Repeat("k", maxIdempotencyKeyLen+1)); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for oversized key, got %d", w.Code)
+	}
+}
+
+func TestUploadDebounce(t *testing.T) {
+	server := newTestServer(t)
+	handler := server.Handler()
+	release := make(chan struct{})
+	server.Runner = &fakeRunner{tools: map[string]func([]string) (string, string, error){
+		"autotrace": func(args []string) (string, string, error) {
+			<-release // hold the job in processing
+			return fakeAutotrace(`<svg width="4" height="4"><path style="stroke:#000000; fill:none;" d="M0 0L4 4"/></svg>`)(args)
+		},
+		"svg2gcode": fakeSvg2gcode("G1 X1 Y1 F1000\n"),
+	}}
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	upload := func(fields ...string) (int, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("image", "square.png")
+		fw.Write(img.Bytes())
+		for i := 0; i+1 < len(fields); i += 2 {
+			mw.WriteField(fields[i], fields[i+1])
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/jobs", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var job apiJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		return w.Code, job.ID
+	}
+	wait := func(id string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			server.mu.Lock()
+			status := server.jobs[id].Status
+			server.mu.Unlock()
+			if status != "processing" {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("job %s did not finish", id)
+	}
+
+	code, first := upload()
+	if code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", code)
+	}
+	if code, again := upload(); code != http.StatusOK || again != first {
+		t.Errorf("a repeat while processing should attach to job %s, got %d and job %s", first, code, again)
+	}
+	code, other := upload("maxWidth", "50")
+	if code != http.StatusAccepted || other == first {
+		t.Errorf("different options should start a new job, got %d and job %s", code, other)
+	}
+	close(release)
+	wait(first)
+	wait(other)
+
+	code, later := upload()
+	if code != http.StatusAccepted || later == first {
+		t.Errorf("a repeat after the job finished should start a new job, got %d and job %s", code, later)
+	}
+	wait(later)
+	server.mu.Lock()
+	n := len(server.jobs)
+	server.mu.Unlock()
+	if n != 3 {
+		t.Errorf("expected 3 jobs, got %d", n)
+	}
+}
+
+func TestOutputSizeClamp(t *testing.T) {
+	server := newTestServer(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("image", "line.png")
+	fw.Write([]byte("\x89PNG\r\n\x1a\n but not really a png"))
+	mw.WriteField("maxWidth", "5000")
+	mw.WriteField("maxHeight", "2")
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/jobs", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected out-of-range sizes to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var job apiJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if job.MaxWidth != DefaultOutputSizeLimits.Max || job.MaxHeight != DefaultOutputSizeLimits.Min {
+		t.Errorf("expected the size clamped to %s mm, got %g x %g", DefaultOutputSizeLimits, job.MaxWidth, job.MaxHeight)
+	}
+	if len(job.Warnings) < 2 || !strings.Contains(job.Warnings[0], "max width of 5000 mm") || !strings.Contains(job.Warnings[1], "max height of 2 mm") {
+		t.Errorf("expected a warning for each clamped dimension, got %q", job.Warnings)
+	}
+}
+
+func TestAPIInspect(t *testing.T) {
+	server := newTestServer(t)
+
+	inspect := func(data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("image", "art.png")
+		fw.Write(data)
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/inspect", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 300, 150)))
+
+	w := inspect(img.Bytes())
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got inspectResponse
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.Width != 300 || got.Height != 150 || got.Format != "png" {
+		t.Errorf("unexpected dimensions: %+v", got)
+	}
+	if got.SuggestedMaxWidth != 50.8 || got.SuggestedMaxHeight != 25.4 {
+		t.Errorf("unexpected suggested size: %+v", got)
+	}
+
+	if w := inspect([]byte("not an image")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415 for garbage, got %d", w.Code)
+	}
+}
+
+func TestAPIEstimateAI(t *testing.T) {
+	server := newTestServer(t)
+
+	estimate := func(fields map[string]string, image []byte) (aiEstimateResponse, int) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		if image != nil {
+			fw, _ := mw.CreateFormFile("image", "art.png")
+			fw.Write(image)
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/ai/estimate", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		var got aiEstimateResponse
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return got, w.Code
+	}
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 1000, 500)))
+	sum := sha256.Sum256(img.Bytes())
+	hash := hex.EncodeToString(sum[:])
+
+	got, code := estimate(map[string]string{"aiPrompt": "trace this"}, img.Bytes())
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if got.InputHash != hash || got.CacheKey != MakeCacheKey(hash, "trace this") || got.CacheHit {
+		t.Errorf("unexpected cache fields: %+v", got)
+	}
+	if got.ImageTokens != 2*geminiImageTileTokens || got.PromptTokens != 3 || got.TotalTokens != 3+2*geminiImageTileTokens+geminiOutputImageTokens {
+		t.Errorf("unexpected token estimate: %+v", got)
+	}
+	if got.Base64Bytes != base64.StdEncoding.EncodedLen(img.Len()) {
+		t.Errorf("base64Bytes = %d", got.Base64Bytes)
+	}
+
+	if _, err := server.AICache.Store(hash, DefaultAIPrompt, img.Bytes(), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = estimate(map[string]string{"imageHash": strings.ToUpper(hash)}, nil)
+	if !got.CacheHit || got.TotalTokens != 0 || got.CacheKey != MakeCacheKey(hash, DefaultAIPrompt) {
+		t.Errorf("the default prompt's cached result should be a hit: %+v", got)
+	}
+
+	// A refinement step's input is the cached output of the step before
+	var refine bytes.Buffer
+	png.Encode(&refine, image.NewGray(image.Rect(0, 0, 100, 100)))
+	got, _ = estimate(map[string]string{"imageHash": hash, "aiRefinePrompts": "sharpen"}, nil)
+	if len(got.Steps) != 2 || !got.Steps[0].CacheHit || got.Steps[1].CacheHit ||
+		got.Steps[1].CacheKey != MakeCacheKey(hash, "sharpen") || got.CacheHit {
+		t.Fatalf("unexpected steps: %+v", got)
+	}
+	if step := got.Steps[1]; got.TotalTokens != step.TotalTokens || step.TotalTokens != 2+2*geminiImageTileTokens+geminiOutputImageTokens {
+		t.Errorf("only the missing step should spend tokens: %+v", got)
+	}
+	if got.PromptTokens != got.Steps[0].PromptTokens+2 {
+		t.Errorf("prompt tokens should be summed over the steps: %+v", got)
+	}
+	if _, err := server.AICache.Store(hash, "sharpen", refine.Bytes(), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = estimate(map[string]string{"imageHash": hash, "aiRefinePrompts": "sharpen"}, nil)
+	if !got.CacheHit || got.TotalTokens != 0 {
+		t.Errorf("a fully cached chain should be a hit: %+v", got)
+	}
+	if len(got.Steps) != 2 || got.Steps[1].ImageTokens != geminiImageTokens(1000, 500) {
+		t.Errorf("a cached step's output should be measured for the next step: %+v", got.Steps)
+	}
+	if hits, misses := server.AICache.Counts(); hits != 0 || misses != 0 {
+		t.Errorf("estimates should not count as cache lookups, got %d hits and %d misses", hits, misses)
+	}
+
+	if _, code := estimate(map[string]string{"imageHash": "abc"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed hash, got %d", code)
+	}
+}
+
+func TestAdminCacheMaintenance(t *testing.T) {
+	server := newTestServer(t)
+
+	post := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/cache/maintenance", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(""); w.Code != http.StatusNotFound {
+		t.Errorf("expected admin routes to be disabled without a token, got %d", w.Code)
+	}
+
+	server.AdminToken = "s3cret"
+	if w := post("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a bad token, got %d", w.Code)
+	}
+
+	w := post("s3cret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var rep MaintenanceReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if !rep.IntegrityOK || !rep.Vacuumed || rep.Migrated {
+		t.Errorf("unexpected report for a healthy database: %+v", rep)
+	}
+}
+
+func TestAdminCachePurge(t *testing.T) {
+	server := newTestServer(t)
+	server.AdminToken = "s3cret"
+	cache := server.AICache
+
+	hash := strings.Repeat("ab", 32)
+	for _, prompt := range []string{"one", "two"} {
+		if _, err := cache.Store(hash, prompt, []byte("image"), "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held, err := cache.LookupInto(hash, "one", t.TempDir())
+	if err != nil || held == nil || filepath.Dir(held.FullPath) == cache.CacheDir() {
+		t.Fatalf("expected a copy of the hit outside the cache, got %+v, %v", held, err)
+	}
+	server.jobs["ai"] = &Job{ID: "ai", Status: "done", AIImageFilename: held.Filename}
+	os.MkdirAll(filepath.Join(server.UploadsDir, "ai"), 0755)
+	statusPage := func() string {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/job/ai", nil))
+		return w.Body.String()
+	}
+	if !strings.Contains(statusPage(), "/ai-cache/"+held.Filename) {
+		t.Fatal("expected the status page to show the cached AI image")
+	}
+	orphan := filepath.Join(cache.CacheDir(), "0123456789abcdef_1.jpg")
+	other := filepath.Join(cache.CacheDir(), "notes.txt")
+	for _, p := range []string{orphan, other} {
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/cache/purge", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var rep PurgeReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if rep.Entries != 2 || rep.Files != 3 || rep.Bytes != 2*int64(len("image"))+1 {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+
+	if hit, err := cache.Contains(hash, "one"); err != nil || hit {
+		t.Errorf("expected the purged entry to be gone, got %v, %v", hit, err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected the orphaned cache file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected a file the cache does not own to be kept: %v", err)
+	}
+	if data, err := os.ReadFile(held.FullPath); err != nil || string(data) != "image" {
+		t.Errorf("expected a looked up copy to outlive the purge, got %q, %v", data, err)
+	}
+	if strings.Contains(statusPage(), "/ai-cache/") {
+		t.Error("expected the status page to leave out a purged AI image")
+	}
+
+	if _, err := cache.Store(hash, "one", []byte("image"), "image/png"); err != nil {
+		t.Fatalf("store after purge: %v", err)
+	}
+	if hit, _ := cache.Contains(hash, "one"); !hit {
+		t.Error("expected the cache to work after a purge")
+	}
+}
+
+func TestAdminDeleteJobs(t *testing.T) {
+	server := newTestServer(t)
+	server.AdminToken = "s3cret"
+
+	old := time.Now().Add(-48 * time.Hour)
+	for id, job := range map[string]*Job{
+		"olderror": {Status: "error", CreatedAt: old},
+		"newerror": {Status: "error", CreatedAt: time.Now()},
+		"olddone":  {Status: "done", CreatedAt: old},
+		"running":  {Status: "processing", CreatedAt: old},
+	} {
+		job.ID = id
+		server.jobs[id] = job
+		if err := os.MkdirAll(filepath.Join(server.UploadsDir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	del := func(form url.Values) (int, jobDeleteReport) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/jobs/delete", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		var rep jobDeleteReport
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+				t.Fatalf("invalid JSON: %v", err)
+			}
+		}
+		return w.Code, rep
+	}
+
+	if code, _ := del(url.Values{}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a selector, got %d", code)
+	}
+	if code, _ := del(url.Values{"olderThan": {"soon"}}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad duration, got %d", code)
+	}
+
+	code, rep := del(url.Values{"status": {"error"}, "olderThan": {"24h"}})
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if !slices.Equal(rep.Deleted, []string{"olderror"}) || len(rep.Skipped) != 0 {
+		t.Errorf("unexpected report for old errors: %+v", rep)
+	}
+	if _, err := os.Stat(filepath.Join(server.UploadsDir, "olderror")); !os.IsNotExist(err) {
+		t.Errorf("expected the job directory to be removed, got %v", err)
+	}
+
+	_, rep = del(url.Values{"id": {"olddone", "running", "missing"}})
+	if !slices.Equal(rep.Deleted, []string{"olddone"}) {
+		t.Errorf("expected only olddone to be deleted, got %v", rep.Deleted)
+	}
+	want := []jobDeleteSkip{{"running", "job is processing"}, {"missing", "not found"}}
+	if !slices.Equal(rep.Skipped, want) {
+		t.Errorf("expected skipped %v, got %v", want, rep.Skipped)
+	}
+	if _, ok := server.jobs["running"]; !ok {
+		t.Error("a processing job was deleted")
+	}
+	if _, ok := server.jobs["newerror"]; !ok {
+		t.Error("a recent error was deleted")
+	}
+}
+
+func TestUploadValidation(t *testing.T) {
+	server := newTestServer(t)
+	server.MaxUploadFiles = 2
+
+	upload := func(files map[string][]byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, data := range files {
+			fw, _ := mw.CreateFormFile("image", name)
+			fw.Write(data)
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/jobs", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\n")
+	w := upload(map[string][]byte{"a.png": png, "b.png": png, "c.png": png})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too many files") {
+		t.Errorf("expected too many files to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = upload(map[string][]byte{"notes.png": []byte("hello"), "empty.png": nil})
+	if w.Code == http.StatusAccepted {
+		t.Fatalf("expected invalid files to be rejected")
+	}
+	for _, want := range []string{"notes.png: not an image", "empty.png: file is empty"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected error to mention %q, got %s", want, w.Body.String())
+		}
+	}
+
+	// An operator allow list is checked against the sniffed type, whatever
+	// the file is called
+	server.AllowedTypes, _ = ParseAllowedTypes(" Image/PNG ,")
+	w = upload(map[string][]byte{"art.png": []byte("GIF89a\x01\x00\x01\x00")})
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), "art.png: image/gif images are not accepted by this server (allowed: image/png)") {
+		t.Errorf("expected a GIF to be refused by the allow list, got %d: %s", w.Code, w.Body.String())
+	}
+	w = upload(map[string][]byte{"art.png": []byte("P6\n2 1\n255\n\x00\x00\x00\xff\xff\xff")})
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), "image/x-portable-pixmap images are not accepted") {
+		t.Errorf("expected a PPM to be sniffed and refused by the allow list, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := ParseAllowedTypes("image/png,text/plain"); err == nil {
+		t.Error("non-image types should be rejected in the allow list")
+	}
+
+	server.mu.Lock()
+	n := len(server.jobs)
+	server.mu.Unlock()
+	if n != 0 {
+		t.Errorf("expected no jobs to be created, got %d", n)
+	}
+}
+
+func TestSniffImageType(t *testing.T) {
+	tga := make([]byte, 18)
+	tga[2], tga[12], tga[14], tga[16] = 2, 4, 3, 24 // truecolor, 4x3, 24 bits
+	for _, c := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"PNG", []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+		{"ASCII PPM", []byte("P3\n# comment\n1 1\n255\n0 0 0\n"), "image/x-portable-pixmap"},
+		{"binary PGM", []byte("P5 1 1 255\n\x80"), "image/x-portable-graymap"},
+		{"PBM", []byte("P1\n1 1\n1\n"), "image/x-portable-bitmap"},
+		{"TGA", tga, "image/x-tga"},
+		{"text starting with P", []byte("P3x is not an image"), "text/plain; charset=utf-8"},
+		{"zeros", make([]byte, 18), "application/octet-stream"},
+		{"icon", []byte("\x00\x00\x01\x00\x01\x00\x10\x10\x00\x00\x01\x00\x20\x00\x68\x04\x00\x00\x16\x00\x00\x00"), "image/x-icon"},
+	} {
+		if got := sniffImageType(c.data); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCallback(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, bad := range []string{"ftp://example.com/hook", "http://127.0.0.1/hook", "http://10.1.2.3/hook", "http://[::1]/hook", "http://0.1.2.3/hook", "http://100.100.0.1/hook", "http://[64:ff9b::a00:1]/hook", "http://[64:ff9b::808:808]/hook", "http://[64:ff9b:1::1]/hook", "http://[::ffff:10.0.0.1]/hook", "http://localhost/hook", "http://user:pw@example.com/", "/relative"} {
+		if err := server.validateCallbackURL(bad); err == nil {
+			t.Errorf("expected callbackURL %q to be rejected", bad)
+		}
+	}
+	if err := server.validateCallbackURL("https://hooks.example.com/plot?x=1"); err != nil {
+		t.Errorf("expected public callbackURL to be accepted: %v", err)
+	}
+
+	var calls int
+	var got callbackPayload
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer hook.Close()
+
+	job := &Job{ID: "21", Status: "done", OriginalName: "fox.png", OutputWidth: 120, OutputHeight: 80, DPI: 150}
+	job.CallbackURL = hook.URL
+
+	// The dial-time check refuses loopback delivery by default
+	saved := callbackBackoff
+	callbackBackoff = []time.Duration{0}
+	defer func() { callbackBackoff = saved }()
+	server.deliverCallback(job, job.Status)
+	if d := job.callbackStatus(); calls != 0 || d.State != "failed" || d.Attempts != 2 || !strings.Contains(d.Error, "refusing to connect to private address") {
+		t.Fatalf("expected delivery to a private address to be refused, got %+v", d)
+	}
+
+	server.AllowPrivateCallbacks = true
+	server.PublicURL = "https://plot.example.com"
+	server.deliverCallback(job, job.Status)
+	if calls != 2 {
+		t.Fatalf("expected a retry after the 503, got %d calls: %+v", calls, job.callbackStatus())
+	}
+	if got.ID != "21" || got.Status != "done" || got.OutputWidth != 120 ||
+		got.DownloadURL != "https://plot.example.com/api/jobs/21/download" {
+		t.Errorf("unexpected payload %+v", got)
+	}
+	if d := job.callbackStatus(); d.State != "delivered" || d.Attempts != 2 || d.HTTPStatus != 200 {
+		t.Errorf("expected delivery on the second attempt, got %+v", d)
+	}
+	if job.Log.String() != "" {
+		t.Errorf("expected the job log to be left alone, got:\n%s", job.Log.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	server := newTestServer(t)
+
+	jobDir := filepath.Join(server.UploadsDir, "8")
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gcode := []byte("G21\nG90\nG0 X0 Y0\nG1 X10 Y10 F300\n")
+	gcodePath := filepath.Join(jobDir, "output.gcode")
+	os.WriteFile(gcodePath, gcode, 0644)
+
+	server.mu.Lock()
+	server.jobs["8"] = &Job{ID: "8", Status: "done", GCodePath: gcodePath}
+	server.jobs["9"] = &Job{ID: "9", Status: "processing"}
+	server.mu.Unlock()
+	server.stats.jobFinished("done")
+	server.AICache.Lookup("0123456789abcdef0123", DefaultAIPrompt)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	if w := get("/download/8"); w.Code != http.StatusOK {
+		t.Fatalf("download failed with %d", w.Code)
+	}
+
+	w := get("/stats")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var stats statsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Jobs.ByStatus["done"] != 1 || stats.Jobs.ByStatus["processing"] != 1 || stats.Jobs.Finished["done"] != 1 {
+		t.Errorf("unexpected job counts %+v", stats.Jobs)
+	}
+	if stats.AICache.Misses != 1 || stats.AICache.Hits != 0 {
+		t.Errorf("expected one cache miss, got %+v", stats.AICache)
+	}
+	if stats.Downloads.Count != 1 || stats.Downloads.Bytes != int64(len(gcode)) {
+		t.Errorf("expected one %d-byte download, got %+v", len(gcode), stats.Downloads)
+	}
+}
+
+func TestLintGCode(t *testing.T) {
+	program := strings.Join([]string{
+		"G21 G90",
+		"S4 M100",
+		"G0 X10 Y10",
+		"S4 M0",
+		"G1 X20 Y10 F3",
+		"G1 X250 Y10 F1000",
+		"M7",
+		"S4 M100",
+		"G1 X30 Y30",
+		"S4 M0",
+	}, "\n") + "\n"
+
+	report, err := lintGCode([]byte(program), lintOptions{ToolOn: "S4 M0", ToolOff: "s4  m100", BedWidth: 200, BedHeight: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{ // code to line
+		"no-homing":         0,
+		"tool-left-on":      0,
+		"extreme-feedrate":  5,
+		"out-of-bounds":     6,
+		"unknown-command":   7,
+		"cut-with-tool-off": 9,
+	}
+	for _, issue := range report.Issues {
+		line, ok := want[issue.Code]
+		if !ok || line != issue.Line {
+			t.Errorf("unexpected issue %+v", issue)
+		}
+		delete(want, issue.Code)
+	}
+	for code := range want {
+		t.Errorf("missing %s issue", code)
+	}
+	if report.Lines != 10 || report.CutMoves != 3 || report.Errors != 2 || report.Warnings != 4 {
+		t.Errorf("unexpected totals: %+v", report)
+	}
+	if b := report.Bounds; b == nil || b.MinX != 0 || b.MaxX != 250 || b.MaxY != 30 {
+		t.Errorf("unexpected bounds: %+v", b)
+	}
+
+	server := newTestServer(t)
+	lint := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/gcode/lint", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+	w := lint(url.Values{"gcode": {"$H\nG21\nS4 M100\nG0 X1 Y1\nS4 M0\nG1 X2 Y2 F1500\nS4 M100\n"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var clean lintReport
+	json.Unmarshal(w.Body.Bytes(), &clean)
+	if len(clean.Issues) != 0 || clean.Moves != 2 {
+		t.Errorf("expected a clean report, got %+v", clean)
+	}
+	if w := lint(url.Values{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without a program, got %d", w.Code)
+	}
+	if w := lint(url.Values{"gcode": {"G0 X1"}, "bedWidth": {"100"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for bedWidth alone, got %d", w.Code)
+	}
+}
+
+func TestFromJob(t *testing.T) {
+	server := newTestServer(t)
+
+	upload := func(fields map[string]string) (*httptest.ResponseRecorder, apiJob) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("image", "line.png")
+		fw.Write([]byte("\x89PNG\r\n\x1a\n but not really a png"))
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/jobs", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		var job apiJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		return w, job
+	}
+
+	w, source := upload(map[string]string{
+		"maxWidth":      "150",
+		"toolOn":        "M3 S500",
+		"aiPrompt":      "Outline the cat",
+		"formats":       "dxf",
+		"fill":          "on",
+		"fillAngle":     "0",
+		"adaptiveFeed":  "true",
+		"minFeed":       "400",
+		"autotraceArgs": "-corner-threshold 80",
+		"toolClasses":   "#FF0000=M3 S1000|M5|300\nwidth<1=M3 S150",
+		"qrCode":        "on",
+		"qrCodeCorner":  "top-left",
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w, copied := upload(map[string]string{"fromJob": "https://gcode.example.com/job/" + source.ID + "?x=1", "maxHeight": "90"})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", w.Code, w.Body.String())
+	}
+	want := source.JobOptions
+	want.MaxHeight = 90
+	if !reflect.DeepEqual(copied.JobOptions, want) {
+		t.Errorf("expected the source's options with maxHeight overridden:\n got %+v\nwant %+v", copied.JobOptions, want)
+	}
+	if copied.FillAngle != 0 || copied.AIPrompt != "Outline the cat" || len(copied.ToolClasses) != 2 {
+		t.Errorf("expected a 0° fill, the prompt, and both tool classes copied, got %+v", copied.JobOptions)
+	}
+
+	if _, again := upload(map[string]string{"fromJob": copied.ID, "fill": "false"}); again.Fill {
+		t.Error("expected an explicit false to turn off a copied option")
+	}
+	// The source has none of these on, so their sub-options must take
+	// their defaults rather than being copied as 0
+	w, plain := upload(map[string]string{})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, field := range []string{"fill", "fitArcs", "qrCode", "adaptiveFeed", "mergeCollinear"} {
+		if w, _ := upload(map[string]string{"fromJob": plain.ID, field: "on"}); w.Code != http.StatusAccepted {
+			t.Errorf("expected %s=on to be accepted on a copy, got %d: %s", field, w.Code, w.Body.String())
+		}
+	}
+	if w, copied := upload(map[string]string{"fromJob": plain.ID, "engine": "builtin"}); w.Code != http.StatusAccepted || copied.Feedrate != defaultBuiltinFeed {
+		t.Errorf("expected engine=builtin on a copy to take the default feedrate, got %d: %s", w.Code, w.Body.String())
+	}
+	if w, _ := upload(map[string]string{"fromJob": "nope"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown job, got %d", w.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?fromJob="+source.ID, nil))
+	if !strings.Contains(rec.Body.String(), `value="`+source.ID+`"`) || !strings.Contains(rec.Body.String(), "Using the settings of line.png") {
+		t.Error("expected the form to start copying the linked job")
+	}
+}
@@ -0,0 +1,48 @@
+package srv
+
+import "net/http"
+
+// awaitingApproval reports whether a job's machine output is held back
+// until someone approves its preview
+func (s *Server) awaitingApproval(job *Job) bool {
+	if !s.RequireApproval {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !job.Approved
+}
+
+// refuseUnapproved writes a 409 and returns true if job needs approval
+// before its output may be downloaded
+func (s *Server) refuseUnapproved(w http.ResponseWriter, job *Job) bool {
+	if !s.awaitingApproval(job) {
+		return false
+	}
+	http.Error(w, "This job must be approved on its status page before it can be downloaded", http.StatusConflict)
+	return true
+}
+
+// HandleJobApprove marks a finished job's output as reviewed, releasing
+// its downloads when RequireApproval is set
+func (s *Server) HandleJobApprove(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	done := exists && job.Status == "done"
+	if done {
+		job.Approved = true
+	}
+	s.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !done {
+		http.Error(w, "Only finished jobs can be approved", http.StatusConflict)
+		return
+	}
+	http.Redirect(w, r, "/job/"+jobID, http.StatusSeeOther)
+}
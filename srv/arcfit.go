@@ -0,0 +1,258 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Arc fitting defaults
+const (
+	defaultArcTolerance = 0.02 // mm
+	defaultMinArcRadius = 0.0  // mm; any radius
+	// minArcSegments is the fewest line segments worth replacing with an arc
+	minArcSegments = 3
+)
+
+// parseArcFit validates the arcTolerance and minArcRadius options, which
+// only apply when fitArcs is on. An empty value takes the default.
+func parseArcFit(enabled bool, tolerance, minRadius string) (float64, float64, error) {
+	if !enabled {
+		return 0, 0, nil
+	}
+	tol, radius := defaultArcTolerance, defaultMinArcRadius
+	if tolerance != "" {
+		n, err := strconv.ParseFloat(tolerance, 64)
+		if err != nil || n <= 0 || math.IsInf(n, 0) {
+			return 0, 0, fmt.Errorf("arcTolerance must be a positive number of mm")
+		}
+		tol = n
+	}
+	if minRadius != "" {
+		n, err := strconv.ParseFloat(minRadius, 64)
+		if err != nil || n < 0 || math.IsInf(n, 0) {
+			return 0, 0, fmt.Errorf("minArcRadius must be a number of mm, 0 or more")
+		}
+		radius = n
+	}
+	return tol, radius, nil
+}
+
+// arcFitStats describes what fitArcs did
+type arcFitStats struct {
+	Arcs     int // G2/G3 moves written
+	Replaced int // G1 moves they replaced
+	Rejected int // fitting arcs kept as lines for being under minArcRadius
+}
+
+// circleThrough returns the center and radius of the circle through three
+// points, and false when they are collinear
+func circleThrough(a, b, c point) (point, float64, bool) {
+	d := 2 * (a.X*(b.Y-c.Y) + b.X*(c.Y-a.Y) + c.X*(a.Y-b.Y))
+	if math.Abs(d) < 1e-12 {
+		return point{}, 0, false
+	}
+	a2, b2, c2 := a.X*a.X+a.Y*a.Y, b.X*b.X+b.Y*b.Y, c.X*c.X+c.Y*c.Y
+	center := point{
+		(a2*(b.Y-c.Y) + b2*(c.Y-a.Y) + c2*(a.Y-b.Y)) / d,
+		(a2*(c.X-b.X) + b2*(a.X-c.X) + c2*(b.X-a.X)) / d,
+	}
+	return center, math.Hypot(a.X-center.X, a.Y-center.Y), true
+}
+
+// fitArc tries to replace the polyline pts with one arc. It fits when every
+// point is within tol of the circle through the first, middle, and last
+// points, every segment's chord bows less than tol from it, the points
+// turn one way around the center, and the arc is less than a full turn.
+// Straight runs, which fit only as huge arcs, are refused.
+func fitArc(pts []point, tol float64) (center point, radius float64, clockwise, ok bool) {
+	first, last := pts[0], pts[len(pts)-1]
+	center, radius, ok = circleThrough(first, pts[len(pts)/2], last)
+	if !ok {
+		return point{}, 0, false, false
+	}
+	straight := true
+	for _, p := range pts[1 : len(pts)-1] {
+		if pointSegmentDistance(p, first, last) > tol {
+			straight = false
+			break
+		}
+	}
+	if straight {
+		return point{}, 0, false, false
+	}
+
+	sweep := 0.0
+	for i, p := range pts {
+		if math.Abs(math.Hypot(p.X-center.X, p.Y-center.Y)-radius) > tol {
+			return point{}, 0, false, false
+		}
+		if i == 0 {
+			continue
+		}
+		q := pts[i-1]
+		if half := math.Hypot(p.X-q.X, p.Y-q.Y) / 2; half >= radius || radius-math.Sqrt(radius*radius-half*half) > tol {
+			return point{}, 0, false, false
+		}
+		step := math.Atan2((q.X-center.X)*(p.Y-center.Y)-(q.Y-center.Y)*(p.X-center.X),
+			(q.X-center.X)*(p.X-center.X)+(q.Y-center.Y)*(p.Y-center.Y))
+		if i > 1 && (step < 0) != (sweep < 0) {
+			return point{}, 0, false, false
+		}
+		sweep += step
+	}
+	if math.Abs(sweep) >= 2*math.Pi-1e-6 {
+		return point{}, 0, false, false
+	}
+	return center, radius, sweep < 0, true
+}
+
+// pointSegmentDistance returns the distance from p to the segment ab
+func pointSegmentDistance(p, a, b point) float64 {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	l2 := dx*dx + dy*dy
+	if l2 == 0 {
+		return math.Hypot(p.X-a.X, p.Y-a.Y)
+	}
+	t := max(0, min(1, ((p.X-a.X)*dx+(p.Y-a.Y)*dy)/l2))
+	return math.Hypot(p.X-a.X-t*dx, p.Y-a.Y-t*dy)
+}
+
+// fitArcs replaces runs of short G1 cuts that follow a circle, which is how
+// svg2gcode writes curves, with G2/G3 arcs, for smoother motion and shorter
+// programs. A run is consecutive lines holding nothing but a linear cut,
+// with an F word allowed on its first line only. Each run is fitted
+// greedily with the longest arc that stays within tol mm of the original
+// points. Arcs with a radius under minRadius mm, which make some
+// controllers stutter, are left as lines and counted as rejected.
+func fitArcs(lines []string, tol, minRadius float64) ([]string, arcFitStats, error) {
+	var stats arcFitStats
+	for _, line := range lines {
+		for _, w := range parseGCodeWords(line) {
+			if w.Letter == 'G' && w.Value == 20 {
+				return lines, stats, fmt.Errorf("inch programs (G20) are not supported")
+			}
+			if w.Letter == 'G' && w.Value == 91 {
+				return lines, stats, fmt.Errorf("relative positioning (G91) is not supported")
+			}
+		}
+	}
+
+	var out []string
+	arcMode := false // the program's motion mode is G2/G3 after an arc we wrote
+	emit := func(line string) {
+		gWord, motionWord, hasXY := false, false, false
+		for _, w := range parseGCodeWords(line) {
+			switch w.Letter {
+			case 'G':
+				gWord = true
+				motionWord = motionWord || w.Value == 0 || w.Value == 1 || w.Value == 2 || w.Value == 3
+			case 'X', 'Y':
+				hasXY = true
+			}
+		}
+		if arcMode && hasXY && !gWord {
+			line = "G1 " + line // the line relied on the G1 an arc replaced
+			motionWord = true
+		}
+		if motionWord {
+			arcMode = false
+		}
+		out = append(out, line)
+	}
+
+	var run []string // lines of the current run
+	var pts []point  // run start followed by each line's end point
+	var feed string  // F word on the run's first line
+	flush := func() {
+		for s := 0; s < len(run); {
+			// The longest arc from point s, then whether its radius is allowed
+			best := -1
+			var center point
+			var radius float64
+			var clockwise bool
+			for e := s + minArcSegments; e <= len(run); e++ {
+				c, r, cw, ok := fitArc(pts[s:e+1], tol)
+				if !ok {
+					break
+				}
+				best, center, radius, clockwise = e, c, r, cw
+			}
+			if best < 0 {
+				emit(run[s])
+				s++
+				continue
+			}
+			if radius < minRadius {
+				stats.Rejected++
+				for _, line := range run[s:best] {
+					emit(line)
+				}
+				s = best
+				continue
+			}
+			from, to := pts[s], pts[best]
+			code := "G3"
+			if clockwise {
+				code = "G2"
+			}
+			arc := fmt.Sprintf("%s X%s Y%s I%s J%s", code,
+				strconv.FormatFloat(to.X, 'f', 3, 64), strconv.FormatFloat(to.Y, 'f', 3, 64),
+				strconv.FormatFloat(center.X-from.X, 'f', 3, 64), strconv.FormatFloat(center.Y-from.Y, 'f', 3, 64))
+			if s == 0 && feed != "" {
+				arc += " " + feed
+			}
+			out = append(out, arc)
+			arcMode = true
+			stats.Arcs++
+			stats.Replaced += best - s
+			s = best
+		}
+		run, feed = nil, ""
+	}
+
+	var pos point
+	motion := -1
+	for _, line := range lines {
+		target := pos
+		hasXY, other := false, false
+		f := ""
+		for _, w := range parseGCodeWords(line) {
+			switch w.Letter {
+			case 'G':
+				if w.Value == 0 || w.Value == 1 || w.Value == 2 || w.Value == 3 {
+					motion = int(w.Value)
+				} else {
+					other = true
+				}
+			case 'X':
+				target.X, hasXY = w.Value, true
+			case 'Y':
+				target.Y, hasXY = w.Value, true
+			case 'F':
+				f = "F" + strconv.FormatFloat(w.Value, 'f', -1, 64)
+			default:
+				other = true
+			}
+		}
+		// Comments stay on lines of their own, so commented moves are kept
+		linear := motion == 1 && hasXY && !other && !strings.ContainsAny(line, ";(")
+		if !linear || f != "" {
+			flush()
+		}
+		if !linear {
+			emit(line)
+			pos = target
+			continue
+		}
+		if len(run) == 0 {
+			pts, feed = []point{pos}, f
+		}
+		run = append(run, line)
+		pts = append(pts, target)
+		pos = target
+	}
+	flush()
+	return out, stats, nil
+}
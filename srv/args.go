@@ -0,0 +1,176 @@
+package srv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Extra command-line options users may pass through to the external tools,
+// mapped to whether the option takes a value. Options the pipeline sets
+// itself (output files, DPI, tool on/off, color count) are deliberately
+// absent so user input cannot redirect output or break scaling.
+var (
+	autotraceExtraOptions = map[string]bool{
+		"-corner-always-threshold":  true,
+		"-corner-surround":          true,
+		"-corner-threshold":         true,
+		"-despeckle-level":          true,
+		"-despeckle-tightness":      true,
+		"-error-threshold":          true,
+		"-filter-iterations":        true,
+		"-line-reversion-threshold": true,
+		"-line-threshold":           true,
+		"-noise-removal":            true,
+		"-preserve-width":           false,
+		"-remove-adjacent-corners":  false,
+		"-tangent-surround":         true,
+		"-width-weight-factor":      true,
+	}
+	svg2gcodeExtraOptions = map[string]bool{
+		"--feedrate":               true,
+		"--tolerance":              true,
+		"--origin":                 true,
+		"--begin":                  true,
+		"--end":                    true,
+		"--between":                true,
+		"--circular-interpolation": true,
+		"--checksums":              false,
+		"--line-numbers":           false,
+		"--newline-before-comment": false,
+	}
+)
+
+// splitArgs splits s into arguments the way a POSIX shell would for plain
+// words: whitespace separates arguments, single quotes preserve text
+// literally, and double quotes and backslashes escape. Nothing is expanded.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// parseExtraArgs splits and validates user-supplied tool arguments against
+// the tool's allowed options. Options may be given as "-opt value" or
+// "-opt=value"; bare values, unknown options, option-like values, and
+// control characters are rejected.
+func parseExtraArgs(field, s string, allowed map[string]bool) ([]string, error) {
+	tokens, err := splitArgs(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	args := []string{}
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if strings.IndexFunc(tok, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("%s: arguments must not contain control characters", field)
+		}
+		name, value, hasValue := strings.Cut(tok, "=")
+		takesValue, ok := allowed[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: option %q is not allowed (allowed: %s)", field, name, strings.Join(sortedKeys(allowed), ", "))
+		}
+		if !takesValue {
+			if hasValue {
+				return nil, fmt.Errorf("%s: option %s does not take a value", field, name)
+			}
+			args = append(args, name)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("%s: option %s requires a value", field, name)
+			}
+			i++
+			value = tokens[i]
+			if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+				return nil, fmt.Errorf("%s: arguments must not contain control characters", field)
+			}
+		}
+		// A value that looks like an option could be parsed as one by the
+		// tool, smuggling past the allowlist; negative numbers are fine
+		if len(value) > 1 && value[0] == '-' && !strings.ContainsRune("0123456789.", rune(value[1])) {
+			return nil, fmt.Errorf("%s: value %q for %s looks like an option", field, value, name)
+		}
+		args = append(args, name, value)
+	}
+	return args, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatCommand renders a command line for the job log, single-quoting any
+// argument a shell would otherwise split or interpret
+func formatCommand(name string, args []string) string {
+	return strings.Join(append([]string{name}, quoteArgs(args)...), " ")
+}
+
+// quoteArgs single-quotes the arguments a shell, or splitArgs, would
+// otherwise split or interpret
+func quoteArgs(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.IndexFunc(a, func(c rune) bool {
+			return !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("-_./,:=+%@", c))
+		}) < 0 {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return quoted
+}
@@ -0,0 +1,98 @@
+package srv
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Paper backgrounds for the background option
+const (
+	BackgroundWhite = "white" // dark lines on white (default)
+	BackgroundBlack = "black" // light lines on black, such as a chalkboard or scratchboard design
+)
+
+// promptColorRegex matches the colors a default prompt may name outright
+var promptColorRegex = regexp.MustCompile(`\b([Bb]lack|[Ww]hite)\b`)
+
+// parseBackground validates the background option, defaulting to white
+func parseBackground(v string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", BackgroundWhite:
+		return BackgroundWhite, nil
+	case BackgroundBlack:
+		return BackgroundBlack, nil
+	}
+	return "", fmt.Errorf("background must be %q or %q", BackgroundWhite, BackgroundBlack)
+}
+
+// lineColor names the color lines are drawn in on a background
+func lineColor(background string) string {
+	if background == BackgroundBlack {
+		return BackgroundWhite
+	}
+	return BackgroundBlack
+}
+
+// backgroundPrompt fills the {background} and {lines} placeholders of an
+// AI prompt with the job's colors. The server's default prompt and the
+// built-in one may name their colors outright, as dark lines on white, so
+// without placeholders they have black and white swapped on a black
+// background instead; on white they are unchanged, as are the results
+// cached under them.
+func backgroundPrompt(prompt, defaultPrompt, background string) string {
+	if background == "" {
+		background = BackgroundWhite
+	}
+	if !strings.Contains(prompt, "{background}") && !strings.Contains(prompt, "{lines}") {
+		if background == BackgroundBlack && (prompt == DefaultAIPrompt || prompt == defaultPrompt) {
+			return promptColorRegex.ReplaceAllStringFunc(prompt, swapPromptColor)
+		}
+		return prompt
+	}
+	return strings.NewReplacer("{background}", background, "{lines}", lineColor(background)).Replace(prompt)
+}
+
+// swapPromptColor turns black into white and back, keeping a capital
+func swapPromptColor(word string) string {
+	swapped := map[string]string{"black": "white", "Black": "White", "white": "black", "White": "Black"}
+	return swapped[word]
+}
+
+// backgroundFlatten is the color transparent pixels are composited onto
+// for a background when the job names none
+func backgroundFlatten(background string) string {
+	if background == BackgroundBlack {
+		return "000000"
+	}
+	return defaultFlattenBackground
+}
+
+// isBackgroundAt reports whether a hex stroke color is the background's:
+// on white, every RGB channel above threshold, as isNearWhiteAt; on black,
+// every channel below 255 minus threshold, the same margin from black
+func isBackgroundAt(hex string, threshold int, background string) bool {
+	if background != BackgroundBlack {
+		return isNearWhiteAt(hex, threshold)
+	}
+	if len(hex) != 6 {
+		return false
+	}
+	t := int64(255 - threshold)
+	for i := 0; i < 6; i += 2 {
+		if v, err := strconv.ParseInt(hex[i:i+2], 16, 64); err != nil || v >= t {
+			return false
+		}
+	}
+	return true
+}
+
+// backgroundPathsName describes the paths the white filter takes off a
+// background, for the job log
+func backgroundPathsName(background string) string {
+	if background == BackgroundBlack {
+		return "near-black"
+	}
+	return "white"
+}
@@ -0,0 +1,218 @@
+package srv
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bundleManifest describes the contents of a job's ZIP bundle
+type bundleManifest struct {
+	JobID        string             `json:"jobId"`
+	Name         string             `json:"name,omitempty"`
+	OriginalName string             `json:"originalName"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	Parameters   JobOptions         `json:"parameters"`
+	Dimensions   manifestDimensions `json:"dimensions"`
+	AIImage      *manifestAIImage   `json:"aiImage,omitempty"`
+	Warnings     []string           `json:"warnings,omitempty"`
+	Files        []manifestFile     `json:"files"`
+}
+
+type manifestDimensions struct {
+	SVGWidthPx   float64 `json:"svgWidthPx"`
+	SVGHeightPx  float64 `json:"svgHeightPx"`
+	OutputWidth  float64 `json:"outputWidthMm"`
+	OutputHeight float64 `json:"outputHeightMm"`
+	DPI          float64 `json:"dpi"`
+}
+
+type manifestAIImage struct {
+	Filename string `json:"filename"`
+	Cached   bool   `json:"cached"`
+}
+
+type manifestFile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// bundleFile is a file on disk to include in the bundle
+type bundleFile struct {
+	name, path, description string
+}
+
+// bundleFiles lists the job outputs that exist on disk
+func (s *Server) bundleFiles(job *Job, name string) []bundleFile {
+	jobDir := filepath.Join(s.UploadsDir, job.ID)
+	baseName := fileBaseName(name, job.OriginalName)
+	candidates := []bundleFile{
+		{baseName + ".gcode", job.GCodePath, "G-Code toolpath"},
+		{baseName + ".svg", filepath.Join(jobDir, "output.svg"), "Traced SVG after white-path filtering"},
+		{baseName + ".raw.svg", filepath.Join(jobDir, "output.raw.svg"), "Unfiltered autotrace output"},
+		{baseName + ".dxf", job.DXFPath, "DXF polylines in mm"},
+		{baseName + ".hpgl", job.HPGLPath, "HP-GL pen plotter program (40 units per mm)"},
+		{baseName + ".plot.svg", job.PlotSVGPath, "Toolpath SVG with cut and travel layers for plotter extensions"},
+		{baseName + ".tiles.zip", job.TilesPath, "One G-Code program per tile of the input, on the whole job's coordinates"},
+	}
+	if job.AIImageFilename != "" {
+		candidates = append(candidates, bundleFile{
+			"ai_" + job.AIImageFilename,
+			filepath.Join(s.AICache.CacheDir(), job.AIImageFilename),
+			"AI-generated line art used as the trace input",
+		})
+	}
+
+	var files []bundleFile
+	for _, f := range candidates {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func newBundleManifest(job *Job, name string) *bundleManifest {
+	m := &bundleManifest{
+		JobID:        job.ID,
+		Name:         name,
+		OriginalName: job.OriginalName,
+		CreatedAt:    job.CreatedAt,
+		Parameters:   job.JobOptions,
+		Dimensions: manifestDimensions{
+			SVGWidthPx:   job.SVGWidth,
+			SVGHeightPx:  job.SVGHeight,
+			OutputWidth:  job.OutputWidth,
+			OutputHeight: job.OutputHeight,
+			DPI:          job.DPI,
+		},
+		Warnings: job.Warnings,
+		Files:    []manifestFile{},
+	}
+	if job.AIImageFilename != "" {
+		m.AIImage = &manifestAIImage{Filename: job.AIImageFilename, Cached: job.AIImageCached}
+	}
+	return m
+}
+
+// HandleDownloadBundle serves a ZIP archive of all job outputs with a manifest.json
+func (s *Server) HandleDownloadBundle(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists || s.jobStatus(job) != "done" || job.GCodePath == "" {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	if s.refuseUnapproved(w, job) {
+		return
+	}
+
+	name := s.jobName(job)
+	data, err := s.buildBundle(job, name)
+	if err != nil {
+		slog.Warn("write bundle", "job", job.ID, "error", err)
+		http.Error(w, "Failed to build bundle", http.StatusInternalServerError)
+		return
+	}
+
+	// Serve from memory through ServeContent so Range requests can resume
+	// an interrupted download. The archive is stable for a finished job
+	// until it is renamed, which changes the manifest and every entry name
+	// but not the modification time, so a strong ETag of the archive itself
+	// keeps If-Range from joining ranges of two different archives.
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileBaseName(name, job.OriginalName)+".zip"))
+	w.Header().Set("Content-Type", "application/zip")
+	http.ServeContent(w, r, "", jobModTime(job), bytes.NewReader(data))
+}
+
+// buildBundle writes the job's ZIP bundle into memory under the job name
+// name, with its log as it stood when the job finished
+func (s *Server) buildBundle(job *Job, name string) ([]byte, error) {
+	var buf bytes.Buffer
+	manifest := newBundleManifest(job, name)
+	zw := zip.NewWriter(&buf)
+	for _, f := range s.bundleFiles(job, name) {
+		size, sum, err := addFileToZip(zw, f.name, f.path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		manifest.Files = append(manifest.Files, manifestFile{
+			Name: f.name, Description: f.description, Size: size, SHA256: sum,
+		})
+	}
+
+	logData := []byte(job.finishedLog)
+	fw, err := zw.Create("log.txt")
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(logData)
+	logSum := sha256.Sum256(logData)
+	manifest.Files = append(manifest.Files, manifestFile{
+		Name: "log.txt", Description: "Processing log",
+		Size: int64(len(logData)), SHA256: hex.EncodeToString(logSum[:]),
+	})
+
+	fw, err = zw.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jobModTime is the Last-Modified time for content generated from a
+// finished job: when its G-Code was written, or its creation time if that
+// is unavailable
+func jobModTime(job *Job) time.Time {
+	if info, err := os.Stat(job.GCodePath); err == nil {
+		return info.ModTime()
+	}
+	return job.CreatedAt
+}
+
+// addFileToZip copies a file into the archive, returning its size and SHA256
+func addFileToZip(zw *zip.Writer, name, path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	fw, err := zw.Create(name)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fw, h), f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,291 @@
+package srv
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDownloadBundleManifest(t *testing.T) {
+	server := newTestServer(t)
+
+	jobDir := filepath.Join(server.UploadsDir, "7")
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gcodePath := filepath.Join(jobDir, "output.gcode")
+	os.WriteFile(gcodePath, []byte("G21\nG90\n"), 0644)
+	os.WriteFile(filepath.Join(jobDir, "output.svg"), []byte("<svg/>"), 0644)
+
+	job := &Job{
+		ID: "7", Status: "done", OriginalName: "dragon.png", GCodePath: gcodePath,
+		JobOptions: JobOptions{MaxWidth: 100, MaxHeight: 50, ToolOn: "M3", ToolOff: "M5"},
+		SVGWidth:   800, SVGHeight: 400, OutputWidth: 100, OutputHeight: 50, DPI: 203.2,
+		finishedLog: "=== Tracing ===\ndone\n",
+	}
+	job.Log.WriteString(job.finishedLog + "written after the job finished\n")
+	server.mu.Lock()
+	server.jobs[job.ID] = job
+	server.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, "/download/7/zip", nil)
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+
+	var manifest bundleManifest
+	names := make(map[string]bool)
+	for _, f := range zr.File {
+		names[f.Name] = true
+		if f.Name == "log.txt" {
+			rc, _ := f.Open()
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(data) != job.finishedLog {
+				t.Errorf("expected the log as it was when the job finished, got %q", data)
+			}
+		}
+		if f.Name == "manifest.json" {
+			rc, _ := f.Open()
+			if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+				t.Fatalf("invalid manifest: %v", err)
+			}
+			rc.Close()
+		}
+	}
+	for _, want := range []string{"dragon.gcode", "dragon.svg", "log.txt", "manifest.json"} {
+		if !names[want] {
+			t.Errorf("bundle missing %s", want)
+		}
+	}
+	if names["dragon.dxf"] {
+		t.Error("bundle should not contain a DXF that was not generated")
+	}
+
+	if manifest.JobID != "7" || manifest.Parameters.MaxWidth != 100 || manifest.Dimensions.DPI != 203.2 {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+	if len(manifest.Files) != 3 {
+		t.Fatalf("expected 3 files in manifest, got %+v", manifest.Files)
+	}
+	if f := manifest.Files[0]; f.Name != "dragon.gcode" || f.Size != 8 || len(f.SHA256) != 64 {
+		t.Errorf("unexpected gcode entry: %+v", f)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	server := newTestServer(t)
+
+	jobDir := filepath.Join(server.UploadsDir, "8")
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gcode := []byte("G21\nG90\nG0 X0 Y0\nG1 X10 Y10 F300\n")
+	gcodePath := filepath.Join(jobDir, "output.gcode")
+	os.WriteFile(gcodePath, gcode, 0644)
+
+	job := &Job{ID: "8", Status: "done", OriginalName: "cat.png", GCodePath: gcodePath}
+	server.mu.Lock()
+	server.jobs[job.ID] = job
+	server.mu.Unlock()
+
+	get := func(path, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/download/8", "bytes=4-7")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", w.Code)
+	}
+	if got := w.Body.String(); got != string(gcode[4:8]) {
+		t.Errorf("expected bytes %q, got %q", gcode[4:8], got)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 4-7/"+strconv.Itoa(len(gcode)) {
+		t.Errorf("unexpected Content-Range %q", got)
+	}
+
+	// Generated content must resume against the same bytes a full download returns
+	for _, path := range []string{"/download/8/zip", "/job/8/toolpath.png?size=64", "/job/8/animation.svg?duration=5"} {
+		full := get(path, "")
+		if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" {
+			t.Fatalf("%s: expected 200 with Accept-Ranges, got %d %q", path, full.Code, full.Header().Get("Accept-Ranges"))
+		}
+		part := get(path, "bytes=10-")
+		if part.Code != http.StatusPartialContent {
+			t.Fatalf("%s: expected status 206, got %d", path, part.Code)
+		}
+		if !bytes.Equal(part.Body.Bytes(), full.Body.Bytes()[10:]) {
+			t.Errorf("%s: ranged body does not match the full download", path)
+		}
+	}
+
+	// A rename changes the archive, so resuming it against an earlier ETag
+	// starts over rather than joining two archives
+	full := get("/download/8/zip", "")
+	etag := full.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || len(etag) != 66 {
+		t.Fatalf("expected a strong ETag for the bundle, got %q", etag)
+	}
+	server.mu.Lock()
+	job.Name = "tabby"
+	server.mu.Unlock()
+	req := httptest.NewRequest(http.MethodGet, "/download/8/zip", nil)
+	req.Header.Set("Range", "bytes=10-")
+	req.Header.Set("If-Range", etag)
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("expected a renamed bundle to be sent whole with a new ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestRequireApproval(t *testing.T) {
+	server := newTestServer(t)
+	server.RequireApproval = true
+
+	jobDir := filepath.Join(server.UploadsDir, "8")
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gcodePath := filepath.Join(jobDir, "output.gcode")
+	os.WriteFile(gcodePath, []byte("G21\nG1 X10 Y10 F300\n"), 0644)
+
+	job := &Job{ID: "8", Status: "done", OriginalName: "cat.png", GCodePath: gcodePath}
+	server.mu.Lock()
+	server.jobs[job.ID] = job
+	server.mu.Unlock()
+
+	do := func(method, path string) int {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+	for _, path := range []string{"/download/8", "/download/8/zip", "/api/jobs/8/download"} {
+		if code := do(http.MethodGet, path); code != http.StatusConflict {
+			t.Errorf("GET %s before approval: expected 409, got %d", path, code)
+		}
+	}
+	if code := do(http.MethodPost, "/job/8/approve"); code != http.StatusSeeOther {
+		t.Fatalf("expected approve to redirect, got %d", code)
+	}
+	if code := do(http.MethodGet, "/download/8"); code != http.StatusOK {
+		t.Errorf("expected the download after approval, got %d", code)
+	}
+
+	job.Status = "processing"
+	job.Approved = false
+	if code := do(http.MethodPost, "/job/8/approve"); code != http.StatusConflict {
+		t.Errorf("expected unfinished jobs to be refused approval, got %d", code)
+	}
+
+	// Approving a job as it finishes reads its status under the lock, as
+	// the processing goroutine publishes it
+	finished := make(chan struct{})
+	go func() {
+		server.setJobStatus(job, "done")
+		close(finished)
+	}()
+	do(http.MethodPost, "/job/8/approve")
+	<-finished
+}
+
+func TestJobDownloadPostProcessing(t *testing.T) {
+	server := newTestServer(t)
+	jobDir := filepath.Join(server.UploadsDir, "5")
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gcode := "G21\nG90\nG0 X0 Y0 ; start\nG1 X10.12345 Y-0.0004 F300\nG2 X20 Y0 I5.55555 J0\n"
+	gcodePath := filepath.Join(jobDir, "output.gcode")
+	os.WriteFile(gcodePath, []byte(gcode), 0644)
+	server.jobs["5"] = &Job{ID: "5", Status: "done", OriginalName: "cat.png", GCodePath: gcodePath}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/job/5/download"+query, nil))
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusOK || w.Body.String() != gcode {
+		t.Fatalf("expected the stored program unchanged, got %d:\n%s", w.Code, w.Body.String())
+	}
+
+	w := get("?header=%25&header=G28&footer=M5%0AM2&precision=2&lineEndings=crlf&offset=100,50")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	want := "%\r\nG28\r\nG21\r\nG90\r\nG0 X100.00 Y50.00 ; start\r\nG1 X110.12 Y50.00 F300\r\nG2 X120.00 Y50.00 I5.56 J0.00\r\nM5\r\nM2\r\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("unexpected post-processed program:\n%q\nwant\n%q", got, want)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), `filename="cat.gcode"`) {
+		t.Errorf("unexpected Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+	if w := get("?precision=0"); !strings.Contains(w.Body.String(), "G1 X10 Y0 F300\n") {
+		t.Errorf("expected -0.0004 to round to 0, got:\n%s", w.Body.String())
+	}
+
+	if data, _ := os.ReadFile(gcodePath); string(data) != gcode {
+		t.Error("the stored program was changed")
+	}
+
+	if w := get("?source=base"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a job without a base program, got %d", w.Code)
+	}
+	basePath := filepath.Join(jobDir, "output.base.gcode")
+	os.WriteFile(basePath, []byte("G1 X1.5 Y2\n"), 0644)
+	server.jobs["5"].BaseGCodePath = basePath
+	w = get("?source=base&precision=0")
+	if w.Code != http.StatusOK || w.Body.String() != "G1 X2 Y2\n" || !strings.Contains(w.Header().Get("Content-Disposition"), `"cat.base.gcode"`) {
+		t.Errorf("unexpected base download %d %q", w.Code, w.Body.String())
+	}
+	os.WriteFile(basePath, []byte("G1 X1 Y2 F5000\n"), 0644)
+	server.jobs["5"].MaxFeed = 1200
+	if w := get("?source=base&footer=G1+X0+F9000"); w.Body.String() != "G1 X1 Y2 F1200\nG1 X0 F1200\n" {
+		t.Errorf("maxFeed should clamp the base program and added lines, got %q", w.Body.String())
+	}
+	server.jobs["5"].MaxFeed = 0
+
+	server.jobs["5"].GCodeFlavor = "grbl"
+	if w := get("?header=G28"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a header on a flavored program to be refused, got %d", w.Code)
+	}
+	if w := get("?source=base&header=G28"); w.Code != http.StatusOK || w.Body.String() != "G28\nG1 X1 Y2 F5000\n" {
+		t.Errorf("expected a header on the base program of a flavored job, got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("?precision=1"); w.Code != http.StatusOK {
+		t.Errorf("expected other transforms of a flavored program to be allowed, got %d", w.Code)
+	}
+	server.jobs["5"].GCodeFlavor = ""
+
+	for _, query := range []string{"?source=raw", "?precision=7", "?precision=x", "?lineEndings=cr", "?offset=10", "?offset=a,b", "?header=G1%00"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+	os.WriteFile(gcodePath, []byte("G91\nG1 X1 Y1\n"), 0644)
+	if w := get("?offset=1,1"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an offset on a relative program to be refused, got %d", w.Code)
+	}
+}
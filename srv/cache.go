@@ -8,12 +8,17 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// DefaultAIPrompt is the default prompt for AI image transformation
+// DefaultAIPrompt is the default prompt for AI image transformation. A
+// deployment can replace it with Server.DefaultPrompt; the constant remains
+// the prompt that pre-migration cache entries are keyed under.
 const DefaultAIPrompt = "Reduce this image to a two color line-art image suitable for use in a " +
 	"child's coloring book. The lines should be black and the background " +
 	"white. The image will be reproduced by an X-Y plotter, so the final " +
@@ -23,6 +28,17 @@ const DefaultAIPrompt = "Reduce this image to a two color line-art image suitabl
 type AIImageCache struct {
 	db       *sql.DB
 	cacheDir string
+	// mu keeps Purge and Maintain from running while a result is being
+	// stored or looked up, so Purge cannot leave a row whose file it
+	// removed, or remove a file LookupInto is copying
+	mu sync.RWMutex
+
+	hits, misses atomic.Int64 // Lookup outcomes since startup
+}
+
+// Counts returns the number of cache hits and misses since startup
+func (c *AIImageCache) Counts() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
 }
 
 // NewAIImageCache creates a new cache with SQLite storage
@@ -36,8 +52,22 @@ func NewAIImageCache(dbPath, cacheDir string) (*AIImageCache, error) {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
+	if _, err := applySchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &AIImageCache{
+		db:       db,
+		cacheDir: cacheDir,
+	}, nil
+}
+
+// applySchema creates the cache table if needed and migrates an old schema,
+// reporting whether a migration ran. It is safe to run repeatedly.
+func applySchema(db *sql.DB) (bool, error) {
 	// Create table if not exists (with prompt column)
-	_, err = db.Exec(`
+	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS ai_image_cache (
 			cache_key TEXT PRIMARY KEY,
 			input_hash TEXT NOT NULL,
@@ -48,24 +78,19 @@ func NewAIImageCache(dbPath, cacheDir string) (*AIImageCache, error) {
 		)
 	`)
 	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("create table: %w", err)
+		return false, fmt.Errorf("create table: %w", err)
 	}
 
 	// Check if we need to migrate old schema (input_hash as primary key without prompt)
-	if err := migrateOldSchema(db); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("migrate schema: %w", err)
+	migrated, err := migrateOldSchema(db)
+	if err != nil {
+		return false, fmt.Errorf("migrate schema: %w", err)
 	}
-
-	return &AIImageCache{
-		db:       db,
-		cacheDir: cacheDir,
-	}, nil
+	return migrated, nil
 }
 
 // migrateOldSchema migrates from old schema (input_hash as primary key) to new schema (cache_key)
-func migrateOldSchema(db *sql.DB) error {
+func migrateOldSchema(db *sql.DB) (bool, error) {
 	// Check if old table exists with input_hash as primary key
 	var count int
 	err := db.QueryRow(`
@@ -73,19 +98,19 @@ func migrateOldSchema(db *sql.DB) error {
 		WHERE name = 'input_hash' AND pk = 1
 	`).Scan(&count)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if count == 0 {
 		// No migration needed - either new schema or empty database
-		return nil
+		return false, nil
 	}
 
 	// Old schema detected - migrate data
 	// 1. Rename old table
 	_, err = db.Exec(`ALTER TABLE ai_image_cache RENAME TO ai_image_cache_old`)
 	if err != nil {
-		return fmt.Errorf("rename old table: %w", err)
+		return false, fmt.Errorf("rename old table: %w", err)
 	}
 
 	// 2. Create new table
@@ -100,10 +125,13 @@ func migrateOldSchema(db *sql.DB) error {
 		)
 	`)
 	if err != nil {
-		return fmt.Errorf("create new table: %w", err)
+		return false, fmt.Errorf("create new table: %w", err)
 	}
 
-	// 3. Migrate data with default prompt
+	// 3. Migrate data with default prompt. The old schema predates custom
+	// prompts, so every entry in it was made with the built-in prompt; this
+	// must stay DefaultAIPrompt even when a server overrides its default,
+	// or the migrated keys would claim a prompt that never produced them.
 	_, err = db.Exec(`
 		INSERT INTO ai_image_cache (cache_key, input_hash, prompt, output_filename, mime_type, created_at)
 		SELECT 
@@ -116,16 +144,16 @@ func migrateOldSchema(db *sql.DB) error {
 		FROM ai_image_cache_old
 	`, hashString(DefaultAIPrompt), DefaultAIPrompt)
 	if err != nil {
-		return fmt.Errorf("migrate data: %w", err)
+		return false, fmt.Errorf("migrate data: %w", err)
 	}
 
 	// 4. Drop old table
 	_, err = db.Exec(`DROP TABLE ai_image_cache_old`)
 	if err != nil {
-		return fmt.Errorf("drop old table: %w", err)
+		return false, fmt.Errorf("drop old table: %w", err)
 	}
 
-	return nil
+	return true, nil
 }
 
 // Close closes the database connection
@@ -173,9 +201,67 @@ type CachedResult struct {
 	Prompt   string
 }
 
-// Lookup checks if we have a cached result for the given input hash and prompt
+// Contains reports whether Lookup would find a result for the input hash and
+// prompt, without counting towards the hit and miss statistics
+func (c *AIImageCache) Contains(inputHash, prompt string) (bool, error) {
+	path, err := c.Peek(inputHash, prompt)
+	return path != "", err
+}
+
+// Peek returns the path of the result Lookup would find for the input hash
+// and prompt, or "" if there is none, without counting towards the hit and
+// miss statistics. The file may be purged once Peek returns, so callers
+// reading it must treat a missing file as a miss.
+func (c *AIImageCache) Peek(inputHash, prompt string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var filename string
+	err := c.db.QueryRow(
+		"SELECT output_filename FROM ai_image_cache WHERE cache_key = ?",
+		MakeCacheKey(inputHash, prompt),
+	).Scan(&filename)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.cacheDir, filename)
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+	return path, nil
+}
+
+// Lookup checks if we have a cached result for the given input hash and
+// prompt. A Purge may remove the file once Lookup returns; use LookupInto to
+// keep it.
 func (c *AIImageCache) Lookup(inputHash, prompt string) (*CachedResult, error) {
+	return c.LookupInto(inputHash, prompt, "")
+}
+
+// LookupInto is Lookup, also copying a hit's file into dir before the lock
+// is released, so a Purge can't remove it first. FullPath is then the copy.
+// An empty dir makes no copy.
+func (c *AIImageCache) LookupInto(inputHash, prompt, dir string) (*CachedResult, error) {
 	cacheKey := MakeCacheKey(inputHash, prompt)
+	result, stale, err := c.lookup(cacheKey, dir)
+	if stale != "" {
+		// The file is missing, so remove its row. That needs the write
+		// lock, and a Store in between may have replaced the row, so only
+		// a row still naming the missing file goes.
+		c.mu.Lock()
+		c.db.Exec("DELETE FROM ai_image_cache WHERE cache_key = ? AND output_filename = ?", cacheKey, stale)
+		c.mu.Unlock()
+	}
+	return result, err
+}
+
+// lookup does LookupInto's work under the read lock. It returns the name of
+// a row's missing file as stale.
+func (c *AIImageCache) lookup(cacheKey, dir string) (*CachedResult, string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
 	var filename, mimeType, storedPrompt string
 	err := c.db.QueryRow(
@@ -184,45 +270,75 @@ func (c *AIImageCache) Lookup(inputHash, prompt string) (*CachedResult, error) {
 	).Scan(&filename, &mimeType, &storedPrompt)
 
 	if err == sql.ErrNoRows {
-		return nil, nil
+		c.misses.Add(1)
+		return nil, "", nil
 	}
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	fullPath := filepath.Join(c.cacheDir, filename)
 	// Verify the file still exists
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		// File is missing, remove from database
-		c.db.Exec("DELETE FROM ai_image_cache WHERE cache_key = ?", cacheKey)
-		return nil, nil
+		c.misses.Add(1)
+		return nil, filename, nil
+	}
+	if dir != "" {
+		copyPath := filepath.Join(dir, filename)
+		if err := copyFile(fullPath, copyPath); err != nil {
+			return nil, "", fmt.Errorf("copy cached file: %w", err)
+		}
+		fullPath = copyPath
 	}
+	c.hits.Add(1)
 
 	return &CachedResult{
 		Filename: filename,
 		MimeType: mimeType,
 		FullPath: fullPath,
 		Prompt:   storedPrompt,
-	}, nil
+	}, "", nil
 }
 
-// Store saves a new cached result
-func (c *AIImageCache) Store(inputHash, prompt string, imageData []byte, mimeType string) (*CachedResult, error) {
-	cacheKey := MakeCacheKey(inputHash, prompt)
+// copyFile copies the file at src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
 
-	// Determine extension from MIME type
-	ext := ".png"
+// aiImageExt returns the file extension for a generated image's MIME type
+func aiImageExt(mimeType string) string {
 	switch mimeType {
 	case "image/jpeg":
-		ext = ".jpg"
+		return ".jpg"
 	case "image/webp":
-		ext = ".webp"
+		return ".webp"
 	case "image/gif":
-		ext = ".gif"
+		return ".gif"
 	}
+	return ".png"
+}
+
+// Store saves a new cached result
+func (c *AIImageCache) Store(inputHash, prompt string, imageData []byte, mimeType string) (*CachedResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cacheKey := MakeCacheKey(inputHash, prompt)
 
 	// Use hash + timestamp for filename to ensure uniqueness
-	filename := fmt.Sprintf("%s_%d%s", inputHash[:16], time.Now().UnixNano(), ext)
+	filename := fmt.Sprintf("%s_%d%s", inputHash[:16], time.Now().UnixNano(), aiImageExt(mimeType))
 	fullPath := filepath.Join(c.cacheDir, filename)
 
 	// Write the file
@@ -247,3 +363,170 @@ func (c *AIImageCache) Store(inputHash, prompt string, imageData []byte, mimeTyp
 		Prompt:   prompt,
 	}, nil
 }
+
+// MaintenanceReport describes the outcome of a Maintain run
+type MaintenanceReport struct {
+	Integrity   []string `json:"integrity"` // PRAGMA integrity_check output, ["ok"] when healthy
+	IntegrityOK bool     `json:"integrityOk"`
+	Migrated    bool     `json:"migrated"` // An old schema was found and migrated
+	Vacuumed    bool     `json:"vacuumed"`
+	Entries     int      `json:"entries"`
+	SizeBefore  int64    `json:"sizeBefore"` // Database size in bytes
+	SizeAfter   int64    `json:"sizeAfter"`
+}
+
+// Maintain checks the database's integrity, re-applies any pending schema
+// migrations, and compacts it with VACUUM. VACUUM is skipped when the
+// integrity check fails so a damaged database is left as found. Like Purge,
+// it holds the cache's lock throughout.
+func (c *AIImageCache) Maintain() (*MaintenanceReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rep := &MaintenanceReport{}
+	var err error
+	if rep.SizeBefore, err = c.dbSize(); err != nil {
+		return nil, fmt.Errorf("database size: %w", err)
+	}
+
+	rows, err := c.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, fmt.Errorf("integrity check: %w", err)
+	}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("integrity check: %w", err)
+		}
+		rep.Integrity = append(rep.Integrity, line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("integrity check: %w", err)
+	}
+	rep.IntegrityOK = len(rep.Integrity) == 1 && rep.Integrity[0] == "ok"
+	if !rep.IntegrityOK {
+		rep.SizeAfter = rep.SizeBefore
+		return rep, nil
+	}
+
+	if rep.Migrated, err = applySchema(c.db); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.db.Exec("VACUUM"); err != nil {
+		return nil, fmt.Errorf("vacuum: %w", err)
+	}
+	rep.Vacuumed = true
+
+	if err := c.db.QueryRow("SELECT COUNT(*) FROM ai_image_cache").Scan(&rep.Entries); err != nil {
+		return nil, fmt.Errorf("count entries: %w", err)
+	}
+	if rep.SizeAfter, err = c.dbSize(); err != nil {
+		return nil, fmt.Errorf("database size: %w", err)
+	}
+	return rep, nil
+}
+
+// dbSize returns the size of the database in bytes
+func (c *AIImageCache) dbSize() (int64, error) {
+	var pages, pageSize int64
+	if err := c.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := c.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+// cacheFilePattern matches the names Store gives its files, so Purge also
+// removes files a crash left behind between writing a file and its row
+var cacheFilePattern = regexp.MustCompile(`^[0-9a-f]{16}_[0-9]+\.(png|jpg|webp|gif)$`)
+
+// PurgeReport describes the outcome of a Purge run
+type PurgeReport struct {
+	Entries    int   `json:"entries"`    // Rows deleted
+	Files      int   `json:"files"`      // Cache files removed
+	Bytes      int64 `json:"bytes"`      // Total size of the removed files
+	SizeBefore int64 `json:"sizeBefore"` // Database size in bytes
+	SizeAfter  int64 `json:"sizeAfter"`
+}
+
+// Purge deletes every cached result: all rows, the files they name, and any
+// other file in the cache directory named the way Store names them, then
+// compacts the database with VACUUM. It holds the cache's lock throughout,
+// so a Store in flight finishes first and none starts until it is done.
+// Rows go before files, so a purge that fails part way leaves at worst
+// files without rows, never rows without files.
+func (c *AIImageCache) Purge() (*PurgeReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rep := &PurgeReport{}
+	var err error
+	if rep.SizeBefore, err = c.dbSize(); err != nil {
+		return nil, fmt.Errorf("database size: %w", err)
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT output_filename FROM ai_image_cache")
+	if err != nil {
+		return nil, fmt.Errorf("list entries: %w", err)
+	}
+	owned := map[string]bool{}
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("list entries: %w", err)
+		}
+		owned[filename] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list entries: %w", err)
+	}
+	res, err := tx.Exec("DELETE FROM ai_image_cache")
+	if err != nil {
+		return nil, fmt.Errorf("delete entries: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	rep.Entries = int(n)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+
+	entries, err := os.ReadDir(c.cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("read cache dir: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !(owned[name] || cacheFilePattern.MatchString(name)) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("remove cache file: %w", err)
+		}
+		if err := os.Remove(filepath.Join(c.cacheDir, name)); err != nil {
+			return nil, fmt.Errorf("remove cache file: %w", err)
+		}
+		rep.Files++
+		rep.Bytes += info.Size()
+	}
+
+	if _, err := c.db.Exec("VACUUM"); err != nil {
+		return nil, fmt.Errorf("vacuum: %w", err)
+	}
+	if rep.SizeAfter, err = c.dbSize(); err != nil {
+		return nil, fmt.Errorf("database size: %w", err)
+	}
+	return rep, nil
+}
@@ -0,0 +1,230 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Callback delivery limits
+const (
+	callbackTimeout   = 10 * time.Second
+	maxCallbackURLLen = 2048
+)
+
+// callbackBackoff is the wait before each retry of a failed callback
+var callbackBackoff = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// callbackPayload is POSTed to a job's callbackURL when it finishes. It
+// deliberately carries no request secrets such as the Gemini API key.
+type callbackPayload struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name,omitempty"`
+	Status       string    `json:"status"`
+	OriginalName string    `json:"originalName"`
+	CreatedAt    time.Time `json:"createdAt"`
+	StatusURL    string    `json:"statusURL"`
+	DownloadURL  string    `json:"downloadURL,omitempty"`
+	OutputWidth  float64   `json:"outputWidthMm,omitempty"`
+	OutputHeight float64   `json:"outputHeightMm,omitempty"`
+	DPI          float64   `json:"dpi,omitempty"`
+	Warnings     []string  `json:"warnings"`
+}
+
+// callbackDelivery is how posting a job's callback went. It is kept apart
+// from the job log, which is final once the job has finished, while the
+// callback is still being delivered.
+type callbackDelivery struct {
+	State      string `json:"state"` // "pending", "delivered", or "failed"
+	Attempts   int    `json:"attempts"`
+	HTTPStatus int    `json:"httpStatus,omitempty"` // of the last response
+	Error      string `json:"error,omitempty"`
+}
+
+// setCallback records the latest state of the job's callback delivery
+func (j *Job) setCallback(d callbackDelivery) {
+	j.callbackMu.Lock()
+	j.callback = &d
+	j.callbackMu.Unlock()
+}
+
+// callbackStatus returns a copy of the job's callback delivery state, or
+// nil if no delivery has started
+func (j *Job) callbackStatus() *callbackDelivery {
+	j.callbackMu.Lock()
+	defer j.callbackMu.Unlock()
+	if j.callback == nil {
+		return nil
+	}
+	d := *j.callback
+	return &d
+}
+
+// validateCallbackURL checks a callbackURL at upload time. Hostnames are
+// checked again when the callback is delivered, since DNS can change.
+func (s *Server) validateCallbackURL(raw string) error {
+	if len(raw) > maxCallbackURLLen {
+		return fmt.Errorf("callbackURL must be at most %d bytes", maxCallbackURLLen)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid callbackURL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callbackURL must use http or https")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("callbackURL must include a host")
+	}
+	if u.User != nil {
+		return fmt.Errorf("callbackURL must not include credentials")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !s.AllowPrivateCallbacks && isPrivateIP(ip) {
+		return fmt.Errorf("callbackURL must not point to a private or local address")
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") && !s.AllowPrivateCallbacks {
+		return fmt.Errorf("callbackURL must not point to a private or local address")
+	}
+	return nil
+}
+
+// blockedPrefixes are the non-public ranges the net.IP helpers don't cover
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network", which Linux routes to the local host
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which reaches any IPv4 address including private ones
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+}
+
+// isPrivateIP reports whether ip is loopback, private, link-local,
+// carrier-grade NAT, NAT64, or otherwise not a public unicast address
+func isPrivateIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// callbackClient returns an HTTP client that refuses to connect to private
+// addresses. The check runs on the resolved address at dial time, so a
+// hostname that resolves (or is rebound) to an internal IP is still blocked.
+func (s *Server) callbackClient() *http.Client {
+	dialer := &net.Dialer{Timeout: callbackTimeout}
+	if !s.AllowPrivateCallbacks {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("refusing to connect to private address %s", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: callbackTimeout,
+		Transport: &http.Transport{
+			Proxy:       nil, // a proxy would bypass the address check
+			DialContext: dialer.DialContext,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (s *Server) newCallbackPayload(job *Job, status string) callbackPayload {
+	p := callbackPayload{
+		ID:           job.ID,
+		Name:         s.jobName(job),
+		Status:       status,
+		OriginalName: job.OriginalName,
+		CreatedAt:    job.CreatedAt,
+		StatusURL:    s.PublicURL + "/api/jobs/" + job.ID,
+		Warnings:     job.warnings(),
+	}
+	if status == "done" {
+		p.DownloadURL = s.PublicURL + "/api/jobs/" + job.ID + "/download"
+		p.OutputWidth, p.OutputHeight, p.DPI = job.OutputWidth, job.OutputHeight, job.DPI
+	}
+	return p
+}
+
+// deliverCallback POSTs the job's final state, status, to its callbackURL,
+// retrying network errors, 429s, and 5xx responses with backoff. It runs
+// on its own goroutine once the job has finished, so progress is recorded
+// with setCallback rather than in the job log.
+func (s *Server) deliverCallback(job *Job, status string) {
+	body, err := json.Marshal(s.newCallbackPayload(job, status))
+	if err != nil {
+		job.setCallback(callbackDelivery{State: "failed", Error: fmt.Sprintf("encoding the payload: %v", err)})
+		return
+	}
+
+	client := s.callbackClient()
+	for attempt := 1; ; attempt++ {
+		code, err := postCallback(client, job, body)
+		d := callbackDelivery{State: "pending", Attempts: attempt, HTTPStatus: code}
+		switch {
+		case err == nil && code < 300:
+			d.State = "delivered"
+			job.setCallback(d)
+			slog.Info("callback delivered", "job", job.ID, "status", code, "attempts", attempt)
+			return
+		case err == nil && code != http.StatusTooManyRequests && code < 500:
+			d.State, d.Error = "failed", fmt.Sprintf("rejected with HTTP %d, not retrying", code)
+			job.setCallback(d)
+			slog.Warn("callback rejected", "job", job.ID, "status", code)
+			return
+		case err == nil:
+			err = fmt.Errorf("HTTP %d", code)
+		}
+
+		d.Error = err.Error()
+		if attempt > len(callbackBackoff) {
+			d.State = "failed"
+			job.setCallback(d)
+			slog.Warn("callback failed", "job", job.ID, "attempts", attempt, "error", err)
+			return
+		}
+		job.setCallback(d)
+		time.Sleep(callbackBackoff[attempt-1])
+	}
+}
+
+func postCallback(client *http.Client, job *Job, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bitmap-to-gcode")
+	req.Header.Set("X-Job-ID", job.ID)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,128 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Collinear merging limits, in degrees
+const (
+	defaultMergeAngle = 0.05
+	// maxMergeAngle bounds mergeAngle; cuts turning more than this are a
+	// shallow curve, and dropping its points would flatten it
+	maxMergeAngle = 1.0
+)
+
+// parseMergeCollinear validates the mergeAngle option, which only applies
+// when mergeCollinear is on. Empty takes the default, and 0 merges only
+// cuts that are exactly in line.
+func parseMergeCollinear(enabled bool, angle string) (float64, error) {
+	if !enabled {
+		return 0, nil
+	}
+	if angle == "" {
+		return defaultMergeAngle, nil
+	}
+	n, err := strconv.ParseFloat(angle, 64)
+	if err != nil || !(n >= 0 && n <= maxMergeAngle) {
+		return 0, fmt.Errorf("mergeAngle must be a number of degrees from 0 to %g", maxMergeAngle)
+	}
+	return n, nil
+}
+
+// collinearStats describes what mergeCollinear did
+type collinearStats struct {
+	Cuts   int // linear cuts before merging
+	Runs   int // runs of two or more cuts merged into one
+	Merged int // cuts dropped, their distance taken up by the run's first
+}
+
+// mergedLine reports whether a line holds nothing but a linear cut: G1,
+// X, Y, and F words. Anything else, a Z move or a power change, has to
+// happen where it is written.
+func mergedLine(line string) bool {
+	for _, w := range parseGCodeWords(line) {
+		switch w.Letter {
+		case 'G':
+			if w.Value != 1 {
+				return false
+			}
+		case 'X', 'Y', 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// mergeCollinear merges runs of consecutive linear cuts heading the same
+// way, within angle degrees, into the run's first cut, which is extended
+// to the run's end. Unlike simplification this moves no point that
+// matters: the dropped points lie on the merged line when angle is 0, and
+// otherwise stray from it by at most its length times the sine of twice
+// angle. Every cut in a run is measured against the direction of its
+// first, so small turns cannot add up along it. A run only takes lines
+// holding nothing but a linear cut, and a cut setting a different feed
+// starts a new run, so every feedrate change is kept where it was.
+func mergeCollinear(lines []string, angle float64) ([]string, collinearStats, error) {
+	var stats collinearStats
+	parsed, err := parseStrokeLines(lines)
+	if err != nil {
+		return lines, stats, err
+	}
+	minCos := math.Cos(angle * math.Pi / 180)
+	if angle == 0 {
+		minCos = 1 - 1e-12 // exactly in line, allowing for float rounding
+	}
+	direction := func(l strokeLine) (point, bool) {
+		d := math.Hypot(l.to.X-l.from.X, l.to.Y-l.from.Y)
+		if d < 1e-9 {
+			return point{}, false
+		}
+		return point{(l.to.X - l.from.X) / d, (l.to.Y - l.from.Y) / d}, true
+	}
+
+	out := make([]string, 0, len(lines))
+	feed := "" // the program's feed after the line being looked at
+	for i := 0; i < len(lines); i++ {
+		if parsed[i].feed != "" {
+			feed = parsed[i].feed
+		}
+		if parsed[i].kind != 'l' {
+			out = append(out, lines[i])
+			continue
+		}
+		stats.Cuts++
+		if !mergedLine(lines[i]) {
+			out = append(out, lines[i])
+			continue
+		}
+		dir, ok := direction(parsed[i])
+		end := i
+		for j := i + 1; j < len(lines); j++ {
+			l := parsed[j]
+			if l.kind != 'l' || !mergedLine(lines[j]) || (l.feed != "" && l.feed != feed) {
+				break
+			}
+			if d, hasLength := direction(l); hasLength {
+				if !ok {
+					dir, ok = d, true
+				} else if dir.X*d.X+dir.Y*d.Y < minCos {
+					break
+				}
+			}
+			end = j
+		}
+		if end == i {
+			out = append(out, lines[i])
+			continue
+		}
+		out = append(out, setXY(lines[i], parsed[end].to))
+		stats.Cuts += end - i
+		stats.Runs++
+		stats.Merged += end - i
+		i = end
+	}
+	return out, stats, nil
+}
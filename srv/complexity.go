@@ -0,0 +1,97 @@
+package srv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ComplexityThresholds are soft limits on output size. Exceeding one only
+// adds an advisory warning to the job; a zero value disables that check.
+type ComplexityThresholds struct {
+	MaxPaths     int   // <path> elements in the final SVG
+	MaxMoves     int   // G-code motion segments
+	MaxFileBytes int64 // G-code file size
+}
+
+// DefaultComplexityThresholds are generous enough that typical line art
+// never trips them, while a noisy photo trace usually does.
+var DefaultComplexityThresholds = ComplexityThresholds{
+	MaxPaths:     2000,
+	MaxMoves:     100000,
+	MaxFileBytes: 10 << 20,
+}
+
+// complexityReport summarizes how large a finished job's output is
+type complexityReport struct {
+	Paths      int
+	Moves      int
+	GCodeBytes int64
+}
+
+// measureComplexity counts the paths in the final SVG and the moves and
+// bytes in the G-code
+func measureComplexity(svgPath, gcodePath string) (complexityReport, error) {
+	var rep complexityReport
+
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return rep, err
+	}
+	paths, err := parseSVGPaths(data)
+	if err != nil {
+		return rep, err
+	}
+	rep.Paths = len(paths)
+
+	moves, err := readGCodeMoves(gcodePath)
+	if err != nil {
+		return rep, err
+	}
+	rep.Moves = len(moves)
+
+	info, err := os.Stat(gcodePath)
+	if err != nil {
+		return rep, err
+	}
+	rep.GCodeBytes = info.Size()
+	return rep, nil
+}
+
+// exceeded describes each threshold the report is over, empty if none
+func (rep complexityReport) exceeded(t ComplexityThresholds) []string {
+	var over []string
+	if t.MaxPaths > 0 && rep.Paths > t.MaxPaths {
+		over = append(over, fmt.Sprintf("%d paths (threshold %d)", rep.Paths, t.MaxPaths))
+	}
+	if t.MaxMoves > 0 && rep.Moves > t.MaxMoves {
+		over = append(over, fmt.Sprintf("%d moves (threshold %d)", rep.Moves, t.MaxMoves))
+	}
+	if t.MaxFileBytes > 0 && rep.GCodeBytes > t.MaxFileBytes {
+		over = append(over, fmt.Sprintf("%s of G-Code (threshold %s)", formatBytes(rep.GCodeBytes), formatBytes(t.MaxFileBytes)))
+	}
+	return over
+}
+
+// complexityWarning returns the advisory for a report, or "" if it is
+// within every threshold
+func complexityWarning(rep complexityReport, t ComplexityThresholds) string {
+	over := rep.exceeded(t)
+	if len(over) == 0 {
+		return ""
+	}
+	return "This job is large/complex (" + strings.Join(over, ", ") +
+		") and may plot slowly; consider a simpler image, fewer colors, or a smaller size"
+}
+
+// formatBytes renders a byte count for people, e.g. "1.5 MB"
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
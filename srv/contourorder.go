@@ -0,0 +1,220 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Cutting orders for the contourOrder option
+const (
+	ContourOrderDocument  = "document"
+	ContourOrderInsideOut = "inside-out"
+	ContourOrderOutsideIn = "outside-in"
+)
+
+// parseContourOrder validates the contourOrder option. Document order, the
+// default, is returned as "" since it leaves the trace alone.
+func parseContourOrder(v string) (string, error) {
+	switch v {
+	case "", ContourOrderDocument:
+		return "", nil
+	case ContourOrderInsideOut, ContourOrderOutsideIn:
+		return v, nil
+	}
+	return "", fmt.Errorf("contourOrder must be %q, %q, or %q", ContourOrderDocument, ContourOrderInsideOut, ContourOrderOutsideIn)
+}
+
+// contour is one subpath of the trace, the unit contour ordering moves
+type contour struct {
+	elem   []byte // the <path> element drawing it
+	pts    []point
+	closed bool
+	box    bounds
+	area   float64 // enclosed area, for closed contours
+	depth  int     // number of closed contours around it
+}
+
+// contourStats describes what orderContours found and did
+type contourStats struct {
+	Closed, Open int
+	MaxDepth     int
+	Moved        int // contours that changed position
+}
+
+// polylineBounds returns the bounding box of pts
+func polylineBounds(pts []point) bounds {
+	b := bounds{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range pts {
+		b.MinX = math.Min(b.MinX, p.X)
+		b.MinY = math.Min(b.MinY, p.Y)
+		b.MaxX = math.Max(b.MaxX, p.X)
+		b.MaxY = math.Max(b.MaxY, p.Y)
+	}
+	return b
+}
+
+// polygonArea returns the unsigned area of the polygon through pts
+func polygonArea(pts []point) float64 {
+	a := 0.0
+	for i, p := range pts {
+		q := pts[(i+1)%len(pts)]
+		a += p.X*q.Y - q.X*p.Y
+	}
+	return math.Abs(a) / 2
+}
+
+// pointInPolygon reports whether p lies inside the polygon through pts,
+// by counting crossings of a ray running from p in the +X direction
+func pointInPolygon(p point, pts []point) bool {
+	inside := false
+	for i, j := 0, len(pts)-1; i < len(pts); j, i = i, i+1 {
+		a, b := pts[i], pts[j]
+		if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// encloses reports whether the closed contour c surrounds d. Centerline
+// traces have no crossing outlines, so d is inside when its box is and
+// its first point is.
+func (c *contour) encloses(d *contour) bool {
+	if !c.closed || c == d || (d.closed && d.area >= c.area) {
+		return false
+	}
+	if d.box.MinX < c.box.MinX || d.box.MinY < c.box.MinY || d.box.MaxX > c.box.MaxX || d.box.MaxY > c.box.MaxY {
+		return false
+	}
+	return pointInPolygon(d.pts[0], c.pts)
+}
+
+// splitContours returns the contours drawn by one <path> element. An
+// element with several subpaths is split into one element per subpath,
+// written in absolute commands, so each can be moved on its own.
+func splitContours(elem []byte) ([]contour, error) {
+	elems, err := parseSVGPaths(elem)
+	if err != nil || len(elems) != 1 {
+		return nil, fmt.Errorf("unreadable path element")
+	}
+	pls, err := flattenPathData(elems[0].D)
+	if err != nil {
+		return nil, err
+	}
+	subpaths := []string{elems[0].D}
+	if len(pls) > 1 {
+		abs, err := transformPathData(elems[0].D, func(p point) point { return p })
+		if err != nil {
+			return nil, err
+		}
+		subpaths = nil
+		for _, s := range strings.Split(abs, "M")[1:] {
+			subpaths = append(subpaths, "M"+s)
+		}
+		if len(subpaths) != len(pls) {
+			return nil, fmt.Errorf("path data: %d subpaths flattened to %d polylines", len(subpaths), len(pls))
+		}
+	}
+
+	var out []contour
+	for i, pl := range pls {
+		if len(pl.Points) == 0 {
+			continue
+		}
+		c := contour{elem: elem, pts: pl.Points, box: polylineBounds(pl.Points)}
+		if len(pls) > 1 {
+			c.elem = pathDataAttrRegex.ReplaceAllLiteral(elem, []byte(` d="`+subpaths[i]+`"`))
+		}
+		first, last := pl.Points[0], pl.Points[len(pl.Points)-1]
+		c.closed = len(pl.Points) >= 3 && (pl.Closed || math.Hypot(last.X-first.X, last.Y-first.Y) < 1e-6)
+		if c.closed {
+			c.area = polygonArea(pl.Points)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// orderContoursData reorders the subpaths of an SVG by how deeply each is
+// nested inside closed contours. Inside-out cuts the innermost first, so
+// pieces are cut free before the outline around them loosens the sheet;
+// outside-in is the reverse. Contours at the same depth keep their
+// document order, and the design is unchanged apart from the order.
+func orderContoursData(data []byte, order string) ([]byte, contourStats, error) {
+	var stats contourStats
+	locs := pathElementRegex.FindAllIndex(data, -1)
+	if len(locs) == 0 {
+		return data, stats, nil
+	}
+	for i := 1; i < len(locs); i++ {
+		if len(bytes.TrimSpace(data[locs[i-1][1]:locs[i][0]])) > 0 {
+			return data, stats, fmt.Errorf("the paths are not all siblings")
+		}
+	}
+
+	var contours []*contour
+	for _, loc := range locs {
+		cs, err := splitContours(data[loc[0]:loc[1]])
+		if err != nil {
+			return data, stats, err
+		}
+		for i := range cs {
+			contours = append(contours, &cs[i])
+		}
+	}
+	for _, d := range contours {
+		for _, c := range contours {
+			if c.encloses(d) {
+				d.depth++
+			}
+		}
+		if d.closed {
+			stats.Closed++
+		} else {
+			stats.Open++
+		}
+		stats.MaxDepth = max(stats.MaxDepth, d.depth)
+	}
+
+	sorted := slices.Clone(contours)
+	slices.SortStableFunc(sorted, func(a, b *contour) int {
+		if order == ContourOrderOutsideIn {
+			return a.depth - b.depth
+		}
+		return b.depth - a.depth
+	})
+	for i := range sorted {
+		if sorted[i] != contours[i] {
+			stats.Moved++
+		}
+	}
+	if stats.Moved == 0 {
+		return data, stats, nil
+	}
+
+	out := append([]byte{}, data[:locs[0][0]]...)
+	for i, c := range sorted {
+		if i > 0 {
+			out = append(out, '\n')
+		}
+		out = append(out, c.elem...)
+	}
+	return append(out, data[locs[len(locs)-1][1]:]...), stats, nil
+}
+
+// orderContours applies orderContoursData to an SVG file in place
+func orderContours(svgPath, order string) (contourStats, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return contourStats{}, err
+	}
+	ordered, stats, err := orderContoursData(data, order)
+	if err != nil || stats.Moved == 0 {
+		return stats, err
+	}
+	return stats, os.WriteFile(svgPath, ordered, 0644)
+}
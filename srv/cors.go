@@ -0,0 +1,65 @@
+package srv
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsAllowedHeaders are the request headers cross-origin API clients may send
+const corsAllowedHeaders = "Content-Type, Idempotency-Key"
+
+// corsExposedHeaders are the response headers cross-origin API clients may read
+const corsExposedHeaders = "Location, Content-Disposition"
+
+// ParseCORSOrigins splits a comma-separated list of allowed origins
+func ParseCORSOrigins(list string) []string {
+	var origins []string
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	return origins
+}
+
+func (s *Server) corsOriginAllowed(origin string) bool {
+	for _, o := range s.CORSOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight requests.
+// With no configured origins it passes requests through untouched.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(s.CORSOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := s.corsOriginAllowed(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,227 @@
+package srv
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Deskew search settings
+const (
+	maxDeskewAngle     = 10.0 // degrees either way that detection considers
+	maxManualDeskew    = 45.0 // degrees either way a deskewAngle may turn
+	minDeskewAngle     = 0.1  // detected skews smaller than this are left alone
+	deskewSampleSide   = 600  // longest side, in samples, of the grid detection reads
+	deskewMinGain      = 1.02 // how much sharper than unrotated the best profile must be
+	deskewCoarseStep   = 0.5
+	deskewFineStep     = 0.05
+	deskewDarkFraction = 0.5 // dark pixels are below this point between paper and ink
+)
+
+// parseDeskewAngle reads the optional manual skew in degrees clockwise.
+// Empty and 0 leave the angle to detection.
+func parseDeskewAngle(v string) (float64, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	angle, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(angle) || math.Abs(angle) > maxManualDeskew {
+		return 0, fmt.Errorf("deskewAngle must be a number of degrees between -%g and %g", maxManualDeskew, maxManualDeskew)
+	}
+	return angle, nil
+}
+
+// describeSkew formats a clockwise angle for the job log
+func describeSkew(angle float64) string {
+	if angle < 0 {
+		return fmt.Sprintf("%.2f° counterclockwise", -angle)
+	}
+	return fmt.Sprintf("%.2f° clockwise", angle)
+}
+
+// luminance returns the Rec. 601 brightness of a pixel, 0-255
+func luminance(c color.Color) float64 {
+	r, g, b, _ := c.RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+}
+
+// detectSkew estimates how many degrees the content of a scan is turned
+// clockwise, within maxDeskewAngle either way. It thresholds a coarse
+// grid of samples into ink and paper, then finds the rotation at which
+// the ink's row profile has the most variance: text lines, rules, and the
+// straight edges of drawings all fall into the fewest rows when level. ok
+// is false when no rotation is clearly better than none, as for art with
+// no dominant straight lines.
+func detectSkew(img image.Image) (angle float64, ok bool) {
+	b := img.Bounds()
+	step := max(1, max(b.Dx(), b.Dy())/deskewSampleSide)
+	var hist [256]int
+	var lums []float64
+	var xs, ys []float64
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			l := luminance(img.At(x, y))
+			hist[int(l)]++
+			lums = append(lums, l)
+			xs = append(xs, float64((x-b.Min.X)/step))
+			ys = append(ys, float64((y-b.Min.Y)/step))
+		}
+	}
+	ink, paper := percentileRange(&hist, len(lums)/20)
+	if paper <= ink {
+		return 0, false
+	}
+	threshold := float64(ink) + (float64(paper)-float64(ink))*deskewDarkFraction
+	var px, py []float64
+	for i, l := range lums {
+		if l < threshold {
+			px, py = append(px, xs[i]), append(py, ys[i])
+		}
+	}
+	if len(px) < 10 {
+		return 0, false
+	}
+
+	// The profile is measured in rows of the sample grid, offset so that
+	// every rotated row index is positive
+	diag := math.Hypot(float64(b.Dx()), float64(b.Dy()))/float64(step) + 2
+	rows := make([]float64, 2*int(diag)+1)
+	score := func(deg float64) float64 {
+		clear(rows)
+		sin, cos := math.Sincos(deg * math.Pi / 180)
+		for i := range px {
+			rows[int(py[i]*cos-px[i]*sin+diag)]++
+		}
+		s := 0.0
+		for _, n := range rows {
+			s += n * n
+		}
+		return s
+	}
+
+	level := score(0)
+	best, bestScore := 0.0, level
+	for deg := -maxDeskewAngle; deg <= maxDeskewAngle+1e-9; deg += deskewCoarseStep {
+		if s := score(deg); s > bestScore {
+			best, bestScore = deg, s
+		}
+	}
+	coarse := best
+	for deg := coarse - deskewCoarseStep; deg <= coarse+deskewCoarseStep+1e-9; deg += deskewFineStep {
+		if s := score(deg); s > bestScore {
+			best, bestScore = deg, s
+		}
+	}
+	if bestScore < level*deskewMinGain {
+		return 0, false
+	}
+	return best, true
+}
+
+// borderColor returns the average color of an image's outermost pixels,
+// which for a scan is the paper
+func borderColor(img image.Image) color.NRGBA {
+	b := img.Bounds()
+	var r, g, bl, n float64
+	add := func(x, y int) {
+		c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		r, g, bl, n = r+float64(c.R), g+float64(c.G), bl+float64(c.B), n+1
+	}
+	for x := b.Min.X; x < b.Max.X; x++ {
+		add(x, b.Min.Y)
+		add(x, b.Max.Y-1)
+	}
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		add(b.Min.X, y)
+		add(b.Max.X-1, y)
+	}
+	if n == 0 {
+		return color.NRGBA{255, 255, 255, 255}
+	}
+	return color.NRGBA{uint8(r/n + 0.5), uint8(g/n + 0.5), uint8(bl/n + 0.5), 255}
+}
+
+// rotateImage turns img counterclockwise by deg degrees about its center,
+// keeping its size, with bilinear sampling. Corners turned in from outside
+// the original are filled with fill.
+func rotateImage(img image.Image, deg float64, fill color.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			src.SetNRGBA(x, y, color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA))
+		}
+	}
+	dst := image.NewNRGBA(src.Bounds())
+	cx, cy := float64(b.Dx()-1)/2, float64(b.Dy()-1)/2
+	// Each destination pixel samples the point deg degrees clockwise of it
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	at := func(x, y int) color.NRGBA {
+		if x < 0 || y < 0 || x >= b.Dx() || y >= b.Dy() {
+			return fill
+		}
+		return src.NRGBAAt(x, y)
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			sx, sy := cx+dx*cos-dy*sin, cy+dx*sin+dy*cos
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			fx, fy := sx-float64(x0), sy-float64(y0)
+			c00, c10, c01, c11 := at(x0, y0), at(x0+1, y0), at(x0, y0+1), at(x0+1, y0+1)
+			mix := func(a, b, c, d uint8) uint8 {
+				top := float64(a)*(1-fx) + float64(b)*fx
+				bottom := float64(c)*(1-fx) + float64(d)*fx
+				return uint8(top*(1-fy) + bottom*fy + 0.5)
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				mix(c00.R, c10.R, c01.R, c11.R),
+				mix(c00.G, c10.G, c01.G, c11.G),
+				mix(c00.B, c10.B, c01.B, c11.B),
+				mix(c00.A, c10.A, c01.A, c11.A),
+			})
+		}
+	}
+	return dst
+}
+
+// deskewFile straightens the image at inPath and writes it as a PNG to
+// outPath. A nonzero angle is taken as the number of degrees the scan is
+// turned clockwise; 0 detects the skew. It returns the skew and whether a
+// file was written, which it is not when no skew worth correcting was
+// found. The skew returned then is 0 if there was no clear one.
+func deskewFile(inPath, outPath string, angle float64) (float64, bool, error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer in.Close()
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return 0, false, fmt.Errorf("decode image: %w", err)
+	}
+	if angle == 0 {
+		var ok bool
+		if angle, ok = detectSkew(img); !ok || math.Abs(angle) < minDeskewAngle {
+			return angle, false, nil
+		}
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return angle, false, err
+	}
+	if err := png.Encode(out, rotateImage(img, angle, borderColor(img))); err != nil {
+		out.Close()
+		return angle, false, err
+	}
+	return angle, true, out.Close()
+}
@@ -0,0 +1,74 @@
+package srv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// writeDXF converts the paths in svgPath into LWPOLYLINE entities in a DXF file.
+// Coordinates are scaled from SVG pixels to mm using the same DPI passed to
+// svg2gcode, and the Y axis is flipped so the origin is at the bottom left.
+func writeDXF(svgPath, dxfPath string, dpi, svgHeight float64) (int, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return 0, err
+	}
+	polylines, err := readSVGPolylines(data)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Create(dxfPath)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	encodeDXF(w, polylines, 25.4/dpi, svgHeight)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return len(polylines), nil
+}
+
+// encodeDXF writes a minimal DXF document with one LWPOLYLINE per polyline
+func encodeDXF(w io.Writer, polylines []polyline, scale, svgHeight float64) {
+	pair := func(code int, value string) {
+		fmt.Fprintf(w, "%d\n%s\n", code, value)
+	}
+
+	pair(0, "SECTION")
+	pair(2, "HEADER")
+	pair(9, "$INSUNITS")
+	pair(70, "4") // millimetres
+	pair(0, "ENDSEC")
+
+	pair(0, "SECTION")
+	pair(2, "ENTITIES")
+	for _, pl := range polylines {
+		pts := pl.Points
+		closed := "0"
+		if pl.Closed {
+			closed = "1"
+			// The closing vertex is implied by the closed flag
+			if len(pts) > 2 && pts[0] == pts[len(pts)-1] {
+				pts = pts[:len(pts)-1]
+			}
+		}
+		pair(0, "LWPOLYLINE")
+		pair(8, "0")
+		pair(90, fmt.Sprintf("%d", len(pts)))
+		pair(70, closed)
+		for _, p := range pts {
+			pair(10, fmt.Sprintf("%.4f", p.X*scale))
+			pair(20, fmt.Sprintf("%.4f", (svgHeight-p.Y)*scale))
+		}
+	}
+	pair(0, "ENDSEC")
+	pair(0, "EOF")
+}
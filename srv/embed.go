@@ -0,0 +1,60 @@
+package srv
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ParseFrameAncestors splits a comma-separated list of origins allowed to
+// frame the embed widget. Each must be a bare http(s) origin such as
+// https://club.example, or "*" for any site.
+func ParseFrameAncestors(list string) ([]string, error) {
+	var origins []string
+	for _, o := range ParseCORSOrigins(list) {
+		if o == "*" {
+			origins = append(origins, o)
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.User != nil || strings.ContainsAny(o, " ;'") {
+			return nil, fmt.Errorf("embed ancestor %q: expected an origin like https://example.com", o)
+		}
+		origins = append(origins, u.Scheme+"://"+u.Host)
+	}
+	return origins, nil
+}
+
+// setFramePolicy limits which sites may show a page in a frame. The page
+// can always be framed by this server itself, plus EmbedAncestors. Browsers
+// that only understand X-Frame-Options get SAMEORIGIN when no other
+// ancestors are allowed; the header cannot list origins, so it is left off
+// otherwise and those browsers allow any parent.
+func (s *Server) setFramePolicy(w http.ResponseWriter) {
+	ancestors := append([]string{"'self'"}, s.EmbedAncestors...)
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+strings.Join(ancestors, " "))
+	if len(s.EmbedAncestors) == 0 {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}
+}
+
+// withFramePolicy applies setFramePolicy to pages reachable from the embed
+// widget, so a framed upload can follow through to its job page
+func (s *Server) withFramePolicy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.setFramePolicy(w)
+		next(w, r)
+	}
+}
+
+// HandleEmbed renders the upload form alone, without the page heading and
+// advanced options, for showing in an iframe on another site
+func (s *Server) HandleEmbed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.renderTemplate(w, "embed.html", nil); err != nil {
+		slog.Warn("render template", "url", r.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,226 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// G-Code engines for the engine option
+const (
+	EngineSvg2gcode = "svg2gcode" // shell out to svg2gcode (default)
+	EngineBuiltin   = "builtin"   // generate the G-Code in process from the SVG's paths
+)
+
+// Builtin engine limits
+const (
+	defaultCurveTolerance = 0.02 // mm
+	minCurveTolerance     = 0.001
+	maxCurveTolerance     = 1.0
+	defaultBuiltinFeed    = 300.0 // mm/min, svg2gcode's default
+	maxBuiltinFeed        = 100000.0
+)
+
+// parseEngine validates the engine option and the builtin engine's
+// curveTolerance and feedrate, which only apply to it. svg2gcodeArgs are
+// svg2gcode's own options, so the builtin engine refuses them rather than
+// quietly dropping them.
+func parseEngine(engine, tolerance, feedrate string, svg2gcodeArgs []string) (string, float64, float64, error) {
+	switch strings.ToLower(strings.TrimSpace(engine)) {
+	case "", EngineSvg2gcode:
+		return EngineSvg2gcode, 0, 0, nil
+	case EngineBuiltin:
+	default:
+		return "", 0, 0, fmt.Errorf("engine must be %q or %q", EngineSvg2gcode, EngineBuiltin)
+	}
+	if len(svg2gcodeArgs) > 0 {
+		return "", 0, 0, fmt.Errorf("svg2gcodeArgs only apply to the svg2gcode engine")
+	}
+	tol, feed := defaultCurveTolerance, defaultBuiltinFeed
+	if tolerance != "" {
+		n, err := strconv.ParseFloat(tolerance, 64)
+		if err != nil || !(n >= minCurveTolerance && n <= maxCurveTolerance) {
+			return "", 0, 0, fmt.Errorf("curveTolerance must be a number of mm from %g to %g", minCurveTolerance, maxCurveTolerance)
+		}
+		tol = n
+	}
+	if feedrate != "" {
+		n, err := strconv.ParseFloat(feedrate, 64)
+		if err != nil || !(n > 0 && n <= maxBuiltinFeed) {
+			return "", 0, 0, fmt.Errorf("feedrate must be a number of mm/min above 0 and at most %g", maxBuiltinFeed)
+		}
+		feed = n
+	}
+	return EngineBuiltin, tol, feed, nil
+}
+
+// builtinStats describes a program the builtin engine wrote
+type builtinStats struct {
+	Paths int // subpaths drawn
+	Cuts  int // linear cutting moves
+
+	DimensionsDefaulted bool // the SVG's height was unknown and defaultSVGDimension was assumed
+	Unmapped            bool // the SVG has a viewBox or transform the engine does not apply
+}
+
+// svgUnmapped reports whether the SVG has coordinate mappings the builtin
+// engine leaves out, which draws path coordinates as SVG pixels from the
+// top left: a root viewBox other than "0 0 width height", or a transform
+// attribute on any element.
+func svgUnmapped(data []byte, width, height float64) bool {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	root := true
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, attr := range el.Attr {
+			switch {
+			case attr.Name.Local == "transform":
+				return true
+			case root && attr.Name.Local == "viewBox":
+				f := strings.FieldsFunc(attr.Value, func(r rune) bool { return r == ' ' || r == ',' })
+				if len(f) != 4 {
+					return true
+				}
+				var v [4]float64
+				for i := range v {
+					if v[i], err = strconv.ParseFloat(f[i], 64); err != nil {
+						return true
+					}
+				}
+				if v != [4]float64{0, 0, width, height} {
+					return true
+				}
+			}
+		}
+		root = false
+	}
+}
+
+// builtinMoves renders polylines as G-Code laid out as svg2gcode lays out
+// its programs: mm and absolute positioning first, then for every path the
+// tool off, a rapid to its start, the tool on, and linear cuts with the feed
+// on the first, ending with the tool off. Points are scaled from SVG pixels
+// to mm and the Y axis flipped, so the origin is at the bottom left.
+// Repeated points are dropped, as they would be cuts of no length.
+func builtinMoves(polylines []polyline, toolOn, toolOff string, feed, scale, svgHeight float64) ([]string, builtinStats) {
+	var stats builtinStats
+	lines := append([]string{}, genericSetupModes...)
+	feedWord := " F" + strconv.FormatFloat(feed, 'f', -1, 64)
+	at := func(p point) (float64, float64) {
+		return p.X * scale, (svgHeight - p.Y) * scale
+	}
+	for _, pl := range polylines {
+		var cuts []string
+		last := pl.Points[0]
+		for _, p := range pl.Points[1:] {
+			if math.Abs(p.X-last.X)*scale < 5e-4 && math.Abs(p.Y-last.Y)*scale < 5e-4 {
+				continue // rounds to the point already reached
+			}
+			x, y := at(p)
+			cuts = append(cuts, fmt.Sprintf("G1 X%.3f Y%.3f", x, y))
+			last = p
+		}
+		if len(cuts) == 0 {
+			continue
+		}
+		cuts[0] += feedWord
+		if toolOff != "" {
+			lines = append(lines, toolOff)
+		}
+		x, y := at(pl.Points[0])
+		lines = append(lines, fmt.Sprintf("G0 X%.3f Y%.3f", x, y))
+		if toolOn != "" {
+			lines = append(lines, toolOn)
+		}
+		lines = append(lines, cuts...)
+		stats.Paths++
+		stats.Cuts += len(cuts)
+	}
+	if toolOff != "" {
+		lines = append(lines, toolOff)
+	}
+	return lines, stats
+}
+
+// writeBuiltinGCode converts the paths in svgPath to G-Code in gcodePath
+// at dpi, flattening curves to within tolerance mm
+func writeBuiltinGCode(svgPath, gcodePath, toolOn, toolOff string, feed, tolerance, dpi float64) (builtinStats, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return builtinStats{}, err
+	}
+	svgWidth, svgHeight, ok := parseSVGDimensions(data)
+	if !ok {
+		svgWidth, svgHeight = defaultSVGDimension, defaultSVGDimension
+	}
+	paths, err := parseSVGPaths(data)
+	if err != nil {
+		return builtinStats{}, err
+	}
+	scale := 25.4 / dpi
+	var polylines []polyline
+	for _, p := range paths {
+		pls, err := flattenPathDataWithin(p.D, tolerance/scale)
+		if err != nil {
+			return builtinStats{}, err
+		}
+		polylines = append(polylines, pls...)
+	}
+	lines, stats := builtinMoves(polylines, toolOn, toolOff, feed, scale, svgHeight)
+	stats.DimensionsDefaulted = !ok
+	stats.Unmapped = svgUnmapped(data, svgWidth, svgHeight)
+	return stats, writeGCodeLines(gcodePath, lines)
+}
+
+// convertSVG writes the G-Code for svgPath to gcodePath at dpi with one set
+// of tool commands, using the job's engine. A feed above 0 overrides the
+// engine's feedrate.
+func (s *Server) convertSVG(job *Job, toolOn, toolOff string, feed float64, svgPath, gcodePath string, dpi float64) error {
+	if job.Engine != EngineBuiltin {
+		args := []string{"--on", toolOn, "--off", toolOff, "--dpi", fmt.Sprintf("%.4f", dpi)}
+		args = append(args, job.Svg2gcodeArgs...)
+		if feed > 0 {
+			args = append(args, "--feedrate", strconv.FormatFloat(feed, 'f', -1, 64))
+		}
+		args = append(args, svgPath, "-o", gcodePath)
+		return s.runTool(job, "svg2gcode", args)
+	}
+	if feed <= 0 {
+		feed = job.Feedrate
+	}
+	stats, err := writeBuiltinGCode(svgPath, gcodePath, toolOn, toolOff, feed, job.CurveTolerance, dpi)
+	if err != nil {
+		return err
+	}
+	job.Log.WriteString(fmt.Sprintf("Builtin engine wrote %d paths as %d cutting moves at F%g, curves within %g mm\n",
+		stats.Paths, stats.Cuts, feed, job.CurveTolerance))
+	if stats.DimensionsDefaulted {
+		job.DimensionsDefaulted = true
+		job.warnOnce(defaultedDimensionsWarning)
+	}
+	if stats.Unmapped {
+		job.warnOnce("The SVG has a viewBox or transform, which the builtin engine does not apply, " +
+			"so the output may be offset or at the wrong scale. Check it before plotting, or use the svg2gcode engine.")
+	}
+	return nil
+}
+
+// generateGCode writes the G-Code for svgPath to gcodePath at dpi, once per
+// tool class if the job has any
+func (s *Server) generateGCode(job *Job, workDir, svgPath, gcodePath string, dpi float64) error {
+	if len(job.ToolClasses) > 0 {
+		return s.convertToolClasses(job, workDir, svgPath, gcodePath, dpi)
+	}
+	return s.convertSVG(job, job.ToolOn, job.ToolOff, 0, svgPath, gcodePath, dpi)
+}
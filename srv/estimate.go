@@ -0,0 +1,193 @@
+package srv
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rough Gemini token accounting for AI cost estimates. Images count as
+// 258 tokens when both sides are at most 384 px and as 258 tokens per
+// 768 px tile otherwise; text runs about four characters per token; a
+// generated image costs about 1290 output tokens.
+const (
+	geminiImageTileTokens   = 258
+	geminiSmallImageSize    = 384
+	geminiImageTileSize     = 768
+	geminiCharsPerToken     = 4
+	geminiOutputImageTokens = 1290
+	// Side in px assumed for a generated image that isn't cached yet, when
+	// it is the input of the next refinement step
+	geminiGeneratedImageSize = 1024
+)
+
+// imageHashRegex matches a hex SHA-256 as returned by HashFile
+var imageHashRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// aiEstimateResponse is returned by /api/ai/estimate. The cache fields are
+// the first step's, cacheHit is whether every step would hit, and the token
+// counts are summed over the steps.
+type aiEstimateResponse struct {
+	InputHash   string `json:"inputHash"`
+	CacheKey    string `json:"cacheKey"`
+	CacheHit    bool   `json:"cacheHit"` // A job would reuse cached results and spend nothing
+	PromptChars int    `json:"promptChars"`
+	Base64Bytes int    `json:"base64Bytes,omitempty"` // Size of the image as sent to Gemini; unknown when only a hash is given
+
+	PromptTokens int `json:"promptTokens"`
+	ImageTokens  int `json:"imageTokens,omitempty"`
+	OutputTokens int `json:"outputTokens"`
+	TotalTokens  int `json:"totalTokens"` // 0 on a cache hit
+
+	Steps []aiEstimateStep `json:"steps"` // The aiPrompt, then each of aiRefinePrompts
+}
+
+// aiEstimateStep is one Gemini call of a job's AI step. A step's input is
+// the previous step's output, so its hash and cache key are only known when
+// that output is cached; otherwise the step counts as a miss.
+type aiEstimateStep struct {
+	InputHash    string `json:"inputHash,omitempty"`
+	CacheKey     string `json:"cacheKey,omitempty"`
+	CacheHit     bool   `json:"cacheHit"`
+	PromptChars  int    `json:"promptChars"`
+	PromptTokens int    `json:"promptTokens"`
+	ImageTokens  int    `json:"imageTokens,omitempty"`
+	OutputTokens int    `json:"outputTokens"`
+	TotalTokens  int    `json:"totalTokens"` // 0 on a cache hit
+}
+
+// geminiImageTokens estimates the input tokens for an image of the given size
+func geminiImageTokens(width, height int) int {
+	if width <= geminiSmallImageSize && height <= geminiSmallImageSize {
+		return geminiImageTileTokens
+	}
+	tiles := func(n int) int { return (n + geminiImageTileSize - 1) / geminiImageTileSize }
+	return tiles(width) * tiles(height) * geminiImageTileTokens
+}
+
+// imageFileTokens estimates the input tokens for the image at path, or
+// returns false if its size can't be read
+func imageFileTokens(path string) (int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, false
+	}
+	return geminiImageTokens(cfg.Width, cfg.Height), true
+}
+
+// HandleAPIEstimateAI reports what the AI step of a job would cost: for the
+// aiPrompt and each of aiRefinePrompts, the cache key, whether the cache
+// already holds the result, and a rough token count, and the tokens summed
+// over them. It takes the image as an upload or its SHA-256 as imageHash,
+// and the prompts (the server's default when aiPrompt is empty) with the
+// background their colors are filled from. Animated GIFs are hashed as
+// uploaded, while a job hashes the frame it extracts, so for those the
+// estimate may report a miss for a job that would hit.
+func (s *Server) HandleAPIEstimateAI(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 50<<20)
+	prompt, err := parseAIPrompt(r.FormValue("aiPrompt"), s.MaxPromptLen)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	if prompt == "" {
+		prompt = s.DefaultPrompt
+	}
+	refine, err := parseAIRefinePrompts(r.Form["aiRefinePrompts"], s.MaxPromptLen)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	background, err := parseBackground(r.FormValue("background"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	prompts := append([]string{prompt}, refine...)
+	for i, p := range prompts {
+		prompts[i] = backgroundPrompt(p, s.DefaultPrompt, background)
+	}
+	var resp aiEstimateResponse
+
+	if file, _, err := r.FormFile("image"); err == nil {
+		defer file.Close()
+		h := sha256.New()
+		size, err := io.Copy(h, file)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "Failed to read uploaded file: " + err.Error()})
+			return
+		}
+		resp.InputHash = hex.EncodeToString(h.Sum(nil))
+		resp.Base64Bytes = base64.StdEncoding.EncodedLen(int(size))
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			if cfg, _, err := image.DecodeConfig(file); err == nil {
+				resp.ImageTokens = geminiImageTokens(cfg.Width, cfg.Height)
+			}
+		}
+	} else if hash := strings.ToLower(strings.TrimSpace(r.FormValue("imageHash"))); imageHashRegex.MatchString(hash) {
+		resp.InputHash = hash
+	} else {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "Provide an image file or its SHA-256 as imageHash"})
+		return
+	}
+
+	// Each step's input is the one before's output, which can only be
+	// hashed and measured if it is cached
+	inputHash, imageTokens := resp.InputHash, resp.ImageTokens
+	resp.CacheHit = true
+	for i, prompt := range prompts {
+		step := aiEstimateStep{
+			InputHash:    inputHash,
+			PromptChars:  len([]rune(prompt)),
+			PromptTokens: (len([]rune(prompt)) + geminiCharsPerToken - 1) / geminiCharsPerToken,
+			ImageTokens:  imageTokens,
+			OutputTokens: geminiOutputImageTokens,
+		}
+		inputHash, imageTokens = "", geminiImageTokens(geminiGeneratedImageSize, geminiGeneratedImageSize)
+		if step.InputHash != "" {
+			step.CacheKey = MakeCacheKey(step.InputHash, prompt)
+			path, err := s.AICache.Peek(step.InputHash, prompt)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, apiError{Error: "Cache lookup failed: " + err.Error()})
+				return
+			}
+			if path != "" {
+				if hash, err := HashFile(path); err == nil {
+					step.CacheHit = true
+					inputHash = hash
+					if n, ok := imageFileTokens(path); ok {
+						imageTokens = n
+					}
+				}
+			}
+		}
+		if !step.CacheHit {
+			step.TotalTokens = step.PromptTokens + step.ImageTokens + step.OutputTokens
+			resp.CacheHit = false
+		}
+		if i == 0 {
+			resp.CacheKey = step.CacheKey
+		}
+		resp.PromptChars += step.PromptChars
+		resp.PromptTokens += step.PromptTokens
+		resp.OutputTokens += step.OutputTokens
+		resp.TotalTokens += step.TotalTokens
+		resp.Steps = append(resp.Steps, step)
+	}
+	resp.ImageTokens = 0
+	for _, step := range resp.Steps {
+		resp.ImageTokens += step.ImageTokens
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
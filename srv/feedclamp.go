@@ -0,0 +1,72 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseMaxFeed validates the maxFeed option in mm/min. Empty and 0 leave
+// feedrates alone. The server's own ceiling, if it has one, wins
+// over a higher or missing value.
+func parseMaxFeed(v string, ceiling float64) (float64, error) {
+	feed := 0.0
+	if v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(n >= 0) || math.IsInf(n, 0) {
+			return 0, fmt.Errorf("maxFeed must be a positive number of mm/min, or 0 for no limit")
+		}
+		feed = n
+	}
+	if ceiling > 0 && (feed == 0 || feed > ceiling) {
+		feed = ceiling
+	}
+	return feed, nil
+}
+
+// feedClampStats describes what clampFeedrates did
+type feedClampStats struct {
+	Clamped   int             // F words lowered
+	Originals map[float64]int // how many F words had each value over the maximum
+}
+
+// String lists the original feeds, fastest first, with their counts
+func (s feedClampStats) String() string {
+	feeds := make([]float64, 0, len(s.Originals))
+	for f := range s.Originals {
+		feeds = append(feeds, f)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(feeds)))
+	parts := make([]string, len(feeds))
+	for i, f := range feeds {
+		parts[i] = fmt.Sprintf("F%s (%d)", strconv.FormatFloat(f, 'f', -1, 64), s.Originals[f])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// clampFeedrates lowers every F word above maxFeed to maxFeed. Lines with
+// no feed over it are kept exactly as they were.
+func clampFeedrates(lines []string, maxFeed float64) ([]string, feedClampStats) {
+	stats := feedClampStats{Originals: make(map[float64]int)}
+	limit := strconv.FormatFloat(maxFeed, 'f', -1, 64)
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = line
+		for _, w := range parseGCodeWords(line) {
+			if w.Letter == 'F' && w.Value > maxFeed {
+				out[i] = mapGCodeWords(line, "F", func(_ byte, v float64) string {
+					if v > maxFeed {
+						stats.Clamped++
+						stats.Originals[v]++
+						return limit
+					}
+					return strconv.FormatFloat(v, 'f', -1, 64)
+				})
+				break
+			}
+		}
+	}
+	return out, stats
+}
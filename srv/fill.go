@@ -0,0 +1,196 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Hatch fill defaults and limits
+const (
+	defaultFillAngle   = 45.0 // degrees counterclockwise from the X axis
+	defaultFillSpacing = 1.0  // mm between hatch lines
+	minFillSpacing     = 0.1  // mm; closer lines only soak the paper
+	maxFillSpacing     = 50.0 // mm
+	// maxFillLines bounds the hatch lines of one job, so a fine spacing on a
+	// large design cannot produce an unplottable program
+	maxFillLines = 200000
+)
+
+// parseFill validates the fillAngle and fillSpacing options, which only
+// apply when fill is on. An empty value takes the default.
+func parseFill(enabled bool, angle, spacing string) (float64, float64, error) {
+	if !enabled {
+		return 0, 0, nil
+	}
+	a, s := defaultFillAngle, defaultFillSpacing
+	if angle != "" {
+		n, err := strconv.ParseFloat(angle, 64)
+		if err != nil || math.IsNaN(n) || math.Abs(n) > 360 {
+			return 0, 0, fmt.Errorf("fillAngle must be a number of degrees between -360 and 360")
+		}
+		a = n
+	}
+	if spacing != "" {
+		n, err := strconv.ParseFloat(spacing, 64)
+		if err != nil || !(n >= minFillSpacing && n <= maxFillSpacing) {
+			return 0, 0, fmt.Errorf("fillSpacing must be a number of mm from %g to %g", minFillSpacing, maxFillSpacing)
+		}
+		s = n
+	}
+	return a, s, nil
+}
+
+// fillStats describes what fillClosedPaths did
+type fillStats struct {
+	Regions int // closed subpaths filled
+	Lines   int // hatch lines added
+	Colors  int // stroke colors hatched, one path element each
+}
+
+// hatchRegions returns the hatch lines filling the closed polygons rings,
+// spacing apart at angle degrees. Rings are combined by the even-odd rule,
+// so a ring inside another cuts a hole in it and one inside that is filled
+// again. Lines sit on a grid through the origin, so neighbouring regions
+// hatch in step, and run back and forth so the travel between them stays
+// short.
+func hatchRegions(rings [][]point, angle, spacing float64) [][2]point {
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	// Turn the rings so the hatch runs along X, hatch, and turn back
+	rotated := make([][]point, len(rings))
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for i, ring := range rings {
+		rotated[i] = make([]point, len(ring))
+		for j, p := range ring {
+			q := point{p.X*cos + p.Y*sin, -p.X*sin + p.Y*cos}
+			rotated[i][j] = q
+			minY, maxY = min(minY, q.Y), max(maxY, q.Y)
+		}
+	}
+	back := func(x, y float64) point { return point{x*cos - y*sin, x*sin + y*cos} }
+
+	var lines [][2]point
+	var xs []float64
+	row := 0
+	for k := math.Ceil(minY / spacing); k*spacing <= maxY; k++ {
+		y := k * spacing
+		xs = xs[:0]
+		for _, ring := range rotated {
+			for i := range ring {
+				a, b := ring[i], ring[(i+1)%len(ring)]
+				if (a.Y > y) != (b.Y > y) {
+					xs = append(xs, a.X+(y-a.Y)*(b.X-a.X)/(b.Y-a.Y))
+				}
+			}
+		}
+		slices.Sort(xs)
+		var spans [][2]point
+		for i := 0; i+1 < len(xs); i += 2 {
+			if xs[i+1]-xs[i] > 1e-9 {
+				spans = append(spans, [2]point{back(xs[i], y), back(xs[i+1], y)})
+			}
+		}
+		if row%2 == 1 {
+			slices.Reverse(spans)
+			for i := range spans {
+				spans[i][0], spans[i][1] = spans[i][1], spans[i][0]
+			}
+		}
+		if len(spans) > 0 {
+			row++
+		}
+		lines = append(lines, spans...)
+	}
+	return lines
+}
+
+// fillClosedPaths adds hatching inside the closed subpaths of an SVG, for
+// pen-shaded art that a centerline trace would otherwise only outline. The
+// closed subpaths of each stroke color are filled together by the
+// even-odd rule, and the hatch lines for the color are added as one new
+// path element in it after the existing paths, so a multi-pen job draws
+// each color's fill with its own pen. spacing is in SVG user units.
+func fillClosedPaths(data []byte, angle, spacing float64) ([]byte, fillStats, error) {
+	var stats fillStats
+	locs := pathElementRegex.FindAllIndex(data, -1)
+	if len(locs) == 0 {
+		return data, stats, nil
+	}
+	groups := map[string][][]point{}
+	var colors []string
+	for _, loc := range locs {
+		elem := data[loc[0]:loc[1]]
+		parsed, err := parseSVGPaths(elem)
+		if err != nil || len(parsed) != 1 {
+			return data, stats, fmt.Errorf("unreadable path element")
+		}
+		pls, err := flattenPathData(parsed[0].D)
+		if err != nil {
+			return data, stats, err
+		}
+		color := "000000"
+		if m := strokeColorRegex.FindSubmatch(elem); m != nil {
+			color = strings.ToLower(string(m[1]))
+		}
+		for _, pl := range pls {
+			if len(pl.Points) < 3 {
+				continue
+			}
+			first, last := pl.Points[0], pl.Points[len(pl.Points)-1]
+			if !pl.Closed && math.Hypot(last.X-first.X, last.Y-first.Y) >= 1e-6 {
+				continue
+			}
+			if polygonArea(pl.Points) < spacing*spacing/4 {
+				continue // too small for a hatch line to land in
+			}
+			if _, ok := groups[color]; !ok {
+				colors = append(colors, color)
+			}
+			groups[color] = append(groups[color], pl.Points)
+			stats.Regions++
+		}
+	}
+
+	var added []byte
+	for _, color := range colors {
+		// SVG Y runs down, so the angle is negated to turn counterclockwise
+		// on the plot
+		lines := hatchRegions(groups[color], -angle, spacing)
+		if len(lines) == 0 {
+			continue
+		}
+		stats.Lines += len(lines)
+		if stats.Lines > maxFillLines {
+			return data, stats, fmt.Errorf("the fill needs more than %d hatch lines; use a wider spacing", maxFillLines)
+		}
+		var d strings.Builder
+		for _, l := range lines {
+			d.WriteString(polylineData([]point{l[0], l[1]}))
+		}
+		added = append(added, fmt.Sprintf(`<path style="stroke:#%s; fill:none;" d="%s"/>`, color, d.String())...)
+		stats.Colors++
+	}
+	if len(added) == 0 {
+		return data, stats, nil
+	}
+	end := locs[len(locs)-1][1]
+	out := append([]byte{}, data[:end]...)
+	out = append(out, added...)
+	return append(out, data[end:]...), stats, nil
+}
+
+// fillPaths applies fillClosedPaths to an SVG file
+func fillPaths(svgPath string, angle, spacing float64) (fillStats, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return fillStats{}, err
+	}
+	filled, stats, err := fillClosedPaths(data, angle, spacing)
+	if err != nil || stats.Lines == 0 {
+		return stats, err
+	}
+	return stats, os.WriteFile(svgPath, filled, 0644)
+}
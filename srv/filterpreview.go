@@ -0,0 +1,45 @@
+package srv
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// HandleFilterPreview serves a job's unfiltered trace with the paths the
+// white filter would take at the threshold query parameter recolored red
+// rather than removed, so the threshold can be tuned by eye before running
+// a new job with it. The threshold defaults to the job's own. The number of
+// marked paths is in the X-Filtered-Paths header.
+func (s *Server) HandleFilterPreview(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Preview not available", http.StatusNotFound)
+		return
+	}
+	threshold := job.WhiteThreshold
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		var err error
+		if threshold, err = parseWhiteThreshold(v); err != nil {
+			http.Error(w, "threshold must be a whole number from 1 to 254", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.UploadsDir, job.ID, "output.raw.svg"))
+	if err != nil {
+		http.Error(w, "Preview not available", http.StatusNotFound)
+		return
+	}
+	marked, n := filterWhitePathsData(data, whiteActionMark, threshold, job.Background)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("X-Filtered-Paths", strconv.Itoa(n))
+	http.ServeContent(w, r, "", jobModTime(job), bytes.NewReader(marked))
+}
@@ -0,0 +1,146 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feed units a flavor's F words can be written in. svg2gcode always writes
+// mm/min; other units are converted when the flavor is applied.
+const (
+	FeedUnitsMMPerMin = "mm/min"
+	FeedUnitsMMPerSec = "mm/s"
+)
+
+// feedUnitFactors divides an mm/min feed into each unit
+var feedUnitFactors = map[string]float64{
+	FeedUnitsMMPerMin: 1,
+	FeedUnitsMMPerSec: 60,
+}
+
+// gcodeFlavor captures the conventions a firmware expects around the
+// motion commands svg2gcode emits. GRBL gets G94 so the feed mode is
+// explicit rather than relying on its power-on default.
+type gcodeFlavor struct {
+	// Preamble is emitted at the start of the program
+	Preamble []string
+	// Home is the homing command, emitted only when homing is requested
+	Home string
+	// Footer is emitted at the end of the program
+	Footer []string
+	// MaxLineLength is the longest line the controller buffers, 0 for no limit
+	MaxLineLength int
+	// FeedUnits is the unit the firmware reads F words in, one of the
+	// FeedUnits constants. A job's feedUnits option overrides it.
+	FeedUnits string
+}
+
+var gcodeFlavors = map[string]gcodeFlavor{
+	"grbl": {
+		Preamble:      []string{"G17 G21 G90 G94"},
+		Home:          "$H",
+		Footer:        []string{"M2"},
+		MaxLineLength: 80, // grbl 1.1 LINE_BUFFER_SIZE
+		FeedUnits:     FeedUnitsMMPerMin,
+	},
+	"marlin": {
+		Preamble:  []string{"G21", "G90"},
+		Home:      "G28 X Y",
+		Footer:    []string{"M84"}, // release steppers
+		FeedUnits: FeedUnitsMMPerMin,
+	},
+	"reprap": {
+		Preamble:  []string{"G21", "G90"},
+		Home:      "G28 X Y",
+		Footer:    []string{"M0"},
+		FeedUnits: FeedUnitsMMPerMin,
+	},
+}
+
+// gcodeFlavorNames returns the supported flavor names in sorted order
+func gcodeFlavorNames() []string {
+	names := make([]string, 0, len(gcodeFlavors))
+	for name := range gcodeFlavors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateGCodeFlavor checks the flavor name and its interaction with homing
+func validateGCodeFlavor(flavor string, home bool) error {
+	if flavor == "" {
+		if home {
+			return fmt.Errorf("gcodeHome requires a gcodeFlavor so the correct homing command can be used")
+		}
+		return nil
+	}
+	if _, ok := gcodeFlavors[flavor]; !ok {
+		return fmt.Errorf("unsupported gcodeFlavor %q (supported: %s)", flavor, strings.Join(gcodeFlavorNames(), ", "))
+	}
+	return nil
+}
+
+// parseFeedUnits checks the feedUnits option, which needs a flavor to
+// apply it. Empty keeps the flavor's own unit.
+func parseFeedUnits(v, flavor string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if flavor == "" {
+		return "", fmt.Errorf("feedUnits requires a gcodeFlavor")
+	}
+	if _, ok := feedUnitFactors[v]; !ok {
+		return "", fmt.Errorf("unsupported feedUnits %q (supported: %s, %s)", v, FeedUnitsMMPerMin, FeedUnitsMMPerSec)
+	}
+	return v, nil
+}
+
+// convertFeedUnits rewrites svg2gcode's mm/min F words in the given unit,
+// rounded to 4 decimal places. Lines without an F word are kept as they were.
+func convertFeedUnits(lines []string, units string) []string {
+	factor := feedUnitFactors[units]
+	if factor == 0 || factor == 1 {
+		return lines
+	}
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = line
+		for _, w := range parseGCodeWords(line) {
+			if w.Letter == 'F' {
+				out[i] = mapGCodeWords(line, "F", func(_ byte, v float64) string {
+					return strconv.FormatFloat(math.Round(v/factor*1e4)/1e4, 'f', -1, 64)
+				})
+				break
+			}
+		}
+	}
+	return out
+}
+
+// applyGCodeFlavor wraps a program with the flavor's preamble and footer,
+// writing its F words in the flavor's feed units. It returns the new lines
+// and any lines that exceed the controller's buffer.
+func applyGCodeFlavor(lines []string, flavor gcodeFlavor, home bool) ([]string, []int) {
+	lines = convertFeedUnits(lines, flavor.FeedUnits)
+	out := make([]string, 0, len(lines)+len(flavor.Preamble)+len(flavor.Footer)+1)
+	out = append(out, flavor.Preamble...)
+	if home {
+		out = append(out, flavor.Home)
+	}
+	out = append(out, lines...)
+	out = append(out, flavor.Footer...)
+
+	var tooLong []int
+	if flavor.MaxLineLength > 0 {
+		for i, l := range out {
+			if len(l) > flavor.MaxLineLength {
+				tooLong = append(tooLong, i+1)
+			}
+		}
+	}
+	return out, tooLong
+}
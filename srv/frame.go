@@ -0,0 +1,67 @@
+package srv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// frameMoves returns a tool-up traversal of the corners of b, starting and
+// ending at the lower-left corner, so the operator can watch the gantry
+// outline the job before anything is drawn
+func frameMoves(b bounds, toolOff string) []string {
+	corners := []point{
+		{b.MinX, b.MinY},
+		{b.MaxX, b.MinY},
+		{b.MaxX, b.MaxY},
+		{b.MinX, b.MaxY},
+		{b.MinX, b.MinY},
+	}
+	lines := []string{"; frame the job: trace the bounding box with the tool up"}
+	if toolOff != "" {
+		lines = append(lines, toolOff)
+	}
+	for _, c := range corners {
+		lines = append(lines, fmt.Sprintf("G0 X%.3f Y%.3f", c.X, c.Y))
+	}
+	return append(lines, "; end frame")
+}
+
+// insertFrame places the frame before the program's first positioning move,
+// after any setup lines, so it runs with the program's own units and modes
+func insertFrame(lines, frame []string) []string {
+	at := len(lines)
+	for i, l := range lines {
+		if hasPositionWord(l) {
+			at = i
+			break
+		}
+	}
+	out := make([]string, 0, len(lines)+len(frame))
+	out = append(out, lines[:at]...)
+	out = append(out, frame...)
+	return append(out, lines[at:]...)
+}
+
+// hasPositionWord reports whether a line carries an X or Y coordinate
+func hasPositionWord(line string) bool {
+	for _, w := range parseGCodeWords(line) {
+		if w.Letter == 'X' || w.Letter == 'Y' {
+			return true
+		}
+	}
+	return false
+}
+
+// frameGCode prepends a frame of the job's cutting bounds to lines. It
+// returns the frame bounds and false if the program has no cutting moves.
+func frameGCode(lines []string, toolOff string) ([]string, bounds, bool) {
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return lines, bounds{}, false
+	}
+	b, ok := movesBounds(moves, true)
+	if !ok {
+		return lines, b, false
+	}
+	return insertFrame(lines, frameMoves(b, toolOff)), b, true
+}
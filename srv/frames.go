@@ -0,0 +1,101 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"os"
+	"strconv"
+)
+
+// parseFrame reads the frame form field; empty selects the first frame
+func parseFrame(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("frame must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// isGIF reports whether data starts with a GIF signature
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+// gifFrame composites an animated GIF up to frame n and returns the image a
+// viewer would show at that point. Later GIF frames are often only the
+// pixels that changed, so frames cannot be traced on their own.
+func gifFrame(g *gif.GIF, n int) *image.RGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	for i := 0; i <= n; i++ {
+		frame := g.Image[i]
+		var saved *image.RGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if i < n && disposal == gif.DisposalPrevious {
+			saved = image.NewRGBA(bounds)
+			draw.Draw(saved, bounds, canvas, bounds.Min, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if i == n {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+	return canvas
+}
+
+// extractFrame writes the selected frame of a multi-frame input to outPath
+// as a PNG. It returns the input's frame count and whether a frame was
+// extracted; single-frame inputs are left for the pipeline to read as-is.
+func extractFrame(inPath, outPath string, frame int) (int, bool, error) {
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		return 0, false, err
+	}
+	if !isGIF(data) {
+		if frame > 0 {
+			return 1, false, fmt.Errorf("frame %d requested but the input has a single frame", frame)
+		}
+		return 1, false, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return 0, false, fmt.Errorf("decode gif: %w", err)
+	}
+	count := len(g.Image)
+	if frame >= count {
+		return count, false, fmt.Errorf("frame %d requested but the GIF has %d frames (numbered from 0)", frame, count)
+	}
+	if count == 1 {
+		return count, false, nil
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return count, false, err
+	}
+	if err := png.Encode(out, gifFrame(g, frame)); err != nil {
+		out.Close()
+		return count, false, err
+	}
+	return count, true, out.Close()
+}
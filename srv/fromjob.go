@@ -0,0 +1,110 @@
+package srv
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// notCopiedOptions are JobOptions that fromJob leaves out: a callback
+// belongs to the integration that started the source job, not to its
+// settings
+var notCopiedOptions = map[string]bool{"callbackURL": true}
+
+// zeroCopiedOptions are JobOptions whose zero is a setting of its own,
+// different from the default they take when left out: a 0° fill hatches
+// along the X axis, not at 45°
+var zeroCopiedOptions = map[string]bool{"fillAngle": true, "mergeAngle": true}
+
+// parseFromJob returns the job ID in a fromJob value, which may be the ID
+// itself or a link to the job's page
+func parseFromJob(v string) string {
+	v = strings.TrimSpace(v)
+	if i := strings.LastIndex(v, "/job/"); i >= 0 {
+		v = v[i+len("/job/"):]
+		if end := strings.IndexAny(v, "/?#"); end >= 0 {
+			v = v[:end]
+		}
+	}
+	return v
+}
+
+// jobOptionsForm returns opts as the upload form fields that set them, so a
+// new upload given these values is processed the same way. Zero values are
+// left out, as an option the source job didn't use takes its default when
+// empty, and sub-options such as fillSpacing are refused at 0 when their
+// feature is turned on. Only zeroCopiedOptions are included at zero.
+func jobOptionsForm(opts JobOptions) (url.Values, error) {
+	form := url.Values{}
+	v := reflect.ValueOf(opts)
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" || notCopiedOptions[name] {
+			continue
+		}
+		if v.Field(i).IsZero() && !zeroCopiedOptions[name] {
+			continue
+		}
+		switch f := v.Field(i).Interface().(type) {
+		case string:
+			form.Set(name, f)
+		case bool:
+			form.Set(name, strconv.FormatBool(f)) // always true, false is left out
+		case int:
+			form.Set(name, strconv.Itoa(f))
+		case float64:
+			form.Set(name, strconv.FormatFloat(f, 'f', -1, 64))
+		case []string:
+			switch name {
+			case "formats":
+				form[name] = append([]string{}, f...)
+			case "aiRefinePrompts":
+				form.Set(name, strings.Join(f, "\n"))
+			default:
+				form.Set(name, strings.Join(quoteArgs(f), " ")) // autotraceArgs, svg2gcodeArgs
+			}
+		case []toolClass:
+			rules := make([]string, len(f))
+			for i, c := range f {
+				rules[i] = c.Rule()
+			}
+			form.Set(name, strings.Join(rules, "\n"))
+		default:
+			return nil, fmt.Errorf("fromJob: option %s can't be copied", name)
+		}
+	}
+	return form, nil
+}
+
+// copyJobSettings fills in the options a request leaves out from the job
+// named by its fromJob field, if it has one. Options the request sets
+// itself win, so a copied setting can still be changed.
+func (s *Server) copyJobSettings(r *http.Request) error {
+	id := parseFromJob(r.FormValue("fromJob"))
+	if id == "" {
+		return nil
+	}
+	s.mu.Lock()
+	source, exists := s.jobs[id]
+	var opts JobOptions
+	if exists {
+		opts = source.JobOptions
+	}
+	s.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("fromJob: job %q not found", id)
+	}
+	form, err := jobOptionsForm(opts)
+	if err != nil {
+		return err
+	}
+	for name, values := range form {
+		if _, set := r.Form[name]; !set {
+			r.Form[name] = values
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package srv
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// gcodeMove is a single linear motion segment in machine coordinates (mm)
+type gcodeMove struct {
+	From, To point
+	Cut      bool    // false for rapid (G0) travel moves
+	Feed     float64 // active feedrate, 0 if none was set
+	Line     int     // 1-based source line number
+}
+
+// gcodeWord is a letter/value pair such as X12.5
+type gcodeWord struct {
+	Letter byte
+	Value  float64
+}
+
+// stripGCodeComment removes ';' and '(...)' comments from a line
+func stripGCodeComment(line string) string {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	for {
+		open := strings.IndexByte(line, '(')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(line[open:], ')')
+		if end < 0 {
+			line = line[:open]
+			break
+		}
+		line = line[:open] + " " + line[open+end+1:]
+	}
+	return line
+}
+
+// parseGCodeWords splits a line into words, ignoring comments and anything
+// that is not a letter followed by a number
+func parseGCodeWords(line string) []gcodeWord {
+	line = stripGCodeComment(line)
+	var words []gcodeWord
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if c < 'A' || c > 'Z' {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(line) && line[j] == ' ' {
+			j++
+		}
+		k := j
+		for k < len(line) && strings.IndexByte("+-.0123456789", line[k]) >= 0 {
+			k++
+		}
+		if v, err := strconv.ParseFloat(line[j:k], 64); err == nil {
+			words = append(words, gcodeWord{Letter: c, Value: v})
+		}
+		if k == j {
+			k = i + 1
+		}
+		i = k
+	}
+	return words
+}
+
+// parseGCodeMoves interprets a G-code program and returns its motion as line
+// segments. It understands G0-G3, G20/G21 units, and G90/G91 positioning;
+// arcs are flattened into straight segments.
+func parseGCodeMoves(r io.Reader) ([]gcodeMove, error) {
+	var (
+		moves    []gcodeMove
+		pos      point
+		motion   = -1 // active motion mode, -1 until set
+		feed     float64
+		relative bool
+		unit     = 1.0 // mm per program unit
+		lineNo   int
+	)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		lineNo++
+		words := parseGCodeWords(sc.Text())
+		if len(words) == 0 {
+			continue
+		}
+
+		var x, y, i, j *float64
+		for _, w := range words {
+			v := w.Value
+			switch w.Letter {
+			case 'G':
+				switch v {
+				case 0, 1, 2, 3:
+					motion = int(v)
+				case 20:
+					unit = 25.4
+				case 21:
+					unit = 1
+				case 90:
+					relative = false
+				case 91:
+					relative = true
+				}
+			case 'X':
+				x = &v
+			case 'Y':
+				y = &v
+			case 'I':
+				i = &v
+			case 'J':
+				j = &v
+			case 'F':
+				feed = v * unit
+			}
+		}
+
+		if (x == nil && y == nil) || motion < 0 {
+			continue
+		}
+		target := pos
+		if relative {
+			if x != nil {
+				target.X += *x * unit
+			}
+			if y != nil {
+				target.Y += *y * unit
+			}
+		} else {
+			if x != nil {
+				target.X = *x * unit
+			}
+			if y != nil {
+				target.Y = *y * unit
+			}
+		}
+
+		cut := motion != 0
+		if (motion == 2 || motion == 3) && (i != nil || j != nil) {
+			center := pos
+			if i != nil {
+				center.X += *i * unit
+			}
+			if j != nil {
+				center.Y += *j * unit
+			}
+			prev := pos
+			for _, p := range gcodeArcPoints(pos, target, center, motion == 2) {
+				moves = append(moves, gcodeMove{From: prev, To: p, Cut: true, Feed: feed, Line: lineNo})
+				prev = p
+			}
+		} else {
+			moves = append(moves, gcodeMove{From: pos, To: target, Cut: cut, Feed: feed, Line: lineNo})
+		}
+		pos = target
+	}
+	return moves, sc.Err()
+}
+
+// gcodeArcPoints flattens a G2 (clockwise) or G3 arc around center
+func gcodeArcPoints(from, to, center point, clockwise bool) []point {
+	r := math.Hypot(from.X-center.X, from.Y-center.Y)
+	a0 := math.Atan2(from.Y-center.Y, from.X-center.X)
+	a1 := math.Atan2(to.Y-center.Y, to.X-center.X)
+	sweep := a1 - a0
+	if clockwise {
+		if sweep >= 0 {
+			sweep -= 2 * math.Pi
+		}
+	} else if sweep <= 0 {
+		sweep += 2 * math.Pi
+	}
+
+	pts := make([]point, 0, curveSegments)
+	for k := 1; k <= curveSegments; k++ {
+		a := a0 + sweep*float64(k)/curveSegments
+		pts = append(pts, point{center.X + r*math.Cos(a), center.Y + r*math.Sin(a)})
+	}
+	pts[len(pts)-1] = to
+	return pts
+}
+
+// readGCodeMoves parses the G-code file at path
+func readGCodeMoves(path string) ([]gcodeMove, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseGCodeMoves(f)
+}
+
+// bounds is an axis-aligned bounding box
+type bounds struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+func (b bounds) Width() float64  { return b.MaxX - b.MinX }
+func (b bounds) Height() float64 { return b.MaxY - b.MinY }
+
+// movesBounds returns the bounding box of the endpoints of the selected
+// moves, and false if no move was selected
+func movesBounds(moves []gcodeMove, cutsOnly bool) (bounds, bool) {
+	b := bounds{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	found := false
+	for _, m := range moves {
+		if cutsOnly && !m.Cut {
+			continue
+		}
+		for _, p := range []point{m.From, m.To} {
+			b.MinX = math.Min(b.MinX, p.X)
+			b.MinY = math.Min(b.MinY, p.Y)
+			b.MaxX = math.Max(b.MaxX, p.X)
+			b.MaxY = math.Max(b.MaxY, p.Y)
+		}
+		found = true
+	}
+	return b, found
+}
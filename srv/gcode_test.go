@@ -0,0 +1,904 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseGCodeMoves(t *testing.T) {
+	t.Run("rapid and linear moves", func(t *testing.T) {
+		program := "G21\nG90 ; absolute\nG0 X10 Y10\nS4 M0 (tool on)\nG1 X20 Y10 F300\nX20 Y20\n"
+		moves, err := parseGCodeMoves(strings.NewReader(program))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(moves) != 3 {
+			t.Fatalf("expected 3 moves, got %d: %+v", len(moves), moves)
+		}
+		if moves[0].Cut || moves[0].To != (point{10, 10}) {
+			t.Errorf("unexpected travel move: %+v", moves[0])
+		}
+		if !moves[2].Cut || moves[2].From != (point{20, 10}) || moves[2].To != (point{20, 20}) || moves[2].Feed != 300 {
+			t.Errorf("modal G1 move not parsed: %+v", moves[2])
+		}
+		if moves[2].Line != 6 {
+			t.Errorf("expected line 6, got %d", moves[2].Line)
+		}
+	})
+
+	t.Run("relative positioning and inches", func(t *testing.T) {
+		moves, err := parseGCodeMoves(strings.NewReader("G20 G91\nG1 X1 Y1\nG1 X1\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := moves[1].To; math.Abs(got.X-50.8) > 1e-9 || math.Abs(got.Y-25.4) > 1e-9 {
+			t.Errorf("unexpected end point: %+v", got)
+		}
+	})
+
+	t.Run("arcs are flattened", func(t *testing.T) {
+		moves, err := parseGCodeMoves(strings.NewReader("G0 X10 Y0\nG3 X-10 Y0 I-10 J0\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(moves) != 1+curveSegments {
+			t.Fatalf("expected %d moves, got %d", 1+curveSegments, len(moves))
+		}
+		b, _ := movesBounds(moves, true)
+		if math.Abs(b.MaxY-10) > 1e-9 || b.MinY < -1e-9 {
+			t.Errorf("counter-clockwise arc should bulge to +Y, got bounds %+v", b)
+		}
+	})
+}
+
+func TestRenderToolpath(t *testing.T) {
+	moves := []gcodeMove{
+		{From: point{0, 0}, To: point{0, 10}},
+		{From: point{0, 10}, To: point{10, 10}, Cut: true},
+	}
+	img := renderToolpath(moves, 100)
+	// The cut runs along the top edge, the travel along the left edge
+	if c := img.RGBAAt(50, 2); c != renderCutColor {
+		t.Errorf("expected cut color at top edge, got %v", c)
+	}
+	if c := img.RGBAAt(2, 50); c != renderTravelColor {
+		t.Errorf("expected travel color at left edge, got %v", c)
+	}
+	if c := img.RGBAAt(50, 50); c.R != 255 || c.G != 255 || c.B != 255 {
+		t.Errorf("expected white background, got %v", c)
+	}
+}
+
+func TestGCodeFlavor(t *testing.T) {
+	if err := validateGCodeFlavor("", true); err == nil {
+		t.Error("expected homing without a flavor to be rejected")
+	}
+	if err := validateGCodeFlavor("smoothie", false); err == nil {
+		t.Error("expected unknown flavor to be rejected")
+	}
+
+	lines := []string{"G0 X1 Y1", "G1 X2 Y2 " + strings.Repeat("0", 80)}
+	out, tooLong := applyGCodeFlavor(lines, gcodeFlavors["grbl"], true)
+	want := []string{"G17 G21 G90 G94", "$H", lines[0], lines[1], "M2"}
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Errorf("applyGCodeFlavor = %q, expected %q", out, want)
+	}
+	if len(tooLong) != 1 || tooLong[0] != 4 {
+		t.Errorf("expected line 4 to exceed the GRBL buffer, got %v", tooLong)
+	}
+
+	out, _ = applyGCodeFlavor(lines, gcodeFlavors["marlin"], false)
+	if out[0] != "G21" || out[len(out)-1] != "M84" {
+		t.Errorf("unexpected marlin output: %q", out)
+	}
+
+	for name, flavor := range gcodeFlavors {
+		if flavor.FeedUnits != FeedUnitsMMPerMin {
+			t.Errorf("%s: feed units %q, expected %q", name, flavor.FeedUnits, FeedUnitsMMPerMin)
+		}
+	}
+	if _, err := parseFeedUnits("mm/s", ""); err == nil {
+		t.Error("expected feedUnits without a flavor to be rejected")
+	}
+	if _, err := parseFeedUnits("in/min", "grbl"); err == nil {
+		t.Error("expected unknown feed units to be rejected")
+	}
+
+	feeds := []string{"G1 X1 Y1 F1500 ; F3000 in a comment", "G0 X0 Y0", "G1 F1000 (F9) X2"}
+	out, _ = applyGCodeFlavor(feeds, jobFlavor(JobOptions{GCodeFlavor: "marlin", FeedUnits: FeedUnitsMMPerSec}), false)
+	want = []string{"G21", "G90", "G1 X1 Y1 F25 ; F3000 in a comment", "G0 X0 Y0", "G1 F16.6667 (F9) X2", "M84"}
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Errorf("mm/s feeds = %q, expected %q", out, want)
+	}
+	out, _ = applyGCodeFlavor(feeds, jobFlavor(JobOptions{GCodeFlavor: "marlin"}), false)
+	if strings.Join(out[2:5], "\n") != strings.Join(feeds, "\n") {
+		t.Errorf("mm/min feeds should be kept as written, got %q", out)
+	}
+}
+
+func TestMachineSetup(t *testing.T) {
+	for _, c := range []struct {
+		flavor                 string
+		home, offset, absolute string
+		want                   string
+	}{
+		{"grbl", "cycle", "g55", "", "G17 G21 G90 G94 / $H / G55"},
+		{"marlin", "cycle", "G59.2", "true", "G21 / G90 / G28 X Y / G59.2"},
+		{"", "cycle", "", "", "G21 / G90 / G28"},
+		{"grbl", "g28", "G54", "false", "G28 / G54"},
+		{"reprap", "none", "", "off", ""},
+	} {
+		setup, err := parseMachineSetup(true, c.flavor, false, c.home, c.offset, c.absolute)
+		if err != nil {
+			t.Errorf("%s %q %q: %v", c.flavor, c.home, c.offset, err)
+			continue
+		}
+		if got := strings.Join(machineSetupLines(setup, c.flavor), " / "); got != c.want {
+			t.Errorf("%s %q %q: setup %q, expected %q", c.flavor, c.home, c.offset, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		flavor, home, offset string
+		gcodeHome            bool
+	}{
+		{"grbl", "", "G59.1", false}, // GRBL has only G54 to G59
+		{"", "", "G53", false},
+		{"marlin", "twice", "", false},
+		{"marlin", "cycle", "", true}, // homing twice
+	} {
+		if _, err := parseMachineSetup(true, c.flavor, c.gcodeHome, c.home, c.offset, ""); err == nil {
+			t.Errorf("%s %q %q gcodeHome=%v: expected an error", c.flavor, c.home, c.offset, c.gcodeHome)
+		}
+	}
+	if setup, err := parseMachineSetup(false, "", false, "bogus", "G99", "x"); err != nil || setup != (machineSetup{}) {
+		t.Errorf("sub-options should be ignored without machineSetup, got %+v, %v", setup, err)
+	}
+
+	// The setup takes the place of the flavor's preamble
+	opts := JobOptions{GCodeFlavor: "grbl", MachineSetup: true, SetupHome: "cycle", SetupWorkOffset: "G54", SetupAbsolute: true}
+	out, _ := applyGCodeFlavor([]string{"G0 X1 Y1"}, jobFlavor(opts), false)
+	out = append(jobMachineSetup(opts), out...)
+	if got := strings.Join(out, " / "); got != "G17 G21 G90 G94 / $H / G54 / G0 X1 Y1 / M2" {
+		t.Errorf("unexpected program %q", got)
+	}
+}
+
+func TestComplexityWarning(t *testing.T) {
+	rep := complexityReport{Paths: 50, Moves: 1200, GCodeBytes: 3 << 20}
+	if msg := complexityWarning(rep, DefaultComplexityThresholds); msg != "" {
+		t.Errorf("expected no warning within defaults, got %q", msg)
+	}
+
+	msg := complexityWarning(rep, ComplexityThresholds{MaxPaths: 10, MaxFileBytes: 1 << 20})
+	for _, want := range []string{"50 paths (threshold 10)", "3.0 MB of G-Code (threshold 1.0 MB)"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected warning to contain %q, got %q", want, msg)
+		}
+	}
+	if strings.Contains(msg, "moves") {
+		t.Errorf("disabled move threshold should not be reported: %q", msg)
+	}
+}
+
+func TestKeepOut(t *testing.T) {
+	regions, err := ParseKeepOutRegions("clamp=20,20,10,10; 50,50,60,60")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(regions) != 2 || regions[0].Name != "clamp" || regions[0].MinX != 10 || regions[1].Name != "region 2" {
+		t.Fatalf("unexpected regions: %+v", regions)
+	}
+	if _, err := ParseKeepOutRegions("1,2,3"); err == nil {
+		t.Error("expected malformed region to be rejected")
+	}
+
+	moves := []gcodeMove{
+		{From: point{0, 0}, To: point{30, 30}, Line: 1},              // travel through the clamp
+		{From: point{0, 15}, To: point{30, 15}, Cut: true, Line: 2},  // crosses the clamp without an endpoint inside
+		{From: point{0, 0}, To: point{40, 5}, Cut: true, Line: 3},    // passes below
+		{From: point{55, 55}, To: point{56, 56}, Cut: true, Line: 4}, // entirely inside
+	}
+	violations := checkKeepOut(moves, regions)
+	if len(violations) != 2 {
+		t.Fatalf("expected 2 violations, got %+v", violations)
+	}
+	if v := violations[0]; v.Move.Line != 2 || v.Entry != (point{10, 15}) {
+		t.Errorf("unexpected first violation: %+v", v)
+	}
+	if v := violations[1]; v.Move.Line != 4 || v.Entry != (point{55, 55}) {
+		t.Errorf("unexpected second violation: %+v", v)
+	}
+}
+
+func TestFrameGCode(t *testing.T) {
+	lines := []string{"G21", "G90", "G0 X10 Y5", "M3", "G1 X30 Y5 F300", "G1 X30 Y25", "M5", "G0 X0 Y0"}
+	out, b, ok := frameGCode(lines, "M5")
+	if !ok {
+		t.Fatal("expected a frame for a program with cuts")
+	}
+	if b != (bounds{10, 5, 30, 25}) {
+		t.Errorf("unexpected frame bounds %+v", b)
+	}
+	want := []string{
+		"G21", "G90",
+		"; frame the job: trace the bounding box with the tool up",
+		"M5",
+		"G0 X10.000 Y5.000", "G0 X30.000 Y5.000", "G0 X30.000 Y25.000", "G0 X10.000 Y25.000", "G0 X10.000 Y5.000",
+		"; end frame",
+	}
+	if strings.Join(out[:len(want)], "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected framed program:\n%s", strings.Join(out, "\n"))
+	}
+	if len(out) != len(lines)+len(want)-2 {
+		t.Errorf("original program lines were lost: %q", out)
+	}
+
+	if _, _, ok := frameGCode([]string{"G21", "G0 X1 Y1"}, "M5"); ok {
+		t.Error("expected no frame for a program without cuts")
+	}
+}
+
+func TestRegistrationGCode(t *testing.T) {
+	lines := []string{"G21", "G90", "G0 X10 Y5", "M3", "G1 X30 Y5 F300", "G1 X30 Y25", "M5"}
+	out, b, ok := registrationGCode(lines, RegistrationCorner, 5, "M3", "M5")
+	if !ok || b != (bounds{10, 5, 30, 25}) {
+		t.Fatalf("expected marks around the cuts, got %+v %v", b, ok)
+	}
+	want := []string{
+		"G21", "G90",
+		"; registration marks",
+		"M5", "G0 X5.000 Y5.000", "M3", "G1 X10.000 Y5.000 F300", "G1 X10.000 Y0.000",
+	}
+	if strings.Join(out[:len(want)], "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected marked program:\n%s", strings.Join(out, "\n"))
+	}
+
+	// Every travel between marks must happen with the tool up
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(out, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := false
+	for _, l := range out {
+		switch strings.TrimSpace(l) {
+		case "M3":
+			down = true
+		case "M5":
+			down = false
+		}
+		if strings.HasPrefix(l, "G0") && down {
+			t.Errorf("travel %q with the tool down", l)
+		}
+	}
+	if got, _ := movesBounds(moves, true); got != (bounds{5, 0, 35, 30}) {
+		t.Errorf("unexpected marked bounds %+v", got)
+	}
+
+	crosses, _, _ := registrationGCode(lines, RegistrationCross, 4, "M3", "M5")
+	if n := strings.Count(strings.Join(crosses, "\n"), "G1 "); n != 8+2 {
+		t.Errorf("expected two strokes per cross, got %d cutting lines", n)
+	}
+
+	if _, _, err := parseRegistrationMarks("cross", "0"); err == nil {
+		t.Error("expected a zero mark size to be rejected")
+	}
+	if _, _, err := parseRegistrationMarks("circle", ""); err == nil {
+		t.Error("expected an unknown style to be rejected")
+	}
+}
+
+func TestEncodePlotSVG(t *testing.T) {
+	lines := "G21\nG0 X10 Y5\nG1 X30 Y5 F300\nG1 X30 Y25\nG0 X0 Y0\nG1 X5 Y0\n"
+	moves, err := parseGCodeMoves(strings.NewReader(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n := encodePlotSVG(&buf, moves, plotMetadata{ToolOn: `M3 S"1000"`, ToolOff: "M5", DPI: 96})
+	if n != 2 {
+		t.Errorf("expected the two joined cuts to become 2 paths, got %d", n)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`width="30.000mm" height="25.000mm" viewBox="0.000 -25.000 30.000 25.000"`,
+		`d="M10.000,-5.000 L30.000,-5.000 L30.000,-25.000"`,
+		`inkscape:label="% Travel" id="layer-travel" style="display:none"`,
+		`toolOn="M3 S&#34;1000&#34;"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in plot SVG:\n%s", want, out)
+		}
+	}
+	if _, err := parseSVGPaths(buf.Bytes()); err != nil {
+		t.Errorf("plot SVG is not well-formed: %v", err)
+	}
+}
+
+func TestClampFeedrates(t *testing.T) {
+	lines := []string{"G21", "G0 X0 Y0 F9000", "G1 X1 Y1 F1000.0 ; slow", "G1 X2 Y2 f3000 (fast)", "G1 X3 Y3 F3000", "G1 X4 Y4 F2000"}
+	out, stats := clampFeedrates(lines, 2000)
+	want := []string{"G21", "G0 X0 Y0 F2000", "G1 X1 Y1 F1000.0 ; slow", "G1 X2 Y2 f2000 (fast)", "G1 X3 Y3 F2000", "G1 X4 Y4 F2000"}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("unexpected program:\n%s", strings.Join(out, "\n"))
+	}
+	if stats.Clamped != 3 || stats.String() != "F9000 (1), F3000 (2)" {
+		t.Errorf("unexpected stats %d %q", stats.Clamped, stats)
+	}
+
+	for _, c := range []struct {
+		v       string
+		ceiling float64
+		want    float64
+	}{{"", 0, 0}, {"0", 0, 0}, {"1500", 0, 1500}, {"", 3000, 3000}, {"5000", 3000, 3000}, {"1500", 3000, 1500}} {
+		if got, err := parseMaxFeed(c.v, c.ceiling); err != nil || got != c.want {
+			t.Errorf("parseMaxFeed(%q, %g) = %g, %v, expected %g", c.v, c.ceiling, got, err, c.want)
+		}
+	}
+	if _, err := parseMaxFeed("-5", 0); err == nil {
+		t.Error("expected a negative maxFeed to be refused")
+	}
+}
+
+func TestToolpathAnimation(t *testing.T) {
+	lines := "G21\nG0 X10 Y5\nG1 X30 Y5 F300\nG1 X30 Y25\nG0 X0 Y0\nG1 X5 Y0\n"
+	moves, err := parseGCodeMoves(strings.NewReader(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n := encodeToolpathAnimation(&buf, moves, 10); n != 4 {
+		t.Errorf("expected 2 travels and 2 cuts animated, got %d", n)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `d="M10.000,-5.000 L30.000,-5.000 L30.000,-25.000" style="fill:none;stroke:#000000`) {
+		t.Errorf("expected the joined cuts as one black path:\n%s", out)
+	}
+
+	// The runs play one after another, in order, filling the duration
+	var end float64
+	for i, m := range regexp.MustCompile(`begin="([0-9.]+)s" dur="([0-9.]+)s"`).FindAllStringSubmatch(out, -1) {
+		begin, _ := strconv.ParseFloat(m[1], 64)
+		dur, _ := strconv.ParseFloat(m[2], 64)
+		if math.Abs(begin-end) > 0.002 {
+			t.Errorf("run %d begins at %gs, expected %gs", i, begin, end)
+		}
+		end = begin + dur
+	}
+	if math.Abs(end-10) > 0.002 {
+		t.Errorf("expected the animation to end at 10s, got %gs", end)
+	}
+	// Travel goes four times faster: the 40 mm cut takes 40/57.56 of it
+	if !strings.Contains(out, `begin="0.486s" dur="6.950s"`) {
+		t.Errorf("unexpected timing of the first cut:\n%s", out)
+	}
+	if _, err := parseSVGPaths(buf.Bytes()); err != nil {
+		t.Errorf("animation SVG is not well-formed: %v", err)
+	}
+}
+
+func TestAdaptFeedrates(t *testing.T) {
+	if got := cornerFeed(1000, 300, 60, 30); got != 650 {
+		t.Errorf("a 60° turn should slow halfway to 650, got %g", got)
+	}
+	if got := cornerFeed(1000, 300, 20, 30); got != 1000 {
+		t.Errorf("a turn under the threshold should keep the feed, got %g", got)
+	}
+
+	program := []string{
+		"G21",
+		"G0 X0 Y0",
+		"M3",
+		"G1 X10 Y0 F1000",
+		"G1 X10 Y10 ; corner",
+		"G1 X11.763 Y20",
+		"G1 X13.5 Y30",
+		"M5",
+		"G0 X50 Y50",
+		"M3",
+		"G1 X60 Y50 F1000",
+		"M5",
+	}
+	out, slowed, err := adaptFeedrates(program, 300, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slowed != 2 {
+		t.Errorf("slowed = %d, want 2", slowed)
+	}
+	want := append([]string(nil), program...)
+	want[3] = "G1 X10 Y0 F300"
+	// The corner's second cut runs at the modal F300 already
+	want[5] = "G1 X11.763 Y20 F1000"
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(out, "\n"), strings.Join(want, "\n"))
+	}
+
+	if out, slowed, _ := adaptFeedrates(program[:4], 300, 30); slowed != 0 || len(out) != 4 || out[3] != program[3] {
+		t.Errorf("a single straight cut should be left alone, got %q", out)
+	}
+	if _, _, err := adaptFeedrates([]string{"G20", "G1 X1 Y0 F40", "G1 X1 Y1"}, 300, 30); err == nil {
+		t.Error("inch programs should be refused")
+	}
+	if _, _, err := parseAdaptiveFeed(true, "", "180"); err == nil {
+		t.Error("a 180° threshold should be rejected")
+	}
+}
+
+func TestPadToBed(t *testing.T) {
+	lines := []string{"G21", "G90", "G0 X0 Y0", "G0 X10 Y5", "M3", "G1 X30 Y5 F300 ; bottom", "G1 X30 Y25", "M5", "G0 X0 Y0"}
+	out, b, err := padToBed(lines, 100, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != (bounds{40, 15, 60, 35}) {
+		t.Errorf("expected the design centered at X40..60 Y15..35, got %+v", b)
+	}
+	want := []string{"G21", "G90", "G0 X30.000 Y10.000", "G0 X40.000 Y15.000", "M3", "G1 X60.000 Y15.000 F300 ; bottom", "G1 X60.000 Y35.000", "M5", "G0 X0 Y0"}
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected padded program:\n%s", strings.Join(out, "\n"))
+	}
+
+	if _, _, err := padToBed(lines, 15, 50); err == nil {
+		t.Error("expected an error for a design wider than the bed")
+	}
+	if _, _, err := padToBed([]string{"G20", "G0 X1 Y1", "G1 X2 Y2"}, 100, 100); err == nil {
+		t.Error("expected inch programs to be refused")
+	}
+}
+
+func TestFitArcs(t *testing.T) {
+	// A quarter circle of radius 10 counterclockwise from (10, 0), a
+	// straight cut, then a half circle of radius 0.5, as svg2gcode would
+	// flatten them
+	lines := []string{"G21", "G90", "G0 X10 Y0", "M3"}
+	for k := 1; k <= 16; k++ {
+		a := math.Pi / 2 * float64(k) / 16
+		line := fmt.Sprintf("G1 X%.4f Y%.4f", 10*math.Cos(a), 10*math.Sin(a))
+		if k == 1 {
+			line += " F1000"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "G1 X0 Y20")
+	for k := 1; k <= 8; k++ {
+		a := math.Pi * (1 - float64(k)/8) // clockwise over the top of (0.5, 20)
+		lines = append(lines, fmt.Sprintf("X%.4f Y%.4f", 0.5+0.5*math.Cos(a), 20+0.5*math.Sin(a)))
+	}
+	lines = append(lines, "X5 Y20", "M5")
+
+	out, stats, err := fitArcs(lines, defaultArcTolerance, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Arcs != 2 || stats.Replaced != 24 || stats.Rejected != 0 {
+		t.Errorf("unexpected stats %+v:\n%s", stats, strings.Join(out, "\n"))
+	}
+	if out[4] != "G3 X0.000 Y10.000 I-10.000 J0.000 F1000" {
+		t.Errorf("unexpected quarter circle %q", out[4])
+	}
+	if out[5] != "G1 X0 Y20" || !strings.HasPrefix(out[6], "G2 ") {
+		t.Errorf("expected the straight cut kept and a clockwise arc after it:\n%s", strings.Join(out, "\n"))
+	}
+	if out[7] != "G1 X5 Y20" {
+		t.Errorf("expected G1 restated after the arc, got %q", out[7])
+	}
+
+	// The arcs must trace the original cuts
+	before, _ := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	after, err := parseGCodeMoves(strings.NewReader(strings.Join(out, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before[len(before)-1].To != after[len(after)-1].To {
+		t.Errorf("the program now ends at %v", after[len(after)-1].To)
+	}
+	for _, m := range after[1:17] {
+		if r := math.Hypot(m.To.X, m.To.Y); math.Abs(r-10) > defaultArcTolerance {
+			t.Errorf("the quarter circle strays to radius %g", r)
+		}
+	}
+
+	// A minimum radius keeps the small half circle as lines
+	out, stats, err = fitArcs(lines, defaultArcTolerance, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Arcs != 1 || stats.Rejected != 1 || len(out) != len(lines)-15 {
+		t.Errorf("unexpected stats %+v with minArcRadius 1:\n%s", stats, strings.Join(out, "\n"))
+	}
+
+	// A square's corners lie on a circle but its sides do not
+	square := []string{"G0 X0 Y0", "G1 X10 Y0", "G1 X10 Y10", "G1 X0 Y10", "G1 X0 Y0"}
+	if out, stats, _ := fitArcs(square, defaultArcTolerance, 0); stats.Arcs != 0 || strings.Join(out, "\n") != strings.Join(square, "\n") {
+		t.Errorf("a square was fitted with arcs: %+v", stats)
+	}
+
+	if _, _, err := fitArcs([]string{"G91", "G1 X1 Y1"}, defaultArcTolerance, 0); err == nil {
+		t.Error("expected relative programs to be refused")
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	// The error correction codewords of the 1-M "HELLO WORLD" example in
+	// the QR specification's annex
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("expected error correction %v, got %v", want, got)
+	}
+
+	readFormat := func(q *qrCode) (int, int) {
+		a, b := 0, 0
+		for i := 0; i <= 5; i++ {
+			a |= boolBit(q.Modules[i][8]) << i
+		}
+		a |= boolBit(q.Modules[7][8])<<6 | boolBit(q.Modules[8][8])<<7 | boolBit(q.Modules[8][7])<<8
+		for i := 9; i < 15; i++ {
+			a |= boolBit(q.Modules[8][14-i]) << i
+		}
+		for i := 0; i < 8; i++ {
+			b |= boolBit(q.Modules[8][q.Size-1-i]) << i
+		}
+		for i := 8; i < 15; i++ {
+			b |= boolBit(q.Modules[q.Size-15+i][8]) << i
+		}
+		return a, b
+	}
+	for mask, want := range map[int]int{1: 0b101000100100101, 5: 0b100000011001110} {
+		q := newQRCode(1)
+		q.drawFormat(mask)
+		if a, b := readFormat(&q.qrCode); a != want || b != want {
+			t.Errorf("mask %d: expected format %015b, got %015b and %015b", mask, want, a, b)
+		}
+	}
+
+	url := "http://test-hostname/s/" + strings.Repeat("A", 43)
+	q, err := encodeQR([]byte(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Size != 37 {
+		t.Errorf("expected version 5 (37 modules) for a %d byte URL, got %d modules", len(url), q.Size)
+	}
+	for _, corner := range [][2]int{{0, 0}, {q.Size - 7, 0}, {0, q.Size - 7}} {
+		for d := 0; d < 7; d++ {
+			if !q.Modules[corner[1]][corner[0]+d] || !q.Modules[corner[1]+3][corner[0]+3] || q.Modules[corner[1]+1][corner[0]+1] {
+				t.Fatalf("no finder pattern at column %d, row %d", corner[0], corner[1])
+			}
+		}
+	}
+	if !q.Modules[q.Size-8][8] {
+		t.Error("expected the dark module above the bottom left format bits")
+	}
+	a, b := readFormat(q)
+	if a != b {
+		t.Errorf("format copies differ: %015b and %015b", a, b)
+	}
+	if (a^0x5412)>>13 != 0b00 {
+		t.Errorf("expected level M in format %015b", a)
+	}
+
+	if _, err := encodeQR(bytes.Repeat([]byte("x"), 300)); err == nil {
+		t.Error("expected an error for data too long for version 10")
+	}
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestQRGCode(t *testing.T) {
+	lines := []string{"G21", "G90", "G0 X0 Y0", "M3", "G1 X40 Y0 F1200", "G1 X40 Y30", "M5", "G0 X0 Y0"}
+	url := "http://test-hostname/s/token"
+	out, at, version, ok, err := qrGCode(lines, url, QRCornerBottomRight, 20, QRStyleHatch, "M3", "M5", 200, 200)
+	if err != nil || !ok {
+		t.Fatalf("expected a QR code, got ok=%v err=%v", ok, err)
+	}
+	if version != 3 {
+		t.Errorf("expected version 3 for %q, got %d", url, version)
+	}
+	// Version 3 is 29 modules, and the quiet zone 4 of them
+	gap := 4 * 20.0 / 29
+	if math.Abs(at.MinX-(40+gap)) > 1e-9 || at.MinY != 0 || math.Abs(at.MaxX-(60+gap)) > 1e-9 || at.MaxY != 20 {
+		t.Errorf("unexpected placement %+v", at)
+	}
+	if out[6] != "; QR code: "+url || out[len(out)-3] != "; end QR code" {
+		t.Errorf("expected the code after the last cut:\n%s", strings.Join(out, "\n"))
+	}
+	if strings.Join(out[len(out)-2:], "\n") != "M5\nG0 X0 Y0" {
+		t.Errorf("expected the program's ending kept, got %q", out[len(out)-2:])
+	}
+
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(out[6:len(out)-2], "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := movesBounds(moves, true)
+	if b.MinX < at.MinX-1e-3 || b.MaxX > at.MaxX+1e-3 || b.MinY < at.MinY-1e-3 || b.MaxY > at.MaxY+1e-3 {
+		t.Errorf("strokes %+v leave the symbol's bounds %+v", b, at)
+	}
+	if moves[1].Feed != 1200 {
+		t.Errorf("expected the program's feed rate, got %v", moves[1].Feed)
+	}
+
+	// Beside the top left corner would be off the bed, so it goes above
+	_, at, _, _, _ = qrGCode(lines, url, QRCornerTopLeft, 10, QRStyleOutline, "M3", "M5", 200, 200)
+	if at.MinX != 0 || math.Abs(at.MinY-(30+4*10.0/29)) > 1e-9 || at.MaxX != 10 {
+		t.Errorf("unexpected top-left placement %+v", at)
+	}
+	// On a bed the design's size there is no room at all
+	if out, _, _, ok, err := qrGCode(lines, url, QRCornerTopLeft, 10, QRStyleOutline, "M3", "M5", 40, 30); err != errQRNoRoom || ok || len(out) != len(lines) {
+		t.Errorf("expected errQRNoRoom and the program unchanged, got ok=%v err=%v", ok, err)
+	}
+
+	if _, _, _, ok, _ := qrGCode([]string{"G21", "G0 X5 Y5"}, url, QRCornerBottomRight, 20, QRStyleHatch, "", "", 200, 200); ok {
+		t.Error("expected no QR code without cutting moves")
+	}
+	if _, _, _, err := parseQRCode(true, "middle", "", ""); err == nil {
+		t.Error("expected an error for an unknown corner")
+	}
+	if _, _, _, err := parseQRCode(true, "", "2", ""); err == nil {
+		t.Error("expected an error for a size under the minimum")
+	}
+}
+
+func TestLeadStrokes(t *testing.T) {
+	lines := []string{
+		"G21", "G90",
+		"M5", "G0 X0 Y0", "M3",
+		"G1 X10 Y0 F1000", "G1 X10 Y10",
+		"M5", "G0 X20 Y0", "M3",
+		"G1 X20 Y0.5", // a dot too short to shorten
+		"M5", "G0 X30 Y0", "M3",
+		"G2 X40 Y0 I5 J0",
+		"M5", "G0 X0 Y0",
+	}
+	out, stats, err := leadStrokes(lines, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Strokes != 3 || stats.LeadIns != 2 || stats.LeadOuts != 1 || stats.Skipped != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	want := []string{
+		"G21", "G90",
+		"M5", "G0 X-1.000 Y0.000", "M3",
+		"G1 X0.000 Y0.000 F1000", "G1 X10 Y0 F1000", "G1 X10.000 Y8.000",
+		"M5", "G0 X20.000 Y-1.000", "M3",
+		"G1 X20.000 Y0.000", "G1 X20 Y0.5",
+		"M5", "G0 X30 Y0", "M3",
+		"G2 X40 Y0 I5 J0",
+		"M5", "G0 X0 Y0",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("unexpected program:\n%s", strings.Join(out, "\n"))
+	}
+
+	// Cuts shorter than the lead-out are dropped, keeping the feed they set
+	out, _, _ = leadStrokes([]string{"G0 X0 Y0", "M3", "G1 X10 Y0 F500", "G1 X10 Y1 F800", "M5"}, 0, 1.5)
+	if strings.Join(out, "\n") != "G0 X0 Y0\nM3\nG1 X9.500 Y0.000 F800\nM5" {
+		t.Errorf("unexpected trim:\n%s", strings.Join(out, "\n"))
+	}
+
+	if _, _, err := leadStrokes([]string{"G91", "G1 X1 Y1"}, 1, 0); err == nil {
+		t.Error("expected relative programs to be refused")
+	}
+	if _, err := parseLead("leadIn", "11"); err == nil {
+		t.Error("expected an error for a lead over the maximum")
+	}
+}
+
+func TestOvercutStrokes(t *testing.T) {
+	lines := []string{
+		"G21", "G90",
+		"M5", "G0 X0 Y0", "M3",
+		"G1 X1 Y0 F1000", "G1 X1 Y1", "G1 X0 Y1", "G1 X0 Y0", // a square, closed
+		"M5", "G0 X10 Y0", "M3",
+		"G1 X20 Y0", // open
+		"M5", "G0 X30 Y0", "M3",
+		"G2 X30 Y0 I5 J0", // a circle, starting on an arc
+		"M5", "G0 X0 Y0",
+	}
+	out, stats, err := overcutStrokes(lines, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Strokes != 3 || stats.Closed != 2 || stats.Overcut != 1 || stats.Skipped != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	want := []string{
+		"G21", "G90",
+		"M5", "G0 X0 Y0", "M3",
+		"G1 X1 Y0 F1000", "G1 X1 Y1", "G1 X0 Y1", "G1 X0 Y0",
+		"G1 X1.000 Y0.000", "G1 X1.000 Y0.500",
+		"M5", "G0 X10 Y0", "M3",
+		"G1 X20 Y0",
+		"M5", "G0 X30 Y0", "M3",
+		"G2 X30 Y0 I5 J0",
+		"M5", "G0 X0 Y0",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("unexpected program:\n%s", strings.Join(out, "\n"))
+	}
+
+	// The retrace stops at an arc
+	out, _, _ = overcutStrokes([]string{"G0 X0 Y0", "M3", "G1 X1 Y0", "G2 X1 Y2 I0 J1", "G1 X0 Y0", "M5"}, 5)
+	if strings.Join(out, "\n") != "G0 X0 Y0\nM3\nG1 X1 Y0\nG2 X1 Y2 I0 J1\nG1 X0 Y0\nG1 X1.000 Y0.000\nM5" {
+		t.Errorf("unexpected retrace:\n%s", strings.Join(out, "\n"))
+	}
+
+	if _, err := parseOvercut("-1"); err == nil {
+		t.Error("expected an error for a negative overcut")
+	}
+}
+
+func TestMergeCollinear(t *testing.T) {
+	lines := []string{
+		"G21", "G90",
+		"G0 X0 Y0", "M3",
+		"G1 X1 Y0 F1000", "G1 X2 Y0", "G1 X2 Y0", "X3 Y0", // in line, a zero-length move among them
+		"G1 X3 Y1", "G1 X3 Y2 F1000", "G1 X3 Y3 F500", "G1 X3 Y4", // same feed merges, a new one doesn't
+		"G1 X4 Y5", "G1 X5 Y6 S200", // a power change stays where it is
+		"G1 X6 Y7.001", "G1 X7 Y8", // turning 0.03°
+		"G2 X9 Y8 I1 J0", "G1 X10 Y8", "M5",
+		"G0 X20 Y0", "G0 X30 Y0", // travel is left alone
+	}
+	out, stats, err := mergeCollinear(lines, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"G21", "G90",
+		"G0 X0 Y0", "M3",
+		"G1 X3.000 Y0.000 F1000",
+		"G1 X3.000 Y2.000",
+		"G1 X3.000 Y4.000 F500",
+		"G1 X4 Y5", "G1 X5 Y6 S200",
+		"G1 X6 Y7.001", "G1 X7 Y8",
+		"G2 X9 Y8 I1 J0", "G1 X10 Y8", "M5",
+		"G0 X20 Y0", "G0 X30 Y0",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("unexpected program:\n%s", strings.Join(out, "\n"))
+	}
+	if stats.Cuts != 13 || stats.Runs != 3 || stats.Merged != 5 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Slight turns merge within the tolerance, measured from each run's
+	// first cut so they cannot build up: the third cut is 0.11° off the
+	// first and starts a new run
+	out, stats, _ = mergeCollinear([]string{"G0 X0 Y0", "G1 X1 Y0", "G1 X2 Y0.001", "G1 X3 Y0.003", "G1 X4 Y0.006"}, 0.1)
+	if strings.Join(out, "\n") != "G0 X0 Y0\nG1 X2.000 Y0.001\nG1 X4.000 Y0.006" || stats.Merged != 2 {
+		t.Errorf("unexpected merge within 0.1°:\n%s", strings.Join(out, "\n"))
+	}
+
+	if _, _, err := mergeCollinear([]string{"G91", "G1 X1", "G1 X1"}, 0); err == nil {
+		t.Error("expected an error for a relative program")
+	}
+	for _, v := range []string{"-1", "2", "x"} {
+		if _, err := parseMergeCollinear(true, v); err == nil {
+			t.Errorf("expected an error for mergeAngle %q", v)
+		}
+	}
+	if a, err := parseMergeCollinear(false, "x"); err != nil || a != 0 {
+		t.Errorf("mergeAngle should be ignored without mergeCollinear, got %g, %v", a, err)
+	}
+	if a, _ := parseMergeCollinear(true, ""); a != defaultMergeAngle {
+		t.Errorf("expected the default mergeAngle, got %g", a)
+	}
+}
+
+func TestBuiltinMoves(t *testing.T) {
+	pls := []polyline{
+		{Points: []point{{0, 10}, {10, 10}, {10, 10.0001}, {10, 0}}},
+		{Points: []point{{5, 5}, {5, 5}}}, // rounds to nothing
+	}
+	lines, stats := builtinMoves(pls, "M3", "M5", 600, 0.5, 10)
+	want := []string{"G21", "G90", "M5", "G0 X0.000 Y0.000", "M3", "G1 X5.000 Y0.000 F600", "G1 X5.000 Y5.000", "M5"}
+	if !slices.Equal(lines, want) {
+		t.Errorf("unexpected program:\n%s", strings.Join(lines, "\n"))
+	}
+	if stats.Paths != 1 || stats.Cuts != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if e, tol, feed, err := parseEngine("", "5", "x", nil); err != nil || e != EngineSvg2gcode || tol != 0 || feed != 0 {
+		t.Errorf("builtin options should be ignored for svg2gcode, got %q %g %g %v", e, tol, feed, err)
+	}
+	if e, tol, feed, err := parseEngine("Builtin", "", "", nil); err != nil || e != EngineBuiltin || tol != defaultCurveTolerance || feed != defaultBuiltinFeed {
+		t.Errorf("expected the builtin defaults, got %q %g %g %v", e, tol, feed, err)
+	}
+	for _, c := range [][3]string{{"inkscape", "", ""}, {"builtin", "0", ""}, {"builtin", "2", ""}, {"builtin", "", "-5"}, {"builtin", "", "0"}} {
+		if _, _, _, err := parseEngine(c[0], c[1], c[2], nil); err == nil {
+			t.Errorf("expected an error for %q", c)
+		}
+	}
+	if _, _, _, err := parseEngine("builtin", "", "", []string{"--feedrate", "2000"}); err == nil {
+		t.Error("expected svg2gcodeArgs to be refused by the builtin engine")
+	}
+
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name, svg           string
+		defaulted, unmapped bool
+	}{
+		{"sized", `<svg width="20" height="10"><path d="M0 10L10 0"/></svg>`, false, false},
+		{"viewBox of its size", `<svg width="20" height="10" viewBox="0 0 20 10"><path d="M0 10L10 0"/></svg>`, false, false},
+		{"no size", `<svg><path d="M0 10L10 0"/></svg>`, true, false},
+		{"offset viewBox", `<svg width="20" height="10" viewBox="5 5 20 10"><path d="M0 10L10 0"/></svg>`, false, true},
+		{"transform", `<svg width="20" height="10"><g transform="scale(2)"><path d="M0 10L10 0"/></g></svg>`, false, true},
+	} {
+		svgPath, gcodePath := filepath.Join(dir, "in.svg"), filepath.Join(dir, "out.gcode")
+		os.WriteFile(svgPath, []byte(c.svg), 0644)
+		stats, err := writeBuiltinGCode(svgPath, gcodePath, "M3", "M5", 600, defaultCurveTolerance, 25.4)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if stats.DimensionsDefaulted != c.defaulted || stats.Unmapped != c.unmapped {
+			t.Errorf("%s: unexpected stats %+v", c.name, stats)
+		}
+		if data, _ := os.ReadFile(gcodePath); strings.Contains(string(data), "Y-") {
+			t.Errorf("%s: expected no negative Y:\n%s", c.name, data)
+		}
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	lines := []string{
+		"; generated by svg2gcode",
+		"G21 (millimeters) G90",
+		"",
+		"(pen down)",
+		"M3 S1000 ; tool on",
+		"G1(inline)X1 Y2 F600",
+		"G1 X3 (open paren never closed",
+		`M291 P"Load (red) pen; then OK" S2 ; prompt`,
+		"M117 Drawing (1 of 2) ; status",
+		"G0 X0 Y0",
+	}
+	got, stats := stripComments(lines)
+	want := []string{
+		"G21 G90",
+		"M3 S1000",
+		"G1 X1 Y2 F600",
+		"G1 X3 (open paren never closed",
+		`M291 P"Load (red) pen; then OK" S2`,
+		"M117 Drawing (1 of 2)",
+		"G0 X0 Y0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if stats.Lines != 3 || stats.Inline != 5 {
+		t.Errorf("expected 3 lines and 5 inline comments removed, got %+v", stats)
+	}
+	before, after := 0, 0
+	for _, l := range lines {
+		before += len(l) + 1
+	}
+	for _, l := range want {
+		after += len(l) + 1
+	}
+	if stats.Before != before || stats.After != after {
+		t.Errorf("expected %d -> %d bytes, got %d -> %d", before, after, stats.Before, stats.After)
+	}
+
+	clean := []string{"G21", "G1 X1 Y1"}
+	if got, stats := stripComments(clean); !reflect.DeepEqual(got, clean) || stats.Inline != 0 || stats.Lines != 0 {
+		t.Errorf("expected a program without comments to be unchanged, got %q %+v", got, stats)
+	}
+}
@@ -0,0 +1,75 @@
+package srv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// hpglUnitsPerMM is the HP-GL plotter unit: 0.025 mm
+const hpglUnitsPerMM = 40
+
+// hpglPointsPerCommand limits how many coordinates go in one PD command, as
+// older plotters have small input buffers
+const hpglPointsPerCommand = 32
+
+// writeHPGL converts the paths in svgPath into pen-up/pen-down moves in an
+// HP-GL file. Scaling and the Y flip match writeDXF.
+func writeHPGL(svgPath, hpglPath string, dpi, svgHeight float64) (int, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return 0, err
+	}
+	polylines, err := readSVGPolylines(data)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Create(hpglPath)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	encodeHPGL(w, polylines, 25.4/dpi*hpglUnitsPerMM, svgHeight)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return len(polylines), nil
+}
+
+// encodeHPGL writes an HP-GL program that draws each polyline with pen 1
+// using absolute plotter-unit coordinates
+func encodeHPGL(w io.Writer, polylines []polyline, scale, svgHeight float64) {
+	coord := func(p point) string {
+		return fmt.Sprintf("%d,%d", int(math.Round(p.X*scale)), int(math.Round((svgHeight-p.Y)*scale)))
+	}
+
+	fmt.Fprint(w, "IN;SP1;PA;\n")
+	for _, pl := range polylines {
+		pts := pl.Points
+		if len(pts) < 2 {
+			continue
+		}
+		if pl.Closed && pts[0] != pts[len(pts)-1] {
+			pts = append(pts[:len(pts):len(pts)], pts[0])
+		}
+		fmt.Fprintf(w, "PU%s;\n", coord(pts[0]))
+		for rest := pts[1:]; len(rest) > 0; {
+			n := min(len(rest), hpglPointsPerCommand)
+			coords := make([]string, n)
+			for i, p := range rest[:n] {
+				coords[i] = coord(p)
+			}
+			fmt.Fprintf(w, "PD%s;\n", strings.Join(coords, ","))
+			rest = rest[n:]
+		}
+	}
+	fmt.Fprint(w, "PU;SP0;\n")
+}
@@ -0,0 +1,63 @@
+package srv
+
+import (
+	"fmt"
+	"time"
+)
+
+// idempotencyTTL is how long an Idempotency-Key keeps mapping to its job
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLen bounds the size of client-supplied keys
+const maxIdempotencyKeyLen = 255
+
+type idempotencyEntry struct {
+	jobID   string
+	expires time.Time
+}
+
+// validateIdempotencyKey rejects keys that are too long or contain non-printable characters
+func validateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLen {
+		return fmt.Errorf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen)
+	}
+	for _, c := range key {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("Idempotency-Key must contain only printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// idempotentJobLocked returns the job previously created with key, if it is
+// still known and the key has not expired. Expired keys are pruned.
+// s.mu must be held.
+func (s *Server) idempotentJobLocked(key string) *Job {
+	if key == "" {
+		return nil
+	}
+	now := time.Now()
+	for k, e := range s.idempotencyKeys {
+		if now.After(e.expires) {
+			delete(s.idempotencyKeys, k)
+		}
+	}
+	e, ok := s.idempotencyKeys[key]
+	if !ok {
+		return nil
+	}
+	job, ok := s.jobs[e.jobID]
+	if !ok {
+		delete(s.idempotencyKeys, key)
+		return nil
+	}
+	return job
+}
+
+// rememberIdempotencyKeyLocked maps key to jobID. s.mu must be held.
+func (s *Server) rememberIdempotencyKeyLocked(key, jobID string) {
+	if key == "" {
+		return
+	}
+	s.idempotencyKeys[key] = idempotencyEntry{jobID: jobID, expires: time.Now().Add(idempotencyTTL)}
+}
@@ -0,0 +1,127 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// imageResolution is the physical pixel density an image declares
+type imageResolution struct {
+	X, Y float64 // pixels per inch
+}
+
+// readImageDPI returns the resolution stored in a PNG pHYs chunk or a JPEG
+// JFIF header. ok is false when the file has none, or only an aspect ratio.
+func readImageDPI(r io.Reader) (res imageResolution, ok bool, err error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(8)
+	if err != nil {
+		return res, false, nil // too short to be PNG or JPEG
+	}
+	switch {
+	case bytes.Equal(head, []byte("\x89PNG\r\n\x1a\n")):
+		br.Discard(8)
+		return pngDPI(br)
+	case head[0] == 0xFF && head[1] == 0xD8:
+		br.Discard(2)
+		return jpegDPI(br)
+	}
+	return res, false, nil
+}
+
+// pngDPI scans chunks up to the image data for pHYs
+func pngDPI(r io.Reader) (imageResolution, bool, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return imageResolution{}, false, fmt.Errorf("read PNG chunk: %w", err)
+		}
+		length := binary.BigEndian.Uint32(hdr[:4])
+		typ := string(hdr[4:])
+		if typ == "IDAT" || typ == "IEND" {
+			return imageResolution{}, false, nil
+		}
+		if typ == "pHYs" && length == 9 {
+			var data [9]byte
+			if _, err := io.ReadFull(r, data[:]); err != nil {
+				return imageResolution{}, false, fmt.Errorf("read pHYs: %w", err)
+			}
+			if data[8] != 1 { // unit unknown: aspect ratio only
+				return imageResolution{}, false, nil
+			}
+			// Pixels per metre to pixels per inch
+			x := float64(binary.BigEndian.Uint32(data[0:4])) * 0.0254
+			y := float64(binary.BigEndian.Uint32(data[4:8])) * 0.0254
+			return imageResolution{x, y}, x > 0 && y > 0, nil
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(length)+4); err != nil { // data and CRC
+			return imageResolution{}, false, fmt.Errorf("skip PNG chunk: %w", err)
+		}
+	}
+}
+
+// jpegDPI reads the density from a JFIF APP0 segment
+func jpegDPI(r io.Reader) (imageResolution, bool, error) {
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return imageResolution{}, false, fmt.Errorf("read JPEG segment: %w", err)
+		}
+		if hdr[0] != 0xFF {
+			return imageResolution{}, false, fmt.Errorf("malformed JPEG segment marker")
+		}
+		marker := hdr[1]
+		length := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if length < 0 {
+			return imageResolution{}, false, fmt.Errorf("malformed JPEG segment length")
+		}
+		// Metadata segments precede the frame header; stop at it
+		if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC {
+			return imageResolution{}, false, nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return imageResolution{}, false, fmt.Errorf("read JPEG segment: %w", err)
+		}
+		if marker != 0xE0 || len(data) < 12 || string(data[:5]) != "JFIF\x00" {
+			continue
+		}
+		x := float64(binary.BigEndian.Uint16(data[8:10]))
+		y := float64(binary.BigEndian.Uint16(data[10:12]))
+		switch data[7] {
+		case 1: // dots per inch
+		case 2: // dots per cm
+			x, y = x*2.54, y*2.54
+		default: // aspect ratio only
+			return imageResolution{}, false, nil
+		}
+		return imageResolution{x, y}, x > 0 && y > 0, nil
+	}
+}
+
+// imagePhysicalSize returns an image's declared size in mm, along with the
+// resolution it was computed from
+func imagePhysicalSize(path string) (widthMM, heightMM float64, res imageResolution, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, res, false, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, res, false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, res, false, err
+	}
+	res, ok, err = readImageDPI(f)
+	if err != nil || !ok {
+		return 0, 0, res, false, err
+	}
+	return float64(cfg.Width) / res.X * 25.4, float64(cfg.Height) / res.Y * 25.4, res, true, nil
+}
@@ -0,0 +1,79 @@
+package srv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultUploadDebounce is how long after an upload an identical one is
+// taken as a repeat, such as a double-clicked submit, and attached to the
+// first job while it is still processing
+const DefaultUploadDebounce = 10 * time.Second
+
+type inFlightEntry struct {
+	jobID   string
+	expires time.Time
+}
+
+// uploadFingerprint identifies an upload by what it would produce: the
+// input image, the job name, and the options, the AI prompt among them.
+// The API key only decides whether the job can run, so it is left out and
+// never hashed.
+func uploadFingerprint(inputPath, name string, opts JobOptions) (string, error) {
+	options, err := json.Marshal(struct {
+		Name    string     `json:"name"`
+		Options JobOptions `json:"options"`
+	}{name, opts})
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	h.Write(options)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// inFlightJobLocked returns the job an identical upload started within
+// UploadDebounce, if it is still processing. Expired entries are pruned.
+// s.mu must be held.
+func (s *Server) inFlightJobLocked(fingerprint string) *Job {
+	if fingerprint == "" {
+		return nil
+	}
+	now := time.Now()
+	for k, e := range s.inFlight {
+		if now.After(e.expires) {
+			delete(s.inFlight, k)
+		}
+	}
+	e, ok := s.inFlight[fingerprint]
+	if !ok {
+		return nil
+	}
+	job, ok := s.jobs[e.jobID]
+	if !ok || job.Status != "processing" {
+		delete(s.inFlight, fingerprint)
+		return nil
+	}
+	return job
+}
+
+// rememberInFlightLocked maps fingerprint to jobID for UploadDebounce.
+// s.mu must be held.
+func (s *Server) rememberInFlightLocked(fingerprint, jobID string) {
+	if fingerprint == "" {
+		return
+	}
+	s.inFlight[fingerprint] = inFlightEntry{jobID: jobID, expires: time.Now().Add(s.UploadDebounce)}
+}
@@ -0,0 +1,57 @@
+package srv
+
+import (
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+)
+
+// recommendedPlotDPI is the pixel density suggested for traced input. Lower
+// densities make autotrace's pixel-level wobble visible in the plot; higher
+// ones shrink the output for little gain.
+const recommendedPlotDPI = 150
+
+// inspectResponse is returned by /api/inspect
+type inspectResponse struct {
+	Width              int     `json:"width"`
+	Height             int     `json:"height"`
+	Format             string  `json:"format"`
+	SuggestedMaxWidth  float64 `json:"suggestedMaxWidth"`
+	SuggestedMaxHeight float64 `json:"suggestedMaxHeight"`
+	SuggestedDPI       float64 `json:"suggestedDPI"`
+}
+
+// suggestedSizeMM converts a pixel count to mm at the recommended DPI
+func suggestedSizeMM(px int) float64 {
+	return math.Round(float64(px)/recommendedPlotDPI*25.4*10) / 10
+}
+
+// HandleAPIInspect reads an uploaded image's header and reports its pixel
+// dimensions and a suggested output size, without decoding the pixels
+func (s *Server) HandleAPIInspect(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 50<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "Failed to read uploaded file: " + err.Error()})
+		return
+	}
+	defer file.Close()
+
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil {
+		writeJSON(w, http.StatusUnsupportedMediaType, apiError{Error: "Cannot read image dimensions (supported: PNG, JPEG, GIF): " + err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, inspectResponse{
+		Width:              cfg.Width,
+		Height:             cfg.Height,
+		Format:             format,
+		SuggestedMaxWidth:  suggestedSizeMM(cfg.Width),
+		SuggestedMaxHeight: suggestedSizeMM(cfg.Height),
+		SuggestedDPI:       recommendedPlotDPI,
+	})
+}
@@ -0,0 +1,145 @@
+package srv
+
+import (
+	"net/http"
+	"time"
+)
+
+// outputMetrics measures a job's finished program
+type outputMetrics struct {
+	Complexity complexityReport
+	Moves      resultMoves
+	CutBounds  *bounds // nil when the program cuts nothing
+}
+
+// measureOutput completes rep, measured from the final SVG and G-code,
+// with the motion of the program at gcodePath
+func measureOutput(rep complexityReport, gcodePath string) (*outputMetrics, error) {
+	moves, err := readGCodeMoves(gcodePath)
+	if err != nil {
+		return nil, err
+	}
+	m := &outputMetrics{Complexity: rep, Moves: *summarizeMoves(moves)}
+	if b, ok := movesBounds(moves, true); ok {
+		m.CutBounds = &b
+	}
+	return m, nil
+}
+
+// jobStatsResponse is the JSON body of GET /job/{id}/stats.json
+type jobStatsResponse struct {
+	JobID      string             `json:"jobId"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	FinishedAt time.Time          `json:"finishedAt"`
+	DurationMs int64              `json:"durationMs"`
+	Dimensions manifestDimensions `json:"dimensions"`
+	Rotated    bool               `json:"rotated"`
+	Trace      statsTrace         `json:"trace"`
+	Output     *statsOutput       `json:"output,omitempty"`
+	Stages     []statsStage       `json:"stages"`
+	Warnings   []string           `json:"warnings"`
+}
+
+type statsTrace struct {
+	Paths  int          `json:"paths"`
+	Colors []statsColor `json:"colors"`
+}
+
+type statsColor struct {
+	Color      string `json:"color"` // RRGGBB, or "" for paths without a stroke color
+	Paths      int    `json:"paths"`
+	Background bool   `json:"background"` // The white filter takes the color as the job's background
+
+}
+
+type statsOutput struct {
+	Paths      int   `json:"paths"`
+	Moves      int   `json:"moves"`
+	GCodeBytes int64 `json:"gcodeBytes"`
+	resultMoves
+	CutBounds *statsBounds `json:"cutBounds,omitempty"`
+}
+
+type statsBounds struct {
+	MinX float64 `json:"minX"`
+	MinY float64 `json:"minY"`
+	MaxX float64 `json:"maxX"`
+	MaxY float64 `json:"maxY"`
+}
+
+// statsStage is one "=== ... ===" section of the job log, timed until the
+// next one starts or the job finishes. A job retried after a tool crash
+// lists each attempt's stages.
+type statsStage struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+func newJobStatsResponse(job *Job) jobStatsResponse {
+	resp := jobStatsResponse{
+		JobID:      job.ID,
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: job.FinishedAt,
+		DurationMs: job.FinishedAt.Sub(job.CreatedAt).Milliseconds(),
+		Dimensions: manifestDimensions{
+			SVGWidthPx:   job.SVGWidth,
+			SVGHeightPx:  job.SVGHeight,
+			OutputWidth:  job.OutputWidth,
+			OutputHeight: job.OutputHeight,
+			DPI:          job.DPI,
+		},
+		Rotated:  job.Rotated,
+		Trace:    statsTrace{Paths: job.TracePaths, Colors: []statsColor{}},
+		Stages:   []statsStage{},
+		Warnings: job.Warnings,
+	}
+	if resp.Warnings == nil {
+		resp.Warnings = []string{}
+	}
+	threshold := job.WhiteThreshold
+	if threshold <= 0 {
+		threshold = defaultWhiteThreshold
+	}
+	for _, c := range job.TraceColors {
+		resp.Trace.Colors = append(resp.Trace.Colors, statsColor{Color: c.Color, Paths: c.Paths,
+			Background: c.Color != "" && isBackgroundAt(c.Color, threshold, job.Background)})
+	}
+	if o := job.Output; o != nil {
+		resp.Output = &statsOutput{Paths: o.Complexity.Paths, Moves: o.Complexity.Moves, GCodeBytes: o.Complexity.GCodeBytes, resultMoves: o.Moves}
+		if b := o.CutBounds; b != nil {
+			resp.Output.CutBounds = &statsBounds{MinX: b.MinX, MinY: b.MinY, MaxX: b.MaxX, MaxY: b.MaxY}
+		}
+	}
+	// Timings stop at FinishedAt, as anything logged after it isn't part of
+	// how long the job took
+	stages := job.Log.Stages()
+	for i, st := range stages {
+		if st.Start.After(job.FinishedAt) {
+			break
+		}
+		end := job.FinishedAt
+		if i+1 < len(stages) && stages[i+1].Start.Before(end) {
+			end = stages[i+1].Start
+		}
+		resp.Stages = append(resp.Stages, statsStage{Name: st.Name, StartedAt: st.Start, DurationMs: end.Sub(st.Start).Milliseconds()})
+	}
+	return resp
+}
+
+// HandleJobStats returns everything measured about a finished job as JSON:
+// its dimensions, the trace's path and color counts, the program's moves,
+// lengths, and bounds, and how long each stage of the log took
+func (s *Server) HandleJobStats(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists || s.jobStatus(job) != "done" {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "Stats not available"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newJobStatsResponse(job))
+}
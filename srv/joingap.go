@@ -0,0 +1,205 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var pathDataAttrRegex = regexp.MustCompile(`\sd=("[^"]*"|'[^']*')`)
+
+// joinablePath is an open, single-stroke path that may be stitched to its
+// neighbours. Only paths drawn with the same style are joined.
+type joinablePath struct {
+	elem  int // index into the document's path elements
+	group string
+	pts   []point
+	used  bool
+}
+
+// pathEnd refers to the start or end point of a joinable path
+type pathEnd struct {
+	path int
+	end  bool
+}
+
+// endpointGrid buckets path endpoints into cells the size of the join gap,
+// so each lookup only has to check the neighbouring cells
+type endpointGrid struct {
+	cell  float64
+	cells map[[2]int][]pathEnd
+}
+
+func (g *endpointGrid) key(p point) [2]int {
+	return [2]int{int(math.Floor(p.X / g.cell)), int(math.Floor(p.Y / g.cell))}
+}
+
+func (g *endpointGrid) add(p point, e pathEnd) {
+	k := g.key(p)
+	g.cells[k] = append(g.cells[k], e)
+}
+
+// nearest returns the closest unused endpoint in group within gap of p
+func (g *endpointGrid) nearest(paths []joinablePath, p point, group string, gap float64) (pathEnd, bool) {
+	var best pathEnd
+	bestDist := math.Inf(1)
+	k := g.key(p)
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			for _, e := range g.cells[[2]int{k[0] + dx, k[1] + dy}] {
+				jp := paths[e.path]
+				if jp.used || jp.group != group {
+					continue
+				}
+				q := jp.pts[0]
+				if e.end {
+					q = jp.pts[len(jp.pts)-1]
+				}
+				if d := math.Hypot(q.X-p.X, q.Y-p.Y); d <= gap && d < bestDist {
+					best, bestDist = e, d
+				}
+			}
+		}
+	}
+	return best, !math.IsInf(bestDist, 1)
+}
+
+func reversedPoints(pts []point) []point {
+	out := make([]point, len(pts))
+	for i, p := range pts {
+		out[len(pts)-1-i] = p
+	}
+	return out
+}
+
+// polylineData formats points as absolute path data
+func polylineData(pts []point) string {
+	var b strings.Builder
+	for i, p := range pts {
+		if i == 0 {
+			fmt.Fprintf(&b, "M%.3f %.3f", p.X, p.Y)
+		} else {
+			fmt.Fprintf(&b, "L%.3f %.3f", p.X, p.Y)
+		}
+	}
+	return b.String()
+}
+
+// joinGapsData stitches open paths whose endpoints lie within gap of each
+// other (SVG user units) into single paths, reversing strokes where needed,
+// so the plotter draws them without lifting. Each chain is written as a
+// polyline in place of its first path and the rest are removed; paths that
+// are not joined are left exactly as they were. It returns the new SVG and
+// the number of joins made.
+func joinGapsData(data []byte, gap float64) ([]byte, int) {
+	locs := pathElementRegex.FindAllIndex(data, -1)
+	grid := &endpointGrid{cell: gap, cells: make(map[[2]int][]pathEnd)}
+	var paths []joinablePath
+	for i, loc := range locs {
+		elems, err := parseSVGPaths(data[loc[0]:loc[1]])
+		if err != nil || len(elems) != 1 {
+			continue
+		}
+		pls, err := flattenPathData(elems[0].D)
+		if err != nil || len(pls) != 1 || pls[0].Closed {
+			continue
+		}
+		jp := joinablePath{elem: i, group: elems[0].Style + "\x00" + elems[0].StrokeWidth, pts: pls[0].Points}
+		grid.add(jp.pts[0], pathEnd{len(paths), false})
+		grid.add(jp.pts[len(jp.pts)-1], pathEnd{len(paths), true})
+		paths = append(paths, jp)
+	}
+
+	// follow returns the points of the path at e, oriented to leave from e
+	follow := func(e pathEnd) []point {
+		paths[e.path].used = true
+		if e.end {
+			return reversedPoints(paths[e.path].pts)
+		}
+		return paths[e.path].pts
+	}
+
+	joins := 0
+	replaced := make(map[int][]byte) // element index to replacement; nil removes
+	for i := range paths {
+		if paths[i].used {
+			continue
+		}
+		paths[i].used = true
+		group := paths[i].group
+		chain := append([]point(nil), paths[i].pts...)
+		members := []int{i}
+		for {
+			e, ok := grid.nearest(paths, chain[len(chain)-1], group, gap)
+			if !ok {
+				break
+			}
+			next := follow(e)
+			if next[0] == chain[len(chain)-1] {
+				next = next[1:]
+			}
+			chain = append(chain, next...)
+			members = append(members, e.path)
+		}
+		for {
+			e, ok := grid.nearest(paths, chain[0], group, gap)
+			if !ok {
+				break
+			}
+			prev := reversedPoints(follow(e))
+			if prev[len(prev)-1] == chain[0] {
+				prev = prev[:len(prev)-1]
+			}
+			chain = append(prev, chain...)
+			members = append(members, e.path)
+		}
+		if len(members) == 1 {
+			continue
+		}
+		joins += len(members) - 1
+
+		// The chain keeps the document position of its earliest path
+		first := paths[members[0]].elem
+		for _, m := range members[1:] {
+			first = min(first, paths[m].elem)
+		}
+		for _, m := range members {
+			replaced[paths[m].elem] = nil
+		}
+		loc := locs[first]
+		elem := data[loc[0]:loc[1]]
+		d := []byte(` d="` + polylineData(chain) + `"`)
+		replaced[first] = pathDataAttrRegex.ReplaceAllLiteral(elem, d)
+	}
+	if joins == 0 {
+		return data, 0
+	}
+
+	var out []byte
+	prev := 0
+	for i, loc := range locs {
+		r, ok := replaced[i]
+		if !ok {
+			continue
+		}
+		out = append(out, data[prev:loc[0]]...)
+		out = append(out, r...)
+		prev = loc[1]
+	}
+	return append(out, data[prev:]...), joins
+}
+
+// joinGaps applies joinGapsData to an SVG file in place
+func joinGaps(svgPath string, gap float64) (int, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return 0, err
+	}
+	joined, n := joinGapsData(data, gap)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, os.WriteFile(svgPath, joined, 0644)
+}
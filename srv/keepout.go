@@ -0,0 +1,120 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxReportedViolations caps how many offending moves are listed in the log
+const maxReportedViolations = 10
+
+// KeepOutRegion is a rectangle in machine coordinates (mm) that cutting
+// moves must not enter, such as the area around a clamp
+type KeepOutRegion struct {
+	Name                   string
+	MinX, MinY, MaxX, MaxY float64
+}
+
+func (k KeepOutRegion) String() string {
+	return fmt.Sprintf("%s (X%g..%g Y%g..%g)", k.Name, k.MinX, k.MaxX, k.MinY, k.MaxY)
+}
+
+// ParseKeepOutRegions parses a semicolon-separated list of rectangles, each
+// "x1,y1,x2,y2" optionally prefixed with "name=". Corners may be given in
+// any order. Unnamed regions are numbered from 1.
+func ParseKeepOutRegions(spec string) ([]KeepOutRegion, error) {
+	var regions []KeepOutRegion
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name := fmt.Sprintf("region %d", len(regions)+1)
+		if n, rest, ok := strings.Cut(item, "="); ok {
+			name = strings.TrimSpace(n)
+			item = rest
+		}
+		parts := strings.Split(item, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("keep-out region %q: expected x1,y1,x2,y2", item)
+		}
+		var v [4]float64
+		for i, p := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("keep-out region %q: %w", item, err)
+			}
+			v[i] = f
+		}
+		regions = append(regions, KeepOutRegion{
+			Name: name,
+			MinX: math.Min(v[0], v[2]), MinY: math.Min(v[1], v[3]),
+			MaxX: math.Max(v[0], v[2]), MaxY: math.Max(v[1], v[3]),
+		})
+	}
+	return regions, nil
+}
+
+// segmentEntry returns the first point at which the segment a-b touches the
+// region, using Liang-Barsky clipping. Touching the boundary counts.
+func (k KeepOutRegion) segmentEntry(a, b point) (point, bool) {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	t0, t1 := 0.0, 1.0
+	// Each edge as p*t <= q
+	edges := [4][2]float64{
+		{-dx, a.X - k.MinX},
+		{dx, k.MaxX - a.X},
+		{-dy, a.Y - k.MinY},
+		{dy, k.MaxY - a.Y},
+	}
+	for _, e := range edges {
+		p, q := e[0], e[1]
+		if p == 0 {
+			if q < 0 {
+				return point{}, false // parallel and outside this edge
+			}
+			continue
+		}
+		t := q / p
+		if p < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+		if t0 > t1 {
+			return point{}, false
+		}
+	}
+	return point{a.X + t0*dx, a.Y + t0*dy}, true
+}
+
+// keepOutViolation is a cutting move that enters a keep-out region
+type keepOutViolation struct {
+	Region KeepOutRegion
+	Move   gcodeMove
+	Entry  point // where the move first enters the region
+}
+
+func (v keepOutViolation) String() string {
+	return fmt.Sprintf("line %d: cut (%.3f, %.3f) -> (%.3f, %.3f) enters %s at (%.3f, %.3f)",
+		v.Move.Line, v.Move.From.X, v.Move.From.Y, v.Move.To.X, v.Move.To.Y, v.Region, v.Entry.X, v.Entry.Y)
+}
+
+// checkKeepOut returns every cutting move that enters one of the regions.
+// Travel moves are ignored since the tool is raised.
+func checkKeepOut(moves []gcodeMove, regions []KeepOutRegion) []keepOutViolation {
+	var violations []keepOutViolation
+	for _, m := range moves {
+		if !m.Cut {
+			continue
+		}
+		for _, r := range regions {
+			if entry, ok := r.segmentEntry(m.From, m.To); ok {
+				violations = append(violations, keepOutViolation{Region: r, Move: m, Entry: entry})
+			}
+		}
+	}
+	return violations
+}
@@ -0,0 +1,150 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// renderDarkBackground replaces white behind layers too light to see on it
+var renderDarkBackground = color.RGBA{64, 64, 64, 255}
+
+// colorLayers returns the stroke colors of the paths in an SVG, most common
+// first, leaving out paths without one. A trace with two or more is worth
+// previewing layer by layer before a multi-pen plot.
+func colorLayers(data []byte) ([]strokeCount, error) {
+	_, hist, err := strokeHistogram(data)
+	if err != nil {
+		return nil, err
+	}
+	layers := hist[:0]
+	for _, c := range hist {
+		if c.Color != "" {
+			layers = append(layers, c)
+		}
+	}
+	return layers, nil
+}
+
+// colorLayerSVG returns a copy of the SVG keeping only the paths stroked in
+// color (RRGGBB, any case), along with how many there are. The root
+// element is kept, so every layer lines up with the full design.
+func colorLayerSVG(data []byte, color string) ([]byte, int) {
+	n := 0
+	layer := pathElementRegex.ReplaceAllFunc(data, func(match []byte) []byte {
+		m := strokeColorRegex.FindSubmatch(match)
+		if m == nil || !strings.EqualFold(string(m[1]), color) {
+			return []byte{}
+		}
+		n++
+		return match
+	})
+	return layer, n
+}
+
+// renderColorLayer draws a layer's paths into a square image of the given
+// size in the layer's color, fitting the whole SVG canvas rather than the
+// paths so that layers of one job can be compared side by side. A swatch of
+// the color sits in the top left corner.
+func renderColorLayer(pls []polyline, svgW, svgH float64, hex string, size int) *image.RGBA {
+	v, _ := strconv.ParseUint(hex, 16, 32)
+	c := color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	var bg image.Image = image.White
+	if isNearWhite(hex) {
+		bg = image.NewUniform(renderDarkBackground)
+	}
+	draw.Draw(img, img.Bounds(), bg, image.Point{}, draw.Src)
+
+	margin := float64(size) * 0.02
+	avail := float64(size) - 2*margin
+	scale := avail / math.Max(math.Max(svgW, svgH), 1e-9)
+	offX := margin + (avail-svgW*scale)/2
+	offY := margin + (avail-svgH*scale)/2
+	for _, pl := range pls {
+		for i := 1; i < len(pl.Points); i++ {
+			a, b := pl.Points[i-1], pl.Points[i]
+			drawLine(img, offX+a.X*scale, offY+a.Y*scale, offX+b.X*scale, offY+b.Y*scale, c)
+		}
+	}
+
+	swatch := max(size/20, 4)
+	inset := max(size/100, 1)
+	border := image.Rect(inset, inset, inset+swatch, inset+swatch)
+	draw.Draw(img, border, image.NewUniform(renderTravelColor), image.Point{}, draw.Src)
+	draw.Draw(img, border.Inset(1), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// HandleColorLayer serves one stroke color of a job's traced SVG on its
+// own, so the color separation can be checked before swapping pens. It
+// renders a PNG with a swatch of the color by default; format=svg returns
+// the layer's paths as an SVG instead.
+func (s *Server) HandleColorLayer(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists || s.jobStatus(job) != "done" {
+		http.Error(w, "Layer not available", http.StatusNotFound)
+		return
+	}
+	hex, err := parseHexColor(r.PathValue("color"))
+	if err != nil || hex == "" {
+		http.Error(w, "color must be a hex color such as FF0000", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		http.Error(w, `format must be "png" or "svg"`, http.StatusBadRequest)
+		return
+	}
+	size, err := parseRenderSize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.UploadsDir, job.ID, "output.svg"))
+	if err != nil {
+		http.Error(w, "Layer not available", http.StatusNotFound)
+		return
+	}
+	layer, n := colorLayerSVG(data, hex)
+	if n == 0 {
+		http.Error(w, fmt.Sprintf("The trace has no paths stroked #%s", hex), http.StatusNotFound)
+		return
+	}
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		http.ServeContent(w, r, "", jobModTime(job), bytes.NewReader(layer))
+		return
+	}
+
+	pls, err := readSVGPolylines(layer)
+	if err != nil {
+		http.Error(w, "Failed to read SVG: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	svgW, svgH, _ := parseSVGDimensions(data)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderColorLayer(pls, svgW, svgH, hex, size)); err != nil {
+		slog.Warn("encode layer png", "job", job.ID, "color", hex, "error", err)
+		http.Error(w, "Failed to render layer", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeContent(w, r, "", jobModTime(job), bytes.NewReader(buf.Bytes()))
+}
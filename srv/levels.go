@@ -0,0 +1,119 @@
+package srv
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+)
+
+// autoLevelsClip is the fraction of pixels ignored at each end of every
+// channel's histogram, so dust specks and a few dead pixels do not pin the
+// range
+const autoLevelsClip = 0.005
+
+// levelsAdjustment records the input range mapped to 0-255 for each channel
+type levelsAdjustment struct {
+	Low, High [3]uint8 // R, G, B
+}
+
+func (a levelsAdjustment) String() string {
+	return fmt.Sprintf("R %d-%d, G %d-%d, B %d-%d",
+		a.Low[0], a.High[0], a.Low[1], a.High[1], a.Low[2], a.High[2])
+}
+
+// autoLevels stretches each color channel so its clip-th percentile becomes
+// black and its (1-clip)th percentile white. Stretching channels separately
+// also neutralizes a color cast from the scanner. Fully transparent pixels
+// are ignored when measuring.
+func autoLevels(src image.Image, clip float64) (*image.NRGBA, levelsAdjustment) {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	var hist [3][256]int
+	total := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			dst.SetNRGBA(x, y, c)
+			if c.A == 0 {
+				continue
+			}
+			hist[0][c.R]++
+			hist[1][c.G]++
+			hist[2][c.B]++
+			total++
+		}
+	}
+
+	var adj levelsAdjustment
+	var lut [3][256]uint8
+	skip := int(float64(total) * clip)
+	for ch := range hist {
+		lo, hi := percentileRange(&hist[ch], skip)
+		adj.Low[ch], adj.High[ch] = lo, hi
+		for v := 0; v < 256; v++ {
+			switch {
+			case hi <= lo:
+				lut[ch][v] = uint8(v) // flat channel, nothing to stretch
+			case v <= int(lo):
+				lut[ch][v] = 0
+			case v >= int(hi):
+				lut[ch][v] = 255
+			default:
+				lut[ch][v] = uint8((v - int(lo)) * 255 / (int(hi) - int(lo)))
+			}
+		}
+	}
+
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = lut[0][dst.Pix[i]]
+		dst.Pix[i+1] = lut[1][dst.Pix[i+1]]
+		dst.Pix[i+2] = lut[2][dst.Pix[i+2]]
+	}
+	return dst, adj
+}
+
+// percentileRange returns the lowest and highest values in hist after
+// discarding skip samples from each end
+func percentileRange(hist *[256]int, skip int) (uint8, uint8) {
+	lo, hi := 0, 255
+	for n := 0; lo < 255; lo++ {
+		if n += hist[lo]; n > skip {
+			break
+		}
+	}
+	for n := 0; hi > 0; hi-- {
+		if n += hist[hi]; n > skip {
+			break
+		}
+	}
+	return uint8(lo), uint8(hi)
+}
+
+// autoLevelsFile applies autoLevels to the image at inPath and writes the
+// result as a PNG to outPath
+func autoLevelsFile(inPath, outPath string) (levelsAdjustment, error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return levelsAdjustment{}, err
+	}
+	defer in.Close()
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return levelsAdjustment{}, fmt.Errorf("decode image: %w", err)
+	}
+
+	leveled, adj := autoLevels(img, autoLevelsClip)
+	out, err := os.Create(outPath)
+	if err != nil {
+		return adj, err
+	}
+	if err := png.Encode(out, leveled); err != nil {
+		out.Close()
+		return adj, err
+	}
+	return adj, out.Close()
+}
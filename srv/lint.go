@@ -0,0 +1,260 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feedrates outside this range (mm/min) are reported as extreme. The low end
+// catches unit mix-ups such as mm/s values; the high end is beyond what hobby
+// plotters and lasers can move.
+const (
+	lintMinFeed = 10
+	lintMaxFeed = 20000
+)
+
+// lintKnownCommands are the G and M codes lint accepts without comment:
+// what svg2gcode and the supported flavors emit, plus common setup codes
+var lintKnownCommands = map[string]bool{
+	"G0": true, "G1": true, "G2": true, "G3": true, "G4": true,
+	"G17": true, "G20": true, "G21": true, "G28": true,
+	"G54": true, "G55": true, "G56": true, "G57": true, "G58": true, "G59": true,
+	"G59.1": true, "G59.2": true, "G59.3": true,
+	"G90": true, "G91": true, "G92": true, "G94": true,
+	"M0": true, "M2": true, "M3": true, "M4": true, "M5": true,
+	"M30": true, "M84": true,
+}
+
+// lintIssue is one problem found in a G-Code program
+type lintIssue struct {
+	Line     int    `json:"line,omitempty"` // 1-based, or 0 for whole-program issues
+	Severity string `json:"severity"`       // "error" or "warning"
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// lintBounds is the area a program's moves cover, in mm
+type lintBounds struct {
+	MinX float64 `json:"minX"`
+	MinY float64 `json:"minY"`
+	MaxX float64 `json:"maxX"`
+	MaxY float64 `json:"maxY"`
+}
+
+// lintReport is returned by /api/gcode/lint
+type lintReport struct {
+	Lines    int         `json:"lines"`
+	Moves    int         `json:"moves"`
+	CutMoves int         `json:"cutMoves"`
+	Bounds   *lintBounds `json:"bounds,omitempty"`
+	Errors   int         `json:"errors"`
+	Warnings int         `json:"warnings"`
+	Issues   []lintIssue `json:"issues"`
+}
+
+// lintOptions describe the machine a program is checked against
+type lintOptions struct {
+	ToolOn, ToolOff     string
+	BedWidth, BedHeight float64 // 0 skips the bounds check
+}
+
+// normalizeGCodeLine uppercases a line and collapses its whitespace, with
+// comments removed, so tool commands can be compared as typed
+func normalizeGCodeLine(line string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(stripGCodeComment(line)), " "))
+}
+
+func (r *lintReport) add(line int, severity, code, msg string) {
+	r.Issues = append(r.Issues, lintIssue{Line: line, Severity: severity, Code: code, Message: msg})
+	if severity == "error" {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// lintGCode checks a G-Code program for unknown commands, moves off the bed,
+// missing homing, unbalanced tool on/off commands, and extreme feedrates.
+// Repeated issues of one kind are reported up to maxReportedViolations
+// times, followed by a count of the rest.
+func lintGCode(data []byte, opts lintOptions) (*lintReport, error) {
+	moves, err := parseGCodeMoves(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	report := &lintReport{Issues: []lintIssue{}, Moves: len(moves)}
+
+	reported := make(map[string]int)
+	severities := make(map[string]string)
+	limited := func(line int, severity, code, msg string) {
+		reported[code]++
+		severities[code] = severity
+		if reported[code] <= maxReportedViolations {
+			report.add(line, severity, code, msg)
+		}
+	}
+
+	toolOn, toolOff := normalizeGCodeLine(opts.ToolOn), normalizeGCodeLine(opts.ToolOff)
+	toolWords := make(map[string]bool)
+	for _, w := range append(parseGCodeWords(toolOn), parseGCodeWords(toolOff)...) {
+		toolWords[string(w.Letter)+strconv.FormatFloat(w.Value, 'f', -1, 64)] = true
+	}
+
+	// Tool state by line, so cuts can be checked against it below
+	toolState := make(map[int]bool)
+	on, homed := false, false
+	firstMove := math.MaxInt
+	if len(moves) > 0 {
+		firstMove = moves[0].Line
+	}
+	text := strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	lines := strings.Split(text, "\n")
+	if text == "" {
+		lines = nil
+	}
+	report.Lines = len(lines)
+	for i, line := range lines {
+		n := i + 1
+		norm := normalizeGCodeLine(line)
+		switch {
+		case norm == "":
+		case toolOn != "" && norm == toolOn:
+			if on {
+				limited(n, "warning", "tool-already-on", "Tool turned on while it is already on")
+			}
+			on = true
+		case toolOff != "" && norm == toolOff:
+			on = false
+		case norm == "$H":
+			if n < firstMove {
+				homed = true
+			}
+		default:
+			for _, w := range parseGCodeWords(norm) {
+				if w.Letter != 'G' && w.Letter != 'M' {
+					continue
+				}
+				code := string(w.Letter) + strconv.FormatFloat(w.Value, 'f', -1, 64)
+				if code == "G28" && n < firstMove {
+					homed = true
+				}
+				if !lintKnownCommands[code] && !toolWords[code] {
+					limited(n, "warning", "unknown-command", fmt.Sprintf("Unknown command %s", code))
+				}
+			}
+		}
+		toolState[n] = on
+	}
+	if len(moves) > 0 && !homed {
+		report.add(0, "warning", "no-homing", "The program does not home (G28 or $H) before its first move")
+	}
+	if on && toolOn != "" {
+		report.add(0, "error", "tool-left-on", "The program ends with the tool still on")
+	}
+
+	seenFeed := make(map[float64]bool)
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, m := range moves {
+		for _, p := range []point{m.From, m.To} {
+			minX, minY = math.Min(minX, p.X), math.Min(minY, p.Y)
+			maxX, maxY = math.Max(maxX, p.X), math.Max(maxY, p.Y)
+		}
+		if opts.BedWidth > 0 && opts.BedHeight > 0 &&
+			(m.To.X < 0 || m.To.Y < 0 || m.To.X > opts.BedWidth || m.To.Y > opts.BedHeight) {
+			limited(m.Line, "error", "out-of-bounds", fmt.Sprintf("Move to (%.3f, %.3f) is outside the %gx%g mm bed",
+				m.To.X, m.To.Y, opts.BedWidth, opts.BedHeight))
+		}
+		if !m.Cut {
+			continue
+		}
+		report.CutMoves++
+		if toolOn != "" && !toolState[m.Line] {
+			limited(m.Line, "warning", "cut-with-tool-off", "Cutting move while the tool is off")
+		}
+		switch {
+		case m.Feed <= 0:
+			limited(m.Line, "error", "no-feedrate", "Cutting move before any feedrate (F) is set")
+		case (m.Feed < lintMinFeed || m.Feed > lintMaxFeed) && !seenFeed[m.Feed]:
+			seenFeed[m.Feed] = true
+			limited(m.Line, "warning", "extreme-feedrate", fmt.Sprintf("Feedrate %g mm/min is outside %d-%d mm/min",
+				m.Feed, lintMinFeed, lintMaxFeed))
+		}
+	}
+	if len(moves) > 0 {
+		report.Bounds = &lintBounds{MinX: minX, MinY: minY, MaxX: maxX, MaxY: maxY}
+	}
+
+	codes := make([]string, 0, len(reported))
+	for code := range reported {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if n := reported[code]; n > maxReportedViolations {
+			report.add(0, severities[code], code, fmt.Sprintf("%d more %s issues not listed", n-maxReportedViolations, code))
+		}
+	}
+	return report, nil
+}
+
+// HandleAPILintGCode checks an uploaded or pasted G-Code program and reports
+// problems as JSON. The program is read from the "gcode" file field, or the
+// "gcode" text field when no file is sent.
+func (s *Server) HandleAPILintGCode(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 50<<20)
+	var data []byte
+	if file, _, err := r.FormFile("gcode"); err == nil {
+		data, err = io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "Failed to read uploaded file: " + err.Error()})
+			return
+		}
+	} else if text := r.FormValue("gcode"); text != "" {
+		data = []byte(text)
+	} else {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "Send the G-Code as a gcode file or text field"})
+		return
+	}
+
+	opts := lintOptions{ToolOn: r.FormValue("toolOn"), ToolOff: r.FormValue("toolOff")}
+	if opts.ToolOn == "" {
+		opts.ToolOn = defaultToolOn
+	}
+	if opts.ToolOff == "" {
+		opts.ToolOff = defaultToolOff
+	}
+	for _, f := range []struct {
+		name string
+		dst  *float64
+	}{{"bedWidth", &opts.BedWidth}, {"bedHeight", &opts.BedHeight}} {
+		v := r.FormValue(f.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 || math.IsInf(n, 0) {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: f.name + " must be a positive number of mm"})
+			return
+		}
+		*f.dst = n
+	}
+	if (opts.BedWidth > 0) != (opts.BedHeight > 0) {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "bedWidth and bedHeight must be given together"})
+		return
+	}
+
+	report, err := lintGCode(data, opts)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "Failed to parse G-Code: " + err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,68 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobLog is a job's processing log. The pipeline appends to it while
+// handlers read it, so access is serialized.
+type jobLog struct {
+	mu     sync.Mutex
+	b      strings.Builder
+	stages []logStage
+}
+
+// logStage is a "=== ... ===" section of a job log and when it was written
+type logStage struct {
+	Name  string
+	Start time.Time
+}
+
+func (l *jobLog) WriteString(s string) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(s, "\n") {
+		if name, ok := strings.CutPrefix(line, "=== "); ok && strings.HasSuffix(name, " ===") {
+			l.stages = append(l.stages, logStage{Name: strings.TrimSuffix(name, " ==="), Start: time.Now()})
+		}
+	}
+	return l.b.WriteString(s)
+}
+
+// Stages returns the sections of the log so far in the order they began,
+// so each lasted until the next one's start
+func (l *jobLog) Stages() []logStage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]logStage(nil), l.stages...)
+}
+
+// String returns a snapshot of the log so far
+func (l *jobLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// NewLogHandler builds the slog handler for the server's logs. format is
+// "text" or "json"; level is one of "debug", "info", "warn", or "error".
+func NewLogHandler(w io.Writer, format, level string) (slog.Handler, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+}
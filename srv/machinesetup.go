@@ -0,0 +1,117 @@
+package srv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// machineSetup is the startup sequence the machineSetup option builds
+type machineSetup struct {
+	Home       string // "" for none, "cycle" for the controller's homing cycle, or "g28"
+	WorkOffset string // work coordinate system such as "G54", or "" to keep the active one
+	Absolute   bool   // set mm units and absolute positioning, and the flavor's other modes
+}
+
+// genericSetupModes are the modes set without a flavor: every program this
+// service writes is in mm with absolute coordinates
+var genericSetupModes = []string{"G21", "G90"}
+
+// extendedWorkOffsets are the work coordinate systems past G59, which GRBL
+// does not have
+var extendedWorkOffsets = map[string]bool{"G59.1": true, "G59.2": true, "G59.3": true}
+
+// parseMachineSetup validates the machineSetup sub-options against the
+// flavor, which must already be valid. They are ignored without
+// machineSetup, and gcodeHome cannot be combined with it since setupHome
+// takes its place.
+func parseMachineSetup(enabled bool, flavor string, gcodeHome bool, home, offset, absolute string) (machineSetup, error) {
+	if !enabled {
+		return machineSetup{}, nil
+	}
+	home, offset = strings.ToLower(strings.TrimSpace(home)), strings.ToUpper(strings.TrimSpace(offset))
+	if gcodeHome {
+		return machineSetup{}, fmt.Errorf("gcodeHome cannot be combined with machineSetup; use setupHome")
+	}
+	setup := machineSetup{Absolute: true}
+	switch home {
+	case "", "none":
+	case "cycle", "g28":
+		setup.Home = home
+	default:
+		return machineSetup{}, fmt.Errorf("setupHome must be none, cycle, or g28")
+	}
+	switch {
+	case offset == "":
+	case offset >= "G54" && offset <= "G59" && len(offset) == 3:
+		setup.WorkOffset = offset
+	case extendedWorkOffsets[offset] && (flavor == "marlin" || flavor == "reprap"):
+		setup.WorkOffset = offset
+	case extendedWorkOffsets[offset]:
+		return machineSetup{}, fmt.Errorf("setupWorkOffset %s needs the marlin or reprap gcodeFlavor", offset)
+	default:
+		return machineSetup{}, fmt.Errorf("setupWorkOffset must be one of G54 to G59, or G59.1 to G59.3 on marlin and reprap")
+	}
+	switch absolute {
+	case "", "on", "true":
+	case "off", "false":
+		setup.Absolute = false
+	default:
+		return machineSetup{}, fmt.Errorf("setupAbsolute must be true or false")
+	}
+	return setup, nil
+}
+
+// machineSetupLines composes the startup sequence for a flavor, "" for
+// none: the modes first, so homing and the offset are read in mm, then
+// homing, then the work offset, which homing would otherwise be measured
+// against. The homing cycle is the flavor's, or G28 without one; "g28" is
+// always G28, which GRBL takes as a move to the position stored with G28.1
+// rather than as homing.
+func machineSetupLines(setup machineSetup, flavor string) []string {
+	var lines []string
+	if setup.Absolute {
+		if f, ok := gcodeFlavors[flavor]; ok {
+			lines = append(lines, f.Preamble...)
+		} else {
+			lines = append(lines, genericSetupModes...)
+		}
+	}
+	switch setup.Home {
+	case "cycle":
+		if f, ok := gcodeFlavors[flavor]; ok {
+			lines = append(lines, f.Home)
+		} else {
+			lines = append(lines, "G28")
+		}
+	case "g28":
+		lines = append(lines, "G28")
+	}
+	if setup.WorkOffset != "" {
+		lines = append(lines, setup.WorkOffset)
+	}
+	return lines
+}
+
+// jobMachineSetup returns the startup sequence a job asked for, nil
+// without machineSetup
+func jobMachineSetup(opts JobOptions) []string {
+	if !opts.MachineSetup {
+		return nil
+	}
+	return machineSetupLines(machineSetup{Home: opts.SetupHome, WorkOffset: opts.SetupWorkOffset, Absolute: opts.SetupAbsolute}, opts.GCodeFlavor)
+}
+
+// jobFlavor returns the flavor a job's program is wrapped in. With
+// machineSetup its preamble gives way to the startup sequence, which sets
+// the same modes when setupAbsolute is on. feedUnits overrides the flavor's
+// own unit.
+func jobFlavor(opts JobOptions) gcodeFlavor {
+	flavor := gcodeFlavors[opts.GCodeFlavor]
+	if opts.MachineSetup {
+		flavor.Preamble = nil
+	}
+	if opts.FeedUnits != "" {
+		flavor.FeedUnits = opts.FeedUnits
+	}
+	return flavor
+}
@@ -0,0 +1,90 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// nameLinksDir holds the human-readable links to job directories made
+// when NameLinks is set
+const nameLinksDir = "by-name"
+
+// maxNameLinkBase bounds the filename part of a name link
+const maxNameLinkBase = 60
+
+// nameLinkBase turns an uploaded filename into a safe link name: the
+// extension is dropped, anything but ASCII letters, digits, '.', '_', and
+// '-' becomes '-', and runs of '-' collapse. Leading dots are removed so the
+// link is never hidden or named "..".
+func nameLinkBase(originalName string) string {
+	base := strings.TrimSuffix(filepath.Base(originalName), filepath.Ext(originalName))
+	var b strings.Builder
+	for _, c := range base {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_':
+			b.WriteRune(c)
+		default:
+			if s := b.String(); s != "" && !strings.HasSuffix(s, "-") {
+				b.WriteByte('-')
+			}
+		}
+	}
+	name := strings.TrimLeft(b.String(), ".-")
+	if len(name) > maxNameLinkBase {
+		name = name[:maxNameLinkBase]
+	}
+	name = strings.TrimRight(name, ".-")
+	if name == "" {
+		return "image"
+	}
+	return name
+}
+
+// linkJobName creates uploads/by-name/<name>-<short id> pointing at the
+// job's directory, so operators browsing the disk can find jobs by the file
+// they came from. Should the short ID collide, the full ID is used instead.
+func (s *Server) linkJobName(jobID, originalName string) (string, error) {
+	dir := filepath.Join(s.UploadsDir, nameLinksDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	base := nameLinkBase(originalName)
+	target := filepath.Join("..", jobID)
+	for _, id := range []string{jobID[:min(8, len(jobID))], jobID} {
+		name := base + "-" + id
+		err := os.Symlink(target, filepath.Join(dir, name))
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("a link for job %s already exists", jobID)
+}
+
+// unlinkJobNames removes the name links pointing at the given jobs
+func (s *Server) unlinkJobNames(jobIDs []string) {
+	dir := filepath.Join(s.UploadsDir, nameLinksDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return // no links were ever made
+	}
+	targets := make(map[string]bool, len(jobIDs))
+	for _, id := range jobIDs {
+		targets[filepath.Join("..", id)] = true
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if target, err := os.Readlink(path); err == nil && targets[target] {
+			if err := os.Remove(path); err != nil {
+				slog.Warn("remove job name link", "link", path, "error", err)
+			}
+		}
+	}
+}
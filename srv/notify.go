@@ -0,0 +1,251 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAlertDebounce is how long identical failures are collapsed into
+// one alert
+const DefaultAlertDebounce = 15 * time.Minute
+
+// alertTimeout bounds each webhook POST or SMTP delivery
+const alertTimeout = 10 * time.Second
+
+// FailureAlerts configures the server-level alerts sent when a job fails.
+// Either or both of WebhookURL and SMTPAddr may be set; with neither, no
+// alerts are sent.
+type FailureAlerts struct {
+	WebhookURL   string        // URL POSTed a JSON failureAlert
+	SMTPAddr     string        // host:port of the mail server
+	SMTPUser     string        // PLAIN auth user name; empty sends without auth
+	SMTPPassword string        // PLAIN auth password
+	From         string        // Envelope and header sender
+	To           []string      // Recipients
+	Debounce     time.Duration // Identical failures within this window send one alert
+}
+
+// Enabled reports whether any alert destination is configured
+func (a FailureAlerts) Enabled() bool {
+	return a.WebhookURL != "" || a.SMTPAddr != ""
+}
+
+// failureAlert is the content of an alert. Repeats counts the identical
+// failures suppressed since the previous alert for the same problem.
+type failureAlert struct {
+	Event        string    `json:"event"`
+	Host         string    `json:"host"`
+	JobID        string    `json:"jobId"`
+	OriginalName string    `json:"originalName"`
+	Stage        string    `json:"stage"`
+	Tool         string    `json:"tool,omitempty"` // the external tool that failed, if one did
+	Error        string    `json:"error"`
+	Time         time.Time `json:"time"`
+	StatusURL    string    `json:"statusURL"`
+	Repeats      int       `json:"repeats"`
+}
+
+// alertState debounces alerts by failure signature
+type alertState struct {
+	mu   sync.Mutex
+	seen map[string]*alertRecord
+}
+
+type alertRecord struct {
+	sent       time.Time // when the last alert for this failure went out
+	suppressed int       // failures since then that sent nothing
+}
+
+var (
+	logStageRegex = regexp.MustCompile(`(?m)^=== (.+?) ===$`)
+	// Gemini keys appear in request URLs, which end up in net/http errors
+	apiKeyParamRegex = regexp.MustCompile(`([?&]key=)[^&\s"']+`)
+	geminiKeyRegex   = regexp.MustCompile(`AIza[0-9A-Za-z_-]{35}`)
+	// Work and upload paths name the job, so they differ between repeats
+	// of the same failure
+	alertPathRegex = regexp.MustCompile(`(?:/[^\s/"':]+)+/?`)
+)
+
+// runAlertDelivery sends an alert off the job's goroutine, so a slow
+// webhook or mail server doesn't hold up the job; tests replace it to
+// deliver synchronously
+var runAlertDelivery = func(send func()) { go send() }
+
+// failedStage returns the last section heading of a job log, which for a
+// failed job names the step that failed
+func failedStage(log string) string {
+	m := logStageRegex.FindAllStringSubmatch(log, -1)
+	if len(m) == 0 {
+		return "starting"
+	}
+	return m[len(m)-1][1]
+}
+
+// sanitizeAlertError removes anything in an error message that could be a
+// Gemini API key
+func sanitizeAlertError(msg, apiKey string) string {
+	if apiKey != "" {
+		msg = strings.ReplaceAll(msg, apiKey, "[redacted]")
+	}
+	msg = apiKeyParamRegex.ReplaceAllString(msg, "${1}[redacted]")
+	return geminiKeyRegex.ReplaceAllString(msg, "[redacted]")
+}
+
+// alertSignature returns what makes two failures the same problem for
+// debouncing: how the tool died when an external tool failed, otherwise
+// the stage and the error with the job's ID and any paths taken out
+func alertSignature(alert failureAlert, failure *toolFailure) string {
+	if failure != nil {
+		kind := "could not run"
+		switch {
+		case failure.OOMKilled:
+			kind = "oom"
+		case failure.Signal != "":
+			kind = failure.Signal
+		case failure.ExitCode != nil:
+			kind = fmt.Sprintf("exit %d", *failure.ExitCode)
+		}
+		return "tool\x00" + failure.Tool + "\x00" + kind
+	}
+	msg := alertPathRegex.ReplaceAllString(alert.Error, "<path>")
+	return alert.Stage + "\x00" + strings.ReplaceAll(msg, alert.JobID, "")
+}
+
+// shouldAlert records a failure with the given signature and reports
+// whether it should be sent, and with how many suppressed repeats
+func (st *alertState) shouldAlert(key string, window time.Duration, now time.Time) (bool, int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.seen == nil {
+		st.seen = make(map[string]*alertRecord)
+	}
+	for k, r := range st.seen {
+		if now.Sub(r.sent) >= window && r.suppressed == 0 {
+			delete(st.seen, k)
+		}
+	}
+	r, ok := st.seen[key]
+	if ok && now.Sub(r.sent) < window {
+		r.suppressed++
+		return false, 0
+	}
+	repeats := 0
+	if ok {
+		repeats = r.suppressed
+	}
+	st.seen[key] = &alertRecord{sent: now}
+	return true, repeats
+}
+
+// alertJobFailure sends a failure alert for a job that ended in error,
+// unless the same failure was alerted within the debounce window. The
+// alert is delivered in the background. apiKey is only used to scrub the
+// key from the message.
+func (s *Server) alertJobFailure(job *Job, apiKey string) {
+	if !s.Alerts.Enabled() {
+		return
+	}
+	alert := failureAlert{
+		Event:        "job.failed",
+		Host:         s.Hostname,
+		JobID:        job.ID,
+		OriginalName: job.OriginalName,
+		Stage:        failedStage(job.Log.String()),
+		Error:        sanitizeAlertError(lastLogLine(job.Log.String()), apiKey),
+		Time:         time.Now().UTC(),
+		StatusURL:    s.PublicURL + "/job/" + job.ID,
+	}
+	if job.ToolFailure != nil {
+		alert.Tool = job.ToolFailure.Tool
+	}
+	send, repeats := s.alerts.shouldAlert(alertSignature(alert, job.ToolFailure), s.Alerts.Debounce, alert.Time)
+	if !send {
+		slog.Debug("failure alert suppressed", "job", job.ID, "stage", alert.Stage)
+		return
+	}
+	alert.Repeats = repeats
+	runAlertDelivery(func() { s.sendFailureAlert(alert) })
+}
+
+// sendFailureAlert delivers alert to every configured destination
+func (s *Server) sendFailureAlert(alert failureAlert) {
+	if s.Alerts.WebhookURL != "" {
+		if err := postFailureAlert(s.Alerts.WebhookURL, alert); err != nil {
+			slog.Warn("failure alert webhook", "job", alert.JobID, "error", err)
+		}
+	}
+	if s.Alerts.SMTPAddr != "" {
+		if err := s.mailFailureAlert(alert); err != nil {
+			slog.Warn("failure alert email", "job", alert.JobID, "error", err)
+		}
+	}
+}
+
+func postFailureAlert(url string, alert failureAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bitmap-to-gcode")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// failureAlertMessage formats an alert as an RFC 5322 message
+func failureAlertMessage(from string, to []string, alert failureAlert) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: [%s] job %s failed: %s\r\n", alert.Host, alert.JobID, alert.Stage)
+	fmt.Fprintf(&b, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Job:   %s (%s)\r\n", alert.JobID, alert.OriginalName)
+	fmt.Fprintf(&b, "Stage: %s\r\n", alert.Stage)
+	fmt.Fprintf(&b, "Error: %s\r\n", alert.Error)
+	fmt.Fprintf(&b, "Log:   %s\r\n", alert.StatusURL)
+	if alert.Repeats > 0 {
+		fmt.Fprintf(&b, "\r\nThe same failure happened %d more times since the last alert.\r\n", alert.Repeats)
+	}
+	return b.Bytes()
+}
+
+func (s *Server) mailFailureAlert(alert failureAlert) error {
+	var auth smtp.Auth
+	if s.Alerts.SMTPUser != "" {
+		host, _, _ := strings.Cut(s.Alerts.SMTPAddr, ":")
+		auth = smtp.PlainAuth("", s.Alerts.SMTPUser, s.Alerts.SMTPPassword, host)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Alerts.SMTPAddr, auth, s.Alerts.From, s.Alerts.To, failureAlertMessage(s.Alerts.From, s.Alerts.To, alert))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(alertTimeout):
+		return fmt.Errorf("timed out after %s", alertTimeout)
+	}
+}
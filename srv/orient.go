@@ -0,0 +1,249 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// svgRootRegex matches the root <svg> start tag
+var svgRootRegex = regexp.MustCompile(`<svg\b[^>]*>`)
+
+// svgSizeAttrRegex matches the width, height, and viewBox attributes of a tag
+var svgSizeAttrRegex = regexp.MustCompile(`\s(width|height|viewBox)=("[^"]*"|'[^']*')`)
+
+// pathCommandPoints is the number of points in one segment of each path
+// command whose arguments are only points
+var pathCommandPoints = map[byte]int{'M': 1, 'L': 1, 'C': 3, 'S': 2, 'Q': 2, 'T': 1}
+
+// fittedArea returns the area in mm² a w x h design covers once fitted into
+// maxW x maxH. A design with a declared physical size is only ever scaled
+// down, so one that already fits covers its own area.
+func fittedArea(w, h, maxW, maxH float64, declared bool) float64 {
+	if !declared || w > maxW || h > maxH {
+		w, h = scaleToFit(w, h, maxW, maxH)
+	}
+	return w * h
+}
+
+// shouldRotate reports whether turning a w x h design 90° lets it cover more
+// of a maxW x maxH bed, as a landscape design on a portrait bed does. Ties,
+// such as square designs or designs small enough to fit either way, keep
+// the original orientation.
+func shouldRotate(w, h, maxW, maxH float64, declared bool) bool {
+	const epsilon = 1e-9
+	return fittedArea(h, w, maxW, maxH, declared) > fittedArea(w, h, maxW, maxH, declared)*(1+epsilon)
+}
+
+// rotateSVGData turns an SVG 90° clockwise: the root's width and height are
+// swapped, its viewBox is turned to match, and every path's data is rewritten
+// in absolute coordinates. Like parseSVGPaths it assumes autotrace output,
+// with no transforms or shapes other than <path>.
+func rotateSVGData(data []byte) ([]byte, error) {
+	root := svgRootRegex.FindIndex(data)
+	if root == nil {
+		return nil, fmt.Errorf("no <svg> element")
+	}
+	tag := data[root[0]:root[1]]
+	attrs := map[string]string{}
+	for _, m := range svgSizeAttrRegex.FindAllSubmatch(tag, -1) {
+		attrs[string(m[1])] = string(m[2][1 : len(m[2])-1])
+	}
+
+	// A point (x, y) in the viewBox (minX, minY, w, h) moves to
+	// (minX + minY + h - y, minY + x - minX) in the viewBox (minX, minY, h, w)
+	_, hasWidth := attrs["width"]
+	if _, hasHeight := attrs["height"]; hasWidth != hasHeight {
+		return nil, fmt.Errorf("the SVG has only one of width and height")
+	}
+	var minX, minY, height float64
+	viewBox, hasViewBox := attrs["viewBox"]
+	if hasViewBox {
+		f := strings.FieldsFunc(viewBox, func(r rune) bool { return r == ' ' || r == ',' })
+		if len(f) != 4 {
+			return nil, fmt.Errorf("malformed viewBox %q", viewBox)
+		}
+		var v [4]float64
+		for i := range v {
+			n, err := strconv.ParseFloat(f[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed viewBox %q", viewBox)
+			}
+			v[i] = n
+		}
+		minX, minY, height = v[0], v[1], v[3]
+		viewBox = fmt.Sprintf("%g %g %g %g", v[0], v[1], v[3], v[2])
+	} else if height = parseSVGLength(attrs["height"]); height <= 0 {
+		return nil, fmt.Errorf("the SVG has no usable height or viewBox")
+	}
+	rotate := func(p point) point {
+		return point{minX + minY + height - p.Y, minY + p.X - minX}
+	}
+
+	var rotateErr error
+	newTag := svgSizeAttrRegex.ReplaceAllFunc(tag, func(attr []byte) []byte {
+		m := svgSizeAttrRegex.FindSubmatch(attr)
+		switch string(m[1]) {
+		case "width":
+			return []byte(fmt.Sprintf(` width="%s"`, attrs["height"]))
+		case "height":
+			return []byte(fmt.Sprintf(` height="%s"`, attrs["width"]))
+		default:
+			return []byte(fmt.Sprintf(` viewBox="%s"`, viewBox))
+		}
+	})
+	body := pathElementRegex.ReplaceAllFunc(data[root[1]:], func(elem []byte) []byte {
+		m := pathDataAttrRegex.FindSubmatch(elem)
+		if m == nil || rotateErr != nil {
+			return elem
+		}
+		d, err := transformPathData(string(m[1][1:len(m[1])-1]), rotate)
+		if err != nil {
+			rotateErr = err
+			return elem
+		}
+		return pathDataAttrRegex.ReplaceAllLiteral(elem, []byte(` d="`+d+`"`))
+	})
+	if rotateErr != nil {
+		return nil, rotateErr
+	}
+
+	out := append([]byte{}, data[:root[0]]...)
+	out = append(out, newTag...)
+	return append(out, body...), nil
+}
+
+// transformPathData maps every point of SVG path data through fn, which
+// must be a rotation, translation, or both, so that curves, arcs, and
+// smooth-curve reflections keep their shape. The result uses absolute
+// commands only, with H and V written as L.
+func transformPathData(d string, fn func(point) point) (string, error) {
+	toks, err := tokenizePathData(d)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		b     strings.Builder
+		cur   point
+		start point
+		i     int
+	)
+	nums := func(n int) ([]float64, error) {
+		out := make([]float64, n)
+		for k := range out {
+			if i >= len(toks) || toks[i].cmd != 0 {
+				return nil, fmt.Errorf("path data: expected number")
+			}
+			out[k] = toks[i].num
+			i++
+		}
+		return out, nil
+	}
+	writePoints := func(cmd byte, pts ...point) {
+		b.WriteByte(cmd)
+		for k, p := range pts {
+			if k > 0 {
+				b.WriteByte(' ')
+			}
+			p = fn(p)
+			fmt.Fprintf(&b, "%.3f %.3f", p.X, p.Y)
+		}
+	}
+
+	var cmd byte
+	for i < len(toks) {
+		if toks[i].cmd != 0 {
+			cmd = toks[i].cmd
+			i++
+		} else if cmd == 0 {
+			return "", fmt.Errorf("path data: missing command")
+		}
+		rel := cmd >= 'a' && cmd <= 'z'
+		upper := cmd &^ 0x20
+		offset := func(x, y float64) point {
+			if rel {
+				return point{cur.X + x, cur.Y + y}
+			}
+			return point{x, y}
+		}
+
+		n := pathCommandPoints[upper]
+		switch upper {
+		case 'M', 'L', 'C', 'S', 'Q', 'T':
+			v, err := nums(2 * n)
+			if err != nil {
+				return "", err
+			}
+			pts := make([]point, n)
+			for k := range pts {
+				pts[k] = offset(v[2*k], v[2*k+1])
+			}
+			writePoints(upper, pts...)
+			cur = pts[n-1]
+			if upper == 'M' {
+				start = cur
+				// Subsequent coordinate pairs are implicit lineto commands
+				if rel {
+					cmd = 'l'
+				} else {
+					cmd = 'L'
+				}
+			}
+		case 'H':
+			v, err := nums(1)
+			if err != nil {
+				return "", err
+			}
+			if rel {
+				v[0] += cur.X
+			}
+			cur = point{v[0], cur.Y}
+			writePoints('L', cur)
+		case 'V':
+			v, err := nums(1)
+			if err != nil {
+				return "", err
+			}
+			if rel {
+				v[0] += cur.Y
+			}
+			cur = point{cur.X, v[0]}
+			writePoints('L', cur)
+		case 'A':
+			v, err := nums(7)
+			if err != nil {
+				return "", err
+			}
+			// The ellipse turns with the path: its radii stay the same and
+			// its rotation follows where fn sends the x axis
+			o, x := fn(point{0, 0}), fn(point{1, 0})
+			angle := math.Atan2(x.Y-o.Y, x.X-o.X) * 180 / math.Pi
+			cur = offset(v[5], v[6])
+			p := fn(cur)
+			fmt.Fprintf(&b, "A%g %g %.3f %g %g %.3f %.3f", v[0], v[1], v[2]+angle, v[3], v[4], p.X, p.Y)
+		case 'Z':
+			b.WriteByte('Z')
+			cur = start
+		default:
+			return "", fmt.Errorf("path data: unsupported command %q", cmd)
+		}
+	}
+	return b.String(), nil
+}
+
+// rotateSVG applies rotateSVGData to an SVG file in place
+func rotateSVG(svgPath string) error {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return err
+	}
+	rotated, err := rotateSVGData(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(svgPath, rotated, 0644)
+}
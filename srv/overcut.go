@@ -0,0 +1,110 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// maxOvercut bounds the overcut option in mm; a closed path retraced much
+// further than this is being cut twice rather than closed cleanly
+const maxOvercut = 10.0
+
+// closeTolerance is how near in mm a stroke must end to its start to be
+// taken as a closed path, allowing for the rounding of printed coordinates
+const closeTolerance = 0.01
+
+// parseOvercut validates the overcut distance in mm. Empty is 0, which
+// leaves closed paths alone.
+func parseOvercut(v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(n >= 0 && n <= maxOvercut) {
+		return 0, fmt.Errorf("overcut must be a number of mm from 0 to %g", maxOvercut)
+	}
+	return n, nil
+}
+
+// overcutStats describes what overcutStrokes did
+type overcutStats struct {
+	Strokes int // pen-down runs found
+	Closed  int // strokes ending where they start
+	Overcut int // closed strokes extended
+	Skipped int // closed strokes left alone: starting on an arc, or no length
+}
+
+// overcutStrokes extends each closed pen-down stroke, one ending where it
+// started, overcut mm past its closing point by retracing its first cuts
+// before the tool lifts, so the seam where the cut starts and ends is cut
+// clean. Strokes are found as leadStrokes finds them. The retrace follows
+// linear cuts only and stops short at an arc; a stroke starting on an arc,
+// or with no length to retrace, is left alone and counted as skipped.
+func overcutStrokes(lines []string, overcut float64) ([]string, overcutStats, error) {
+	var stats overcutStats
+	parsed, err := parseStrokeLines(lines)
+	if err != nil {
+		return lines, stats, err
+	}
+
+	after := make(map[int][]string) // moves to go after the indexed line
+	length := func(l strokeLine) float64 { return math.Hypot(l.to.X-l.from.X, l.to.Y-l.from.Y) }
+	for i := 0; i < len(parsed); {
+		if k := parsed[i].kind; k != 'l' && k != 'a' {
+			i++
+			continue
+		}
+		var cuts []int
+		end := i
+		for ; end < len(parsed); end++ {
+			k := parsed[end].kind
+			if k == 'l' || k == 'a' {
+				cuts = append(cuts, end)
+			} else if k != 0 {
+				break
+			}
+		}
+		i = end
+		stats.Strokes++
+
+		first, last := parsed[cuts[0]], parsed[cuts[len(cuts)-1]]
+		if math.Hypot(last.to.X-first.from.X, last.to.Y-first.from.Y) > closeTolerance {
+			continue
+		}
+		stats.Closed++
+
+		var moves []string
+		rest := overcut
+		for _, c := range cuts {
+			l := parsed[c]
+			d := length(l)
+			if l.kind != 'l' || rest < 1e-9 {
+				break
+			}
+			to := l.to
+			if d > rest {
+				to = point{l.from.X + rest*(l.to.X-l.from.X)/d, l.from.Y + rest*(l.to.Y-l.from.Y)/d}
+				d = rest
+			}
+			if d < 1e-9 {
+				continue
+			}
+			moves = append(moves, fmt.Sprintf("G1 X%.3f Y%.3f", to.X, to.Y))
+			rest -= d
+		}
+		if len(moves) == 0 {
+			stats.Skipped++
+			continue
+		}
+		after[cuts[len(cuts)-1]] = moves
+		stats.Overcut++
+	}
+
+	out := make([]string, 0, len(lines)+len(after))
+	for i, line := range lines {
+		out = append(out, line)
+		out = append(out, after[i]...)
+	}
+	return out, stats, nil
+}
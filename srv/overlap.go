@@ -0,0 +1,314 @@
+package srv
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Overlap detection tolerances in SVG user units
+const (
+	overlapEpsilon      = 1e-3 // distance under which points count as the same
+	maxReportedOverlaps = 10
+)
+
+// overlapSegment is one straight segment of the flattened trace
+type overlapSegment struct {
+	a, b    point
+	line    int // index of its polyline
+	idx     int // position within the polyline
+	n       int // number of segments in the polyline
+	closed  bool
+	box     bounds
+	removed bool
+}
+
+// adjacent reports whether s and t follow each other along one polyline
+func (s *overlapSegment) adjacent(t *overlapSegment) bool {
+	if s.line != t.line {
+		return false
+	}
+	d := s.idx - t.idx
+	return d == 1 || d == -1 || (s.closed && (d == s.n-1 || d == 1-s.n))
+}
+
+// overlapSpan is a stretch drawn twice
+type overlapSpan struct {
+	From, To point
+}
+
+// overlapReport lists the problems checkOverlapsData found
+type overlapReport struct {
+	Crossings     []point       // where a path crosses itself
+	Overlaps      []overlapSpan // stretches drawn by two collinear segments
+	OverlapLength float64       // total length of Overlaps
+	Duplicates    int           // segments that exactly repeat an earlier one
+	Removed       int           // duplicates removed
+}
+
+func cross(o, a, b point) float64 {
+	return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X)
+}
+
+// segmentCrossing returns the point where segments ab and cd cross at a
+// single point inside both, not counting shared or touching endpoints
+func segmentCrossing(a, b, c, d point) (point, bool) {
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	if !((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) || !((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return point{}, false
+	}
+	t := d1 / (d1 - d2)
+	return point{a.X + (b.X-a.X)*t, a.Y + (b.Y-a.Y)*t}, true
+}
+
+// collinearOverlap returns the stretch shared by segments ab and cd when
+// they lie on one line and overlap for more than overlapEpsilon
+func collinearOverlap(a, b, c, d point) (overlapSpan, bool) {
+	length := math.Hypot(b.X-a.X, b.Y-a.Y)
+	if length < overlapEpsilon {
+		return overlapSpan{}, false
+	}
+	if math.Abs(cross(a, b, c))/length > overlapEpsilon || math.Abs(cross(a, b, d))/length > overlapEpsilon {
+		return overlapSpan{}, false
+	}
+	// Project c and d onto ab, measured in units of its length
+	ux, uy := (b.X-a.X)/length, (b.Y-a.Y)/length
+	tc := (c.X-a.X)*ux + (c.Y-a.Y)*uy
+	td := (d.X-a.X)*ux + (d.Y-a.Y)*uy
+	lo, hi := max(0, min(tc, td)), min(length, max(tc, td))
+	if hi-lo <= overlapEpsilon {
+		return overlapSpan{}, false
+	}
+	return overlapSpan{point{a.X + ux*lo, a.Y + uy*lo}, point{a.X + ux*hi, a.Y + uy*hi}}, true
+}
+
+// sameSegment reports whether two segments join the same points, in
+// either direction
+func sameSegment(s, t *overlapSegment) bool {
+	near := func(p, q point) bool { return math.Hypot(p.X-q.X, p.Y-q.Y) <= overlapEpsilon }
+	return (near(s.a, t.a) && near(s.b, t.b)) || (near(s.a, t.b) && near(s.b, t.a))
+}
+
+// findOverlaps compares every pair of segments whose boxes meet, using a
+// grid so that only segments in the same cells are compared. A pair whose
+// boxes share several cells is handled in the one holding the low corner
+// of the shared area.
+func findOverlaps(segs []*overlapSegment) overlapReport {
+	var rep overlapReport
+	if len(segs) < 2 {
+		return rep
+	}
+	all := bounds{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, s := range segs {
+		all.MinX, all.MinY = min(all.MinX, s.box.MinX), min(all.MinY, s.box.MinY)
+		all.MaxX, all.MaxY = max(all.MaxX, s.box.MaxX), max(all.MaxY, s.box.MaxY)
+	}
+	cell := max(all.Width(), all.Height()) / math.Ceil(math.Sqrt(float64(len(segs))))
+	if cell <= 0 {
+		cell = 1
+	}
+	key := func(x, y float64) [2]int {
+		return [2]int{int(math.Floor((x - all.MinX) / cell)), int(math.Floor((y - all.MinY) / cell))}
+	}
+	grid := make(map[[2]int][]int)
+	for i, s := range segs {
+		lo, hi := key(s.box.MinX-overlapEpsilon, s.box.MinY-overlapEpsilon), key(s.box.MaxX+overlapEpsilon, s.box.MaxY+overlapEpsilon)
+		for x := lo[0]; x <= hi[0]; x++ {
+			for y := lo[1]; y <= hi[1]; y++ {
+				grid[[2]int{x, y}] = append(grid[[2]int{x, y}], i)
+			}
+		}
+	}
+
+	for k, members := range grid {
+		for mi, i := range members {
+			for _, j := range members[mi+1:] {
+				s, t := segs[i], segs[j]
+				if s.box.MinX > t.box.MaxX+overlapEpsilon || t.box.MinX > s.box.MaxX+overlapEpsilon ||
+					s.box.MinY > t.box.MaxY+overlapEpsilon || t.box.MinY > s.box.MaxY+overlapEpsilon {
+					continue
+				}
+				if key(max(s.box.MinX, t.box.MinX)-overlapEpsilon, max(s.box.MinY, t.box.MinY)-overlapEpsilon) != k {
+					continue
+				}
+				if span, ok := collinearOverlap(s.a, s.b, t.a, t.b); ok {
+					rep.Overlaps = append(rep.Overlaps, span)
+					rep.OverlapLength += math.Hypot(span.To.X-span.From.X, span.To.Y-span.From.Y)
+					if sameSegment(s, t) {
+						segs[max(i, j)].removed = true // keep the one drawn first
+					}
+					continue
+				}
+				if s.line == t.line && !s.adjacent(t) {
+					if p, ok := segmentCrossing(s.a, s.b, t.a, t.b); ok {
+						rep.Crossings = append(rep.Crossings, p)
+					}
+				}
+			}
+		}
+	}
+	for _, s := range segs {
+		if s.removed {
+			rep.Duplicates++
+		}
+	}
+	// Report in reading order rather than the grid's map order
+	comparePoints := func(p, q point) int { return cmp.Or(cmp.Compare(p.Y, q.Y), cmp.Compare(p.X, q.X)) }
+	slices.SortFunc(rep.Crossings, comparePoints)
+	slices.SortFunc(rep.Overlaps, func(p, q overlapSpan) int {
+		return cmp.Or(comparePoints(p.From, q.From), comparePoints(p.To, q.To))
+	})
+	return rep
+}
+
+// keptRuns returns the point runs left of a polyline once its removed
+// segments are taken out. A closed polyline's last and first runs are
+// joined, since they meet at its start point.
+func keptRuns(segs []*overlapSegment, closed bool) [][]point {
+	var runs [][]point
+	var run []point
+	for _, s := range segs {
+		if s.removed {
+			if len(run) > 1 {
+				runs = append(runs, run)
+			}
+			run = nil
+			continue
+		}
+		if run == nil {
+			run = []point{s.a}
+		}
+		run = append(run, s.b)
+	}
+	if len(run) > 1 {
+		runs = append(runs, run)
+	}
+	if closed && len(runs) > 1 && !segs[0].removed && !segs[len(segs)-1].removed {
+		last := runs[len(runs)-1]
+		runs[0] = append(last, runs[0][1:]...)
+		runs = runs[:len(runs)-1]
+	}
+	return runs
+}
+
+// checkOverlapsData looks for paths that cross themselves and for strokes
+// drawn twice, by the same or different paths, in the flattened trace.
+// Crossings between different paths are normal in a drawing and are not
+// reported. With removeDuplicates, a segment that exactly repeats an
+// earlier one is taken out; the paths that lose segments are rewritten as
+// polylines and the rest are left exactly as they were.
+func checkOverlapsData(data []byte, removeDuplicates bool) ([]byte, overlapReport, error) {
+	locs := pathElementRegex.FindAllIndex(data, -1)
+	type elemLines struct {
+		pls  []polyline
+		segs [][]*overlapSegment
+	}
+	elems := make([]elemLines, len(locs))
+	var segs []*overlapSegment
+	line := 0
+	for e, loc := range locs {
+		parsed, err := parseSVGPaths(data[loc[0]:loc[1]])
+		if err != nil || len(parsed) != 1 {
+			return data, overlapReport{}, fmt.Errorf("unreadable path element")
+		}
+		pls, err := flattenPathData(parsed[0].D)
+		if err != nil {
+			return data, overlapReport{}, err
+		}
+		elems[e].pls = pls
+		for _, pl := range pls {
+			var lineSegs []*overlapSegment
+			for i := 1; i < len(pl.Points); i++ {
+				a, b := pl.Points[i-1], pl.Points[i]
+				if a == b {
+					continue
+				}
+				lineSegs = append(lineSegs, &overlapSegment{a: a, b: b, line: line, idx: len(lineSegs), closed: pl.Closed,
+					box: bounds{min(a.X, b.X), min(a.Y, b.Y), max(a.X, b.X), max(a.Y, b.Y)}})
+			}
+			for _, s := range lineSegs {
+				s.n = len(lineSegs)
+			}
+			elems[e].segs = append(elems[e].segs, lineSegs)
+			segs = append(segs, lineSegs...)
+			line++
+		}
+	}
+
+	rep := findOverlaps(segs)
+	if !removeDuplicates || rep.Duplicates == 0 {
+		return data, rep, nil
+	}
+
+	var out []byte
+	prev := 0
+	for e, loc := range locs {
+		changed := false
+		var d strings.Builder
+		for i, pl := range elems[e].pls {
+			lineSegs := elems[e].segs[i]
+			for _, s := range lineSegs {
+				if s.removed {
+					changed = true
+					rep.Removed++
+				}
+			}
+			for _, run := range keptRuns(lineSegs, pl.Closed) {
+				d.WriteString(polylineData(run))
+			}
+		}
+		if !changed {
+			continue
+		}
+		out = append(out, data[prev:loc[0]]...)
+		if d.Len() > 0 {
+			out = append(out, pathDataAttrRegex.ReplaceAllLiteral(data[loc[0]:loc[1]], []byte(` d="`+d.String()+`"`))...)
+		}
+		prev = loc[1]
+	}
+	return append(out, data[prev:]...), rep, nil
+}
+
+// logOverlapReport writes what checkOverlaps found to log, listing
+// the first few locations of each kind
+func logOverlapReport(log io.StringWriter, rep overlapReport) {
+	log.WriteString(fmt.Sprintf("%d self-intersections, %d overlapping stretches (%.1f px drawn twice), %d duplicate segments\n",
+		len(rep.Crossings), len(rep.Overlaps), rep.OverlapLength, rep.Duplicates))
+	for i, p := range rep.Crossings {
+		if i == maxReportedOverlaps {
+			log.WriteString(fmt.Sprintf("  ... and %d more self-intersections\n", len(rep.Crossings)-i))
+			break
+		}
+		log.WriteString(fmt.Sprintf("  Path crosses itself at (%.2f, %.2f)\n", p.X, p.Y))
+	}
+	for i, o := range rep.Overlaps {
+		if i == maxReportedOverlaps {
+			log.WriteString(fmt.Sprintf("  ... and %d more overlaps\n", len(rep.Overlaps)-i))
+			break
+		}
+		log.WriteString(fmt.Sprintf("  Drawn twice from (%.2f, %.2f) to (%.2f, %.2f)\n", o.From.X, o.From.Y, o.To.X, o.To.Y))
+	}
+	if rep.Removed > 0 {
+		log.WriteString(fmt.Sprintf("Removed %d duplicate segments\n", rep.Removed))
+	}
+	log.WriteString("\n")
+}
+
+// checkOverlaps applies checkOverlapsData to an SVG file, rewriting it
+// only when duplicates were removed
+func checkOverlaps(svgPath string, removeDuplicates bool) (overlapReport, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return overlapReport{}, err
+	}
+	cleaned, rep, err := checkOverlapsData(data, removeDuplicates)
+	if err != nil || rep.Removed == 0 {
+		return rep, err
+	}
+	return rep, os.WriteFile(svgPath, cleaned, 0644)
+}
@@ -0,0 +1,144 @@
+package srv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// padToBed moves a program so its cuts are centered on a bedW x bedH mm bed
+// with the origin at the bed's lower-left corner, so every job plotted on
+// the same bed shares one coordinate frame whatever the design's size.
+// Other words are left alone, as is a travel to X0 Y0 after the last cut,
+// which parks the tool at the bed origin. It returns the new lines and the
+// cut bounds after the move.
+func padToBed(lines []string, bedW, bedH float64) ([]string, bounds, error) {
+	const epsilon = 1e-6
+	for _, line := range lines {
+		for _, w := range parseGCodeWords(line) {
+			if w.Letter == 'G' && w.Value == 20 {
+				return lines, bounds{}, fmt.Errorf("inch programs (G20) are not supported")
+			}
+			if w.Letter == 'G' && w.Value == 91 {
+				return lines, bounds{}, fmt.Errorf("relative positioning (G91) is not supported")
+			}
+		}
+	}
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return lines, bounds{}, err
+	}
+	b, ok := movesBounds(moves, true)
+	if !ok {
+		return lines, bounds{}, fmt.Errorf("the program has no cutting moves")
+	}
+	if b.Width() > bedW+epsilon || b.Height() > bedH+epsilon {
+		return lines, b, fmt.Errorf("the %.2f x %.2f mm design does not fit the %.2f x %.2f mm bed", b.Width(), b.Height(), bedW, bedH)
+	}
+
+	dx := (bedW-b.Width())/2 - b.MinX
+	dy := (bedH-b.Height())/2 - b.MinY
+	return shiftMoves(lines, moves, dx, dy), bounds{b.MinX + dx, b.MinY + dy, b.MaxX + dx, b.MaxY + dy}, nil
+}
+
+// shiftProgram moves a program by dx, dy the way padToBed does, leaving a
+// park move after the last cut alone
+func shiftProgram(lines []string, dx, dy float64) []string {
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return lines
+	}
+	return shiftMoves(lines, moves, dx, dy)
+}
+
+// shiftMoves moves the lines by dx, dy given their parsed moves
+func shiftMoves(lines []string, moves []gcodeMove, dx, dy float64) []string {
+	lastCut := 0 // 1-based line of the last cutting move
+	for _, m := range moves {
+		if m.Cut {
+			lastCut = m.Line
+		}
+	}
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = line
+		if !hasPositionWord(line) || (i+1 > lastCut && isParkMove(line)) {
+			continue
+		}
+		out[i] = shiftPositionWords(line, dx, dy)
+	}
+	return out
+}
+
+// isParkMove reports whether a line is a rapid move to X0 Y0
+func isParkMove(line string) bool {
+	var rapid, x, y bool
+	for _, w := range parseGCodeWords(line) {
+		switch w.Letter {
+		case 'G':
+			rapid = rapid || w.Value == 0
+		case 'X':
+			x = w.Value == 0
+		case 'Y':
+			y = w.Value == 0
+		default:
+			return false
+		}
+	}
+	return rapid && x && y
+}
+
+// shiftPositionWords adds dx to a line's X word and dy to its Y word,
+// keeping everything else, including any comment, as it was
+func shiftPositionWords(line string, dx, dy float64) string {
+	return mapGCodeWords(line, "XY", func(letter byte, v float64) string {
+		if letter == 'X' {
+			v += dx
+		} else {
+			v += dy
+		}
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	})
+}
+
+// mapGCodeWords replaces the number of each word whose letter is in
+// letters with fn's formatting of it. Comments and other words are kept
+// as they were.
+func mapGCodeWords(line, letters string, fn func(letter byte, v float64) string) string {
+	code, comment := line, ""
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		code, comment = line[:i], line[i:]
+	}
+	var b strings.Builder
+	for i := 0; i < len(code); {
+		if code[i] == '(' {
+			end := strings.IndexByte(code[i:], ')')
+			if end < 0 {
+				end = len(code) - i - 1
+			}
+			b.WriteString(code[i : i+end+1])
+			i += end + 1
+			continue
+		}
+		c := code[i] &^ 0x20
+		if c < 'A' || c > 'Z' || strings.IndexByte(letters, c) < 0 {
+			b.WriteByte(code[i])
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(code) && strings.IndexByte("+-.0123456789", code[j]) >= 0 {
+			j++
+		}
+		v, err := strconv.ParseFloat(code[i+1:j], 64)
+		if err != nil {
+			b.WriteString(code[i:j])
+			i = j
+			continue
+		}
+		b.WriteByte(code[i])
+		b.WriteString(fn(c, v))
+		i = j
+	}
+	return b.String() + comment
+}
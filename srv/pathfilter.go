@@ -0,0 +1,96 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+var (
+	pathElementRegex      = regexp.MustCompile(`<path[^>]*/>`)
+	strokeWidthStyleRegex = regexp.MustCompile(`stroke-width:\s*([0-9.]+(?:[eE][-+]?[0-9]+)?)`)
+)
+
+// parseSVGDistance reads a form field measured in SVG pixels, such as
+// minPathLength; empty gives 0, which disables the option
+func parseSVGDistance(field, v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("%s must be a non-negative number of SVG pixels", field)
+	}
+	return n, nil
+}
+
+// pathStrokeWidth returns a path's stroke width in SVG user units. The style
+// property wins over the attribute, as in CSS; SVG's default is 1.
+func pathStrokeWidth(p svgPathElement) float64 {
+	if m := strokeWidthStyleRegex.FindStringSubmatch(p.Style); m != nil {
+		if w, err := strconv.ParseFloat(m[1], 64); err == nil {
+			return w
+		}
+	}
+	if w, err := strconv.ParseFloat(p.StrokeWidth, 64); err == nil {
+		return w
+	}
+	return 1
+}
+
+// pathLength returns the total drawn length of path data, summed over all
+// subpaths after flattening curves. Closed subpaths already end at their
+// start point.
+func pathLength(d string) (float64, error) {
+	polylines, err := flattenPathData(d)
+	if err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for _, pl := range polylines {
+		pts := pl.Points
+		for i := 1; i < len(pts); i++ {
+			total += math.Hypot(pts[i].X-pts[i-1].X, pts[i].Y-pts[i-1].Y)
+		}
+	}
+	return total, nil
+}
+
+// filterSmallPathsData removes paths thinner than minWidth or shorter than
+// minLength (SVG user units; zero disables either check). It returns the
+// filtered SVG and how many paths each check removed. Paths whose data
+// cannot be parsed are kept.
+func filterSmallPathsData(data []byte, minWidth, minLength float64) ([]byte, int, int) {
+	thin, short := 0, 0
+	filtered := pathElementRegex.ReplaceAllFunc(data, func(match []byte) []byte {
+		paths, err := parseSVGPaths(match)
+		if err != nil || len(paths) != 1 {
+			return match
+		}
+		p := paths[0]
+		if minWidth > 0 && pathStrokeWidth(p) < minWidth {
+			thin++
+			return []byte{}
+		}
+		if minLength > 0 {
+			if l, err := pathLength(p.D); err == nil && l < minLength {
+				short++
+				return []byte{}
+			}
+		}
+		return match
+	})
+	return filtered, thin, short
+}
+
+// filterSmallPaths applies filterSmallPathsData to an SVG file in place
+func filterSmallPaths(svgPath string, minWidth, minLength float64) (int, int, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	filtered, thin, short := filterSmallPathsData(data, minWidth, minLength)
+	return thin, short, os.WriteFile(svgPath, filtered, 0644)
+}
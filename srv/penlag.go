@@ -0,0 +1,241 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxLead bounds leadIn and leadOut in mm; pen lag worth more than this is
+// better fixed in the machine
+const maxLead = 10.0
+
+// parseLead validates a leadIn or leadOut distance in mm. Empty is 0,
+// which leaves stroke ends alone.
+func parseLead(name, v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(n >= 0 && n <= maxLead) {
+		return 0, fmt.Errorf("%s must be a number of mm from 0 to %g", name, maxLead)
+	}
+	return n, nil
+}
+
+// leadStats describes what leadStrokes did
+type leadStats struct {
+	Strokes  int // pen-down runs found
+	LeadIns  int // strokes started early
+	LeadOuts int // strokes ended early
+	Skipped  int // stroke ends left alone: arcs, no travel to move, or too short
+}
+
+// strokeLine is one line of a program as leadStrokes and overcutStrokes
+// see it
+type strokeLine struct {
+	kind     byte // 't' travel, 'l' linear cut, 'a' arc cut, 'o' other code, 0 blank or comment
+	from, to point
+	feed     string // F word, if the line has one
+}
+
+// setXY sets the X and Y words of a move, adding whichever it lacks
+func setXY(line string, p point) string {
+	hasX, hasY := false, false
+	line = mapGCodeWords(line, "XY", func(letter byte, v float64) string {
+		if letter == 'X' {
+			hasX = true
+			return strconv.FormatFloat(p.X, 'f', 3, 64)
+		}
+		hasY = true
+		return strconv.FormatFloat(p.Y, 'f', 3, 64)
+	})
+	if hasX && hasY {
+		return line
+	}
+	code, comment := line, ""
+	if i := strings.IndexAny(line, ";("); i >= 0 {
+		code, comment = line[:i], line[i:]
+	}
+	code = strings.TrimRight(code, " ")
+	if !hasX {
+		code += fmt.Sprintf(" X%.3f", p.X)
+	}
+	if !hasY {
+		code += fmt.Sprintf(" Y%.3f", p.Y)
+	}
+	if comment != "" {
+		code += " " + comment
+	}
+	return code
+}
+
+// parseStrokeLines classifies each line of an absolute, millimetre program
+// and tracks where each move starts and ends
+func parseStrokeLines(lines []string) ([]strokeLine, error) {
+	parsed := make([]strokeLine, len(lines))
+	var pos point
+	motion := -1
+	for i, line := range lines {
+		words := parseGCodeWords(line)
+		if len(words) == 0 {
+			continue
+		}
+		target := pos
+		hasXY := false
+		for _, w := range words {
+			switch w.Letter {
+			case 'G':
+				switch w.Value {
+				case 0, 1, 2, 3:
+					motion = int(w.Value)
+				case 20:
+					return nil, fmt.Errorf("inch programs (G20) are not supported")
+				case 91:
+					return nil, fmt.Errorf("relative positioning (G91) is not supported")
+				}
+			case 'X':
+				target.X, hasXY = w.Value, true
+			case 'Y':
+				target.Y, hasXY = w.Value, true
+			case 'F':
+				parsed[i].feed = "F" + strconv.FormatFloat(w.Value, 'f', -1, 64)
+			}
+		}
+		p := &parsed[i]
+		p.from, p.to, p.kind = pos, target, 'o'
+		if hasXY {
+			switch motion {
+			case 0:
+				p.kind = 't'
+			case 1:
+				p.kind = 'l'
+			case 2, 3:
+				p.kind = 'a'
+			}
+		}
+		pos = target
+	}
+	return parsed, nil
+}
+
+// leadStrokes compensates for a pen that lags on the way down and up. A
+// pen-down stroke is a run of cuts with no travel or other command, such
+// as the tool commands, between them. With leadIn, the travel before each
+// stroke stops leadIn mm short of it, back along its first cut, and the
+// stroke starts there, so the pen has settled by the true start. With
+// leadOut, each stroke is cut leadOut mm short along its path, so the pen
+// is up by the true end. Ends on an arc, strokes no travel leads to, and
+// strokes no longer than leadOut are left alone and counted as skipped.
+func leadStrokes(lines []string, leadIn, leadOut float64) ([]string, leadStats, error) {
+	var stats leadStats
+	parsed, err := parseStrokeLines(lines)
+	if err != nil {
+		return lines, stats, err
+	}
+
+	replace := make(map[int]string)
+	insert := make(map[int]string) // a line to go before the indexed one
+	drop := make(map[int]bool)
+	length := func(l strokeLine) float64 { return math.Hypot(l.to.X-l.from.X, l.to.Y-l.from.Y) }
+	lastEnd := -1 // index of the line ending the previous stroke
+	for i := 0; i < len(parsed); {
+		if k := parsed[i].kind; k != 'l' && k != 'a' {
+			i++
+			continue
+		}
+		var cuts []int
+		end := i
+		for ; end < len(parsed); end++ {
+			k := parsed[end].kind
+			if k == 'l' || k == 'a' {
+				cuts = append(cuts, end)
+			} else if k != 0 {
+				break
+			}
+		}
+		stats.Strokes++
+
+		if leadIn > 0 {
+			first := parsed[cuts[0]]
+			travel := -1
+			for t := cuts[0] - 1; t > lastEnd; t-- {
+				if parsed[t].kind == 't' {
+					travel = t
+					break
+				}
+			}
+			if d := length(first); first.kind != 'l' || travel < 0 || d < 1e-9 {
+				stats.Skipped++
+			} else {
+				s := first.from
+				early := point{s.X - leadIn*(first.to.X-s.X)/d, s.Y - leadIn*(first.to.Y-s.Y)/d}
+				replace[travel] = setXY(lines[travel], early)
+				move := fmt.Sprintf("G1 X%.3f Y%.3f", s.X, s.Y)
+				if first.feed != "" {
+					move += " " + first.feed
+				}
+				insert[cuts[0]] = move
+				stats.LeadIns++
+			}
+		}
+
+		if leadOut > 0 {
+			rest := leadOut
+			feed := ""
+			var dropped []int
+			trimmed := false
+			for c := len(cuts) - 1; c >= 0; c-- {
+				l := parsed[cuts[c]]
+				if l.kind != 'l' {
+					break
+				}
+				if feed == "" {
+					feed = l.feed
+				}
+				if d := length(l); d > rest+1e-9 {
+					line := setXY(lines[cuts[c]], point{l.to.X - rest*(l.to.X-l.from.X)/d, l.to.Y - rest*(l.to.Y-l.from.Y)/d})
+					if len(dropped) > 0 && feed != "" && l.feed == "" {
+						line += " " + feed // the feed a dropped cut set stays in effect
+					} else if len(dropped) > 0 && feed != "" && l.feed != feed {
+						line = feedWordRegex.ReplaceAllLiteralString(line, " "+feed)
+					}
+					replace[cuts[c]] = line
+					trimmed = true
+					break
+				} else if c == 0 {
+					break // the whole stroke would go
+				} else {
+					rest -= d
+					dropped = append(dropped, cuts[c])
+				}
+			}
+			if trimmed {
+				for _, d := range dropped {
+					drop[d] = true
+				}
+				stats.LeadOuts++
+			} else {
+				stats.Skipped++
+			}
+		}
+		lastEnd = cuts[len(cuts)-1]
+		i = end
+	}
+
+	out := make([]string, 0, len(lines)+len(insert))
+	for i, line := range lines {
+		if move, ok := insert[i]; ok {
+			out = append(out, move)
+		}
+		if drop[i] {
+			continue
+		}
+		if r, ok := replace[i]; ok {
+			line = r
+		}
+		out = append(out, line)
+	}
+	return out, stats, nil
+}
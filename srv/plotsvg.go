@@ -0,0 +1,123 @@
+package srv
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// plotSVGNamespace identifies the machine metadata element in plot SVGs
+const plotSVGNamespace = "https://github.com/c-jiph/bitmap-to-gcode/plot-svg"
+
+// plotMetadata is the machine setup recorded in a plot SVG, so the drawing
+// can be turned back into the same G-Code or checked against it
+type plotMetadata struct {
+	ToolOn, ToolOff string
+	Flavor          string
+	DPI             float64
+	Feed            float64 // first cutting feedrate in the program, 0 if none
+	Page            *bounds // the drawing's page in mm, nil to fit the toolpath
+}
+
+// writePlotSVG renders the toolpath in gcodePath as an SVG for plotter
+// extensions such as Inkscape's AxiDraw and plotting extensions. Cuts go in
+// a visible "1 Cut" layer; travel moves go in a hidden "% Travel" layer that
+// plotters skip. Coordinates are machine millimetres with Y negated, so
+// the drawing keeps its position on the bed. It returns the number of cut
+// paths written.
+func writePlotSVG(gcodePath, outPath string, meta plotMetadata) (int, error) {
+	moves, err := readGCodeMoves(gcodePath)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range moves {
+		if m.Cut && m.Feed > 0 {
+			meta.Feed = m.Feed
+			break
+		}
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	n := encodePlotSVG(w, moves, meta)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return n, f.Close()
+}
+
+// encodePlotSVG writes the plot SVG document and returns the number of cut
+// paths in it
+func encodePlotSVG(w io.Writer, moves []gcodeMove, meta plotMetadata) int {
+	b, ok := movesBounds(moves, false)
+	if !ok {
+		b = bounds{}
+	}
+	if meta.Page != nil {
+		b = *meta.Page
+	}
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>`+"\n")
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" xmlns:b2g="%s" `, plotSVGNamespace)
+	fmt.Fprintf(w, `width="%.3fmm" height="%.3fmm" viewBox="%.3f %.3f %.3f %.3f">`+"\n",
+		b.Width(), b.Height(), b.MinX, -b.MaxY, b.Width(), b.Height())
+
+	fmt.Fprint(w, "<metadata>\n")
+	fmt.Fprintf(w, `  <b2g:machine units="mm" toolOn="%s" toolOff="%s" flavor="%s" dpi="%.4f" feed="%g"/>`+"\n",
+		xmlAttr(meta.ToolOn), xmlAttr(meta.ToolOff), xmlAttr(meta.Flavor), meta.DPI, meta.Feed)
+	fmt.Fprint(w, "</metadata>\n")
+
+	// Consecutive cuts that join up become one path, so plotters lift the
+	// pen only where the G-Code does
+	var cuts, travel []string
+	var cur strings.Builder
+	var last point
+	flush := func() {
+		if cur.Len() > 0 {
+			cuts = append(cuts, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, m := range moves {
+		if !m.Cut {
+			flush()
+			if m.From != m.To {
+				travel = append(travel, fmt.Sprintf("M%.3f,%.3f L%.3f,%.3f", m.From.X, -m.From.Y, m.To.X, -m.To.Y))
+			}
+			continue
+		}
+		if cur.Len() == 0 || m.From != last {
+			flush()
+			fmt.Fprintf(&cur, "M%.3f,%.3f", m.From.X, -m.From.Y)
+		}
+		fmt.Fprintf(&cur, " L%.3f,%.3f", m.To.X, -m.To.Y)
+		last = m.To
+	}
+	flush()
+
+	fmt.Fprint(w, `<g inkscape:groupmode="layer" inkscape:label="1 Cut" id="layer-cut">`+"\n")
+	for _, d := range cuts {
+		fmt.Fprintf(w, `  <path d="%s" style="fill:none;stroke:#000000;stroke-width:0.3"/>`+"\n", d)
+	}
+	fmt.Fprint(w, "</g>\n")
+	fmt.Fprint(w, `<g inkscape:groupmode="layer" inkscape:label="% Travel" id="layer-travel" style="display:none">`+"\n")
+	for _, d := range travel {
+		fmt.Fprintf(w, `  <path d="%s" style="fill:none;stroke:#999999;stroke-width:0.2;stroke-dasharray:1,1"/>`+"\n", d)
+	}
+	fmt.Fprint(w, "</g>\n</svg>\n")
+	return len(cuts)
+}
+
+// xmlAttr escapes s for use in a double-quoted XML attribute
+func xmlAttr(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
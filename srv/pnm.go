@@ -0,0 +1,66 @@
+package srv
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+)
+
+// encodePPM writes img as a binary (P6) PPM. Transparent pixels are
+// composited onto bg, since autotrace has no notion of alpha and would
+// otherwise see whatever color a transparent pixel happens to store.
+func encodePPM(w io.Writer, img image.Image, bg color.RGBA) error {
+	b := img.Bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", b.Dx(), b.Dy())
+	row := make([]byte, 3*b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl := flattenOnto(img.At(x, y), bg)
+			i := 3 * (x - b.Min.X)
+			row[i], row[i+1], row[i+2] = r, g, bl
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// flattenOnto composites c over the opaque color bg
+func flattenOnto(c color.Color, bg color.RGBA) (uint8, uint8, uint8) {
+	r, g, b, a := c.RGBA() // alpha-premultiplied, 0-0xffff
+	over := func(v uint32, under uint8) uint8 {
+		return uint8((v + uint32(under)*0x101*(0xffff-a)/0xffff) >> 8)
+	}
+	return over(r, bg.R), over(g, bg.G), over(b, bg.B)
+}
+
+// normalizeInputFile decodes the image at inPath and writes it to outPath as
+// a PPM, the format autotrace reads most reliably, with any transparency
+// flattened onto bg. It returns the decoded format name and size for the
+// job log.
+func normalizeInputFile(inPath, outPath string, bg color.RGBA) (string, image.Rectangle, error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return "", image.Rectangle{}, err
+	}
+	defer in.Close()
+	img, format, err := image.Decode(in)
+	if err != nil {
+		return "", image.Rectangle{}, fmt.Errorf("decode image: %w", err)
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return format, img.Bounds(), err
+	}
+	if err := encodePPM(out, img, bg); err != nil {
+		out.Close()
+		return format, img.Bounds(), err
+	}
+	return format, img.Bounds(), out.Close()
+}
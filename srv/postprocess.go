@@ -0,0 +1,227 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readGCodeLines reads a G-code file as a slice of lines without terminators
+func readGCodeLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// writeGCodeLines writes lines to path, each terminated by a newline
+func writeGCodeLines(path string, lines []string) error {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// rewriteGCode applies fn to the lines of a G-code file in place
+func rewriteGCode(path string, fn func([]string) []string) error {
+	lines, err := readGCodeLines(path)
+	if err != nil {
+		return err
+	}
+	return writeGCodeLines(path, fn(lines))
+}
+
+// Request-time post-processing limits
+const (
+	maxDownloadPrecision  = 6
+	maxDownloadHeaderSize = 4096 // bytes of header or footer text
+)
+
+// downloadTransform is post-processing applied to a job's G-code as it is
+// downloaded, leaving the stored program alone
+type downloadTransform struct {
+	Header, Footer []string // lines added before and after the program
+	Precision      int      // decimals for axis words; -1 keeps them as written
+	CRLF           bool     // end lines with CR LF instead of LF
+	OffsetX        float64  // mm added to every X and Y word
+	OffsetY        float64
+}
+
+// parseDownloadTransform reads the header, footer, precision, lineEndings,
+// and offset query parameters. header and footer may be repeated or hold
+// several lines; offset is "X,Y" in mm.
+func parseDownloadTransform(q url.Values) (downloadTransform, error) {
+	t := downloadTransform{Precision: -1}
+	extraLines := func(name string) ([]string, error) {
+		text := strings.ReplaceAll(strings.Join(q[name], "\n"), "\r\n", "\n")
+		if len(text) > maxDownloadHeaderSize {
+			return nil, fmt.Errorf("%s is longer than %d bytes", name, maxDownloadHeaderSize)
+		}
+		if text == "" {
+			return nil, nil
+		}
+		lines := strings.Split(text, "\n")
+		for _, l := range lines {
+			if strings.ContainsFunc(l, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) {
+				return nil, fmt.Errorf("%s must not contain control characters", name)
+			}
+		}
+		return lines, nil
+	}
+	var err error
+	if t.Header, err = extraLines("header"); err != nil {
+		return t, err
+	}
+	if t.Footer, err = extraLines("footer"); err != nil {
+		return t, err
+	}
+	if v := q.Get("precision"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxDownloadPrecision {
+			return t, fmt.Errorf("precision must be a whole number of decimals from 0 to %d", maxDownloadPrecision)
+		}
+		t.Precision = n
+	}
+	switch q.Get("lineEndings") {
+	case "", "lf":
+	case "crlf":
+		t.CRLF = true
+	default:
+		return t, fmt.Errorf(`lineEndings must be "lf" or "crlf"`)
+	}
+	if v := q.Get("offset"); v != "" {
+		xs, ys, ok := strings.Cut(v, ",")
+		x, errX := strconv.ParseFloat(strings.TrimSpace(xs), 64)
+		y, errY := strconv.ParseFloat(strings.TrimSpace(ys), 64)
+		if !ok || errX != nil || errY != nil || math.IsNaN(x) || math.IsNaN(y) || math.IsInf(x, 0) || math.IsInf(y, 0) {
+			return t, fmt.Errorf("offset must be X,Y in mm, such as 10,-5")
+		}
+		t.OffsetX, t.OffsetY = x, y
+	}
+	return t, nil
+}
+
+// apply returns the transformed program. The offset moves every X and Y
+// word, so it is refused for relative (G91) programs, where that would
+// move the tool further on each line, and for inch (G20) ones.
+func (t downloadTransform) apply(lines []string) ([]byte, error) {
+	out := make([]string, 0, len(t.Header)+len(lines)+len(t.Footer))
+	out = append(out, t.Header...)
+	for _, line := range lines {
+		if t.OffsetX != 0 || t.OffsetY != 0 {
+			for _, w := range parseGCodeWords(line) {
+				if w.Letter == 'G' && w.Value == 91 {
+					return nil, fmt.Errorf("offset is not supported for relative positioning (G91) programs")
+				}
+				if w.Letter == 'G' && w.Value == 20 {
+					return nil, fmt.Errorf("offset is not supported for inch (G20) programs")
+				}
+			}
+			if hasPositionWord(line) {
+				line = shiftPositionWords(line, t.OffsetX, t.OffsetY)
+			}
+		}
+		if t.Precision >= 0 {
+			line = mapGCodeWords(line, "XYZIJKR", func(_ byte, v float64) string {
+				s := strconv.FormatFloat(v, 'f', t.Precision, 64)
+				if n, _ := strconv.ParseFloat(s, 64); n == 0 {
+					s = strconv.FormatFloat(0, 'f', t.Precision, 64) // no "-0.00"
+				}
+				return s
+			})
+		}
+		out = append(out, line)
+	}
+	out = append(out, t.Footer...)
+
+	eol := "\n"
+	if t.CRLF {
+		eol = "\r\n"
+	}
+	var b bytes.Buffer
+	for _, l := range out {
+		b.WriteString(l)
+		b.WriteString(eol)
+	}
+	return b.Bytes(), nil
+}
+
+// HandleJobDownload serves a job's G-code with the post-processing in its
+// query parameters applied on the fly, so a different header, footer,
+// precision, line ending, or offset needs no new job. source=base starts
+// from svg2gcode's output instead of the job's post-processed program. A
+// header or footer is refused on the finished program of a job with a
+// gcodeFlavor or machine setup, which already has its own preamble and end.
+// Neither stored file is changed; with no parameters the download is the
+// job's output.gcode. The job's maxFeed always applies.
+func (s *Server) HandleJobDownload(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists || s.jobStatus(job) != "done" || job.GCodePath == "" {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	if s.refuseUnapproved(w, job) {
+		return
+	}
+	path, suffix := job.GCodePath, ".gcode"
+	switch r.URL.Query().Get("source") {
+	case "", "final":
+	case "base":
+		if job.BaseGCodePath == "" {
+			http.Error(w, "This job has no base G-Code", http.StatusNotFound)
+			return
+		}
+		path, suffix = job.BaseGCodePath, ".base.gcode"
+	default:
+		http.Error(w, `source must be "final" or "base"`, http.StatusBadRequest)
+		return
+	}
+	t, err := parseDownloadTransform(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if path == job.GCodePath && (job.GCodeFlavor != "" || job.MachineSetup) && (len(t.Header) > 0 || len(t.Footer) > 0) {
+		http.Error(w, "This job's program already has a gcodeFlavor or machine setup preamble; add a header or footer with source=base", http.StatusBadRequest)
+		return
+	}
+	lines, err := readGCodeLines(path)
+	if err != nil {
+		http.Error(w, "Failed to read G-Code", http.StatusInternalServerError)
+		return
+	}
+	if job.MaxFeed > 0 {
+		// maxFeed is a safety limit, so it holds for the base program and
+		// added lines too
+		lines, _ = clampFeedrates(lines, job.MaxFeed)
+		t.Header, _ = clampFeedrates(t.Header, job.MaxFeed)
+		t.Footer, _ = clampFeedrates(t.Footer, job.MaxFeed)
+	}
+	data, err := t.apply(lines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.downloadBaseName(job)+suffix))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", jobModTime(job), bytes.NewReader(data))
+}
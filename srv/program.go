@@ -0,0 +1,376 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// refinePaths joins gaps between, deduplicates, and orders the paths of the
+// traced SVG at svgPath, as the job asks, reporting each step to log. The
+// whole trace and every tile's are refined the same way.
+func refinePaths(job *Job, svgPath string, log io.StringWriter) {
+	if job.JoinGap > 0 {
+		log.WriteString("=== Joining path gaps ===\n")
+		if n, err := joinGaps(svgPath, job.JoinGap); err != nil {
+			log.WriteString(fmt.Sprintf("Warning: failed to join paths: %v\n\n", err))
+		} else {
+			log.WriteString(fmt.Sprintf("%d joins made between endpoints within %g px\n\n", n, job.JoinGap))
+		}
+	}
+
+	if job.CheckOverlaps {
+		log.WriteString("=== Checking for overlapping paths ===\n")
+		if rep, err := checkOverlaps(svgPath, job.RemoveDuplicates); err != nil {
+			log.WriteString(fmt.Sprintf("Warning: overlap check failed: %v\n\n", err))
+		} else {
+			logOverlapReport(log, rep)
+		}
+	}
+
+	if job.ContourOrder != "" {
+		log.WriteString("=== Ordering contours ===\n")
+		if stats, err := orderContours(svgPath, job.ContourOrder); err != nil {
+			log.WriteString(fmt.Sprintf("Warning: keeping document order, contour ordering failed: %v\n\n", err))
+		} else {
+			log.WriteString(fmt.Sprintf("%d closed and %d open paths, nested up to %d deep; cutting %s moved %d of them\n\n",
+				stats.Closed, stats.Open, stats.MaxDepth, job.ContourOrder, stats.Moved))
+		}
+	}
+}
+
+// finishProgram runs the post-processing stages on the G-Code at gcodePath,
+// rewriting it in place, and reports each stage to log. tile is "" for the
+// whole job's program, which is padded to the bed and gets any registration
+// marks and QR code, and finishProgram returns how far padding moved it. A
+// tile's program, named by tile, is moved by shift instead, so it lines up
+// with the whole job's; every other stage runs on it just the same.
+func (s *Server) finishProgram(job *Job, gcodePath, tile string, shift point, log io.StringWriter) (point, error) {
+	whole := tile == ""
+	var padShift point
+
+	// Arcs are fitted first so adaptive feed sees them as single moves
+	if job.FitArcs {
+		log.WriteString("\n=== Fitting arcs ===\n")
+		var stats arcFitStats
+		var fitErr error
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, stats, fitErr = fitArcs(lines, job.ArcTolerance, job.MinArcRadius)
+			return lines
+		})
+		switch {
+		case err != nil:
+			return padShift, err
+		case fitErr != nil:
+			log.WriteString(fmt.Sprintf("Warning: arcs not fitted: %v\n", fitErr))
+		default:
+			log.WriteString(fmt.Sprintf("%d arcs replaced %d cutting moves, within %g mm\n", stats.Arcs, stats.Replaced, job.ArcTolerance))
+			if job.MinArcRadius > 0 {
+				log.WriteString(fmt.Sprintf("%d candidate arcs under the %g mm minimum radius kept as lines\n", stats.Rejected, job.MinArcRadius))
+			}
+		}
+	}
+
+	// Collinear cuts are merged once arcs, which need every point svg2gcode
+	// wrote, are fitted, and before turns are weighed for adaptive feed
+	if job.MergeCollinear {
+		log.WriteString("\n=== Merging collinear moves ===\n")
+		var stats collinearStats
+		var mergeErr error
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, stats, mergeErr = mergeCollinear(lines, job.MergeAngle)
+			return lines
+		})
+		switch {
+		case err != nil:
+			return padShift, err
+		case mergeErr != nil:
+			log.WriteString(fmt.Sprintf("Warning: moves not merged: %v\n", mergeErr))
+		default:
+			fewer := 0.0
+			if stats.Cuts > 0 {
+				fewer = float64(stats.Merged) * 100 / float64(stats.Cuts)
+			}
+			log.WriteString(fmt.Sprintf("Merged %d runs of cuts within %g°: %d -> %d cutting moves (%.1f%% fewer)\n",
+				stats.Runs, job.MergeAngle, stats.Cuts, stats.Cuts-stats.Merged, fewer))
+		}
+	}
+
+	// Slow down before marks and the frame go in, so only the drawing changes
+	if job.AdaptiveFeed {
+		log.WriteString("\n=== Adapting feedrate to curvature ===\n")
+		var slowed int
+		var adaptErr error
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, slowed, adaptErr = adaptFeedrates(lines, job.MinFeed, job.CurvatureThreshold)
+			return lines
+		})
+		switch {
+		case err != nil:
+			return padShift, err
+		case adaptErr != nil:
+			log.WriteString(fmt.Sprintf("Warning: feedrate left unchanged: %v\n", adaptErr))
+		default:
+			log.WriteString(fmt.Sprintf("%d cutting moves at turns sharper than %g° slowed, down to %g mm/min\n",
+				slowed, job.CurvatureThreshold, job.MinFeed))
+		}
+	}
+
+	// Marks and the frame are placed around the design where it ends up
+	if whole && job.PadToBed {
+		log.WriteString("\n=== Padding to bed ===\n")
+		var placed bounds
+		var padErr error
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			before, _ := cutBounds(lines)
+			lines, placed, padErr = padToBed(lines, job.MaxWidth, job.MaxHeight)
+			padShift = point{placed.MinX - before.MinX, placed.MinY - before.MinY}
+			return lines
+		})
+		if err == nil {
+			err = padErr
+		}
+		if err != nil {
+			return padShift, err
+		}
+		log.WriteString(fmt.Sprintf("Centered the design at X%.3f..%.3f Y%.3f..%.3f of the %.2f x %.2f mm bed\n",
+			placed.MinX, placed.MaxX, placed.MinY, placed.MaxY, job.MaxWidth, job.MaxHeight))
+	}
+
+	// Marks go in before the frame so the frame outlines them too
+	if whole && job.RegistrationMarks != "" {
+		log.WriteString("\n=== Adding registration marks ===\n")
+		var around bounds
+		var marked bool
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, around, marked = registrationGCode(lines, job.RegistrationMarks, job.RegistrationMarkSize, job.ToolOn, job.ToolOff)
+			return lines
+		})
+		if err != nil {
+			return padShift, err
+		}
+		if marked {
+			log.WriteString(fmt.Sprintf("Prepended %.1f mm %s marks at the corners of X%.3f..%.3f Y%.3f..%.3f\n",
+				job.RegistrationMarkSize, job.RegistrationMarks, around.MinX, around.MaxX, around.MinY, around.MaxY))
+		} else {
+			log.WriteString("No cutting moves to place marks around\n")
+		}
+	}
+
+	// The code is drawn last, after the design, but framed with it
+	if whole && job.QRCode {
+		log.WriteString("\n=== Adding QR code ===\n")
+		link, err := s.Shares.Create(job.ID, "", time.Time{})
+		if err != nil {
+			job.warn(fmt.Sprintf("Could not create a share link for the QR code: %v", err))
+		} else {
+			url := s.PublicURL + "/s/" + link.Token
+			var at bounds
+			var version int
+			var placed bool
+			var qrErr error
+			err := rewriteGCode(gcodePath, func(lines []string) []string {
+				lines, at, version, placed, qrErr = qrGCode(lines, url, job.QRCodeCorner, job.QRCodeSize, job.QRCodeStyle, job.ToolOn, job.ToolOff, job.MaxWidth, job.MaxHeight)
+				return lines
+			})
+			if err == nil && !errors.Is(qrErr, errQRNoRoom) {
+				err = qrErr
+			}
+			switch {
+			case err != nil:
+				return padShift, err
+			case qrErr != nil:
+				job.warn(fmt.Sprintf("QR code left out: a %.1f mm code at the %s corner would not fit on the %.2f x %.2f mm bed",
+					job.QRCodeSize, job.QRCodeCorner, job.MaxWidth, job.MaxHeight))
+			case placed:
+				log.WriteString(fmt.Sprintf("Appended a %.1f mm version %d QR code (%s) of %s at X%.3f..%.3f Y%.3f..%.3f\n",
+					job.QRCodeSize, version, job.QRCodeStyle, url, at.MinX, at.MaxX, at.MinY, at.MaxY))
+			default:
+				log.WriteString("No cutting moves to place the QR code beside\n")
+			}
+		}
+	}
+
+	// A tile goes where it is in the whole job's program, padding included
+	if !whole && shift != (point{}) {
+		log.WriteString("\n=== Shifting tile ===\n")
+		if err := rewriteGCode(gcodePath, func(lines []string) []string { return shiftProgram(lines, shift.X, shift.Y) }); err != nil {
+			return padShift, err
+		}
+		log.WriteString(fmt.Sprintf("Moved by X%.3f Y%.3f to match the padded job\n", shift.X, shift.Y))
+	}
+
+	// Every stroke is in by now, marks and QR code included, so they all
+	// get the same overcut and compensation. Closed strokes are found
+	// before lead-ins move their starts, and a lead-out then ends the
+	// overcut early like any other stroke.
+	if job.Overcut > 0 {
+		log.WriteString("\n=== Overcutting closed paths ===\n")
+		var stats overcutStats
+		var overcutErr error
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, stats, overcutErr = overcutStrokes(lines, job.Overcut)
+			return lines
+		})
+		switch {
+		case err != nil:
+			return padShift, err
+		case overcutErr != nil:
+			log.WriteString(fmt.Sprintf("Warning: closed paths left as they were: %v\n", overcutErr))
+		default:
+			log.WriteString(fmt.Sprintf("%d strokes, %d closed: %d cut %g mm past their closing point, %d left alone\n",
+				stats.Strokes, stats.Closed, stats.Overcut, job.Overcut, stats.Skipped))
+		}
+	}
+
+	if job.LeadIn > 0 || job.LeadOut > 0 {
+		log.WriteString("\n=== Compensating pen lag ===\n")
+		var stats leadStats
+		var leadErr error
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, stats, leadErr = leadStrokes(lines, job.LeadIn, job.LeadOut)
+			return lines
+		})
+		switch {
+		case err != nil:
+			return padShift, err
+		case leadErr != nil:
+			log.WriteString(fmt.Sprintf("Warning: stroke ends left as they were: %v\n", leadErr))
+		default:
+			log.WriteString(fmt.Sprintf("%d strokes: %d started %g mm early, %d ended %g mm early, %d ends left alone\n",
+				stats.Strokes, stats.LeadIns, job.LeadIn, stats.LeadOuts, job.LeadOut, stats.Skipped))
+		}
+	}
+
+	// Every feed the program will have is in by now
+	if job.MaxFeed > 0 {
+		log.WriteString("\n=== Clamping feedrates ===\n")
+		var stats feedClampStats
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, stats = clampFeedrates(lines, job.MaxFeed)
+			return lines
+		})
+		if err != nil {
+			return padShift, err
+		}
+		if stats.Clamped == 0 {
+			log.WriteString(fmt.Sprintf("No feedrates over %g mm/min\n", job.MaxFeed))
+		} else {
+			log.WriteString(fmt.Sprintf("%d feedrates over %g mm/min clamped: %s\n", stats.Clamped, job.MaxFeed, stats))
+		}
+	}
+
+	if job.FrameFirst {
+		log.WriteString("\n=== Framing job ===\n")
+		var frame bounds
+		var framed bool
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, frame, framed = frameGCode(lines, job.ToolOff)
+			return lines
+		})
+		if err != nil {
+			return padShift, err
+		}
+		if framed {
+			log.WriteString(fmt.Sprintf("Prepended tool-up frame X%.3f..%.3f Y%.3f..%.3f (%.1f x %.1f mm)\n",
+				frame.MinX, frame.MaxX, frame.MinY, frame.MaxY, frame.Width(), frame.Height()))
+		} else {
+			log.WriteString("No cutting moves to frame\n")
+		}
+	}
+
+	// Comments go after every step that adds them, and before the flavor so
+	// its line length check sees the stripped lines. The flavor adds none.
+	if job.StripComments {
+		log.WriteString("\n=== Stripping comments ===\n")
+		var stats commentStats
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, stats = stripComments(lines)
+			return lines
+		})
+		if err != nil {
+			return padShift, err
+		}
+		saved := 0.0
+		if stats.Before > 0 {
+			saved = 100 * float64(stats.Before-stats.After) / float64(stats.Before)
+		}
+		log.WriteString(fmt.Sprintf("Removed %d comment or blank lines and %d inline comments: %d -> %d bytes (%.1f%% smaller)\n",
+			stats.Lines, stats.Inline, stats.Before, stats.After, saved))
+	}
+
+	if job.GCodeFlavor != "" {
+		flavor := jobFlavor(job.JobOptions)
+		log.WriteString(fmt.Sprintf("\n=== Applying %s G-Code flavor ===\n", job.GCodeFlavor))
+		var tooLong []int
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			lines, tooLong = applyGCodeFlavor(lines, flavor, job.GCodeHome)
+			return lines
+		})
+		if err != nil {
+			return padShift, err
+		}
+		if job.MachineSetup {
+			log.WriteString("Preamble: replaced by the machine setup\n")
+		} else {
+			log.WriteString(fmt.Sprintf("Preamble: %s\n", strings.Join(flavor.Preamble, " / ")))
+		}
+		if job.GCodeHome {
+			log.WriteString(fmt.Sprintf("Homing: %s\n", flavor.Home))
+		}
+		log.WriteString(fmt.Sprintf("Footer: %s\n", strings.Join(flavor.Footer, " / ")))
+		log.WriteString(fmt.Sprintf("Feed units: %s\n", flavor.FeedUnits))
+		if len(tooLong) > 0 {
+			log.WriteString(fmt.Sprintf("Warning: %d lines exceed the %d character %s line buffer (first at line %d)\n",
+				len(tooLong), flavor.MaxLineLength, job.GCodeFlavor, tooLong[0]))
+		}
+	}
+
+	// Last of all, so the setup is the first thing the controller reads
+	if setup := jobMachineSetup(job.JobOptions); setup != nil {
+		log.WriteString("\n=== Writing machine setup ===\n")
+		err := rewriteGCode(gcodePath, func(lines []string) []string {
+			return append(append([]string{}, setup...), lines...)
+		})
+		if err != nil {
+			return padShift, err
+		}
+		if len(setup) == 0 {
+			log.WriteString("Nothing to set up: setupAbsolute is off and no homing or work offset was chosen\n")
+		} else {
+			log.WriteString(fmt.Sprintf("Setup: %s\n", strings.Join(setup, " / ")))
+		}
+	}
+
+	if len(s.KeepOut) > 0 {
+		log.WriteString("\n=== Checking keep-out regions ===\n")
+		moves, err := readGCodeMoves(gcodePath)
+		if err != nil {
+			return padShift, err
+		}
+		violations := checkKeepOut(moves, s.KeepOut)
+		if len(violations) == 0 {
+			log.WriteString(fmt.Sprintf("No cutting moves enter the %d keep-out regions\n", len(s.KeepOut)))
+		} else {
+			for i, v := range violations {
+				if i == maxReportedViolations {
+					log.WriteString(fmt.Sprintf("... and %d more\n", len(violations)-i))
+					break
+				}
+				log.WriteString(v.String() + "\n")
+			}
+			msg := fmt.Sprintf("%d cutting moves enter a keep-out region (first at line %d, %s); see the log for coordinates",
+				len(violations), violations[0].Move.Line, violations[0].Region.Name)
+			if s.KeepOutFail {
+				return padShift, errors.New(msg)
+			}
+			if !whole {
+				msg = tile + ": " + msg
+			}
+			job.warn(msg)
+		}
+	}
+	return padShift, nil
+}
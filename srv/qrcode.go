@@ -0,0 +1,427 @@
+package srv
+
+import "fmt"
+
+// qrBlocks is the error correction layout of one QR version at level M:
+// ecLen error correction codewords per block, and the data codewords of
+// each block in order
+type qrBlocks struct {
+	ecLen int
+	data  []int
+}
+
+// qrVersionsM lists versions 1-10 at error correction level M, which
+// survives about 15% of the symbol being smudged or missed by the pen.
+// Share URLs fit comfortably in the smaller ones.
+var qrVersionsM = []qrBlocks{
+	1:  {10, []int{16}},
+	2:  {16, []int{28}},
+	3:  {26, []int{44}},
+	4:  {18, []int{32, 32}},
+	5:  {24, []int{43, 43}},
+	6:  {16, []int{27, 27, 27, 27}},
+	7:  {18, []int{31, 31, 31, 31}},
+	8:  {22, []int{38, 38, 39, 39}},
+	9:  {22, []int{36, 36, 36, 37, 37}},
+	10: {26, []int{43, 43, 43, 43, 44}},
+}
+
+// qrAlignment holds the alignment pattern center coordinates by version
+var qrAlignment = [][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// qrCode is an encoded symbol. Modules are indexed [row][column]; true is
+// dark. The quiet zone around the symbol is not included.
+type qrCode struct {
+	Size    int
+	Modules [][]bool
+}
+
+// encodeQR encodes data in byte mode at error correction level M, in the
+// smallest version from 1 to 10 that holds it
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersionsM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		capacity := 0
+		for _, n := range qrVersionsM[v].data {
+			capacity += n
+		}
+		if 4+countBits+8*len(data) <= capacity*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes is too long for a QR code up to version %d", len(data), len(qrVersionsM)-1)
+	}
+	q := newQRCode(version)
+	q.drawCodewords(qrCodewords(version, data))
+	q.applyBestMask()
+	return &q.qrCode, nil
+}
+
+// qrCodewords returns the data and error correction codewords for data,
+// interleaved across blocks in transmission order
+func qrCodewords(version int, data []byte) []byte {
+	layout := qrVersionsM[version]
+	capacity := 0
+	for _, n := range layout.data {
+		capacity += n
+	}
+
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	put(0b0100, 4) // byte mode
+	if version >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	put(0, min(4, capacity*8-len(bits))) // terminator
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	stream := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		stream = append(stream, b)
+	}
+	for pad := byte(0xEC); len(stream) < capacity; pad ^= 0xEC ^ 0x11 {
+		stream = append(stream, pad)
+	}
+
+	divisor := reedSolomonDivisor(layout.ecLen)
+	var blocks, ecc [][]byte
+	for _, n := range layout.data {
+		blocks = append(blocks, stream[:n])
+		ecc = append(ecc, reedSolomonRemainder(stream[:n], divisor))
+		stream = stream[n:]
+	}
+	var out []byte
+	for i := 0; i < layout.data[len(layout.data)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecLen; i++ {
+		for _, e := range ecc {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// gfMultiply multiplies in GF(2^8) modulo the QR polynomial 0x11D
+func gfMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z >> 7
+		z = z<<1 ^ hi*0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// reedSolomonDivisor returns the generator polynomial of the given degree,
+// highest coefficient first with the leading 1 omitted
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder returns the error correction codewords for data
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, c := range divisor {
+			result[i] ^= gfMultiply(c, factor)
+		}
+	}
+	return result
+}
+
+// qrBuilder is a symbol under construction, tracking which modules belong
+// to function patterns and so are never masked
+type qrBuilder struct {
+	qrCode
+	version  int
+	function [][]bool
+}
+
+func newQRCode(version int) *qrBuilder {
+	size := 17 + 4*version
+	q := &qrBuilder{qrCode: qrCode{Size: size}, version: version}
+	q.Modules = make([][]bool, size)
+	q.function = make([][]bool, size)
+	for i := range q.Modules {
+		q.Modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		q.setFunction(6, i, i%2 == 0) // timing patterns
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(size-4, 3)
+	q.drawFinder(3, size-4)
+	if version >= 2 {
+		pos := qrAlignment[version]
+		for _, r := range pos {
+			for _, c := range pos {
+				// Skip the three centers that fall on finder patterns
+				if (r == 6 && c == 6) || (r == 6 && c == pos[len(pos)-1]) || (r == pos[len(pos)-1] && c == 6) {
+					continue
+				}
+				q.drawAlignment(c, r)
+			}
+		}
+	}
+	q.drawFormat(0) // reserve the format areas; the real mask is drawn later
+	if version >= 7 {
+		q.drawVersion()
+	}
+	return q
+}
+
+// setFunction sets the module at column x, row y as part of a pattern
+func (q *qrBuilder) setFunction(x, y int, dark bool) {
+	q.Modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFinder draws a finder pattern and its separator centered at x, y
+func (q *qrBuilder) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= q.Size || yy >= q.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			q.setFunction(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawAlignment draws a 5x5 alignment pattern centered at x, y
+func (q *qrBuilder) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information for level M and
+// mask, and the dark module
+func (q *qrBuilder) drawFormat(mask int) {
+	data := 0b00<<3 | mask // level M
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.Size-15+i, bit(i))
+	}
+	q.setFunction(8, q.Size-8, true)
+}
+
+// drawVersion draws both copies of the version information (version 7+)
+func (q *qrBuilder) drawVersion() {
+	rem := q.version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := q.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 == 1
+		a, b := q.Size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords fills the non-function modules with data in the zigzag
+// order of two-column strips, from the bottom right
+func (q *qrBuilder) drawCodewords(data []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert // upward strip
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.Modules[y][x] = data[i>>3]>>(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// qrMask reports whether mask pattern m inverts the module at x, y
+func qrMask(m, x, y int) bool {
+	switch m {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (q *qrBuilder) applyMask(m int) {
+	for y := range q.Modules {
+		for x := range q.Modules[y] {
+			if !q.function[y][x] && qrMask(m, x, y) {
+				q.Modules[y][x] = !q.Modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty score and draws
+// its format information
+func (q *qrBuilder) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for m := 0; m < 8; m++ {
+		q.applyMask(m)
+		q.drawFormat(m)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = m, p
+		}
+		q.applyMask(m) // masks are their own inverse
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+}
+
+// penalty scores the symbol by the four rules of ISO/IEC 18004: long
+// runs, 2x2 blocks, finder-like patterns, and dark/light imbalance
+func (q *qrBuilder) penalty() int {
+	n := q.Size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.Modules[x][y]
+		}
+		return q.Modules[y][x]
+	}
+	p := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+			// 1:1:3:1:1 with four light modules on one side
+			for x := 0; x+11 <= n; x++ {
+				var pattern [11]bool
+				for k := range pattern {
+					pattern[k] = at(x+k, y, transpose)
+				}
+				if pattern == [11]bool{true, false, true, true, true, false, true, false, false, false, false} ||
+					pattern == [11]bool{false, false, false, false, true, false, true, true, true, false, true} {
+					p += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.Modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.Modules[y][x]
+				if q.Modules[y][x+1] == c && q.Modules[y+1][x] == c && q.Modules[y+1][x+1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	percent := dark * 100 / (n * n)
+	return p + abs(percent-50)/5*10
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
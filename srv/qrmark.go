@@ -0,0 +1,197 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// QR code corners for the qrCodeCorner option
+const (
+	QRCornerBottomRight = "bottom-right"
+	QRCornerBottomLeft  = "bottom-left"
+	QRCornerTopRight    = "top-right"
+	QRCornerTopLeft     = "top-left"
+)
+
+// QR code styles for the qrCodeStyle option
+const (
+	QRStyleHatch   = "hatch"   // dark modules filled with back-and-forth lines
+	QRStyleOutline = "outline" // each row's dark runs outlined, for pens about as wide as a module
+)
+
+// QR code size limits in mm, and the hatch line spacing
+const (
+	defaultQRCodeSize = 20.0
+	minQRCodeSize     = 5.0
+	maxQRCodeSize     = 200.0
+	qrHatchPitch      = 0.4 // mm between hatch lines, about a fine pen's width
+	qrQuietZone       = 4   // light modules required around the symbol
+)
+
+// parseQRCode validates the qrCodeCorner, qrCodeSize, and qrCodeStyle
+// options, which only apply when qrCode is on. Empty values take the
+// defaults.
+func parseQRCode(enabled bool, corner, size, style string) (string, float64, string, error) {
+	if !enabled {
+		return "", 0, "", nil
+	}
+	switch corner {
+	case "":
+		corner = QRCornerBottomRight
+	case QRCornerBottomRight, QRCornerBottomLeft, QRCornerTopRight, QRCornerTopLeft:
+	default:
+		return "", 0, "", fmt.Errorf("qrCodeCorner must be %q, %q, %q, or %q",
+			QRCornerBottomRight, QRCornerBottomLeft, QRCornerTopRight, QRCornerTopLeft)
+	}
+	switch style {
+	case "":
+		style = QRStyleHatch
+	case QRStyleHatch, QRStyleOutline:
+	default:
+		return "", 0, "", fmt.Errorf("qrCodeStyle must be %q or %q", QRStyleHatch, QRStyleOutline)
+	}
+	n := defaultQRCodeSize
+	if size != "" {
+		var err error
+		n, err = strconv.ParseFloat(size, 64)
+		if err != nil || !(n >= minQRCodeSize && n <= maxQRCodeSize) {
+			return "", 0, "", fmt.Errorf("qrCodeSize must be a number of mm from %g to %g", minQRCodeSize, maxQRCodeSize)
+		}
+	}
+	return corner, n, style, nil
+}
+
+// qrPlacement returns the lower left corner of a symbol size mm square set
+// at the given corner of b, outside it with a quiet zone of gap mm between,
+// and false if there is no room for it on a bedWidth x bedHeight mm bed.
+// The symbol goes beside the drawing, level with its top or bottom edge,
+// or failing that above or below it, level with its side.
+func qrPlacement(b bounds, corner string, size, gap, bedWidth, bedHeight float64) (point, bool) {
+	right := corner == QRCornerBottomRight || corner == QRCornerTopRight
+	top := corner == QRCornerTopRight || corner == QRCornerTopLeft
+	var beside, stacked point
+	if right {
+		beside.X, stacked.X = b.MaxX+gap, b.MaxX-size
+	} else {
+		beside.X, stacked.X = b.MinX-gap-size, b.MinX
+	}
+	if top {
+		beside.Y, stacked.Y = b.MaxY-size, b.MaxY+gap
+	} else {
+		beside.Y, stacked.Y = b.MinY, b.MinY-gap-size
+	}
+	const eps = 1e-9
+	for _, p := range []point{beside, stacked} {
+		if p.X >= -eps && p.Y >= -eps && p.X+size <= bedWidth+eps && p.Y+size <= bedHeight+eps {
+			return p, true
+		}
+	}
+	return point{}, false
+}
+
+// qrStrokes returns the polylines that draw the dark modules of q as a
+// size mm square with its lower left corner at origin. Symbol rows run down
+// from the top, so row 0 is drawn at the highest Y. A hatched run of dark
+// modules is one zigzag stroke that never leaves the run, so the tool only
+// lifts between runs.
+func qrStrokes(q *qrCode, origin point, size float64, style string) [][]point {
+	module := size / float64(q.Size)
+	lines := max(2, int(math.Ceil(module/qrHatchPitch)))
+	var strokes [][]point
+	for r, row := range q.Modules {
+		top := origin.Y + size - float64(r)*module
+		for c := 0; c < q.Size; {
+			if !row[c] {
+				c++
+				continue
+			}
+			end := c
+			for end < q.Size && row[end] {
+				end++
+			}
+			x0, x1 := origin.X+float64(c)*module, origin.X+float64(end)*module
+			c = end
+			if style == QRStyleOutline {
+				strokes = append(strokes, []point{{x0, top}, {x1, top}, {x1, top - module}, {x0, top - module}, {x0, top}})
+				continue
+			}
+			var s []point
+			for k := 0; k < lines; k++ {
+				y := top - (float64(k)+0.5)*module/float64(lines)
+				if k%2 == 0 {
+					s = append(s, point{x0, y}, point{x1, y})
+				} else {
+					s = append(s, point{x1, y}, point{x0, y})
+				}
+			}
+			strokes = append(strokes, s)
+		}
+	}
+	return strokes
+}
+
+// errQRNoRoom is returned by qrGCode when the symbol doesn't fit on the bed
+// at the chosen corner
+var errQRNoRoom = errors.New("no room on the bed for the QR code at that corner")
+
+// qrGCode appends a QR code of url beside a corner of the job's cutting
+// bounds, after the last cut so it is drawn once the design is done. The
+// symbol must fit on the bedWidth x bedHeight mm bed, or errQRNoRoom is
+// returned. It returns the symbol's bounds, its version, and false if the
+// program has no cutting moves.
+func qrGCode(lines []string, url, corner string, size float64, style, toolOn, toolOff string, bedWidth, bedHeight float64) ([]string, bounds, int, bool, error) {
+	q, err := encodeQR([]byte(url))
+	if err != nil {
+		return lines, bounds{}, 0, false, err
+	}
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return lines, bounds{}, 0, false, nil
+	}
+	b, ok := movesBounds(moves, true)
+	if !ok {
+		return lines, b, 0, false, nil
+	}
+	last := 0
+	for _, m := range moves {
+		if m.Cut {
+			last = max(last, m.Line)
+		}
+	}
+
+	origin, fits := qrPlacement(b, corner, size, qrQuietZone*size/float64(q.Size), bedWidth, bedHeight)
+	if !fits {
+		return lines, bounds{}, 0, false, errQRNoRoom
+	}
+	feed := firstFeed(lines)
+	code := []string{fmt.Sprintf("; QR code: %s", url)}
+	for _, s := range qrStrokes(q, origin, size, style) {
+		if toolOff != "" {
+			code = append(code, toolOff)
+		}
+		code = append(code, fmt.Sprintf("G0 X%.3f Y%.3f", s[0].X, s[0].Y))
+		if toolOn != "" {
+			code = append(code, toolOn)
+		}
+		for i, p := range s[1:] {
+			line := fmt.Sprintf("G1 X%.3f Y%.3f", p.X, p.Y)
+			if i == 0 && feed != "" {
+				line += " F" + feed
+			}
+			code = append(code, line)
+		}
+	}
+	if toolOff != "" {
+		code = append(code, toolOff)
+	}
+	code = append(code, "; end QR code")
+
+	out := make([]string, 0, len(lines)+len(code))
+	out = append(out, lines[:last]...)
+	out = append(out, code...)
+	out = append(out, lines[last:]...)
+	return out, bounds{origin.X, origin.Y, origin.X + size, origin.Y + size}, 1 + (q.Size-21)/4, true, nil
+}
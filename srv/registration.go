@@ -0,0 +1,124 @@
+package srv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Registration mark styles for the registrationMarks option
+const (
+	RegistrationCross  = "cross"  // a + centered on each corner
+	RegistrationCorner = "corner" // an L at each corner, its arms pointing away from the drawing
+)
+
+// Registration mark size limits in mm
+const (
+	defaultRegistrationMarkSize = 5.0
+	maxRegistrationMarkSize     = 50.0
+)
+
+func parseRegistrationMarks(style, size string) (string, float64, error) {
+	switch style {
+	case "", "none":
+		return "", 0, nil
+	case RegistrationCross, RegistrationCorner:
+	default:
+		return "", 0, fmt.Errorf("registrationMarks must be %q or %q", RegistrationCross, RegistrationCorner)
+	}
+	if size == "" {
+		return style, defaultRegistrationMarkSize, nil
+	}
+	n, err := strconv.ParseFloat(size, 64)
+	if err != nil || !(n > 0 && n <= maxRegistrationMarkSize) {
+		return "", 0, fmt.Errorf("registrationMarkSize must be a number of mm greater than 0 and at most %g", maxRegistrationMarkSize)
+	}
+	return style, n, nil
+}
+
+// registrationStrokes returns the polylines making up the marks at the
+// four corners of b. Each arm of a mark is size mm long.
+func registrationStrokes(b bounds, style string, size float64) [][]point {
+	corners := []struct {
+		p      point
+		dx, dy float64 // direction away from the drawing
+	}{
+		{point{b.MinX, b.MinY}, -1, -1},
+		{point{b.MaxX, b.MinY}, 1, -1},
+		{point{b.MaxX, b.MaxY}, 1, 1},
+		{point{b.MinX, b.MaxY}, -1, 1},
+	}
+	var strokes [][]point
+	for _, c := range corners {
+		if style == RegistrationCorner {
+			strokes = append(strokes, []point{
+				{c.p.X + c.dx*size, c.p.Y},
+				c.p,
+				{c.p.X, c.p.Y + c.dy*size},
+			})
+			continue
+		}
+		half := size / 2
+		strokes = append(strokes,
+			[]point{{c.p.X - half, c.p.Y}, {c.p.X + half, c.p.Y}},
+			[]point{{c.p.X, c.p.Y - half}, {c.p.X, c.p.Y + half}},
+		)
+	}
+	return strokes
+}
+
+// registrationMoves renders strokes as G-Code. The tool is raised before
+// every travel and lowered only once the tool is over the start of a
+// stroke, so nothing is drawn between marks.
+func registrationMoves(strokes [][]point, toolOn, toolOff, feed string) []string {
+	lines := []string{"; registration marks"}
+	for _, s := range strokes {
+		if toolOff != "" {
+			lines = append(lines, toolOff)
+		}
+		lines = append(lines, fmt.Sprintf("G0 X%.3f Y%.3f", s[0].X, s[0].Y))
+		if toolOn != "" {
+			lines = append(lines, toolOn)
+		}
+		for i, p := range s[1:] {
+			line := fmt.Sprintf("G1 X%.3f Y%.3f", p.X, p.Y)
+			if i == 0 && feed != "" {
+				line += " F" + feed
+			}
+			lines = append(lines, line)
+		}
+	}
+	if toolOff != "" {
+		lines = append(lines, toolOff)
+	}
+	return append(lines, "; end registration marks")
+}
+
+// firstFeed returns the first feed rate set in lines, so marks drawn before
+// the program's own cuts move at the same speed
+func firstFeed(lines []string) string {
+	for _, l := range lines {
+		for _, w := range parseGCodeWords(l) {
+			if w.Letter == 'F' {
+				return strconv.FormatFloat(w.Value, 'f', -1, 64)
+			}
+		}
+	}
+	return ""
+}
+
+// registrationGCode prepends registration marks at the corners of the job's
+// cutting bounds. It returns the bounds the marks were placed around and
+// false if the program has no cutting moves.
+func registrationGCode(lines []string, style string, size float64, toolOn, toolOff string) ([]string, bounds, bool) {
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return lines, bounds{}, false
+	}
+	b, ok := movesBounds(moves, true)
+	if !ok {
+		return lines, b, false
+	}
+	marks := registrationMoves(registrationStrokes(b, style, size), toolOn, toolOff, firstFeed(lines))
+	return insertFrame(lines, marks), b, true
+}
@@ -0,0 +1,124 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Toolpath render size limits in pixels
+const (
+	defaultRenderSize = 800
+	maxRenderSize     = 4096
+)
+
+var (
+	renderCutColor    = color.RGBA{0, 0, 0, 255}
+	renderTravelColor = color.RGBA{200, 200, 200, 255}
+)
+
+// renderToolpath draws moves into a square image of the given size, fitting
+// the toolpath with a small margin. Travels are drawn first so cuts stay on top.
+func renderToolpath(moves []gcodeMove, size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	b, ok := movesBounds(moves, false)
+	if !ok {
+		return img
+	}
+	margin := float64(size) * 0.02
+	avail := float64(size) - 2*margin
+	scale := avail / math.Max(math.Max(b.Width(), b.Height()), 1e-9)
+	// Center the drawing and flip Y so machine +Y points up
+	offX := margin + (avail-b.Width()*scale)/2
+	offY := margin + (avail-b.Height()*scale)/2
+	toPixel := func(p point) (float64, float64) {
+		return offX + (p.X-b.MinX)*scale, float64(size) - (offY + (p.Y-b.MinY)*scale)
+	}
+
+	for _, pass := range []bool{false, true} {
+		c := renderTravelColor
+		if pass {
+			c = renderCutColor
+		}
+		for _, m := range moves {
+			if m.Cut != pass {
+				continue
+			}
+			x0, y0 := toPixel(m.From)
+			x1, y1 := toPixel(m.To)
+			drawLine(img, x0, y0, x1, y1, c)
+		}
+	}
+	return img
+}
+
+// drawLine rasterizes a one-pixel line between two points
+func drawLine(img *image.RGBA, x0, y0, x1, y1 float64, c color.RGBA) {
+	steps := int(math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0))))
+	if steps == 0 {
+		img.SetRGBA(int(x0), int(y0), c)
+		return
+	}
+	dx := (x1 - x0) / float64(steps)
+	dy := (y1 - y0) / float64(steps)
+	for k := 0; k <= steps; k++ {
+		img.SetRGBA(int(math.Round(x0+dx*float64(k))), int(math.Round(y0+dy*float64(k))), c)
+	}
+}
+
+// parseRenderSize reads the size query parameter for rendered images
+func parseRenderSize(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("size")
+	if v == "" {
+		return defaultRenderSize, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 16 || size > maxRenderSize {
+		return 0, fmt.Errorf("size must be an integer between 16 and %d", maxRenderSize)
+	}
+	return size, nil
+}
+
+// HandleToolpathPNG renders the job's G-code toolpath as a PNG image
+func (s *Server) HandleToolpathPNG(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists || s.jobStatus(job) != "done" || job.GCodePath == "" {
+		http.Error(w, "Toolpath not available", http.StatusNotFound)
+		return
+	}
+
+	size, err := parseRenderSize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	moves, err := readGCodeMoves(job.GCodePath)
+	if err != nil {
+		http.Error(w, "Failed to read G-Code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderToolpath(moves, size)); err != nil {
+		slog.Warn("encode toolpath png", "job", job.ID, "error", err)
+		http.Error(w, "Failed to render toolpath", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeContent(w, r, "", jobModTime(job), bytes.NewReader(buf.Bytes()))
+}
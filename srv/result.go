@@ -0,0 +1,147 @@
+package srv
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jobResultFile is written into every finished job's directory, so tools
+// that watch uploads/ can pick up results without calling the API
+const jobResultFile = "result.json"
+
+// jobResult is the content of result.json. Files maps each output that
+// exists to its name within the job directory.
+type jobResult struct {
+	JobID        string             `json:"jobId"`
+	Name         string             `json:"name,omitempty"`
+	OriginalName string             `json:"originalName"`
+	Status       string             `json:"status"`
+	Error        string             `json:"error,omitempty"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	FinishedAt   time.Time          `json:"finishedAt"`
+	Parameters   JobOptions         `json:"parameters"`
+	Dimensions   manifestDimensions `json:"dimensions"`
+	Moves        *resultMoves       `json:"moves,omitempty"`
+	AIImage      *manifestAIImage   `json:"aiImage,omitempty"`
+	Warnings     []string           `json:"warnings"`
+	Files        map[string]string  `json:"files"`
+}
+
+// resultMoves summarizes the final G-Code's motion
+type resultMoves struct {
+	Cuts           int     `json:"cuts"`
+	Travels        int     `json:"travels"`
+	CutLengthMm    float64 `json:"cutLengthMm"`
+	TravelLengthMm float64 `json:"travelLengthMm"`
+}
+
+// summarizeMoves counts cutting and travel moves and their lengths
+func summarizeMoves(moves []gcodeMove) *resultMoves {
+	r := &resultMoves{}
+	for _, m := range moves {
+		length := math.Hypot(m.To.X-m.From.X, m.To.Y-m.From.Y)
+		if m.Cut {
+			r.Cuts++
+			r.CutLengthMm += length
+		} else {
+			r.Travels++
+			r.TravelLengthMm += length
+		}
+	}
+	r.CutLengthMm = math.Round(r.CutLengthMm*1000) / 1000
+	r.TravelLengthMm = math.Round(r.TravelLengthMm*1000) / 1000
+	return r
+}
+
+// lastLogLine returns the last non-blank line of a job log. processJob
+// stops as soon as it logs an error, so for a failed job this is the error.
+func lastLogLine(log string) string {
+	lines := strings.Split(strings.TrimRight(log, "\n "), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func newJobResult(job *Job, status, name, jobDir string) *jobResult {
+	r := &jobResult{
+		JobID:        job.ID,
+		Name:         name,
+		OriginalName: job.OriginalName,
+		Status:       status,
+		CreatedAt:    job.CreatedAt,
+		FinishedAt:   time.Now().UTC(),
+		Parameters:   job.JobOptions,
+		Dimensions: manifestDimensions{
+			SVGWidthPx:   job.SVGWidth,
+			SVGHeightPx:  job.SVGHeight,
+			OutputWidth:  job.OutputWidth,
+			OutputHeight: job.OutputHeight,
+			DPI:          job.DPI,
+		},
+		Warnings: job.Warnings,
+		Files:    map[string]string{},
+	}
+	if r.Warnings == nil {
+		r.Warnings = []string{}
+	}
+	if status == "error" {
+		r.Error = lastLogLine(job.Log.String())
+	}
+	if job.AIImageFilename != "" {
+		r.AIImage = &manifestAIImage{Filename: job.AIImageFilename, Cached: job.AIImageCached}
+	}
+
+	for kind, path := range map[string]string{
+		"gcode":     job.GCodePath,
+		"baseGcode": job.BaseGCodePath,
+		"svg":       filepath.Join(jobDir, "output.svg"),
+		"rawSvg":    filepath.Join(jobDir, "output.raw.svg"),
+		"dxf":       job.DXFPath,
+		"hpgl":      job.HPGLPath,
+		"plotSvg":   job.PlotSVGPath,
+		"tiles":     job.TilesPath,
+	} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			r.Files[kind] = filepath.Base(path)
+		}
+	}
+	if job.Output != nil {
+		r.Moves = &job.Output.Moves
+	} else if job.GCodePath != "" {
+		if moves, err := readGCodeMoves(job.GCodePath); err == nil {
+			r.Moves = summarizeMoves(moves)
+		}
+	}
+	return r
+}
+
+// writeJobResult writes result.json for a job ending in status, under its
+// current name, into the job directory, replacing it atomically so a
+// watcher never reads a partial file
+func writeJobResult(job *Job, status, name, jobDir string) error {
+	data, err := json.MarshalIndent(newJobResult(job, status, name, jobDir), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(jobDir, "."+jobResultFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(jobDir, jobResultFile))
+}
@@ -0,0 +1,58 @@
+package srv
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DefaultMaxJobs bounds the jobs held in memory. Each retained job keeps
+// its full processing log, so an unbounded map grows with every upload.
+const DefaultMaxJobs = 1000
+
+// evictJobsLocked drops the oldest finished jobs until at most s.MaxJobs
+// remain, returning the IDs it removed. Jobs that are still processing or
+// waiting for an API key are never evicted, so the cap can be exceeded
+// while many jobs are in flight. s.mu must be held.
+func (s *Server) evictJobsLocked() []string {
+	if s.MaxJobs <= 0 || len(s.jobs) <= s.MaxJobs {
+		return nil
+	}
+	var finished []*Job
+	for _, job := range s.jobs {
+		if job.Status == "done" || job.Status == "error" {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreatedAt.Before(finished[j].CreatedAt)
+	})
+
+	var evicted []string
+	for _, job := range finished {
+		if len(s.jobs) <= s.MaxJobs {
+			break
+		}
+		delete(s.jobs, job.ID)
+		evicted = append(evicted, job.ID)
+	}
+	return evicted
+}
+
+// forgetJobs logs evicted jobs and, if EvictJobFiles is set, deletes their
+// upload directories and name links. It does file I/O, so call it without
+// s.mu held.
+func (s *Server) forgetJobs(ids []string) {
+	if s.EvictJobFiles && len(ids) > 0 {
+		s.unlinkJobNames(ids)
+	}
+	for _, id := range ids {
+		slog.Info("evicted job", "job", id, "maxJobs", s.MaxJobs, "filesRemoved", s.EvictJobFiles)
+		if s.EvictJobFiles {
+			if err := os.RemoveAll(filepath.Join(s.UploadsDir, id)); err != nil {
+				slog.Warn("remove evicted job files", "job", id, "error", err)
+			}
+		}
+	}
+}
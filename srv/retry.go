@@ -0,0 +1,59 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// DefaultToolRetryDelay is the wait before the first automatic retry of a
+// job whose tool crashed; each further retry waits twice as long
+const DefaultToolRetryDelay = 10 * time.Second
+
+// MaxToolRetries bounds -tool-retries so a crashing tool cannot keep a job
+// cycling for long
+const MaxToolRetries = 5
+
+// runToolRetry runs a requeued job once its delay has passed. Tests replace
+// it to run retries in the calling goroutine.
+var runToolRetry = func(delay time.Duration, retry func()) { time.AfterFunc(delay, retry) }
+
+// isTransientToolError reports whether a tool failure looks like the
+// machine's fault rather than the input's: the process was killed by a
+// signal (as the OOM killer does), exited with a shell-style signal status
+// above 128, or could not be started for lack of memory or processes. An
+// ordinary non-zero exit is how autotrace and svg2gcode reject bad input,
+// so retrying it would only fail again.
+func isTransientToolError(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return true
+		}
+		return exitErr.ExitCode() > 128
+	}
+	return errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.EAGAIN)
+}
+
+// scheduleToolRetry requeues a job that failed on a transient tool error,
+// if it has retries left, and reports whether it did. processJob asks
+// before publishing the failure, so the job stays "processing" while it
+// waits and picks up again from its original input.
+func (s *Server) scheduleToolRetry(job *Job, jobDir, inputPath, apiKey, aiPrompt string) bool {
+	if !job.toolCrashed || job.toolRetries >= s.ToolRetries {
+		return false
+	}
+	job.toolCrashed = false
+	job.toolRetries++
+	delay := s.ToolRetryDelay << (job.toolRetries - 1)
+	job.Log.WriteString(fmt.Sprintf("\n=== Tool crashed; retrying in %s (retry %d of %d) ===\n\n", delay, job.toolRetries, s.ToolRetries))
+	slog.Info("job requeued", "job", job.ID, "reason", "tool crash", "retry", job.toolRetries, "delay", delay)
+
+	runToolRetry(delay, func() {
+		s.processJob(job, jobDir, inputPath, apiKey, aiPrompt)
+	})
+	return true
+}
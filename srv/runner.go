@@ -0,0 +1,53 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// CommandRunner runs the external tools a job needs (autotrace and
+// svg2gcode). Tests substitute a fake so processJob can be exercised
+// without the tools installed.
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) (stdout, stderr []byte, err error)
+}
+
+// execRunner runs commands with os/exec
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) ([]byte, []byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// runTool runs an external tool through the server's CommandRunner,
+// copying the command line and its output into the job log. A failure is
+// recorded on the job as its ToolFailure.
+func (s *Server) runTool(job *Job, name string, args []string) error {
+	job.Log.WriteString(fmt.Sprintf("Command: %s\n\n", formatCommand(name, args)))
+
+	stdout, stderr, err := s.Runner.Run(context.Background(), name, args...)
+	if len(stdout) > 0 {
+		job.Log.WriteString("stdout:\n")
+		job.Log.WriteString(string(stdout))
+		job.Log.WriteString("\n")
+	}
+	if len(stderr) > 0 {
+		job.Log.WriteString("stderr:\n")
+		job.Log.WriteString(string(stderr))
+		job.Log.WriteString("\n")
+	}
+	job.ToolFailure = nil
+	if err != nil {
+		job.ToolFailure = newToolFailure(name, err)
+		job.toolCrashed = job.ToolFailure.Transient
+		job.Log.WriteString(job.ToolFailure.String() + "\n")
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// inlineSVGElements are the elements sanitizeSVG keeps. Anything else is
+// dropped with its content: <script> and <foreignObject> obviously, but also
+// animation elements, which can write a javascript: href, and any HTML
+// element name, which the browser's HTML parser would let break out of the
+// <svg> when the markup is inlined into a page.
+var inlineSVGElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "title": true, "desc": true, "symbol": true, "use": true,
+	"path": true, "rect": true, "circle": true, "ellipse": true, "line": true, "polyline": true, "polygon": true,
+	"text": true, "tspan": true, "textPath": true,
+	"clipPath": true, "mask": true, "marker": true, "pattern": true,
+	"linearGradient": true, "radialGradient": true, "stop": true,
+}
+
+// inlineSVGAttrPrefixes are the attribute namespaces sanitizeSVG keeps;
+// editor namespaces such as inkscape: are dropped along with their elements
+var inlineSVGAttrPrefixes = map[string]bool{"": true, "xmlns": true, "xml": true, "xlink": true}
+
+var (
+	svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	svgAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;")
+)
+
+// sanitizeSVG rewrites an SVG document so it is safe to inline into an HTML
+// page: only inlineSVGElements survive, event handler attributes (on*) are
+// removed, and href, src, and url() references must point inside the
+// document (#id). Comments, processing instructions, and doctypes are
+// dropped, and text is re-escaped, so nothing in the output can end the
+// <svg> early.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	var open []xml.Name // RawToken does not check that end tags match
+	skip := 0           // depth inside a dropped element
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse svg: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name)
+			if skip > 0 || t.Name.Space != "" || !inlineSVGElements[t.Name.Local] {
+				skip++
+				continue
+			}
+			out.WriteString("<" + t.Name.Local)
+			for _, attr := range t.Attr {
+				if !safeSVGAttr(attr) {
+					continue
+				}
+				name := attr.Name.Local
+				if attr.Name.Space != "" {
+					name = attr.Name.Space + ":" + name
+				}
+				out.WriteString(" " + name + `="` + svgAttrEscaper.Replace(attr.Value) + `"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return nil, fmt.Errorf("parse svg: unexpected end element </%s>", t.Name.Local)
+			}
+			open = open[:len(open)-1]
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out.WriteString("</" + t.Name.Local + ">")
+		case xml.CharData:
+			if skip == 0 && len(open) > 0 {
+				out.WriteString(svgTextEscaper.Replace(string(t)))
+			}
+		}
+	}
+	if len(open) != 0 {
+		return nil, fmt.Errorf("parse svg: unclosed element <%s>", open[len(open)-1].Local)
+	}
+	return out.Bytes(), nil
+}
+
+// safeSVGAttr reports whether sanitizeSVG keeps an attribute
+func safeSVGAttr(attr xml.Attr) bool {
+	if !inlineSVGAttrPrefixes[attr.Name.Space] || strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") {
+		return false
+	}
+	value := strings.ToLower(attr.Value)
+	switch strings.ToLower(attr.Name.Local) {
+	case "href", "src":
+		return strings.HasPrefix(strings.TrimSpace(attr.Value), "#")
+	}
+	// Presentation attributes and inline style may reference paint servers
+	// and clip paths with url(); only local ones are allowed
+	for rest := value; ; {
+		i := strings.Index(rest, "url(")
+		if i < 0 {
+			break
+		}
+		rest = strings.TrimLeft(rest[i+len("url("):], " \t\n\r\"'")
+		if !strings.HasPrefix(rest, "#") {
+			return false
+		}
+	}
+	return !strings.Contains(value, "javascript:") && !strings.Contains(value, "expression(") && !strings.Contains(value, "@import")
+}
+
+// readInlineSVG reads a job's SVG for embedding in a status page, sanitized
+// with sanitizeSVG. It returns "" if the file is missing or unparseable.
+func readInlineSVG(path string) template.HTML {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	clean, err := sanitizeSVG(data)
+	if err != nil {
+		slog.Warn("sanitize svg", "path", path, "error", err)
+		return ""
+	}
+	return template.HTML(clean)
+}
@@ -2,50 +2,272 @@ package srv
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"html/template"
+	"image"
 	"io"
 	"log/slog"
 	"mime"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Server struct {
-	Hostname     string
-	TemplatesDir string
-	StaticDir    string
-	UploadsDir   string
-	AICache      *AIImageCache
-
-	mu    sync.Mutex
-	jobs  map[string]*Job
+	Hostname              string
+	TemplatesDir          string
+	StaticDir             string
+	UploadsDir            string
+	WorkDir               string // Scratch space for intermediate files, cleaned after each job
+	AICache               *AIImageCache
+	TraceCache            *TraceCache
+	CacheTraces           bool // Reuse autotrace's SVG for an image traced before with the same arguments (see runAutotrace)
+	Shares                *ShareStore
+	AllowedTypes          []string             // Sniffed image MIME types accepted for upload; empty accepts any image
+	Runner                CommandRunner        // Runs autotrace and svg2gcode
+	ToolRetries           int                  // Automatic retries of a job after a tool crash; 0 disables
+	ToolRetryDelay        time.Duration        // Wait before the first retry, doubling for each one after
+	DefaultPrompt         string               // AI prompt used when a job gives none; DefaultAIPrompt unless overridden
+	CORSOrigins           []string             // Origins allowed to call /api routes cross-origin; "*" allows any
+	EmbedAncestors        []string             // Origins allowed to frame /embed and job pages besides this server; "*" allows any
+	Complexity            ComplexityThresholds // Soft limits that trigger a "large job" warning
+	KeepOut               []KeepOutRegion      // Areas cutting moves must not enter
+	KeepOutFail           bool                 // Fail jobs that enter a keep-out region instead of warning
+	Timeouts              HTTPTimeouts         // Connection timeouts used by Serve
+	DPI                   DPILimits            // Bounds on the DPI passed to svg2gcode
+	OutputSize            OutputSizeLimits     // Bounds max width and height are clamped to at upload
+	AdminToken            string               // Bearer token for /admin routes; empty disables them
+	MaxPromptLen          int                  // Longest accepted aiPrompt in characters
+	MaxUploadFiles        int                  // Most images accepted in one upload request
+	PublicURL             string               // Externally visible base URL, used in callback payloads
+	AllowPrivateCallbacks bool                 // Permit callbackURLs on private networks (disables the SSRF check)
+	NormalizeAIOutput     bool                 // Re-encode AI results as PNG before caching them
+	MaxAIConcurrent       int                  // Most Gemini calls in flight at once, across all jobs; 0 is unlimited
+	MaxJobs               int                  // Most jobs kept in memory before the oldest finished ones are evicted; 0 is unlimited
+	EvictJobFiles         bool                 // Also delete an evicted job's upload directory
+	RequireApproval       bool                 // Hold downloads until the job's preview is approved
+	NameLinks             bool                 // Link each job directory as uploads/by-name/<filename>-<id>
+	AIModalities          []string             // Gemini responseModalities, AIModalitiesTextImage or AIModalitiesImage
+	Alerts                FailureAlerts        // Where to report failed jobs; the zero value sends nothing
+	UploadDebounce        time.Duration        // Window in which an identical upload attaches to the processing job; 0 disables
+	MaxFeed               float64              // Ceiling in mm/min every job's feedrates are clamped to; 0 for none
+
+	shareSecret []byte        // Signs cookies for unlocked password-protected share links
+	aiSlots     chan struct{} // Holds a token per Gemini call in flight; nil when MaxAIConcurrent is 0
+	aiSlotsOnce sync.Once     // Sizes aiSlots from MaxAIConcurrent on first use
+	stats       serverStats   // Counters reported by GET /stats
+	alerts      alertState    // Debounces failure alerts
+
+	mu              sync.Mutex
+	jobs            map[string]*Job
+	idempotencyKeys map[string]idempotencyEntry
+	inFlight        map[string]inFlightEntry // Recent uploads by uploadFingerprint
 }
 
 type Job struct {
 	ID              string
-	Status          string // "processing", "done", "error"
-	Log             strings.Builder
+	Name            string // Optional friendly name chosen by the user; guarded by Server.mu once the job is registered (see jobName)
+	Status          string // "processing", "needs-api-key", "done", "error"
+	Log             jobLog
 	GCodePath       string
+	BaseGCodePath   string // svg2gcode's or the builtin engine's output before any post-processing
 	OriginalName    string
 	CreatedAt       time.Time
-	MaxWidth        float64
-	MaxHeight       float64
-	ToolOn          string
-	ToolOff         string
-	UseAI           bool
 	AIImageFilename string // Filename of AI-generated image in cache
 	AIImageCached   bool   // Whether the AI image was served from cache
+	AIText          string // Text Gemini returned with the image, when text was requested
+	DXFPath         string
+	HPGLPath        string
+	PlotSVGPath     string
+	TilesPath       string // ZIP of one program per tile, when TileGrid split the input
+	Approved        bool   // Preview reviewed and accepted; gates downloads when Server.RequireApproval is set
+
+	JobOptions
+
+	// Computed during processing
+	SVGWidth     float64 // Traced SVG size in pixels
+	SVGHeight    float64
+	OutputWidth  float64 // Final output size in mm
+	OutputHeight float64
+	DPI          float64
+	ImageDPI     float64 // Horizontal resolution declared by the input, when UseImageDPI found one
+	Rotated      bool    // AutoOrient turned the design 90° clockwise to fit the bed
+
+	DimensionsDefaulted bool         // SVG size was unknown and defaultSVGDimension was assumed
+	Warnings            []string     // Problems the user should see on the status page; appended under warnMu
+	ToolFailure         *toolFailure // How the last external tool run failed, if it did
+
+	TracePaths  int            // Paths in the last trace, before any filtering
+	TraceColors []strokeCount  // The last trace's paths by stroke color, most common first
+	Output      *outputMetrics // Measurements of the finished program
+	FinishedAt  time.Time      // When the job became "done"
+	finishedLog string         // The log as it stood at FinishedAt, so the bundle stays byte-for-byte stable
+
+	paused *pausedJob // Set while Status is "needs-api-key"; guarded by Server.mu
+	warnMu sync.Mutex // Guards Warnings, which are read while the job is still processing
+
+	callback   *callbackDelivery // Set once the job's callback is due; guarded by callbackMu
+	callbackMu sync.Mutex
+
+	toolCrashed bool // The last tool failure was transient (see isTransientToolError)
+	toolRetries int  // Automatic retries used after tool crashes
+}
+
+// pausedJob holds what processJob needs to resume a job that is waiting for
+// an API key. The key itself is never stored.
+type pausedJob struct {
+	inputPath string
+	aiPrompt  string
+}
+
+// warn records a warning prominently in the job log and on the status page
+func (j *Job) warn(msg string) {
+	j.warnMu.Lock()
+	j.Warnings = append(j.Warnings, msg)
+	j.warnMu.Unlock()
+	j.Log.WriteString("\n*** WARNING: " + msg + " ***\n\n")
+}
+
+// warnOnce is warn for a problem that several steps may find, such as
+// one in an SVG that every tile program is made from
+func (j *Job) warnOnce(msg string) {
+	j.warnMu.Lock()
+	seen := slices.Contains(j.Warnings, msg)
+	j.warnMu.Unlock()
+	if !seen {
+		j.warn(msg)
+	}
+}
+
+// warnings returns a copy of the job's warnings so far
+func (j *Job) warnings() []string {
+	j.warnMu.Lock()
+	defer j.warnMu.Unlock()
+	return append([]string{}, j.Warnings...)
+}
+
+// JobOptions holds the processing parameters chosen at upload time
+type JobOptions struct {
+	MaxWidth             float64     `json:"maxWidth"`
+	MaxHeight            float64     `json:"maxHeight"`
+	ToolOn               string      `json:"toolOn"`
+	ToolOff              string      `json:"toolOff"`
+	UseAI                bool        `json:"useAI"`
+	AIPrompt             string      `json:"aiPrompt,omitempty"`             // Instructions for Gemini; the server's DefaultPrompt unless the upload gave one
+	AIRefinePrompts      []string    `json:"aiRefinePrompts,omitempty"`      // Further prompts run in turn on the AI output, one Gemini call each
+	Formats              []string    `json:"formats"`                        // Extra output formats requested (e.g. "dxf")
+	Background           string      `json:"background"`                     // BackgroundWhite or BackgroundBlack; sets the AI prompt's colors, the default flattenBackground, and which paths the white filter takes
+	FlattenBackground    string      `json:"flattenBackground"`              // Hex color (RRGGBB) transparent pixels are composited onto before tracing
+	BackgroundColor      string      `json:"backgroundColor,omitempty"`      // Hex color autotrace treats as background (RRGGBB), empty for autotrace's default
+	WhiteAction          string      `json:"whiteAction"`                    // What to do with near-white paths: WhiteActionRemove, WhiteActionRecolorBlack, or WhiteActionKeep
+	WhiteThreshold       int         `json:"whiteThreshold,omitempty"`       // A path is near-white when every RGB channel of its stroke is above this
+	GCodeFlavor          string      `json:"gcodeFlavor,omitempty"`          // Firmware conventions to apply (see gcodeFlavors), empty for svg2gcode's raw output
+	GCodeHome            bool        `json:"gcodeHome,omitempty"`            // Prepend the flavor's homing command
+	FeedUnits            string      `json:"feedUnits,omitempty"`            // Unit to write F words in (see feedUnitFactors), empty for the flavor's own
+	MachineSetup         bool        `json:"machineSetup,omitempty"`         // Start the program with the startup sequence below (see machineSetupLines)
+	SetupHome            string      `json:"setupHome,omitempty"`            // "cycle" for the controller's homing cycle, "g28" for G28, empty for none
+	SetupWorkOffset      string      `json:"setupWorkOffset,omitempty"`      // Work coordinate system to select, such as G54
+	SetupAbsolute        bool        `json:"setupAbsolute,omitempty"`        // Set mm units, absolute positioning, and the flavor's other modes
+	FrameFirst           bool        `json:"frameFirst,omitempty"`           // Trace the bounding box with the tool up before drawing
+	RegistrationMarks    string      `json:"registrationMarks,omitempty"`    // Draw "cross" or "corner" marks at the bounding-box corners
+	RegistrationMarkSize float64     `json:"registrationMarkSize,omitempty"` // Arm length of each registration mark in mm
+	QRCode               bool        `json:"qrCode,omitempty"`               // Draw a QR code of a share link to the job beside the design
+	QRCodeCorner         string      `json:"qrCodeCorner,omitempty"`         // Corner of the design the QR code sits beside
+	QRCodeSize           float64     `json:"qrCodeSize,omitempty"`           // Side of the QR code in mm, quiet zone not included
+	QRCodeStyle          string      `json:"qrCodeStyle,omitempty"`          // How dark modules are drawn: QRStyleHatch or QRStyleOutline
+	LeadIn               float64     `json:"leadIn,omitempty"`               // Start each pen-down stroke this many mm early, for pens slow to settle
+	LeadOut              float64     `json:"leadOut,omitempty"`              // End each pen-down stroke this many mm early, for pens slow to lift
+	Overcut              float64     `json:"overcut,omitempty"`              // Retrace each closed stroke this many mm past its closing point, for clean seams
+	StripComments        bool        `json:"stripComments,omitempty"`        // Remove comments and blank lines from the final G-code
+	Deskew               bool        `json:"deskew,omitempty"`               // Straighten a scan turned slightly on the scanner bed before tracing
+	DeskewAngle          float64     `json:"deskewAngle,omitempty"`          // Skew to correct in degrees clockwise; 0 detects it
+	AutoLevels           bool        `json:"autoLevels,omitempty"`           // Stretch each channel's histogram to full range before tracing
+	NormalizeInput       bool        `json:"normalizeInput,omitempty"`       // Flatten alpha onto white and hand autotrace a PPM
+	AutoRetryEmpty       bool        `json:"autoRetryEmpty,omitempty"`       // Retry an empty trace with relaxed settings (see emptyTraceRetries)
+	UseImageDPI          bool        `json:"useImageDPI,omitempty"`          // Size the output from the input's DPI metadata, within the max box
+	AutoOrient           bool        `json:"autoOrient,omitempty"`           // Turn the design 90° when that fits the max box better
+	MinStrokeWidth       float64     `json:"minStrokeWidth,omitempty"`       // Drop traced paths with a thinner stroke, in SVG pixels
+	MinPathLength        float64     `json:"minPathLength,omitempty"`        // Drop traced paths shorter than this, in SVG pixels
+	JoinGap              float64     `json:"joinGap,omitempty"`              // Join paths whose endpoints are this close, in SVG pixels
+	Frame                int         `json:"frame,omitempty"`                // Frame of an animated GIF to trace, from 0
+	CallbackURL          string      `json:"callbackURL,omitempty"`          // URL POSTed with the job's final state
+	AutotraceArgs        []string    `json:"autotraceArgs,omitempty"`        // Extra autotrace options, validated against autotraceExtraOptions
+	Svg2gcodeArgs        []string    `json:"svg2gcodeArgs,omitempty"`        // Extra svg2gcode options, validated against svg2gcodeExtraOptions
+	Engine               string      `json:"engine,omitempty"`               // EngineSvg2gcode or EngineBuiltin, which writes the G-Code in process
+	CurveTolerance       float64     `json:"curveTolerance,omitempty"`       // mm the builtin engine's flattened curves may stray from the SVG's
+	Feedrate             float64     `json:"feedrate,omitempty"`             // mm/min the builtin engine cuts at
+	ToolClasses          []toolClass `json:"toolClasses,omitempty"`          // Per stroke color/width tool settings, e.g. laser cut vs score
+	FitArcs              bool        `json:"fitArcs,omitempty"`              // Replace runs of short cuts along a circle with G2/G3 (see fitArcs)
+	ArcTolerance         float64     `json:"arcTolerance,omitempty"`         // Largest distance in mm an arc may stray from the cuts it replaces
+	MinArcRadius         float64     `json:"minArcRadius,omitempty"`         // Arcs tighter than this many mm are kept as lines
+	MergeCollinear       bool        `json:"mergeCollinear,omitempty"`       // Merge runs of cuts heading the same way into one (see mergeCollinear)
+	MergeAngle           float64     `json:"mergeAngle,omitempty"`           // Largest turn in degrees between cuts that are merged
+	AdaptiveFeed         bool        `json:"adaptiveFeed,omitempty"`         // Slow cuts around sharp turns (see adaptFeedrates)
+	MinFeed              float64     `json:"minFeed,omitempty"`              // Feed in mm/min for the sharpest turns
+	MaxFeed              float64     `json:"maxFeed,omitempty"`              // Clamp every F word in the output to this many mm/min, with Server.MaxFeed as a ceiling
+	CurvatureThreshold   float64     `json:"curvatureThreshold,omitempty"`   // Turn angle in degrees above which cuts slow down
+	CheckOverlaps        bool        `json:"checkOverlaps,omitempty"`        // Log self-intersecting paths and strokes drawn twice
+	RemoveDuplicates     bool        `json:"removeDuplicates,omitempty"`     // Also remove segments that exactly repeat an earlier one
+	Fill                 bool        `json:"fill,omitempty"`                 // Hatch the inside of closed paths
+	FillAngle            float64     `json:"fillAngle,omitempty"`            // Hatch direction in degrees counterclockwise from the X axis
+	FillSpacing          float64     `json:"fillSpacing,omitempty"`          // Distance between hatch lines in mm
+	ContourOrder         string      `json:"contourOrder,omitempty"`         // "inside-out" or "outside-in" to cut by nesting depth, empty for document order
+	PadToBed             bool        `json:"padToBed,omitempty"`             // Center the design on the max box and use the box's corner as origin
+	TileGrid             string      `json:"tileGrid,omitempty"`             // ROWSxCOLS grid the input is split into and traced a tile at a time
+}
+
+// supportedFormats lists the optional output formats beyond G-code
+var supportedFormats = map[string]bool{
+	"dxf":     true,
+	"hpgl":    true,
+	"plotsvg": true,
+}
+
+// parseFormats reads the requested extra output formats. Values may be
+// repeated form fields or a single comma-separated list.
+func parseFormats(values []string) ([]string, error) {
+	formats := []string{}
+	seen := make(map[string]bool)
+	for _, v := range values {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.ToLower(strings.TrimSpace(f))
+			if f == "" || seen[f] {
+				continue
+			}
+			if !supportedFormats[f] {
+				return nil, fmt.Errorf("unsupported output format %q", f)
+			}
+			seen[f] = true
+			formats = append(formats, f)
+		}
+	}
+	return formats, nil
+}
+
+// WantsFormat reports whether the job requested the given extra output format
+func (j *Job) WantsFormat(format string) bool {
+	for _, f := range j.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
 }
 
 func New(hostname string) (*Server, error) {
@@ -69,42 +291,141 @@ func New(hostname string) (*Server, error) {
 		return nil, fmt.Errorf("init AI cache: %w", err)
 	}
 
+	traceCache, err := NewTraceCache(aiCache.db, filepath.Join(baseDir, "trace_cache"))
+	if err != nil {
+		return nil, fmt.Errorf("init trace cache: %w", err)
+	}
+
+	shares, err := NewShareStore(aiCache.db)
+	if err != nil {
+		return nil, fmt.Errorf("init share links: %w", err)
+	}
+	shareSecret := make([]byte, 32)
+	if _, err := rand.Read(shareSecret); err != nil {
+		return nil, fmt.Errorf("generate share secret: %w", err)
+	}
+
 	templatesDir := os.Getenv("TEMPLATES_DIR")
 	if templatesDir == "" {
 		templatesDir = filepath.Join(baseDir, "srv", "templates")
 	}
+	workDir := os.Getenv("WORK_DIR")
+	if workDir == "" {
+		workDir = filepath.Join(os.TempDir(), "bitmap-to-gcode")
+	}
+
 	staticDir := os.Getenv("STATIC_DIR")
 	if staticDir == "" {
 		staticDir = filepath.Join(baseDir, "srv", "static")
 	}
+	defaultPrompt := strings.TrimSpace(os.Getenv("DEFAULT_AI_PROMPT"))
+	if defaultPrompt == "" {
+		defaultPrompt = DefaultAIPrompt
+	}
 	srv := &Server{
-		Hostname:     hostname,
-		TemplatesDir: templatesDir,
-		StaticDir:    staticDir,
-		UploadsDir:   uploadsDir,
-		AICache:      aiCache,
-		jobs:         make(map[string]*Job),
+		Hostname:          hostname,
+		Runner:            execRunner{},
+		ToolRetryDelay:    DefaultToolRetryDelay,
+		DefaultPrompt:     defaultPrompt,
+		TemplatesDir:      templatesDir,
+		StaticDir:         staticDir,
+		UploadsDir:        uploadsDir,
+		WorkDir:           workDir,
+		AICache:           aiCache,
+		TraceCache:        traceCache,
+		Shares:            shares,
+		shareSecret:       shareSecret,
+		Complexity:        DefaultComplexityThresholds,
+		Timeouts:          DefaultHTTPTimeouts,
+		DPI:               DefaultDPILimits,
+		OutputSize:        DefaultOutputSizeLimits,
+		MaxPromptLen:      DefaultMaxPromptLen,
+		MaxUploadFiles:    DefaultMaxUploadFiles,
+		MaxJobs:           DefaultMaxJobs,
+		PublicURL:         "http://" + hostname,
+		NormalizeAIOutput: true,
+		MaxAIConcurrent:   DefaultMaxAIConcurrent,
+		AIModalities:      AIModalitiesTextImage,
+		Alerts:            FailureAlerts{Debounce: DefaultAlertDebounce},
+		stats:             serverStats{started: time.Now()},
+		jobs:              make(map[string]*Job),
+		idempotencyKeys:   make(map[string]idempotencyEntry),
+		inFlight:          make(map[string]inFlightEntry),
+		UploadDebounce:    DefaultUploadDebounce,
 	}
 	return srv, nil
 }
 
 func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
+	// A fromJob link from a job page starts the form copying that job
+	fromJob, fromJobLabel := parseFromJob(r.URL.Query().Get("fromJob")), ""
+	if fromJob != "" {
+		s.mu.Lock()
+		if job, exists := s.jobs[fromJob]; exists {
+			fromJobLabel = cmp.Or(job.Name, job.OriginalName, job.ID)
+		} else {
+			fromJob = ""
+		}
+		s.mu.Unlock()
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := s.renderTemplate(w, "index.html", map[string]interface{}{
-		"Hostname": s.Hostname,
+		"Hostname":      s.Hostname,
+		"MaxPromptLen":  s.MaxPromptLen,
+		"DefaultPrompt": s.DefaultPrompt,
+		"FromJob":       fromJob,
+		"FromJobLabel":  fromJobLabel,
 	}); err != nil {
 		slog.Warn("render template", "url", r.URL.Path, "error", err)
 	}
 }
 
 func (s *Server) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	job, status, err := s.startJob(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Redirect to job status page
+	http.Redirect(w, r, "/job/"+job.ID, http.StatusSeeOther)
+}
+
+// startJob parses an upload request, saves the input image, and starts
+// processing in the background. It returns http.StatusAccepted for a new job,
+// http.StatusOK when an Idempotency-Key or an identical upload still
+// processing matched an existing job, or the error status to report.
+func (s *Server) startJob(r *http.Request) (*Job, int, error) {
+	// A retried request with the same key gets the original job back
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if err := validateIdempotencyKey(idempotencyKey); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	s.mu.Lock()
+	existing := s.idempotentJobLocked(idempotencyKey)
+	s.mu.Unlock()
+	if existing != nil {
+		return existing, http.StatusOK, nil
+	}
+
 	// Max 50MB
-	r.ParseMultipartForm(50 << 20)
+	r.ParseMultipartForm(maxUploadBytes)
+
+	if err := s.validateUploadFiles(r.MultipartForm); err != nil {
+		var ue *uploadError
+		if errors.As(err, &ue) {
+			return nil, ue.status, err
+		}
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := s.copyJobSettings(r); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
 
 	file, header, err := r.FormFile("image")
 	if err != nil {
-		http.Error(w, "Failed to read uploaded file: "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest, fmt.Errorf("Failed to read uploaded file: %w", err)
 	}
 	defer file.Close()
 
@@ -121,31 +442,218 @@ func (s *Server) HandleUpload(w http.ResponseWriter, r *http.Request) {
 			maxHeight = v
 		}
 	}
+	// Out-of-range sizes are usually untouched defaults or typos, so they
+	// are clamped with a warning on the job rather than refused
+	var sizeWarnings []string
+	for _, d := range []struct {
+		name string
+		v    *float64
+	}{{"width", &maxWidth}, {"height", &maxHeight}} {
+		if clamped := s.OutputSize.clamp(*d.v); clamped != *d.v {
+			sizeWarnings = append(sizeWarnings, fmt.Sprintf("The requested max %s of %g mm is outside the allowed range of %s mm, so %g mm was used instead.",
+				d.name, *d.v, s.OutputSize, clamped))
+			*d.v = clamped
+		}
+	}
 
 	// Parse tool control options
 	toolOn := r.FormValue("toolOn")
 	if toolOn == "" {
-		toolOn = "S4 M0"
+		toolOn = defaultToolOn
 	}
 	toolOff := r.FormValue("toolOff")
 	if toolOff == "" {
-		toolOff = "S4 M100"
+		toolOff = defaultToolOff
 	}
 
 	// Parse AI transformation options
 	useAI := r.FormValue("useAI") == "on" || r.FormValue("useAI") == "true"
 	apiKey := r.FormValue("apiKey") // Never log this!
-	aiPrompt := r.FormValue("aiPrompt")
+	aiPrompt, err := parseAIPrompt(r.FormValue("aiPrompt"), s.MaxPromptLen)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
 	if aiPrompt == "" {
-		aiPrompt = DefaultAIPrompt
+		aiPrompt = s.DefaultPrompt
+	}
+	aiRefinePrompts, err := parseAIRefinePrompts(r.Form["aiRefinePrompts"], s.MaxPromptLen)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	formats, err := parseFormats(r.Form["formats"])
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	backgroundColor, err := parseHexColor(r.FormValue("backgroundColor"))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid backgroundColor: %w", err)
+	}
+
+	background, err := parseBackground(r.FormValue("background"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	flattenBackground, err := parseHexColor(r.FormValue("flattenBackground"))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid flattenBackground: %w", err)
+	}
+	if flattenBackground == "" {
+		flattenBackground = backgroundFlatten(background)
+	}
+
+	whiteThreshold, err := parseWhiteThreshold(r.FormValue("whiteThreshold"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	whiteAction, err := parseWhiteAction(r.FormValue("whiteAction"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	minStrokeWidth, err := parseSVGDistance("minStrokeWidth", r.FormValue("minStrokeWidth"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	minPathLength, err := parseSVGDistance("minPathLength", r.FormValue("minPathLength"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	joinGap, err := parseSVGDistance("joinGap", r.FormValue("joinGap"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	removeDuplicates := r.FormValue("removeDuplicates") == "on" || r.FormValue("removeDuplicates") == "true"
+	checkOverlaps := removeDuplicates || r.FormValue("checkOverlaps") == "on" || r.FormValue("checkOverlaps") == "true"
+	contourOrder, err := parseContourOrder(r.FormValue("contourOrder"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	fill := r.FormValue("fill") == "on" || r.FormValue("fill") == "true"
+	fillAngle, fillSpacing, err := parseFill(fill, r.FormValue("fillAngle"), r.FormValue("fillSpacing"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	gcodeFlavor := strings.ToLower(r.FormValue("gcodeFlavor"))
+	gcodeHome := r.FormValue("gcodeHome") == "on" || r.FormValue("gcodeHome") == "true"
+	if err := validateGCodeFlavor(gcodeFlavor, gcodeHome); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	feedUnits, err := parseFeedUnits(r.FormValue("feedUnits"), gcodeFlavor)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	machineSetupOn := r.FormValue("machineSetup") == "on" || r.FormValue("machineSetup") == "true"
+	setup, err := parseMachineSetup(machineSetupOn, gcodeFlavor, gcodeHome, r.FormValue("setupHome"), r.FormValue("setupWorkOffset"), r.FormValue("setupAbsolute"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	frameFirst := r.FormValue("frameFirst") == "on" || r.FormValue("frameFirst") == "true"
+	tileGrid, err := parseTileGrid(r.FormValue("tileGrid"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	stripComments := r.FormValue("stripComments") == "on" || r.FormValue("stripComments") == "true"
+	registrationMarks, registrationMarkSize, err := parseRegistrationMarks(r.FormValue("registrationMarks"), r.FormValue("registrationMarkSize"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	qrCode := r.FormValue("qrCode") == "on" || r.FormValue("qrCode") == "true"
+	qrCodeCorner, qrCodeSize, qrCodeStyle, err := parseQRCode(qrCode, r.FormValue("qrCodeCorner"), r.FormValue("qrCodeSize"), r.FormValue("qrCodeStyle"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	leadIn, err := parseLead("leadIn", r.FormValue("leadIn"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	leadOut, err := parseLead("leadOut", r.FormValue("leadOut"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	overcut, err := parseOvercut(r.FormValue("overcut"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	deskewAngle, err := parseDeskewAngle(r.FormValue("deskewAngle"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	deskew := deskewAngle != 0 || r.FormValue("deskew") == "on" || r.FormValue("deskew") == "true"
+	autoLevels := r.FormValue("autoLevels") == "on" || r.FormValue("autoLevels") == "true"
+	normalizeInput := r.FormValue("normalizeInput") == "on" || r.FormValue("normalizeInput") == "true"
+	autoRetryEmpty := r.FormValue("autoRetryEmpty") == "on" || r.FormValue("autoRetryEmpty") == "true"
+	useImageDPI := r.FormValue("useImageDPI") == "on" || r.FormValue("useImageDPI") == "true"
+	autoOrient := r.FormValue("autoOrient") == "on" || r.FormValue("autoOrient") == "true"
+
+	frame, err := parseFrame(r.FormValue("frame"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	name, err := parseJobName(r.FormValue("name"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	callbackURL := strings.TrimSpace(r.FormValue("callbackURL"))
+	if callbackURL != "" {
+		if err := s.validateCallbackURL(callbackURL); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	extraAutotraceArgs, err := parseExtraArgs("autotraceArgs", r.FormValue("autotraceArgs"), autotraceExtraOptions)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	extraSvg2gcodeArgs, err := parseExtraArgs("svg2gcodeArgs", r.FormValue("svg2gcodeArgs"), svg2gcodeExtraOptions)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	engine, curveTolerance, feedrate, err := parseEngine(r.FormValue("engine"), r.FormValue("curveTolerance"), r.FormValue("feedrate"), extraSvg2gcodeArgs)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	toolClasses, err := parseToolClasses(r.FormValue("toolClasses"), toolOff)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	for _, c := range toolClasses {
+		if c.Feed > 0 && slices.Contains(extraSvg2gcodeArgs, "--feedrate") {
+			return nil, http.StatusBadRequest, fmt.Errorf("toolClasses feeds cannot be combined with --feedrate in svg2gcodeArgs")
+		}
+	}
+	fitArcs := r.FormValue("fitArcs") == "on" || r.FormValue("fitArcs") == "true"
+	arcTolerance, minArcRadius, err := parseArcFit(fitArcs, r.FormValue("arcTolerance"), r.FormValue("minArcRadius"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	mergeCollinear := r.FormValue("mergeCollinear") == "on" || r.FormValue("mergeCollinear") == "true"
+	mergeAngle, err := parseMergeCollinear(mergeCollinear, r.FormValue("mergeAngle"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	adaptiveFeed := r.FormValue("adaptiveFeed") == "on" || r.FormValue("adaptiveFeed") == "true"
+	padToBed := r.FormValue("padToBed") == "on" || r.FormValue("padToBed") == "true"
+	minFeed, curvatureThreshold, err := parseAdaptiveFeed(adaptiveFeed, r.FormValue("minFeed"), r.FormValue("curvatureThreshold"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	maxFeed, err := parseMaxFeed(r.FormValue("maxFeed"), s.MaxFeed)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
 	}
 
-	// Generate job ID
-	jobID := fmt.Sprintf("%d", time.Now().UnixNano())
+	jobID, err := newJobID()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to generate job ID: %w", err)
+	}
 	jobDir := filepath.Join(s.UploadsDir, jobID)
 	if err := os.MkdirAll(jobDir, 0755); err != nil {
-		http.Error(w, "Failed to create job directory: "+err.Error(), http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to create job directory: %w", err)
 	}
 
 	// Save uploaded file
@@ -153,160 +661,525 @@ func (s *Server) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	inputPath := filepath.Join(jobDir, "input"+ext)
 	dst, err := os.Create(inputPath)
 	if err != nil {
-		http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to save file: %w", err)
 	}
 	if _, err := io.Copy(dst, file); err != nil {
 		dst.Close()
-		http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to save file: %w", err)
 	}
 	dst.Close()
 
 	// Create job
 	job := &Job{
 		ID:           jobID,
+		Name:         name,
 		Status:       "processing",
 		OriginalName: header.Filename,
 		CreatedAt:    time.Now(),
-		MaxWidth:     maxWidth,
-		MaxHeight:    maxHeight,
-		ToolOn:       toolOn,
-		ToolOff:      toolOff,
-		UseAI:        useAI,
+		JobOptions: JobOptions{
+			MaxWidth:             maxWidth,
+			MaxHeight:            maxHeight,
+			ToolOn:               toolOn,
+			ToolOff:              toolOff,
+			UseAI:                useAI,
+			AIPrompt:             aiPrompt,
+			AIRefinePrompts:      aiRefinePrompts,
+			Formats:              formats,
+			Background:           background,
+			FlattenBackground:    flattenBackground,
+			BackgroundColor:      backgroundColor,
+			WhiteAction:          whiteAction,
+			WhiteThreshold:       whiteThreshold,
+			GCodeFlavor:          gcodeFlavor,
+			GCodeHome:            gcodeHome,
+			FeedUnits:            feedUnits,
+			MachineSetup:         machineSetupOn,
+			SetupHome:            setup.Home,
+			SetupWorkOffset:      setup.WorkOffset,
+			SetupAbsolute:        setup.Absolute,
+			FrameFirst:           frameFirst,
+			RegistrationMarks:    registrationMarks,
+			RegistrationMarkSize: registrationMarkSize,
+			QRCode:               qrCode,
+			QRCodeCorner:         qrCodeCorner,
+			QRCodeSize:           qrCodeSize,
+			QRCodeStyle:          qrCodeStyle,
+			LeadIn:               leadIn,
+			LeadOut:              leadOut,
+			Overcut:              overcut,
+			StripComments:        stripComments,
+			Deskew:               deskew,
+			DeskewAngle:          deskewAngle,
+			AutoLevels:           autoLevels,
+			NormalizeInput:       normalizeInput,
+			AutoRetryEmpty:       autoRetryEmpty,
+			UseImageDPI:          useImageDPI,
+			AutoOrient:           autoOrient,
+			MinStrokeWidth:       minStrokeWidth,
+			MinPathLength:        minPathLength,
+			JoinGap:              joinGap,
+			CheckOverlaps:        checkOverlaps,
+			RemoveDuplicates:     removeDuplicates,
+			Fill:                 fill,
+			FillAngle:            fillAngle,
+			FillSpacing:          fillSpacing,
+			ContourOrder:         contourOrder,
+			Frame:                frame,
+			CallbackURL:          callbackURL,
+			AutotraceArgs:        extraAutotraceArgs,
+			Svg2gcodeArgs:        extraSvg2gcodeArgs,
+			Engine:               engine,
+			CurveTolerance:       curveTolerance,
+			Feedrate:             feedrate,
+			ToolClasses:          toolClasses,
+			FitArcs:              fitArcs,
+			ArcTolerance:         arcTolerance,
+			MinArcRadius:         minArcRadius,
+			MergeCollinear:       mergeCollinear,
+			MergeAngle:           mergeAngle,
+			AdaptiveFeed:         adaptiveFeed,
+			PadToBed:             padToBed,
+			TileGrid:             tileGrid,
+			MinFeed:              minFeed,
+			MaxFeed:              maxFeed,
+			CurvatureThreshold:   curvatureThreshold,
+		},
+	}
+
+	for _, w := range sizeWarnings {
+		job.warn(w)
+	}
+
+	// A repeat of an upload still processing, such as a double-clicked
+	// submit, attaches to that job rather than tracing the image twice
+	var fingerprint string
+	if s.UploadDebounce > 0 {
+		if fingerprint, err = uploadFingerprint(inputPath, job.Name, job.JobOptions); err != nil {
+			slog.Warn("fingerprint upload", "job", jobID, "error", err)
+		}
 	}
 
 	s.mu.Lock()
+	// A concurrent retry may have registered the key while we saved the upload
+	if existing := s.idempotentJobLocked(idempotencyKey); existing != nil {
+		s.mu.Unlock()
+		os.RemoveAll(jobDir)
+		return existing, http.StatusOK, nil
+	}
+	if existing := s.inFlightJobLocked(fingerprint); existing != nil {
+		s.rememberIdempotencyKeyLocked(idempotencyKey, existing.ID)
+		s.mu.Unlock()
+		os.RemoveAll(jobDir)
+		slog.Info("duplicate upload attached", "job", existing.ID, "file", header.Filename)
+		return existing, http.StatusOK, nil
+	}
 	s.jobs[jobID] = job
+	s.rememberIdempotencyKeyLocked(idempotencyKey, jobID)
+	s.rememberInFlightLocked(fingerprint, jobID)
+	evicted := s.evictJobsLocked()
 	s.mu.Unlock()
+	s.stats.jobCreated()
+	s.forgetJobs(evicted)
+	if s.NameLinks {
+		if name, err := s.linkJobName(jobID, header.Filename); err != nil {
+			slog.Warn("link job name", "job", jobID, "error", err)
+		} else {
+			job.Log.WriteString(fmt.Sprintf("Job directory linked as %s/%s\n\n", nameLinksDir, name))
+		}
+	}
 
 	// Process in background (pass apiKey and prompt directly, do not store)
 	go s.processJob(job, jobDir, inputPath, apiKey, aiPrompt)
 
-	// Redirect to job status page
-	http.Redirect(w, r, "/job/"+jobID, http.StatusSeeOther)
+	return job, http.StatusAccepted, nil
 }
 
 func (s *Server) processJob(job *Job, jobDir, inputPath, apiKey, aiPrompt string) {
-	svgPath := filepath.Join(jobDir, "output.svg")
-	gcodePath := filepath.Join(jobDir, "output.gcode")
-
-	// If AI transformation is enabled, run it first
-	if job.UseAI {
-		job.Log.WriteString("=== Running AI Image Transformation ===\n")
+	start := time.Now()
+	slog.Info("job started", "job", job.ID, "file", job.OriginalName, "ai", job.UseAI)
+	status := s.runJob(job, jobDir, inputPath, apiKey, aiPrompt)
+	if status == "needs-api-key" {
+		s.mu.Lock()
+		job.paused = &pausedJob{inputPath: inputPath, aiPrompt: aiPrompt}
+		job.Status = status
+		s.mu.Unlock()
+		slog.Info("job paused", "job", job.ID, "reason", "no API key", "duration", time.Since(start))
+		return
+	}
+	// The retry is decided before the status is published, so a job about
+	// to run again stays "processing" for pollers, eviction, and deletes
+	if status == "error" && s.scheduleToolRetry(job, jobDir, inputPath, apiKey, aiPrompt) {
+		return
+	}
+	if err := writeJobResult(job, status, s.jobName(job), jobDir); err != nil {
+		slog.Warn("write job result", "job", job.ID, "error", err)
+	}
+	if job.CallbackURL != "" {
+		job.setCallback(callbackDelivery{State: "pending"})
+	}
+	s.setJobStatus(job, status)
+	slog.Info("job finished", "job", job.ID, "status", status, "duration", time.Since(start))
+	s.stats.jobFinished(status)
+	if status == "error" {
+		s.alertJobFailure(job, apiKey)
+	}
+	if job.CallbackURL != "" {
+		go s.deliverCallback(job, status)
+	}
+}
 
-		// Hash the input image to check cache
-		inputHash, err := HashFile(inputPath)
-		if err != nil {
-			job.Log.WriteString(fmt.Sprintf("Error hashing input file: %v\n", err))
-			job.Status = "error"
-			return
+// runJob runs the pipeline for a job and returns the status it ended in,
+// leaving processJob to publish it
+func (s *Server) runJob(job *Job, jobDir, inputPath, apiKey, aiPrompt string) string {
+	// Intermediates live in a scratch directory that is removed when the job
+	// finishes; deliverables are installed into jobDir only once complete
+	workDir, err := s.jobWorkDir(job)
+	if err != nil {
+		job.Log.WriteString(fmt.Sprintf("Error creating work directory: %v\n", err))
+		return "error"
+	}
+	defer os.RemoveAll(workDir)
+
+	svgPath := filepath.Join(workDir, "traced.svg")
+	baseGCodePath := filepath.Join(workDir, "base.gcode") // as the engine wrote it
+	gcodePath := filepath.Join(workDir, "output.gcode")   // post-processed from the base
+
+	// The declared size comes from the upload itself, since neither the
+	// frame extraction nor the AI step below preserves its metadata
+	fitWidth, fitHeight := job.MaxWidth, job.MaxHeight
+	var declaredWidth, declaredHeight float64 // mm, when UseImageDPI found metadata
+	if job.UseImageDPI {
+		job.Log.WriteString("=== Reading image DPI ===\n")
+		if w, h, res, ok, err := imagePhysicalSize(inputPath); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: could not read DPI metadata, using the max dimensions: %v\n\n", err))
+		} else if !ok {
+			job.Log.WriteString("No DPI metadata found; using the max dimensions\n\n")
+		} else {
+			job.ImageDPI = res.X
+			declaredWidth, declaredHeight = w, h
+			job.Log.WriteString(fmt.Sprintf("Image declares %.2f x %.2f DPI: %.2f x %.2f mm\n\n", res.X, res.Y, w, h))
 		}
-		job.Log.WriteString(fmt.Sprintf("Input image hash: %s\n", inputHash[:16]))
+	}
 
-		// Check cache first
-		cached, err := s.AICache.Lookup(inputHash, aiPrompt)
-		if err != nil {
-			job.Log.WriteString(fmt.Sprintf("Cache lookup error: %v\n", err))
-			// Continue with API call
-		}
+	// Multi-frame inputs are flattened to the selected frame first, so the AI
+	// step and autotrace both see a single still image
+	framePath := filepath.Join(workDir, "frame.png")
+	count, extracted, err := extractFrame(inputPath, framePath, job.Frame)
+	if err != nil {
+		job.Log.WriteString(fmt.Sprintf("Error selecting frame: %v\n", err))
+		return "error"
+	}
+	if extracted {
+		job.Log.WriteString(fmt.Sprintf("=== Selecting frame ===\nInput has %d frames; tracing frame %d\n\n", count, job.Frame))
+		inputPath = framePath
+	}
 
+	// If AI transformation is enabled, run it first. Refinement prompts run
+	// in turn on the previous step's output, and each step is cached under
+	// the hash of its own input, so a chain that shares a prefix with an
+	// earlier job reuses those steps.
+	if job.UseAI {
+		prompts := append([]string{aiPrompt}, job.AIRefinePrompts...)
+		for i, p := range prompts {
+			prompts[i] = backgroundPrompt(p, s.DefaultPrompt, job.Background)
+		}
 		var aiImagePath string
-		if cached != nil {
-			// Cache hit!
-			job.Log.WriteString(fmt.Sprintf("Cache HIT - using cached result: %s\n", cached.Filename))
-			aiImagePath = cached.FullPath
-			job.AIImageFilename = cached.Filename
-			job.AIImageCached = true
-		} else {
-			// Cache miss - call the API
-			job.Log.WriteString("Cache MISS - calling Gemini API...\n")
-
-			if apiKey == "" {
-				job.Log.WriteString("Error: AI transformation enabled but no API key provided\n")
-				job.Status = "error"
-				return
+		var texts []string
+		job.AIImageCached = true
+		for step, prompt := range prompts {
+			if len(prompts) == 1 {
+				job.Log.WriteString("=== Running AI Image Transformation ===\n")
+			} else {
+				job.Log.WriteString(fmt.Sprintf("=== Running AI Image Transformation (step %d of %d) ===\n", step+1, len(prompts)))
+				if step > 0 {
+					job.Log.WriteString(fmt.Sprintf("Prompt: %s\n", prompt))
+				}
 			}
 
-			imageData, mimeType, err := s.callGeminiAPI(inputPath, apiKey, aiPrompt)
+			// Hash the input image to check cache
+			inputHash, err := HashFile(inputPath)
 			if err != nil {
-				job.Log.WriteString(fmt.Sprintf("AI transformation error: %v\n", err))
-				job.Status = "error"
-				return
+				job.Log.WriteString(fmt.Sprintf("Error hashing input file: %v\n", err))
+				return "error"
 			}
+			job.Log.WriteString(fmt.Sprintf("Input image hash: %s\n", inputHash[:16]))
 
-			// Store in cache
-			result, err := s.AICache.Store(inputHash, aiPrompt, imageData, mimeType)
+			// Check cache first. The job works from its own copy of a
+			// cached result, which a purge of the cache can't remove.
+			cached, err := s.AICache.LookupInto(inputHash, prompt, workDir)
 			if err != nil {
-				job.Log.WriteString(fmt.Sprintf("Warning: failed to cache result: %v\n", err))
-				// Continue anyway - write to job dir instead
-				ext := ".png"
-				if mimeType == "image/jpeg" {
-					ext = ".jpg"
+				job.Log.WriteString(fmt.Sprintf("Cache lookup error: %v\n", err))
+				// Continue with API call
+			}
+
+			if cached != nil {
+				// Cache hit!
+				job.Log.WriteString(fmt.Sprintf("Cache HIT - using cached result: %s\n", cached.Filename))
+				aiImagePath = cached.FullPath
+				job.AIImageFilename = cached.Filename
+			} else {
+				job.AIImageCached = false
+				// Cache miss - call the API
+				job.Log.WriteString("Cache MISS - calling Gemini API...\n")
+
+				if apiKey == "" {
+					// Wait for the user to supply a key on the status page rather
+					// than failing a job they would have to upload again
+					job.Log.WriteString("No API key provided; waiting for one to be entered on the status page\n")
+					return "needs-api-key"
+				}
+
+				release := s.acquireAISlot(job)
+				imageData, mimeType, aiText, err := s.callGeminiAPI(inputPath, apiKey, prompt, s.AIModalities)
+				if err != nil && slices.Equal(s.AIModalities, AIModalitiesImage) && isModalityError(err) {
+					job.Log.WriteString("The model does not support image-only responses; retrying with text and image\n")
+					imageData, mimeType, aiText, err = s.callGeminiAPI(inputPath, apiKey, prompt, AIModalitiesTextImage)
+				}
+				release()
+				if err != nil {
+					job.Log.WriteString(fmt.Sprintf("AI transformation error: %v\n", err))
+					return "error"
 				}
-				aiImagePath = filepath.Join(jobDir, "ai_generated"+ext)
+
+				if s.NormalizeAIOutput {
+					if normalized, err := normalizeAIImage(imageData); err != nil {
+						job.Log.WriteString(fmt.Sprintf("Warning: keeping AI output as returned (%s): %v\n", mimeType, err))
+					} else {
+						if mimeType != "image/png" {
+							job.Log.WriteString(fmt.Sprintf("Re-encoded AI output (%s) as PNG\n", mimeType))
+						}
+						imageData, mimeType = normalized, "image/png"
+					}
+				}
+
+				// The job works from a copy in the work dir, as it does for a
+				// cache hit, so a purge of the cache can't remove its input
+				aiImagePath = filepath.Join(workDir, fmt.Sprintf("ai_generated_%d%s", step+1, aiImageExt(mimeType)))
 				if err := os.WriteFile(aiImagePath, imageData, 0644); err != nil {
 					job.Log.WriteString(fmt.Sprintf("Error saving AI image: %v\n", err))
-					job.Status = "error"
-					return
+					return "error"
+				}
+				savedAs := filepath.Base(aiImagePath)
+				// Store in cache
+				result, err := s.AICache.Store(inputHash, prompt, imageData, mimeType)
+				if err != nil {
+					job.Log.WriteString(fmt.Sprintf("Warning: failed to cache result: %v\n", err))
+					// Continue anyway, and show no image rather than an
+					// earlier step's
+					job.AIImageFilename = ""
+				} else {
+					job.AIImageFilename = result.Filename
+					savedAs = result.Filename
+				}
+				job.Log.WriteString(fmt.Sprintf("AI transformation complete, saved as: %s\n", savedAs))
+				if aiText != "" {
+					if len(prompts) > 1 {
+						texts = append(texts, fmt.Sprintf("Step %d: %s", step+1, aiText))
+					} else {
+						texts = append(texts, aiText)
+					}
+					job.Log.WriteString(fmt.Sprintf("Gemini said: %s\n", aiText))
 				}
-			} else {
-				aiImagePath = result.FullPath
-				job.AIImageFilename = result.Filename
 			}
-			job.Log.WriteString(fmt.Sprintf("AI transformation complete, saved as: %s\n", filepath.Base(aiImagePath)))
+
+			job.Log.WriteString("\n")
+
+			// Each step's output is the next one's input, and the last one's
+			// is the input for the rest of the pipeline
+			inputPath = aiImagePath
 		}
+		job.AIText = strings.Join(texts, "\n")
+	}
 
-		job.Log.WriteString("\n")
+	// Transparent pixels have no defined color to autotrace, so an input with
+	// an alpha channel is given the background color before anything
+	// measures or traces it. This is the first half of normalizing the
+	// input; the conversion to PPM waits until just before the trace, since
+	// the steps in between decode the image themselves.
+	if hasAlphaChannel(inputPath) {
+		flatPath := filepath.Join(workDir, "flattened.png")
+		if flattened, err := flattenAlphaFile(inputPath, flatPath, job.FlattenBackground); err != nil {
+			job.Log.WriteString(fmt.Sprintf("=== Flattening transparency ===\nWarning: leaving the transparency to autotrace: %v\n\n", err))
+		} else if flattened {
+			job.Log.WriteString(fmt.Sprintf("=== Flattening transparency ===\nComposited the input onto #%s\n\n", job.FlattenBackground))
+			inputPath = flatPath
+		}
+	}
 
-		// Use the AI-generated image as input for the rest of the pipeline
-		inputPath = aiImagePath
+	if job.Deskew {
+		job.Log.WriteString("=== Deskewing ===\n")
+		deskewedPath := filepath.Join(workDir, "deskewed.png")
+		angle, rotated, err := deskewFile(inputPath, deskewedPath, job.DeskewAngle)
+		switch {
+		case err != nil:
+			job.Log.WriteString(fmt.Sprintf("Warning: skipping deskew: %v\n\n", err))
+		case rotated && job.DeskewAngle != 0:
+			job.Log.WriteString(fmt.Sprintf("Corrected the requested skew of %s\n\n", describeSkew(angle)))
+			inputPath = deskewedPath
+		case rotated:
+			job.Log.WriteString(fmt.Sprintf("Detected and corrected a skew of %s\n\n", describeSkew(angle)))
+			inputPath = deskewedPath
+		case angle != 0:
+			job.Log.WriteString(fmt.Sprintf("Detected a skew of %s, too small to correct\n\n", describeSkew(angle)))
+		default:
+			job.Log.WriteString("No clear skew found; the input is unchanged. Set deskewAngle to correct it by hand.\n\n")
+		}
 	}
 
-	// Run autotrace with centerline option
-	job.Log.WriteString("=== Running autotrace ===\n")
-	job.Log.WriteString(fmt.Sprintf("Command: autotrace -centerline -color-count 2 -output-file %s %s\n\n", svgPath, inputPath))
+	if job.AutoLevels {
+		job.Log.WriteString("=== Auto levels ===\n")
+		leveledPath := filepath.Join(workDir, "preprocessed.png")
+		if adj, err := autoLevelsFile(inputPath, leveledPath); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: skipping auto levels: %v\n\n", err))
+		} else {
+			job.Log.WriteString(fmt.Sprintf("Stretched %s to 0-255 (ignoring the extreme %.1f%% of pixels)\n\n", adj, autoLevelsClip*100))
+			inputPath = leveledPath
+		}
+	}
 
-	cmd := exec.Command("autotrace", "-centerline", "-color-count", "2", "-output-file", svgPath, inputPath)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Tiles are cut from the image autotrace would have traced whole, and
+	// written as PPM themselves when the input would have been normalized
+	var tiles []imageTile
+	var tiledSize image.Rectangle
+	if rows, cols := tileGridSize(job.TileGrid); rows*cols > 1 {
+		job.Log.WriteString("=== Tiling input ===\n")
+		tiles, tiledSize, err = cropTiles(inputPath, workDir, rows, cols, job.NormalizeInput, hexRGBA(job.FlattenBackground))
+		if err != nil {
+			job.Log.WriteString(fmt.Sprintf("Error: %v\n", err))
+			return "error"
+		}
+		job.Log.WriteString(fmt.Sprintf("Split the %dx%d px input into %d rows and %d columns of about %dx%d px, traced one at a time\n\n",
+			tiledSize.Dx(), tiledSize.Dy(), rows, cols, tiles[0].Rect.Dx(), tiles[0].Rect.Dy()))
+	}
 
-	err := cmd.Run()
-	if stdout.Len() > 0 {
-		job.Log.WriteString("stdout:\n")
-		job.Log.WriteString(stdout.String())
-		job.Log.WriteString("\n")
+	if job.NormalizeInput && tiles == nil {
+		job.Log.WriteString("=== Normalizing input ===\n")
+		ppmPath := filepath.Join(workDir, "input.ppm")
+		if format, size, err := normalizeInputFile(inputPath, ppmPath, hexRGBA(job.FlattenBackground)); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: passing the input to autotrace unchanged: %v\n\n", err))
+		} else {
+			job.Log.WriteString(fmt.Sprintf("Converted %dx%d %s to PPM, transparency flattened onto #%s\n\n", size.Dx(), size.Dy(), format, job.FlattenBackground))
+			inputPath = ppmPath
+		}
 	}
-	if stderr.Len() > 0 {
-		job.Log.WriteString("stderr:\n")
-		job.Log.WriteString(stderr.String())
-		job.Log.WriteString("\n")
+
+	// Trace, retrying with relaxed settings if asked to and nothing survives
+	// the white filter
+	var relax *traceRelaxation
+	for attempt := 0; ; attempt++ {
+		if relax == nil {
+			job.Log.WriteString("=== Running autotrace ===\n")
+		} else {
+			job.Log.WriteString(fmt.Sprintf("=== Running autotrace (retry %d of %d: %s) ===\n", attempt, len(emptyTraceRetries), relax))
+		}
+		if tiles != nil {
+			err = s.traceTiles(job, tiles, tiledSize, relax, svgPath)
+		} else {
+			err = s.runAutotrace(job, relax, inputPath, svgPath)
+		}
+		if err != nil {
+			job.Log.WriteString(fmt.Sprintf("\nError: %v\n", err))
+			return "error"
+		}
+		job.Log.WriteString("autotrace completed successfully\n\n")
+		logTraceAnalysis(job, svgPath)
+
+		// Keep the unfiltered trace for reference
+		if err := installFile(svgPath, filepath.Join(jobDir, "output.raw.svg")); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: failed to save unfiltered SVG: %v\n", err))
+		}
+
+		// Remove (or recolor) white/near-white paths from SVG
+		name := backgroundPathsName(job.Background)
+		job.Log.WriteString(fmt.Sprintf("=== Filtering %s paths from SVG ===\n", name))
+		if job.WhiteAction == WhiteActionKeep {
+			job.Log.WriteString(fmt.Sprintf("Kept %s paths (whiteAction=keep)\n\n", name))
+		} else if n, err := filterWhitePaths(svgPath, job.WhiteAction, job.WhiteThreshold, job.Background); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: failed to filter %s paths: %v\n", name, err))
+		} else if job.WhiteAction == WhiteActionRecolorBlack {
+			job.Log.WriteString(fmt.Sprintf("%d %s paths recolored to black\n\n", n, name))
+		} else {
+			job.Log.WriteString(fmt.Sprintf("%d %s paths removed\n\n", n, name))
+		}
+
+		if job.MinStrokeWidth > 0 || job.MinPathLength > 0 {
+			job.Log.WriteString("=== Filtering small paths from SVG ===\n")
+			if thin, short, err := filterSmallPaths(svgPath, job.MinStrokeWidth, job.MinPathLength); err != nil {
+				job.Log.WriteString(fmt.Sprintf("Warning: failed to filter small paths: %v\n\n", err))
+			} else {
+				job.Log.WriteString(fmt.Sprintf("%d paths thinner than %g px and %d paths shorter than %g px removed\n\n",
+					thin, job.MinStrokeWidth, short, job.MinPathLength))
+			}
+		}
+
+		if !job.AutoRetryEmpty {
+			break
+		}
+		if n, err := countDrawablePaths(svgPath); err != nil || n > 0 {
+			break
+		}
+		if attempt == len(emptyTraceRetries) {
+			job.Log.WriteString(fmt.Sprintf("Error: the trace is still empty after %d retries\n", attempt))
+			return "error"
+		}
+		job.Log.WriteString("The trace is empty; retrying with relaxed settings\n\n")
+		relax = &emptyTraceRetries[attempt]
 	}
 
-	if err != nil {
-		job.Log.WriteString(fmt.Sprintf("\nError: %v\n", err))
-		job.Status = "error"
-		return
+	refinePaths(job, svgPath, &job.Log)
+
+	// Turn the design when that lets it fill more of the bed. A declared
+	// size is compared as is, since it is never enlarged to fill the bed.
+	if job.AutoOrient {
+		job.Log.WriteString("=== Auto orientation ===\n")
+		w, h, declared := declaredWidth, declaredHeight, declaredWidth > 0
+		ok := true
+		if !declared {
+			w, h, ok = getSVGDimensions(svgPath)
+		}
+		if !ok {
+			job.Log.WriteString("The traced SVG has no usable size; keeping the original orientation\n\n")
+		} else if !shouldRotate(w, h, job.MaxWidth, job.MaxHeight, declared) {
+			job.Log.WriteString(fmt.Sprintf("Keeping the original orientation: a %.2f x %.2f design fits the %.2f x %.2f mm bed no better turned 90°\n\n",
+				w, h, job.MaxWidth, job.MaxHeight))
+		} else if err := rotateSVG(svgPath); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: keeping the original orientation, rotation failed: %v\n\n", err))
+		} else {
+			job.Rotated = true
+			declaredWidth, declaredHeight = declaredHeight, declaredWidth
+			job.Log.WriteString(fmt.Sprintf("Rotated 90° clockwise: the %.2f x %.2f design covers %.0f mm² of the %.2f x %.2f mm bed turned, %.0f mm² as is\n\n",
+				w, h, fittedArea(h, w, job.MaxWidth, job.MaxHeight, declared), job.MaxWidth, job.MaxHeight,
+				fittedArea(w, h, job.MaxWidth, job.MaxHeight, declared)))
+		}
 	}
-	job.Log.WriteString("autotrace completed successfully\n\n")
 
-	// Remove white/near-white paths from SVG
-	job.Log.WriteString("=== Filtering white paths from SVG ===\n")
-	if err := filterWhitePaths(svgPath); err != nil {
-		job.Log.WriteString(fmt.Sprintf("Warning: failed to filter white paths: %v\n", err))
-	} else {
-		job.Log.WriteString("White paths removed\n\n")
+	if declaredWidth > 0 {
+		w, h := declaredWidth, declaredHeight
+		if w > job.MaxWidth || h > job.MaxHeight {
+			job.warn(fmt.Sprintf("The image's declared size of %.2f x %.2f mm is larger than the %.2f x %.2f mm maximum, so it was scaled down to fit.",
+				w, h, job.MaxWidth, job.MaxHeight))
+			w, h = scaleToFit(w, h, job.MaxWidth, job.MaxHeight)
+		}
+		fitWidth, fitHeight = w, h
+		job.Log.WriteString(fmt.Sprintf("Fitting output to %.2f x %.2f mm from the image's DPI\n", w, h))
+	}
+	if err := installFile(svgPath, filepath.Join(jobDir, "output.svg")); err != nil {
+		job.Log.WriteString(fmt.Sprintf("Error saving SVG: %v\n", err))
+		return "error"
 	}
 
 	// Calculate DPI to achieve desired output size
 	// svg2gcode uses DPI to convert pixels to mm: mm = pixels / DPI * 25.4
 	// So to get desired mm from pixels: DPI = pixels / mm * 25.4
-	svgWidth, svgHeight := getSVGDimensions(svgPath)
+	svgWidth, svgHeight, dimsOK := getSVGDimensions(svgPath)
 	job.Log.WriteString(fmt.Sprintf("SVG dimensions: %.2f x %.2f pixels\n", svgWidth, svgHeight))
+	if !dimsOK {
+		job.DimensionsDefaulted = true
+		job.warnOnce(defaultedDimensionsWarning)
+	}
 	job.Log.WriteString(fmt.Sprintf("Max output dimensions: %.2f x %.2f mm\n", job.MaxWidth, job.MaxHeight))
 
-	scaledWidth, scaledHeight := scaleToFit(svgWidth, svgHeight, job.MaxWidth, job.MaxHeight)
+	scaledWidth, scaledHeight := scaleToFit(svgWidth, svgHeight, fitWidth, fitHeight)
 	job.Log.WriteString(fmt.Sprintf("Target output dimensions: %.2f x %.2f mm\n", scaledWidth, scaledHeight))
 
 	// Calculate DPI: we need svgWidth pixels to equal scaledWidth mm
@@ -314,41 +1187,171 @@ func (s *Server) processJob(job *Job, jobDir, inputPath, apiKey, aiPrompt string
 	// So: scaledWidth = svgWidth / DPI * 25.4
 	// Therefore: DPI = svgWidth / scaledWidth * 25.4
 	dpi := svgWidth / scaledWidth * 25.4
-	job.Log.WriteString(fmt.Sprintf("Calculated DPI: %.2f\n\n", dpi))
-
-	dpiArg := fmt.Sprintf("%.4f", dpi)
+	job.Log.WriteString(fmt.Sprintf("Calculated DPI: %.2f\n", dpi))
+	if clamped := s.DPI.clamp(dpi); clamped != dpi {
+		// The clamped DPI no longer maps the SVG onto the requested size, so
+		// report the size the G-Code will actually have
+		job.Log.WriteString(fmt.Sprintf("DPI %.2f is outside the allowed range %s; clamped to %.2f\n", dpi, s.DPI, clamped))
+		dpi = clamped
+		scaledWidth, scaledHeight = svgWidth/dpi*25.4, svgHeight/dpi*25.4
+		job.warn(fmt.Sprintf("The calculated DPI was clamped to %.2f, so the output is %.2f x %.2f mm rather than the requested size.",
+			dpi, scaledWidth, scaledHeight))
+	}
+	job.Log.WriteString("\n")
 
-	// Run svg2gcode
-	job.Log.WriteString("=== Running svg2gcode ===\n")
-	job.Log.WriteString(fmt.Sprintf("Command: svg2gcode --on '%s' --off '%s' --dpi %s %s -o %s\n\n", job.ToolOn, job.ToolOff, dpiArg, svgPath, gcodePath))
+	job.SVGWidth, job.SVGHeight = svgWidth, svgHeight
+	job.OutputWidth, job.OutputHeight = scaledWidth, scaledHeight
+	job.DPI = dpi
 
-	cmd = exec.Command("svg2gcode", "--on", job.ToolOn, "--off", job.ToolOff, "--dpi", dpiArg, svgPath, "-o", gcodePath)
-	stdout.Reset()
-	stderr.Reset()
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Hatching waits for the DPI, since its spacing is set in mm
+	if job.Fill {
+		job.Log.WriteString("=== Filling closed paths ===\n")
+		if stats, err := fillPaths(svgPath, job.FillAngle, job.FillSpacing/25.4*dpi); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: leaving closed paths unfilled: %v\n\n", err))
+		} else {
+			job.Log.WriteString(fmt.Sprintf("%d closed paths hatched at %g° every %g mm with %d lines in %d colors\n\n",
+				stats.Regions, job.FillAngle, job.FillSpacing, stats.Lines, stats.Colors))
+			if stats.Lines > 0 {
+				if err := installFile(svgPath, filepath.Join(jobDir, "output.svg")); err != nil {
+					job.Log.WriteString(fmt.Sprintf("Error saving SVG: %v\n", err))
+					return "error"
+				}
+			}
+		}
+	}
 
-	err = cmd.Run()
-	if stdout.Len() > 0 {
-		job.Log.WriteString("stdout:\n")
-		job.Log.WriteString(stdout.String())
-		job.Log.WriteString("\n")
+	// Run svg2gcode, or the builtin engine, once per tool class if the job
+	// has any
+	if job.Engine == EngineBuiltin {
+		job.Log.WriteString("=== Generating G-Code (builtin engine) ===\n")
+	} else {
+		job.Log.WriteString("=== Running svg2gcode ===\n")
+	}
+	if err := s.generateGCode(job, workDir, svgPath, baseGCodePath, dpi); err != nil {
+		job.Log.WriteString(fmt.Sprintf("\nError: %v\n", err))
+		return "error"
 	}
-	if stderr.Len() > 0 {
-		job.Log.WriteString("stderr:\n")
-		job.Log.WriteString(stderr.String())
-		job.Log.WriteString("\n")
+	if job.Engine != EngineBuiltin {
+		job.Log.WriteString("svg2gcode completed successfully\n")
 	}
 
-	if err != nil {
+	// Post-processing below rewrites a copy, so the base stays as svg2gcode
+	// wrote it for downloads that re-apply transforms to it
+	if err := installFile(baseGCodePath, gcodePath); err != nil {
 		job.Log.WriteString(fmt.Sprintf("\nError: %v\n", err))
-		job.Status = "error"
-		return
+		return "error"
+	}
+
+	padShift, err := s.finishProgram(job, gcodePath, "", point{}, &job.Log)
+	if err != nil {
+		job.Log.WriteString(fmt.Sprintf("Error: %v\n", err))
+		return "error"
+	}
+
+	if tiles != nil {
+		job.Log.WriteString("\n=== Writing tile programs ===\n")
+		tilesPath := filepath.Join(jobDir, "output.tiles.zip")
+		if n, err := s.writeTilePrograms(job, workDir, tiles, dpi, padShift, tilesPath); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Error: %v\n", err))
+			return "error"
+		} else if n == 0 {
+			os.Remove(tilesPath)
+			job.warn("No tile has anything to draw, so there are no tile programs.")
+		} else {
+			job.Log.WriteString(fmt.Sprintf("Wrote %d of %d tile programs to output.tiles.zip\n", n, len(tiles)))
+			job.TilesPath = tilesPath
+		}
+	}
+
+	if job.WantsFormat("dxf") {
+		dxfPath := filepath.Join(jobDir, "output.dxf")
+		job.Log.WriteString("\n=== Writing DXF ===\n")
+		if n, err := writeDXF(svgPath, dxfPath, dpi, svgHeight); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: failed to write DXF: %v\n", err))
+		} else {
+			job.Log.WriteString(fmt.Sprintf("Wrote %d polylines to output.dxf\n", n))
+			job.DXFPath = dxfPath
+		}
+	}
+
+	if job.WantsFormat("hpgl") {
+		hpglPath := filepath.Join(jobDir, "output.hpgl")
+		job.Log.WriteString("\n=== Writing HPGL ===\n")
+		if n, err := writeHPGL(svgPath, hpglPath, dpi, svgHeight); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: failed to write HPGL: %v\n", err))
+		} else {
+			job.Log.WriteString(fmt.Sprintf("Wrote %d polylines to output.hpgl\n", n))
+			job.HPGLPath = hpglPath
+		}
+	}
+
+	if job.WantsFormat("plotsvg") {
+		plotPath := filepath.Join(jobDir, "output.plot.svg")
+		job.Log.WriteString("\n=== Writing plotter SVG ===\n")
+		meta := plotMetadata{ToolOn: job.ToolOn, ToolOff: job.ToolOff, Flavor: job.GCodeFlavor, DPI: dpi}
+		if job.PadToBed {
+			meta.Page = &bounds{0, 0, job.MaxWidth, job.MaxHeight}
+		}
+		if n, err := writePlotSVG(gcodePath, plotPath, meta); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: failed to write plotter SVG: %v\n", err))
+		} else {
+			job.Log.WriteString(fmt.Sprintf("Wrote %d cut paths to output.plot.svg\n", n))
+			job.PlotSVGPath = plotPath
+		}
+	}
+
+	job.Log.WriteString("\n=== Checking output complexity ===\n")
+	if rep, err := measureComplexity(svgPath, gcodePath); err != nil {
+		job.Log.WriteString(fmt.Sprintf("Warning: failed to measure output: %v\n", err))
+	} else {
+		job.Log.WriteString(fmt.Sprintf("Paths: %d, moves: %d, G-Code size: %s\n", rep.Paths, rep.Moves, formatBytes(rep.GCodeBytes)))
+		if msg := complexityWarning(rep, s.Complexity); msg != "" {
+			job.warn(msg)
+		}
+		if job.Output, err = measureOutput(rep, gcodePath); err != nil {
+			job.Log.WriteString(fmt.Sprintf("Warning: failed to measure moves: %v\n", err))
+		}
 	}
-	job.Log.WriteString("svg2gcode completed successfully\n")
 
-	job.GCodePath = gcodePath
-	job.Status = "done"
+	finalGCodePath := filepath.Join(jobDir, "output.gcode")
+	if err := installFile(gcodePath, finalGCodePath); err != nil {
+		job.Log.WriteString(fmt.Sprintf("Error saving G-Code: %v\n", err))
+		return "error"
+	}
+
+	finalBasePath := filepath.Join(jobDir, "output.base.gcode")
+	if err := installFile(baseGCodePath, finalBasePath); err != nil {
+		job.Log.WriteString(fmt.Sprintf("Warning: could not keep the base G-Code: %v\n", err))
+	} else {
+		job.BaseGCodePath = finalBasePath
+	}
+
+	job.GCodePath = finalGCodePath
+	job.FinishedAt = time.Now()
+	job.finishedLog = job.Log.String()
+	return "done"
+}
+
+// setJobStatus publishes a job's status. Handlers read Status under s.mu,
+// so the processing goroutine never writes it without the lock.
+func (s *Server) setJobStatus(job *Job, status string) {
+	s.mu.Lock()
+	job.Status = status
+	s.mu.Unlock()
+}
+
+// jobName reads a job's name, which HandleJobRename may change at any time
+func (s *Server) jobName(job *Job) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return job.Name
+}
+
+// jobStatus reads a job's status as setJobStatus last published it
+func (s *Server) jobStatus(job *Job) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return job.Status
 }
 
 func (s *Server) HandleJobStatus(w http.ResponseWriter, r *http.Request) {
@@ -366,32 +1369,176 @@ func (s *Server) HandleJobStatus(w http.ResponseWriter, r *http.Request) {
 	jobDir := filepath.Join(s.UploadsDir, jobID)
 
 	// Read SVG content if job is done
+	status := s.jobStatus(job)
 	var svgContent template.HTML
-	if job.Status == "done" || job.Status == "error" {
-		svgPath := filepath.Join(jobDir, "output.svg")
-		if data, err := os.ReadFile(svgPath); err == nil {
-			svgContent = template.HTML(data)
+	if status == "done" || status == "error" {
+		svgContent = readInlineSVG(filepath.Join(jobDir, "output.svg"))
+	}
+
+	// Offer per-color previews when the trace has more than one stroke color
+	var layers []strokeCount
+	if status == "done" {
+		if data, err := os.ReadFile(filepath.Join(jobDir, "output.svg")); err == nil {
+			if layers, _ = colorLayers(data); len(layers) < 2 {
+				layers = nil
+			}
 		}
 	}
 
-	// Build AI image URL if one exists
+	// The white filter preview needs the unfiltered trace
+	_, err := os.Stat(filepath.Join(jobDir, "output.raw.svg"))
+	filterPreview := err == nil
+
+	// Build AI image URL if one exists. A purge of the cache removes the
+	// files of jobs that already finished.
 	var aiImageURL string
 	if job.AIImageFilename != "" {
-		aiImageURL = "/ai-cache/" + job.AIImageFilename
+		if _, err := os.Stat(filepath.Join(s.AICache.CacheDir(), job.AIImageFilename)); err == nil {
+			aiImageURL = "/ai-cache/" + job.AIImageFilename
+		}
+	}
+
+	shareLinks, err := s.Shares.ForJob(job.ID)
+	if err != nil {
+		slog.Warn("list share links", "job", job.ID, "error", err)
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := s.renderTemplate(w, "job.html", map[string]interface{}{
 		"Job":        job,
+		"Name":       s.jobName(job),
+		"Status":     status,
+		"Warnings":   job.warnings(),
 		"Log":        job.Log.String(),
 		"Hostname":   s.Hostname,
 		"SVGContent": svgContent,
 		"AIImageURL": aiImageURL,
+		"ShareLinks": shareLinks,
+		"Layers":     layers,
+
+		"FilterPreview": filterPreview,
+
+		"AwaitingApproval": status == "done" && s.awaitingApproval(job),
 	}); err != nil {
 		slog.Warn("render template", "url", r.URL.Path, "error", err)
 	}
 }
 
+// jobIDEncoding renders job IDs as lowercase base32 so they are safe in URLs
+// and directory names on case-insensitive filesystems
+var jobIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// newJobID returns a random 128-bit job ID. IDs used to be UnixNano
+// timestamps, which let anyone enumerate other users' jobs; IDs are opaque
+// strings everywhere else, so older numeric IDs and their upload directories
+// keep working.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return jobIDEncoding.EncodeToString(b), nil
+}
+
+// DefaultMaxPromptLen is generous for a descriptive prompt while keeping
+// runaway input out of the Gemini request and the cache database
+const DefaultMaxPromptLen = 2000
+
+// parseAIPrompt trims a user-supplied prompt and checks its length and
+// content. Newlines and tabs are allowed so prompts can be formatted;
+// other control characters and invalid UTF-8 are rejected.
+func parseAIPrompt(v string, maxLen int) (string, error) {
+	v = strings.TrimSpace(v)
+	if !utf8.ValidString(v) {
+		return "", fmt.Errorf("aiPrompt must be valid UTF-8")
+	}
+	if n := utf8.RuneCountInString(v); maxLen > 0 && n > maxLen {
+		return "", fmt.Errorf("aiPrompt is %d characters; the maximum is %d", n, maxLen)
+	}
+	for _, c := range v {
+		if unicode.IsControl(c) && c != '\n' && c != '\r' && c != '\t' {
+			return "", fmt.Errorf("aiPrompt must not contain control characters")
+		}
+	}
+	return v, nil
+}
+
+// maxAIRefineSteps bounds the refinement prompts of one job, each of which
+// is a separate Gemini call
+const maxAIRefineSteps = 4
+
+// parseAIRefinePrompts reads the aiRefinePrompts option. Each non-blank
+// line of each value is one refinement prompt, so the form can take them in
+// one text box and the API as repeated fields.
+func parseAIRefinePrompts(values []string, maxLen int) ([]string, error) {
+	var prompts []string
+	for _, v := range values {
+		for _, line := range strings.Split(v, "\n") {
+			p, err := parseAIPrompt(line, maxLen)
+			if err != nil {
+				return nil, fmt.Errorf("aiRefinePrompts: %w", err)
+			}
+			if p != "" {
+				prompts = append(prompts, p)
+			}
+		}
+	}
+	if len(prompts) > maxAIRefineSteps {
+		return nil, fmt.Errorf("aiRefinePrompts has %d prompts; the maximum is %d", len(prompts), maxAIRefineSteps)
+	}
+	return prompts, nil
+}
+
+// CheckDefaultPrompt reports whether DefaultPrompt would be accepted as a
+// job's aiPrompt, since the upload form submits it as one
+func (s *Server) CheckDefaultPrompt() error {
+	if _, err := parseAIPrompt(s.DefaultPrompt, s.MaxPromptLen); err != nil {
+		return fmt.Errorf("default prompt: %w", err)
+	}
+	return nil
+}
+
+// maxJobNameLen bounds a job's friendly name in bytes
+const maxJobNameLen = 100
+
+// parseJobName validates a user-supplied job name; empty clears the name
+func parseJobName(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if len(v) > maxJobNameLen {
+		return "", fmt.Errorf("name must be at most %d bytes", maxJobNameLen)
+	}
+	for _, c := range v {
+		if unicode.IsControl(c) {
+			return "", fmt.Errorf("name must not contain control characters")
+		}
+	}
+	return v, nil
+}
+
+// HandleJobRename sets or clears a job's friendly name from the "name" form field
+func (s *Server) HandleJobRename(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	name, err := parseJobName(r.FormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	if exists {
+		job.Name = name
+	}
+	s.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/job/"+job.ID, http.StatusSeeOther)
+}
+
 func (s *Server) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	jobID := r.PathValue("id")
 
@@ -399,21 +1546,132 @@ func (s *Server) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	job, exists := s.jobs[jobID]
 	s.mu.Unlock()
 
-	if !exists || job.Status != "done" || job.GCodePath == "" {
+	if !exists || s.jobStatus(job) != "done" || job.GCodePath == "" {
 		http.Error(w, "File not available", http.StatusNotFound)
 		return
 	}
+	if s.refuseUnapproved(w, job) {
+		return
+	}
 
-	// Generate download filename from original
-	baseName := strings.TrimSuffix(job.OriginalName, filepath.Ext(job.OriginalName))
-	downloadName := baseName + ".gcode"
-
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", downloadName))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.downloadBaseName(job)+".gcode"))
 	w.Header().Set("Content-Type", "application/octet-stream")
 	http.ServeFile(w, r, job.GCodePath)
 }
 
+// HandleProvideKey resumes a job paused for lack of an API key. The job
+// restarts from the beginning of processJob, which quickly reaches the AI
+// stage again since nothing before it is expensive.
+func (s *Server) HandleProvideKey(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+	apiKey := strings.TrimSpace(r.FormValue("apiKey")) // Never log this!
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	if !exists {
+		s.mu.Unlock()
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if job.Status != "needs-api-key" || job.paused == nil {
+		s.mu.Unlock()
+		http.Error(w, "Job is not waiting for an API key", http.StatusConflict)
+		return
+	}
+	if apiKey == "" {
+		s.mu.Unlock()
+		http.Error(w, "An API key is required", http.StatusBadRequest)
+		return
+	}
+	paused := job.paused
+	job.paused = nil
+	job.Status = "processing"
+	s.mu.Unlock()
+
+	job.Log.WriteString("\n=== Resuming with the provided API key ===\n")
+	go s.processJob(job, filepath.Join(s.UploadsDir, job.ID), paused.inputPath, apiKey, paused.aiPrompt)
+
+	http.Redirect(w, r, "/job/"+jobID, http.StatusSeeOther)
+}
+
+// HandleJobLog serves the job's log as plain text. In-progress jobs return
+// the log so far; the X-Job-Status header says whether more is coming.
+func (s *Server) HandleJobLog(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	job, exists := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Job-Status", s.jobStatus(job))
+	if s.jobStatus(job) != "done" && s.jobStatus(job) != "error" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	io.WriteString(w, job.Log.String())
+}
+
+// HandleDownloadFormat serves one of the optional extra output formats
+func (s *Server) HandleDownloadFormat(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+	format := r.PathValue("format")
+
+	s.mu.Lock()
+	job, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists || s.jobStatus(job) != "done" {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+
+	var path, contentType string
+	ext := format
+	switch format {
+	case "dxf":
+		path, contentType = job.DXFPath, "application/dxf"
+	case "hpgl":
+		path, contentType = job.HPGLPath, "application/vnd.hp-hpgl"
+	case "plotsvg":
+		path, contentType, ext = job.PlotSVGPath, "image/svg+xml", "plot.svg"
+	case "tiles":
+		path, contentType, ext = job.TilesPath, "application/zip", "tiles.zip"
+	}
+	if path == "" {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	if s.refuseUnapproved(w, job) {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.downloadBaseName(job)+"."+ext))
+	w.Header().Set("Content-Type", contentType)
+	http.ServeFile(w, r, path)
+}
+
+// downloadBaseName returns the job's name if it has one, otherwise the
+// original filename without its extension
+func (s *Server) downloadBaseName(job *Job) string {
+	return fileBaseName(s.jobName(job), job.OriginalName)
+}
 
+// fileBaseName is downloadBaseName for a job name read once, for callers
+// that name several files after it
+func fileBaseName(name, originalName string) string {
+	if name != "" {
+		return strings.Map(func(c rune) rune {
+			if strings.ContainsRune(`/\:*?"<>|`, c) {
+				return '-'
+			}
+			return c
+		}, name)
+	}
+	return strings.TrimSuffix(originalName, filepath.Ext(originalName))
+}
 
 func (s *Server) renderTemplate(w http.ResponseWriter, name string, data any) error {
 	path := filepath.Join(s.TemplatesDir, name)
@@ -427,32 +1685,146 @@ func (s *Server) renderTemplate(w http.ResponseWriter, name string, data any) er
 	return nil
 }
 
-// getSVGDimensions extracts width and height from an SVG file
-func getSVGDimensions(svgPath string) (width, height float64) {
+// Tool commands used when a job, test pattern, or lint request gives none
+const (
+	defaultToolOn  = "S4 M0"
+	defaultToolOff = "S4 M100"
+)
+
+// defaultSVGDimension is used when an SVG declares neither width/height nor a viewBox
+const defaultSVGDimension = 100
+
+// defaultedDimensionsWarning is the job warning for an SVG whose size was
+// assumed to be defaultSVGDimension
+var defaultedDimensionsWarning = fmt.Sprintf("The traced SVG has no usable width/height or viewBox, so a %dx%d default was assumed. "+
+	"The output size and scale are unreliable; check the G-Code dimensions before plotting.",
+	defaultSVGDimension, defaultSVGDimension)
+
+// getSVGDimensions extracts width and height from an SVG file's root element,
+// falling back to the viewBox size. ok is false when neither was usable and
+// the 100x100 default was returned instead.
+func getSVGDimensions(svgPath string) (width, height float64, ok bool) {
 	data, err := os.ReadFile(svgPath)
 	if err != nil {
-		return 100, 100 // default
+		return defaultSVGDimension, defaultSVGDimension, false
+	}
+	return parseSVGDimensions(data)
+}
+
+func parseSVGDimensions(data []byte) (width, height float64, ok bool) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return defaultSVGDimension, defaultSVGDimension, false
+		}
+		el, isStart := tok.(xml.StartElement)
+		if !isStart {
+			continue
+		}
+		if el.Name.Local != "svg" {
+			return defaultSVGDimension, defaultSVGDimension, false
+		}
+
+		var viewBox string
+		for _, attr := range el.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width = parseSVGLength(attr.Value)
+			case "height":
+				height = parseSVGLength(attr.Value)
+			case "viewBox":
+				viewBox = attr.Value
+			}
+		}
+		if (width <= 0 || height <= 0) && viewBox != "" {
+			f := strings.FieldsFunc(viewBox, func(r rune) bool { return r == ' ' || r == ',' })
+			if len(f) == 4 {
+				vw, errW := strconv.ParseFloat(f[2], 64)
+				vh, errH := strconv.ParseFloat(f[3], 64)
+				if errW == nil && errH == nil && vw > 0 && vh > 0 {
+					width, height = vw, vh
+				}
+			}
+		}
+		if width <= 0 || height <= 0 {
+			return defaultSVGDimension, defaultSVGDimension, false
+		}
+		return width, height, true
+	}
+}
+
+// parseSVGLength parses the numeric part of a length such as "832" or "832px".
+// Percentages cannot be resolved without a viewport and return 0.
+func parseSVGLength(s string) float64 {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		return 0
+	}
+	end := 0
+	for end < len(s) && strings.IndexByte("+-.0123456789eE", s[end]) >= 0 {
+		end++
+	}
+	v, err := strconv.ParseFloat(s[:end], 64)
+	if err != nil {
+		return 0
 	}
+	return v
+}
 
-	// Try to match width and height attributes
-	widthRe := regexp.MustCompile(`<svg[^>]*\swidth="([0-9.]+)`)
-	heightRe := regexp.MustCompile(`<svg[^>]*\sheight="([0-9.]+)`)
+// DPILimits bounds the DPI computed for svg2gcode. Tiny or huge traced SVGs
+// can otherwise yield DPI values svg2gcode handles badly, producing G-Code
+// at the wrong scale. A zero bound is not enforced.
+type DPILimits struct {
+	Min float64
+	Max float64
+}
 
-	if m := widthRe.FindSubmatch(data); m != nil {
-		width, _ = strconv.ParseFloat(string(m[1]), 64)
+// DefaultDPILimits comfortably cover real scans and drawings mapped onto a
+// plotter bed while catching degenerate traces
+var DefaultDPILimits = DPILimits{Min: 1, Max: 10000}
+
+func (l DPILimits) String() string {
+	min, max := "0", "unlimited"
+	if l.Min > 0 {
+		min = fmt.Sprintf("%g", l.Min)
 	}
-	if m := heightRe.FindSubmatch(data); m != nil {
-		height, _ = strconv.ParseFloat(string(m[1]), 64)
+	if l.Max > 0 {
+		max = fmt.Sprintf("%g", l.Max)
 	}
+	return min + "-" + max
+}
 
-	if width == 0 {
-		width = 100
+// clamp returns dpi limited to the configured range
+func (l DPILimits) clamp(dpi float64) float64 {
+	if l.Min > 0 && dpi < l.Min {
+		return l.Min
 	}
-	if height == 0 {
-		height = 100
+	if l.Max > 0 && dpi > l.Max {
+		return l.Max
 	}
+	return dpi
+}
+
+// OutputSizeLimits bounds the max width and height a job may request, in
+// mm. Requests outside them are clamped, and the job warns, rather than
+// producing a drawing far too small or too big for the machine. A zero
+// bound is not enforced.
+type OutputSizeLimits struct {
+	Min float64
+	Max float64
+}
+
+// DefaultOutputSizeLimits run from a postage stamp to a little over A0
+var DefaultOutputSizeLimits = OutputSizeLimits{Min: 10, Max: 1200}
+
+func (l OutputSizeLimits) String() string {
+	return DPILimits(l).String()
+}
 
-	return width, height
+// clamp returns size limited to the configured range
+func (l OutputSizeLimits) clamp(size float64) float64 {
+	return DPILimits(l).clamp(size)
 }
 
 // scaleToFit calculates dimensions that fit within maxW x maxH while maintaining aspect ratio
@@ -474,35 +1846,122 @@ func scaleToFit(srcW, srcH, maxW, maxH float64) (float64, float64) {
 	return srcW * scale, srcH * scale
 }
 
-// filterWhitePaths removes paths with white or near-white stroke colors from an SVG file
-func filterWhitePaths(svgPath string) error {
+// White path handling modes for filterWhitePaths
+const (
+	WhiteActionRemove       = "remove"        // delete near-white paths (default)
+	WhiteActionRecolorBlack = "recolor-black" // rewrite their stroke to black so they plot
+	WhiteActionKeep         = "keep"          // leave the SVG untouched
+
+	// whiteActionMark recolors them red instead, for the filter preview;
+	// it is not a job option
+	whiteActionMark = "mark"
+)
+
+// defaultWhiteThreshold is the channel value every component of a near-white
+// stroke color is above
+const defaultWhiteThreshold = 240
+
+// parseWhiteThreshold validates the whiteThreshold option, defaulting to
+// defaultWhiteThreshold
+func parseWhiteThreshold(s string) (int, error) {
+	if s == "" {
+		return defaultWhiteThreshold, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 254 {
+		return 0, fmt.Errorf("whiteThreshold must be a whole number from 1 to 254")
+	}
+	return n, nil
+}
+
+// parseWhiteAction validates the whiteAction option, defaulting to remove
+func parseWhiteAction(s string) (string, error) {
+	switch s {
+	case "":
+		return WhiteActionRemove, nil
+	case WhiteActionRemove, WhiteActionRecolorBlack, WhiteActionKeep:
+		return s, nil
+	}
+	return "", fmt.Errorf("whiteAction must be %q, %q, or %q", WhiteActionRemove, WhiteActionRecolorBlack, WhiteActionKeep)
+}
+
+// filterWhitePaths removes or recolors paths with white or near-white stroke
+// colors in an SVG file, returning how many paths were affected. A threshold
+// of 0 means defaultWhiteThreshold.
+func filterWhitePaths(svgPath, action string, threshold int, background string) (int, error) {
+	if action == WhiteActionKeep {
+		return 0, nil
+	}
 	data, err := os.ReadFile(svgPath)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	filtered, n := filterWhitePathsData(data, action, threshold, background)
+	return n, os.WriteFile(svgPath, filtered, 0644)
+}
 
-	// Match path elements with stroke color
-	pathRegex := regexp.MustCompile(`<path[^>]*style="[^"]*stroke:#([0-9a-fA-F]{6})[^"]*"[^>]*/>`)
+var (
+	whitePathRegex   = regexp.MustCompile(`<path[^>]*style="[^"]*stroke:#([0-9a-fA-F]{6})[^"]*"[^>]*/>`)
+	strokeColorRegex = regexp.MustCompile(`stroke:#([0-9a-fA-F]{6})`)
+)
 
-	filtered := pathRegex.ReplaceAllFunc(data, func(match []byte) []byte {
+func filterWhitePathsData(data []byte, action string, threshold int, background string) ([]byte, int) {
+	if threshold <= 0 {
+		threshold = defaultWhiteThreshold
+	}
+	count := 0
+	filtered := whitePathRegex.ReplaceAllFunc(data, func(match []byte) []byte {
 		// Extract the color
-		colorMatch := regexp.MustCompile(`stroke:#([0-9a-fA-F]{6})`).FindSubmatch(match)
+		colorMatch := strokeColorRegex.FindSubmatchIndex(match)
 		if colorMatch == nil {
 			return match
 		}
 
-		hexColor := string(colorMatch[1])
-		if isNearWhite(hexColor) {
-			return []byte{} // Remove the path
+		hexColor := string(match[colorMatch[2]:colorMatch[3]])
+		if !isBackgroundAt(hexColor, threshold, background) {
+			return match
+		}
+		count++
+		if action == WhiteActionRecolorBlack || action == whiteActionMark {
+			color := "000000"
+			if action == whiteActionMark {
+				color = "FF0000"
+			}
+			recolored := append([]byte{}, match[:colorMatch[2]]...)
+			recolored = append(recolored, color...)
+			return append(recolored, match[colorMatch[3]:]...)
 		}
-		return match
+		return []byte{} // Remove the path
 	})
+	return filtered, count
+}
 
-	return os.WriteFile(svgPath, filtered, 0644)
+// parseHexColor validates a hex color such as "#F5F0E1" or "fff" and returns
+// it as six uppercase hex digits without the leading '#'. Empty input is allowed.
+func parseHexColor(s string) (string, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if s == "" {
+		return "", nil
+	}
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return "", fmt.Errorf("expected 3 or 6 hex digits, got %q", s)
+	}
+	if _, err := strconv.ParseUint(s, 16, 32); err != nil {
+		return "", fmt.Errorf("invalid hex color %q", s)
+	}
+	return strings.ToUpper(s), nil
 }
 
 // isNearWhite checks if a hex color is white or near-white (high RGB values)
 func isNearWhite(hex string) bool {
+	return isNearWhiteAt(hex, defaultWhiteThreshold)
+}
+
+// isNearWhiteAt checks if every RGB component of a hex color is above threshold
+func isNearWhiteAt(hex string, threshold int) bool {
 	if len(hex) != 6 {
 		return false
 	}
@@ -511,18 +1970,18 @@ func isNearWhite(hex string) bool {
 	g, _ := strconv.ParseInt(hex[2:4], 16, 64)
 	b, _ := strconv.ParseInt(hex[4:6], 16, 64)
 
-	// Consider colors with all components > 240 as "near white"
-	threshold := int64(240)
-	return r > threshold && g > threshold && b > threshold
+	t := int64(threshold)
+	return r > t && g > t && b > t
 }
 
-// callGeminiAPI calls the Gemini API to transform an image to line art
-// Returns the raw image data and mime type
-func (s *Server) callGeminiAPI(inputPath, apiKey, prompt string) (imageData []byte, mimeType string, err error) {
+// callGeminiAPI calls the Gemini API to transform an image to line art,
+// asking for the given response modalities.
+// Returns the raw image data and mime type, and any text parts joined
+func (s *Server) callGeminiAPI(inputPath, apiKey, prompt string, modalities []string) (imageData []byte, mimeType, text string, err error) {
 	// Read the input image
 	inputData, err := os.ReadFile(inputPath)
 	if err != nil {
-		return nil, "", fmt.Errorf("read input image: %w", err)
+		return nil, "", "", fmt.Errorf("read input image: %w", err)
 	}
 
 	// Determine MIME type from extension
@@ -566,33 +2025,33 @@ func (s *Server) callGeminiAPI(inputPath, apiKey, prompt string) (imageData []by
 			},
 		},
 		"generationConfig": map[string]interface{}{
-			"responseModalities": []string{"text", "image"},
+			"responseModalities": modalities,
 		},
 	}
 
 	reqJSON, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil, "", fmt.Errorf("marshal request: %w", err)
+		return nil, "", "", fmt.Errorf("marshal request: %w", err)
 	}
 
 	// Call the Gemini API
 	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/gemini-2.0-flash-exp:generateContent?key=%s", apiKey)
 	req, err := http.NewRequest("POST", url, bytes.NewReader(reqJSON))
 	if err != nil {
-		return nil, "", fmt.Errorf("create request: %w", err)
+		return nil, "", "", fmt.Errorf("create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{Timeout: 120 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("API request failed: %w", err)
+		return nil, "", "", fmt.Errorf("API request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, "", fmt.Errorf("read response: %w", err)
+		return nil, "", "", fmt.Errorf("read response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -602,10 +2061,11 @@ func (s *Server) callGeminiAPI(inputPath, apiKey, prompt string) (imageData []by
 				Message string `json:"message"`
 			} `json:"error"`
 		}
-		if json.Unmarshal(respBody, &errResp) == nil && errResp.Error.Message != "" {
-			return nil, "", fmt.Errorf("API error: %s", errResp.Error.Message)
+		apiErr := &geminiAPIError{Status: resp.StatusCode}
+		if json.Unmarshal(respBody, &errResp) == nil {
+			apiErr.Message = errResp.Error.Message
 		}
-		return nil, "", fmt.Errorf("API error (status %d)", resp.StatusCode)
+		return nil, "", "", apiErr
 	}
 
 	// Parse the response
@@ -624,36 +2084,123 @@ func (s *Server) callGeminiAPI(inputPath, apiKey, prompt string) (imageData []by
 	}
 
 	if err := json.Unmarshal(respBody, &apiResp); err != nil {
-		return nil, "", fmt.Errorf("parse response: %w", err)
+		return nil, "", "", fmt.Errorf("parse response: %w", err)
 	}
 
-	// Find the image in the response
+	// Find the image in the response, keeping any text that came with it
+	var texts []string
 	for _, candidate := range apiResp.Candidates {
 		for _, part := range candidate.Content.Parts {
-			if part.InlineData != nil {
+			if t := strings.TrimSpace(part.Text); t != "" {
+				texts = append(texts, t)
+			}
+			if part.InlineData != nil && imageData == nil {
 				// Decode the image
-				imgData, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+				imageData, err = base64.StdEncoding.DecodeString(part.InlineData.Data)
 				if err != nil {
-					return nil, "", fmt.Errorf("decode image: %w", err)
+					return nil, "", "", fmt.Errorf("decode image: %w", err)
 				}
-				return imgData, part.InlineData.MimeType, nil
+				mimeType = part.InlineData.MimeType
 			}
 		}
+		if imageData != nil {
+			break
+		}
 	}
-
-	return nil, "", fmt.Errorf("no image in API response")
+	if imageData == nil {
+		return nil, "", "", fmt.Errorf("no image in API response")
+	}
+	return imageData, mimeType, strings.Join(texts, "\n"), nil
 }
 
-// Serve starts the HTTP server with the configured routes
-func (s *Server) Serve(addr string) error {
+// Handler returns the HTTP handler with all routes registered
+func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /{$}", s.HandleRoot)
 	mux.HandleFunc("POST /upload", s.HandleUpload)
-	mux.HandleFunc("GET /job/{id}", s.HandleJobStatus)
-	mux.HandleFunc("GET /download/{id}", s.HandleDownload)
+	mux.HandleFunc("GET /embed", s.withFramePolicy(s.HandleEmbed))
+	mux.HandleFunc("GET /job/{id}", s.withFramePolicy(s.HandleJobStatus))
+	mux.HandleFunc("GET /job/{id}/log", s.HandleJobLog)
+	mux.HandleFunc("GET /job/{id}/toolpath.png", s.HandleToolpathPNG)
+	mux.HandleFunc("GET /job/{id}/animation.svg", s.HandleToolpathAnimation)
+	mux.HandleFunc("GET /job/{id}/stats.json", s.HandleJobStats)
+	mux.HandleFunc("GET /job/{id}/layer/{color}", s.HandleColorLayer)
+	mux.HandleFunc("GET /job/{id}/filter-preview", s.HandleFilterPreview)
+	mux.HandleFunc("GET /job/{id}/download", s.withDownloadStats(s.HandleJobDownload))
+	mux.HandleFunc("POST /job/{id}/rename", s.HandleJobRename)
+	mux.HandleFunc("POST /job/{id}/provide-key", s.HandleProvideKey)
+	mux.HandleFunc("POST /job/{id}/approve", s.HandleJobApprove)
+	mux.HandleFunc("POST /job/{id}/share", s.HandleJobShare)
+	mux.HandleFunc("GET /s/{token}", s.HandleSharedJob)
+	mux.HandleFunc("POST /s/{token}", s.HandleShareUnlock)
+	mux.HandleFunc("GET /s/{token}/download", s.withDownloadStats(s.HandleSharedDownload))
+	mux.HandleFunc("GET /s/{token}/svg", s.HandleSharedSVG)
+	mux.HandleFunc("GET /download/{id}", s.withDownloadStats(s.HandleDownload))
+	mux.HandleFunc("GET /download/{id}/zip", s.withDownloadStats(s.HandleDownloadBundle))
+	mux.HandleFunc("GET /download/{id}/{format}", s.withDownloadStats(s.HandleDownloadFormat))
+	mux.HandleFunc("GET /test-pattern", s.HandleTestPattern)
+	mux.HandleFunc("GET /stats", s.HandleStats)
+
+	// API routes get CORS headers when cross-origin access is configured
+	api := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, s.withCORS(h))
+	}
+	api("POST /api/jobs", s.HandleAPICreateJob)
+	api("GET /api/jobs/{id}", s.HandleAPIJobStatus)
+	api("GET /api/jobs/{id}/download", s.withDownloadStats(s.HandleDownload))
+	api("POST /api/inspect", s.HandleAPIInspect)
+	api("POST /api/ai/estimate", s.HandleAPIEstimateAI)
+	api("POST /api/gcode/lint", s.HandleAPILintGCode)
+	api("OPTIONS /api/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /openapi.json", s.HandleOpenAPI)
+	mux.HandleFunc("GET /api/docs", s.HandleAPIDocs)
+	mux.HandleFunc("POST /admin/cache/maintenance", s.withAdminAuth(s.HandleAdminCacheMaintenance))
+	mux.HandleFunc("POST /admin/cache/purge", s.withAdminAuth(s.HandleAdminCachePurge))
+	mux.HandleFunc("POST /admin/jobs/delete", s.withAdminAuth(s.HandleAdminDeleteJobs))
 
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(s.StaticDir))))
 	mux.Handle("/ai-cache/", http.StripPrefix("/ai-cache/", http.FileServer(http.Dir(s.AICache.CacheDir()))))
+	return mux
+}
+
+// HTTPTimeouts bounds how long a client may hold a connection. A zero
+// value disables that timeout.
+type HTTPTimeouts struct {
+	ReadHeader time.Duration // Time to read request headers
+	Read       time.Duration // Time to read the whole request, including an upload body
+	Write      time.Duration // Time to write the response
+	Idle       time.Duration // Time a keep-alive connection may sit unused
+}
+
+// DefaultHTTPTimeouts cut off slow-loris clients at the header stage while
+// leaving room for a 50MB upload over a slow link. Writes are unbounded by
+// default because large downloads and streamed responses can legitimately
+// take a long time.
+var DefaultHTTPTimeouts = HTTPTimeouts{
+	ReadHeader: 10 * time.Second,
+	Read:       5 * time.Minute,
+	Write:      0,
+	Idle:       2 * time.Minute,
+}
+
+// Serve starts the HTTP server with the configured routes
+func (s *Server) Serve(addr string) error {
+	s.cleanWorkDir()
 	slog.Info("starting server", "addr", addr)
-	return http.ListenAndServe(addr, mux)
+	return s.httpServer(addr).ListenAndServe()
+}
+
+// httpServer returns the http.Server Serve listens with, carrying the
+// configured routes and timeouts
+func (s *Server) httpServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: s.Timeouts.ReadHeader,
+		ReadTimeout:       s.Timeouts.Read,
+		WriteTimeout:      s.Timeouts.Write,
+		IdleTimeout:       s.Timeouts.Idle,
+	}
 }
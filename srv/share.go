@@ -0,0 +1,366 @@
+package srv
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxShareExpiry bounds how long a share link may stay valid
+const maxShareExpiry = 365 * 24 * time.Hour
+
+// shareLink grants read-only access to one job through an unguessable token
+type shareLink struct {
+	Token     string
+	JobID     string
+	Protected bool      // A password is required
+	ExpiresAt time.Time // Zero for links that never expire
+	CreatedAt time.Time
+
+	passwordSalt string
+	passwordHash string
+}
+
+// Expired reports whether the link is past its expiry time
+func (l *shareLink) Expired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+// checkPassword reports whether password unlocks the link
+func (l *shareLink) checkPassword(password string) bool {
+	if !l.Protected {
+		return true
+	}
+	got := hashSharePassword(l.passwordSalt, password)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(l.passwordHash)) == 1
+}
+
+// hashSharePassword hashes a share password with its salt. Share passwords
+// only gate a link whose token is already unguessable, so a salted hash is
+// enough here.
+func hashSharePassword(salt, password string) string {
+	h := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(h[:])
+}
+
+// randomToken returns n random bytes encoded for use in a URL
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ShareStore persists share tokens in the application database
+type ShareStore struct {
+	db *sql.DB
+}
+
+// NewShareStore creates the share link table in db if needed
+func NewShareStore(db *sql.DB) (*ShareStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS share_links (
+			token TEXT PRIMARY KEY,
+			job_id TEXT NOT NULL,
+			password_salt TEXT NOT NULL DEFAULT '',
+			password_hash TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("create share table: %w", err)
+	}
+	return &ShareStore{db: db}, nil
+}
+
+// Create mints a new share link for a job. An empty password leaves the link
+// unprotected and a zero expiresAt never expires.
+func (st *ShareStore) Create(jobID, password string, expiresAt time.Time) (*shareLink, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("generate token: %w", err)
+	}
+	link := &shareLink{Token: token, JobID: jobID, ExpiresAt: expiresAt, CreatedAt: time.Now().UTC()}
+	if password != "" {
+		if link.passwordSalt, err = randomToken(16); err != nil {
+			return nil, fmt.Errorf("generate salt: %w", err)
+		}
+		link.passwordHash = hashSharePassword(link.passwordSalt, password)
+		link.Protected = true
+	}
+
+	var expires any
+	if !expiresAt.IsZero() {
+		expires = expiresAt.UTC()
+	}
+	_, err = st.db.Exec(
+		"INSERT INTO share_links (token, job_id, password_salt, password_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		link.Token, link.JobID, link.passwordSalt, link.passwordHash, expires, link.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("insert share link: %w", err)
+	}
+	return link, nil
+}
+
+const shareLinkColumns = "token, job_id, password_salt, password_hash, expires_at, created_at"
+
+func scanShareLink(sc interface{ Scan(...any) error }) (*shareLink, error) {
+	var link shareLink
+	var expires sql.NullTime
+	if err := sc.Scan(&link.Token, &link.JobID, &link.passwordSalt, &link.passwordHash, &expires, &link.CreatedAt); err != nil {
+		return nil, err
+	}
+	link.Protected = link.passwordHash != ""
+	if expires.Valid {
+		link.ExpiresAt = expires.Time
+	}
+	return &link, nil
+}
+
+// Lookup returns the link for token, or nil if it does not exist or has expired
+func (st *ShareStore) Lookup(token string) (*shareLink, error) {
+	link, err := scanShareLink(st.db.QueryRow("SELECT "+shareLinkColumns+" FROM share_links WHERE token = ?", token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if link.Expired(time.Now()) {
+		return nil, nil
+	}
+	return link, nil
+}
+
+// ForJob returns the unexpired links for a job, newest first
+func (st *ShareStore) ForJob(jobID string) ([]*shareLink, error) {
+	rows, err := st.db.Query("SELECT "+shareLinkColumns+" FROM share_links WHERE job_id = ? ORDER BY created_at DESC", jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []*shareLink
+	now := time.Now()
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !link.Expired(now) {
+			links = append(links, link)
+		}
+	}
+	return links, rows.Err()
+}
+
+// parseShareExpiry reads the expiresIn form field, a duration such as "24h";
+// empty means the link never expires
+func parseShareExpiry(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || d > maxShareExpiry {
+		return time.Time{}, fmt.Errorf("expiresIn must be a positive duration of at most %s", maxShareExpiry)
+	}
+	return time.Now().Add(d), nil
+}
+
+// HandleJobShare mints a share link for a job and returns to its status page,
+// which lists the job's active links
+func (s *Server) HandleJobShare(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	s.mu.Lock()
+	_, exists := s.jobs[jobID]
+	s.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	expiresAt, err := parseShareExpiry(r.FormValue("expiresIn"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.Shares.Create(jobID, r.FormValue("password"), expiresAt); err != nil {
+		slog.Error("create share link", "job", jobID, "error", err)
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/job/"+jobID, http.StatusSeeOther)
+}
+
+// shareCookieName is the cookie that remembers an unlocked protected link
+func shareCookieName(token string) string {
+	return "share_" + token
+}
+
+// shareCookieValue proves the holder entered the link's password. It is
+// bound to the server's secret, so cookies do not survive a restart.
+func (s *Server) shareCookieValue(link *shareLink) string {
+	mac := hmac.New(sha256.New, s.shareSecret)
+	mac.Write([]byte(link.Token + ":" + link.passwordHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sharedJob resolves a share token from the request to its job. It writes
+// the error response itself and returns nil when access is not granted; for
+// a locked protected link it renders the password prompt.
+func (s *Server) sharedJob(w http.ResponseWriter, r *http.Request) (*shareLink, *Job) {
+	link, err := s.Shares.Lookup(r.PathValue("token"))
+	if err != nil {
+		slog.Error("look up share link", "error", err)
+		http.Error(w, "Failed to look up share link", http.StatusInternalServerError)
+		return nil, nil
+	}
+	if link == nil {
+		http.Error(w, "Share link not found or expired", http.StatusNotFound)
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	job, exists := s.jobs[link.JobID]
+	s.mu.Unlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, nil
+	}
+
+	if link.Protected {
+		c, err := r.Cookie(shareCookieName(link.Token))
+		if err != nil || !hmac.Equal([]byte(c.Value), []byte(s.shareCookieValue(link))) {
+			s.renderSharePassword(w, r, link, http.StatusUnauthorized, "")
+			return nil, nil
+		}
+	}
+	return link, job
+}
+
+func (s *Server) renderSharePassword(w http.ResponseWriter, r *http.Request, link *shareLink, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := s.renderTemplate(w, "share_password.html", map[string]interface{}{
+		"Token":   link.Token,
+		"Message": message,
+	}); err != nil {
+		slog.Warn("render template", "url", r.URL.Path, "error", err)
+	}
+}
+
+// HandleShareUnlock checks the password for a protected link and remembers
+// the result in a cookie scoped to the link
+func (s *Server) HandleShareUnlock(w http.ResponseWriter, r *http.Request) {
+	link, err := s.Shares.Lookup(r.PathValue("token"))
+	if err != nil {
+		slog.Error("look up share link", "error", err)
+		http.Error(w, "Failed to look up share link", http.StatusInternalServerError)
+		return
+	}
+	if link == nil {
+		http.Error(w, "Share link not found or expired", http.StatusNotFound)
+		return
+	}
+	if !link.checkPassword(r.FormValue("password")) {
+		s.renderSharePassword(w, r, link, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+	if link.Protected {
+		cookie := &http.Cookie{
+			Name:     shareCookieName(link.Token),
+			Value:    s.shareCookieValue(link),
+			Path:     "/s/" + link.Token,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if !link.ExpiresAt.IsZero() {
+			cookie.Expires = link.ExpiresAt
+		}
+		http.SetCookie(w, cookie)
+	}
+	http.Redirect(w, r, "/s/"+link.Token, http.StatusSeeOther)
+}
+
+// HandleSharedJob renders a read-only status page for a shared job
+func (s *Server) HandleSharedJob(w http.ResponseWriter, r *http.Request) {
+	link, job := s.sharedJob(w, r)
+	if job == nil {
+		return
+	}
+
+	status := s.jobStatus(job)
+	var svgContent template.HTML
+	if status == "done" {
+		svgContent = readInlineSVG(filepath.Join(s.UploadsDir, job.ID, "output.svg"))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.renderTemplate(w, "job.html", map[string]interface{}{
+		"Job":        job,
+		"Name":       s.jobName(job),
+		"Status":     status,
+		"Warnings":   job.warnings(),
+		"Share":      link,
+		"Hostname":   s.Hostname,
+		"SVGContent": svgContent,
+
+		"AwaitingApproval": status == "done" && s.awaitingApproval(job),
+	}); err != nil {
+		slog.Warn("render template", "url", r.URL.Path, "error", err)
+	}
+}
+
+// HandleSharedDownload serves a shared job's G-Code
+func (s *Server) HandleSharedDownload(w http.ResponseWriter, r *http.Request) {
+	_, job := s.sharedJob(w, r)
+	if job == nil {
+		return
+	}
+	if s.jobStatus(job) != "done" || job.GCodePath == "" {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	if s.refuseUnapproved(w, job) {
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.downloadBaseName(job)+".gcode"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, job.GCodePath)
+}
+
+// HandleSharedSVG serves a shared job's traced SVG
+func (s *Server) HandleSharedSVG(w http.ResponseWriter, r *http.Request) {
+	_, job := s.sharedJob(w, r)
+	if job == nil {
+		return
+	}
+	svgPath := filepath.Join(s.UploadsDir, job.ID, "output.svg")
+	if s.jobStatus(job) != "done" {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(svgPath); err != nil {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", s.downloadBaseName(job)+".svg"))
+	w.Header().Set("Content-Type", "image/svg+xml")
+	http.ServeFile(w, r, svgPath)
+}
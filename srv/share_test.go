@@ -0,0 +1,115 @@
+package srv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareLinks(t *testing.T) {
+	server := newTestServer(t)
+
+	// A distinctive ID, so a share view that leaks it is caught
+	const jobID = "secretjobid"
+	jobDir := filepath.Join(server.UploadsDir, jobID)
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gcodePath := filepath.Join(jobDir, "output.gcode")
+	os.WriteFile(gcodePath, []byte("G21\nG90\n"), 0644)
+	os.WriteFile(filepath.Join(jobDir, "output.svg"), []byte("<svg/>"), 0644)
+
+	job := &Job{ID: jobID, Status: "done", OriginalName: "owl.png", GCodePath: gcodePath}
+	server.mu.Lock()
+	server.jobs[job.ID] = job
+	server.mu.Unlock()
+
+	do := func(method, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/job/"+jobID+"/share", url.Values{"password": {"hunter2"}, "expiresIn": {"24h"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body.String())
+	}
+	links, err := server.Shares.ForJob(jobID)
+	if err != nil || len(links) != 1 {
+		t.Fatalf("expected one share link, got %v, %v", links, err)
+	}
+	link := links[0]
+	if link.Token == job.ID || len(link.Token) < 40 || !link.Protected {
+		t.Errorf("unexpected share link %+v", link)
+	}
+	base := "/s/" + link.Token
+
+	if w := do(http.MethodGet, base, nil); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "requires a password") {
+		t.Errorf("expected a password prompt, got %d", w.Code)
+	} else if strings.Contains(w.Body.String(), job.ID) {
+		t.Error("the password prompt leaks the job ID")
+	}
+	if w := do(http.MethodGet, base+"/download", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected locked download to be refused, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, base, url.Values{"password": {"wrong"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong password to be refused, got %d", w.Code)
+	} else if strings.Contains(w.Body.String(), job.ID) {
+		t.Error("the wrong password page leaks the job ID")
+	}
+
+	w = do(http.MethodPost, base, url.Values{"password": {"hunter2"}})
+	if w.Code != http.StatusSeeOther || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("expected unlock to set a cookie and redirect, got %d", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	w = do(http.MethodGet, base, nil, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "Processing Log") || strings.Contains(body, "/job/"+jobID+"/rename") {
+		t.Error("shared view should not expose the log or owner controls")
+	}
+	if body := w.Body.String(); strings.Contains(body, job.ID) || !strings.Contains(body, "<title>Shared job - ") {
+		t.Errorf("the unlocked shared view leaks the job ID or lacks the neutral title:\n%s", body)
+	}
+	if w := do(http.MethodGet, base+"/download", nil, cookie); w.Body.String() != "G21\nG90\n" {
+		t.Errorf("unexpected shared download %q", w.Body.String())
+	}
+	if w := do(http.MethodGet, base+"/svg", nil, cookie); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("unexpected shared SVG response %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	open, err := server.Shares.Create(jobID, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := do(http.MethodGet, "/s/"+open.Token, nil); w.Code != http.StatusOK || strings.Contains(w.Body.String(), job.ID) {
+		t.Errorf("expected the open shared view without the job ID, got %d", w.Code)
+	}
+
+	if w := do(http.MethodGet, "/s/not-a-token", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected unknown token to 404, got %d", w.Code)
+	}
+	expired, err := server.Shares.Create(jobID, "", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := do(http.MethodGet, "/s/"+expired.Token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected expired link to 404, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/job/"+jobID+"/share", url.Values{"expiresIn": {"forever"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid expiry to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package srv
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serverStats holds simple counters for GET /stats. They live in memory
+// only and reset when the server restarts.
+type serverStats struct {
+	mu            sync.Mutex
+	started       time.Time
+	jobsCreated   int
+	jobsFinished  map[string]int // by final status
+	downloads     int
+	downloadBytes int64
+}
+
+func (st *serverStats) jobCreated() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.jobsCreated++
+}
+
+func (st *serverStats) jobFinished(status string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.jobsFinished == nil {
+		st.jobsFinished = make(map[string]int)
+	}
+	st.jobsFinished[status]++
+}
+
+func (st *serverStats) served(n int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.downloads++
+	st.downloadBytes += n
+}
+
+// statsResponse is the JSON body of GET /stats
+type statsResponse struct {
+	StartedAt     time.Time `json:"startedAt"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	Jobs          struct {
+		Created  int            `json:"created"`
+		ByStatus map[string]int `json:"byStatus"` // jobs currently held, by status
+		Finished map[string]int `json:"finished"` // jobs finished since startup, by final status
+	} `json:"jobs"`
+	AICache struct {
+		Hits   int64 `json:"hits"`
+		Misses int64 `json:"misses"`
+	} `json:"aiCache"`
+	TraceCache struct {
+		Hits   int64 `json:"hits"`
+		Misses int64 `json:"misses"`
+	} `json:"traceCache"`
+	Downloads struct {
+		Count int   `json:"count"`
+		Bytes int64 `json:"bytes"`
+	} `json:"downloads"`
+}
+
+// HandleStats reports the in-memory counters as JSON
+func (s *Server) HandleStats(w http.ResponseWriter, r *http.Request) {
+	var resp statsResponse
+
+	s.mu.Lock()
+	resp.Jobs.ByStatus = make(map[string]int)
+	for _, job := range s.jobs {
+		resp.Jobs.ByStatus[job.Status]++
+	}
+	s.mu.Unlock()
+
+	s.stats.mu.Lock()
+	resp.StartedAt = s.stats.started
+	resp.UptimeSeconds = int64(time.Since(s.stats.started).Seconds())
+	resp.Jobs.Created = s.stats.jobsCreated
+	resp.Jobs.Finished = make(map[string]int, len(s.stats.jobsFinished))
+	for status, n := range s.stats.jobsFinished {
+		resp.Jobs.Finished[status] = n
+	}
+	resp.Downloads.Count = s.stats.downloads
+	resp.Downloads.Bytes = s.stats.downloadBytes
+	s.stats.mu.Unlock()
+
+	resp.AICache.Hits, resp.AICache.Misses = s.AICache.Counts()
+	resp.TraceCache.Hits, resp.TraceCache.Misses = s.TraceCache.Counts()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// countingWriter counts the body bytes written through it
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// withDownloadStats counts the bytes a download handler sends
+func (s *Server) withDownloadStats(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ResponseWriter: w}
+		h(cw, r)
+		if cw.n > 0 {
+			s.stats.served(cw.n)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package srv
+
+import "strings"
+
+// commentStats describes what stripComments did
+type commentStats struct {
+	Lines         int // comment-only and blank lines removed
+	Inline        int // comments removed from lines that keep a command
+	Before, After int // program size in bytes, newlines included
+}
+
+// messageCommands take free text, where parentheses are part of the
+// message rather than a comment
+var messageCommands = map[float64]bool{117: true, 118: true}
+
+// stripLineComment removes the comments from one line: a ';' and the rest
+// of the line, and '(...)' runs unless keepParens is set. Text inside
+// double quotes, as in RepRapFirmware string arguments, is never a comment,
+// and a '(' without a closing ')' is left as written rather than guessed
+// at. The words either side of a removed comment keep one space between
+// them. It reports whether anything was removed.
+func stripLineComment(line string, keepParens bool) (string, bool) {
+	var b strings.Builder
+	stripped, quoted := false, false
+scan:
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ';':
+			stripped = true
+			break scan
+		case c == '(' && !keepParens:
+			end := strings.IndexByte(line[i:], ')')
+			if end < 0 {
+				b.WriteString(line[i:])
+				break scan
+			}
+			stripped = true
+			i += end
+			for i+1 < len(line) && (line[i+1] == ' ' || line[i+1] == '\t') {
+				i++
+			}
+			if s := b.String(); s != "" && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\t") {
+				b.WriteByte(' ')
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	if !stripped {
+		return line, false
+	}
+	return strings.TrimRight(b.String(), " \t"), true
+}
+
+// stripComments removes the comments from a program, and the lines left
+// with nothing else on them, while keeping every command as written. The
+// parenthesized text of message commands (M117, M118) is kept, since it is
+// what the controller displays.
+func stripComments(lines []string) ([]string, commentStats) {
+	var stats commentStats
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		stats.Before += len(line) + 1
+		words := parseGCodeWords(line)
+		keepParens := len(words) > 0 && words[0].Letter == 'M' && messageCommands[words[0].Value]
+		code, stripped := stripLineComment(line, keepParens)
+		if strings.TrimSpace(code) == "" {
+			stats.Lines++
+			continue
+		}
+		if stripped {
+			stats.Inline++
+		}
+		out = append(out, code)
+		stats.After += len(code) + 1
+	}
+	return out, stats
+}
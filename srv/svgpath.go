@@ -0,0 +1,455 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// point is a 2D coordinate in SVG user units (pixels for autotrace output)
+type point struct {
+	X, Y float64
+}
+
+// polyline is a flattened subpath
+type polyline struct {
+	Points []point
+	Closed bool
+}
+
+// svgPathElement is a <path> element read from an SVG document
+type svgPathElement struct {
+	D           string
+	Style       string
+	StrokeWidth string // stroke-width attribute, if any
+}
+
+// parseSVGPaths returns every <path> element in an SVG document in document order.
+// Transforms are not applied; autotrace output never uses them.
+func parseSVGPaths(data []byte) ([]svgPathElement, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var paths []svgPathElement
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse svg: %w", err)
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok || el.Name.Local != "path" {
+			continue
+		}
+		var p svgPathElement
+		for _, attr := range el.Attr {
+			switch attr.Name.Local {
+			case "d":
+				p.D = attr.Value
+			case "style":
+				p.Style = attr.Value
+			case "stroke-width":
+				p.StrokeWidth = attr.Value
+			}
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// curveSegments is the number of line segments used to approximate each curve
+const curveSegments = 16
+
+// maxCurveSegments bounds the segments a tolerance can split one curve into
+const maxCurveSegments = 1000
+
+// flattenPathData parses SVG path data and converts it into polylines,
+// approximating curves and arcs with curveSegments straight segments each.
+func flattenPathData(d string) ([]polyline, error) {
+	return flattenPathDataWithin(d, 0)
+}
+
+// flattenPathDataWithin is flattenPathData with each curve split into as
+// many segments as keep it within tolerance, in SVG user units, of the
+// true curve. A tolerance of 0 uses curveSegments.
+func flattenPathDataWithin(d string, tolerance float64) ([]polyline, error) {
+	toks, err := tokenizePathData(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result  []polyline
+		current *polyline
+		cur     point
+		start   point
+		lastCtl point // last control point, for S/T reflection
+		lastCmd byte
+		i       int
+	)
+
+	num := func() (float64, error) {
+		if i >= len(toks) || toks[i].cmd != 0 {
+			return 0, fmt.Errorf("path data: expected number")
+		}
+		v := toks[i].num
+		i++
+		return v, nil
+	}
+	nums := func(n int) ([]float64, error) {
+		out := make([]float64, n)
+		for k := range out {
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			out[k] = v
+		}
+		return out, nil
+	}
+	lineTo := func(p point) {
+		if current == nil {
+			result = append(result, polyline{Points: []point{cur}})
+			current = &result[len(result)-1]
+		}
+		current.Points = append(current.Points, p)
+		cur = p
+	}
+
+	var cmd byte
+	for i < len(toks) {
+		if toks[i].cmd != 0 {
+			cmd = toks[i].cmd
+			i++
+		} else if cmd == 0 {
+			return nil, fmt.Errorf("path data: missing command")
+		}
+		rel := cmd >= 'a' && cmd <= 'z'
+		upper := cmd &^ 0x20
+		offset := func(x, y float64) point {
+			if rel {
+				return point{cur.X + x, cur.Y + y}
+			}
+			return point{x, y}
+		}
+
+		switch upper {
+		case 'M':
+			v, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			cur = offset(v[0], v[1])
+			start = cur
+			result = append(result, polyline{Points: []point{cur}})
+			current = &result[len(result)-1]
+			// Subsequent coordinate pairs are implicit lineto commands
+			if rel {
+				cmd = 'l'
+			} else {
+				cmd = 'L'
+			}
+		case 'L':
+			v, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			lineTo(offset(v[0], v[1]))
+		case 'H':
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			if rel {
+				v += cur.X
+			}
+			lineTo(point{v, cur.Y})
+		case 'V':
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			if rel {
+				v += cur.Y
+			}
+			lineTo(point{cur.X, v})
+		case 'C', 'S':
+			var c1 point
+			var rest []float64
+			if upper == 'C' {
+				v, err := nums(6)
+				if err != nil {
+					return nil, err
+				}
+				c1 = offset(v[0], v[1])
+				rest = v[2:]
+			} else {
+				v, err := nums(4)
+				if err != nil {
+					return nil, err
+				}
+				c1 = cur
+				if l := lastCmd &^ 0x20; l == 'C' || l == 'S' {
+					c1 = point{2*cur.X - lastCtl.X, 2*cur.Y - lastCtl.Y}
+				}
+				rest = v
+			}
+			c2 := offset(rest[0], rest[1])
+			end := offset(rest[2], rest[3])
+			p0 := cur
+			n := curveSegments
+			if tolerance > 0 {
+				n = bezierSegments(3, math.Max(secondDifference(p0, c1, c2), secondDifference(c1, c2, end)), tolerance)
+			}
+			for k := 1; k <= n; k++ {
+				lineTo(cubicAt(p0, c1, c2, end, float64(k)/float64(n)))
+			}
+			lastCtl = c2
+		case 'Q', 'T':
+			var c point
+			var end point
+			if upper == 'Q' {
+				v, err := nums(4)
+				if err != nil {
+					return nil, err
+				}
+				c = offset(v[0], v[1])
+				end = offset(v[2], v[3])
+			} else {
+				v, err := nums(2)
+				if err != nil {
+					return nil, err
+				}
+				c = cur
+				if l := lastCmd &^ 0x20; l == 'Q' || l == 'T' {
+					c = point{2*cur.X - lastCtl.X, 2*cur.Y - lastCtl.Y}
+				}
+				end = offset(v[0], v[1])
+			}
+			p0 := cur
+			n := curveSegments
+			if tolerance > 0 {
+				n = bezierSegments(2, secondDifference(p0, c, end), tolerance)
+			}
+			for k := 1; k <= n; k++ {
+				lineTo(quadAt(p0, c, end, float64(k)/float64(n)))
+			}
+			lastCtl = c
+		case 'A':
+			v, err := nums(7)
+			if err != nil {
+				return nil, err
+			}
+			end := offset(v[5], v[6])
+			for _, p := range arcPoints(cur, end, v[0], v[1], v[2], v[3] != 0, v[4] != 0, tolerance) {
+				lineTo(p)
+			}
+		case 'Z':
+			if current != nil {
+				if cur != start {
+					current.Points = append(current.Points, start)
+				}
+				current.Closed = true
+			}
+			cur = start
+			current = nil
+		default:
+			return nil, fmt.Errorf("path data: unsupported command %q", cmd)
+		}
+		lastCmd = cmd
+	}
+
+	// Drop degenerate subpaths consisting of a lone moveto
+	out := result[:0]
+	for _, pl := range result {
+		if len(pl.Points) > 1 {
+			out = append(out, pl)
+		}
+	}
+	return out, nil
+}
+
+type pathToken struct {
+	cmd byte // 0 for numbers
+	num float64
+}
+
+// tokenizePathData splits SVG path data into commands and numbers
+func tokenizePathData(d string) ([]pathToken, error) {
+	var toks []pathToken
+	i := 0
+	for i < len(d) {
+		c := d[i]
+		switch {
+		case c == ' ' || c == ',' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) >= 0:
+			toks = append(toks, pathToken{cmd: c})
+			i++
+		default:
+			j := i
+			if d[j] == '+' || d[j] == '-' {
+				j++
+			}
+			seenDot, seenExp := false, false
+			for j < len(d) {
+				ch := d[j]
+				if ch >= '0' && ch <= '9' {
+					j++
+				} else if ch == '.' && !seenDot && !seenExp {
+					seenDot = true
+					j++
+				} else if (ch == 'e' || ch == 'E') && !seenExp && j > i {
+					seenExp = true
+					j++
+					if j < len(d) && (d[j] == '+' || d[j] == '-') {
+						j++
+					}
+				} else {
+					break
+				}
+			}
+			if j == i {
+				return nil, fmt.Errorf("path data: unexpected character %q", c)
+			}
+			v, err := strconv.ParseFloat(d[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("path data: bad number %q", d[i:j])
+			}
+			toks = append(toks, pathToken{num: v})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+func cubicAt(p0, p1, p2, p3 point, t float64) point {
+	mt := 1 - t
+	a := mt * mt * mt
+	b := 3 * mt * mt * t
+	c := 3 * mt * t * t
+	d := t * t * t
+	return point{
+		a*p0.X + b*p1.X + c*p2.X + d*p3.X,
+		a*p0.Y + b*p1.Y + c*p2.Y + d*p3.Y,
+	}
+}
+
+func quadAt(p0, p1, p2 point, t float64) point {
+	mt := 1 - t
+	return point{
+		mt*mt*p0.X + 2*mt*t*p1.X + t*t*p2.X,
+		mt*mt*p0.Y + 2*mt*t*p1.Y + t*t*p2.Y,
+	}
+}
+
+// secondDifference is the length of a - 2b + c, which bounds how far a
+// Bézier curve bends between three consecutive control points
+func secondDifference(a, b, c point) float64 {
+	return math.Hypot(a.X-2*b.X+c.X, a.Y-2*b.Y+c.Y)
+}
+
+// bezierSegments is the number of equal steps in t that keep a Bézier
+// curve of a degree within tolerance of its chords, by Wang's formula, given
+// the largest second difference of its control points
+func bezierSegments(degree int, bend, tolerance float64) int {
+	n := math.Ceil(math.Sqrt(float64(degree*(degree-1)) / 8 * bend / tolerance))
+	return int(math.Max(1, math.Min(n, maxCurveSegments)))
+}
+
+// arcSegments is the number of equal steps that keep an arc of radius r
+// sweeping dTheta radians within tolerance of its chords
+func arcSegments(r, dTheta, tolerance float64) int {
+	step := math.Pi
+	if tolerance < r {
+		step = 2 * math.Acos(1-tolerance/r)
+	}
+	n := math.Ceil(math.Abs(dTheta) / step)
+	return int(math.Max(1, math.Min(n, maxCurveSegments)))
+}
+
+// arcPoints approximates an SVG elliptical arc using the endpoint-to-center
+// conversion from the SVG specification (appendix F.6), with curveSegments
+// segments, or as many as keep it within tolerance when that is above 0.
+func arcPoints(from, to point, rx, ry, xRotDeg float64, largeArc, sweep bool, tolerance float64) []point {
+	if from == to {
+		return nil
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		return []point{to}
+	}
+
+	phi := xRotDeg * math.Pi / 180
+	cosPhi, sinPhi := math.Cos(phi), math.Sin(phi)
+	dx, dy := (from.X-to.X)/2, (from.Y-to.Y)/2
+	x1 := cosPhi*dx + sinPhi*dy
+	y1 := -sinPhi*dx + cosPhi*dy
+
+	// Scale radii up if they are too small to span the endpoints
+	if lambda := x1*x1/(rx*rx) + y1*y1/(ry*ry); lambda > 1 {
+		s := math.Sqrt(lambda)
+		rx *= s
+		ry *= s
+	}
+
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := 0.0
+	if den != 0 && num > 0 {
+		coef = math.Sqrt(num / den)
+	}
+	if largeArc == sweep {
+		coef = -coef
+	}
+	cx1 := coef * rx * y1 / ry
+	cy1 := -coef * ry * x1 / rx
+	cx := cosPhi*cx1 - sinPhi*cy1 + (from.X+to.X)/2
+	cy := sinPhi*cx1 + cosPhi*cy1 + (from.Y+to.Y)/2
+
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta1 := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	dTheta := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && dTheta > 0 {
+		dTheta -= 2 * math.Pi
+	} else if sweep && dTheta < 0 {
+		dTheta += 2 * math.Pi
+	}
+
+	n := curveSegments
+	if tolerance > 0 {
+		n = arcSegments(math.Max(rx, ry), dTheta, tolerance)
+	}
+	pts := make([]point, 0, n)
+	for k := 1; k <= n; k++ {
+		t := theta1 + dTheta*float64(k)/float64(n)
+		x := rx * math.Cos(t)
+		y := ry * math.Sin(t)
+		pts = append(pts, point{cosPhi*x - sinPhi*y + cx, sinPhi*x + cosPhi*y + cy})
+	}
+	pts[len(pts)-1] = to
+	return pts
+}
+
+// readSVGPolylines parses an SVG file's paths and flattens them into polylines
+func readSVGPolylines(data []byte) ([]polyline, error) {
+	paths, err := parseSVGPaths(data)
+	if err != nil {
+		return nil, err
+	}
+	var all []polyline
+	for _, p := range paths {
+		pls, err := flattenPathData(p.D)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, pls...)
+	}
+	return all, nil
+}
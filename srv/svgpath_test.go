@@ -0,0 +1,443 @@
+package srv
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlattenPathData(t *testing.T) {
+	t.Run("lines and implicit lineto", func(t *testing.T) {
+		pls, err := flattenPathData("M10,10 20,10 l0 10 H5 v-5z")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(pls) != 1 {
+			t.Fatalf("expected 1 polyline, got %d", len(pls))
+		}
+		want := []point{{10, 10}, {20, 10}, {20, 20}, {5, 20}, {5, 15}, {10, 10}}
+		if !pointsEqual(pls[0].Points, want) {
+			t.Errorf("points = %v, expected %v", pls[0].Points, want)
+		}
+		if !pls[0].Closed {
+			t.Error("expected polyline to be closed")
+		}
+	})
+
+	t.Run("cubic curve ends at endpoint", func(t *testing.T) {
+		pls, err := flattenPathData("M0 0C0 10 10 10 10 0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		pts := pls[0].Points
+		if len(pts) != curveSegments+1 {
+			t.Errorf("expected %d points, got %d", curveSegments+1, len(pts))
+		}
+		if last := pts[len(pts)-1]; last != (point{10, 0}) {
+			t.Errorf("last point = %v, expected {10 0}", last)
+		}
+		if mid := pts[curveSegments/2]; math.Abs(mid.Y-7.5) > 1e-9 {
+			t.Errorf("curve midpoint Y = %v, expected 7.5", mid.Y)
+		}
+	})
+
+	t.Run("arc passes through its extreme", func(t *testing.T) {
+		pls, err := flattenPathData("M0 0 A5 5 0 0 1 10 0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		minY := 0.0
+		for _, p := range pls[0].Points {
+			minY = math.Min(minY, p.Y)
+		}
+		if math.Abs(minY+5) > 1e-9 {
+			t.Errorf("arc min Y = %v, expected -5", minY)
+		}
+	})
+
+	t.Run("tolerance", func(t *testing.T) {
+		const d = "M0 0C0 10 10 10 10 0"
+		coarse, _ := flattenPathDataWithin(d, 0.5)
+		fine, err := flattenPathDataWithin(d, 0.01)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(fine[0].Points) <= len(coarse[0].Points) {
+			t.Errorf("expected a finer tolerance to use more points, got %d and %d", len(fine[0].Points), len(coarse[0].Points))
+		}
+		pts := fine[0].Points
+		for k := 0; k <= 200; k++ {
+			p := cubicAt(point{0, 0}, point{0, 10}, point{10, 10}, point{10, 0}, float64(k)/200)
+			dist := math.Inf(1)
+			for i := 1; i < len(pts); i++ {
+				dist = math.Min(dist, pointSegmentDistance(p, pts[i-1], pts[i]))
+			}
+			if dist > 0.01 {
+				t.Fatalf("curve strays %g from its segments at t=%g", dist, float64(k)/200)
+			}
+		}
+
+		arc, _ := flattenPathDataWithin("M0 0 A5 5 0 0 1 10 0", 0.01)
+		pts = arc[0].Points
+		for i := 1; i < len(pts); i++ {
+			mid := point{(pts[i-1].X + pts[i].X) / 2, (pts[i-1].Y + pts[i].Y) / 2}
+			if r := math.Hypot(mid.X-5, mid.Y); r < 5-0.01 {
+				t.Fatalf("arc chord %d strays %g from the arc", i, 5-r)
+			}
+		}
+	})
+
+	t.Run("multiple subpaths and exponents", func(t *testing.T) {
+		pls, err := flattenPathData("M0 0L1e1 0M-5-5L-5.5.5")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(pls) != 2 {
+			t.Fatalf("expected 2 polylines, got %d", len(pls))
+		}
+		if !pointsEqual(pls[1].Points, []point{{-5, -5}, {-5.5, 0.5}}) {
+			t.Errorf("second polyline = %v", pls[1].Points)
+		}
+	})
+
+	t.Run("invalid data", func(t *testing.T) {
+		if _, err := flattenPathData("M0 0 L1"); err == nil {
+			t.Error("expected error for truncated path data")
+		}
+		if _, err := flattenPathData("10 10"); err == nil {
+			t.Error("expected error for missing command")
+		}
+	})
+}
+
+func TestEncodeDXF(t *testing.T) {
+	var buf bytes.Buffer
+	encodeDXF(&buf, []polyline{
+		{Points: []point{{0, 0}, {10, 0}, {10, 10}, {0, 0}}, Closed: true},
+	}, 0.5, 10)
+
+	out := buf.String()
+	for _, want := range []string{"LWPOLYLINE", "90\n3\n", "70\n1\n", "10\n5.0000\n20\n5.0000\n", "0\nEOF\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected DXF output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestEncodeHPGL(t *testing.T) {
+	var buf bytes.Buffer
+	encodeHPGL(&buf, []polyline{
+		{Points: []point{{0, 0}, {10, 0}, {10, 10}}, Closed: true},
+		{Points: []point{{4, 4}}},
+	}, 2, 10)
+
+	want := "IN;SP1;PA;\nPU0,20;\nPD20,20,20,0,0,20;\nPU;SP0;\n"
+	if got := buf.String(); got != want {
+		t.Errorf("encodeHPGL = %q, expected %q", got, want)
+	}
+
+	buf.Reset()
+	long := polyline{}
+	for i := 0; i <= hpglPointsPerCommand+1; i++ {
+		long.Points = append(long.Points, point{float64(i), 0})
+	}
+	encodeHPGL(&buf, []polyline{long}, 1, 0)
+	if n := strings.Count(buf.String(), "PD"); n != 2 {
+		t.Errorf("expected long polyline to be split into 2 PD commands, got %d:\n%s", n, buf.String())
+	}
+}
+
+func pointsEqual(a, b []point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i].X-b[i].X) > 1e-9 || math.Abs(a[i].Y-b[i].Y) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStrokeHistogram(t *testing.T) {
+	svg := `<svg>
+<path style="stroke:#000000; fill:none;" d="M0 0L1 1"/>
+<path style="stroke:#7f7f7f; fill:none;" d="M0 0L1 1"/>
+<path style="stroke:#000000; fill:none;" d="M0 0L1 1"/>
+<path d="M0 0L1 1"/>
+</svg>`
+	total, hist, err := strokeHistogram([]byte(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []strokeCount{{"000000", 2}, {"", 1}, {"7F7F7F", 1}}
+	if total != 4 || !reflect.DeepEqual(hist, want) {
+		t.Errorf("strokeHistogram = %d, %v; expected 4, %v", total, hist, want)
+	}
+}
+
+func TestFilterSmallPaths(t *testing.T) {
+	svg := []byte(`<svg>
+<path style="stroke:#000000; stroke-width:3.5; fill:none;" d="M0 0L100 0"/>
+<path style="stroke:#000000; stroke-width:0.5; fill:none;" d="M0 10L100 10"/>
+<path stroke-width="0.2" style="stroke:#000000; fill:none;" d="M0 20L100 20"/>
+<path style="stroke:#000000; fill:none;" d="M0 30L2 30"/>
+<path style="stroke:#000000; fill:none;" d="M0 40L3 40L3 43Z"/>
+</svg>`)
+
+	out, thin, short := filterSmallPathsData(svg, 1, 0)
+	if thin != 2 || short != 0 {
+		t.Errorf("width filter removed %d thin, %d short; want 2, 0", thin, short)
+	}
+	if bytes.Contains(out, []byte("M0 10L100 10")) || bytes.Contains(out, []byte("M0 20L100 20")) {
+		t.Errorf("thin paths kept:\n%s", out)
+	}
+
+	// The closed triangle is 3+3+sqrt(18) long, just over 10
+	out, thin, short = filterSmallPathsData(svg, 0, 10)
+	if thin != 0 || short != 1 {
+		t.Errorf("length filter removed %d thin, %d short; want 0, 1", thin, short)
+	}
+	if bytes.Contains(out, []byte("M0 30L2 30")) || !bytes.Contains(out, []byte("M0 40L3 40L3 43Z")) {
+		t.Errorf("wrong short paths removed:\n%s", out)
+	}
+
+	if out, thin, short := filterSmallPathsData(svg, 0, 0); thin+short != 0 || !bytes.Equal(out, svg) {
+		t.Error("zero thresholds should leave the SVG unchanged")
+	}
+
+	for _, v := range []string{"-1", "abc", "Inf"} {
+		if _, err := parseSVGDistance("minPathLength", v); err == nil {
+			t.Errorf("parseSVGDistance(%q) should fail", v)
+		}
+	}
+}
+
+func TestJoinGaps(t *testing.T) {
+	const black = `style="stroke:#000000; fill:none;"`
+	svg := []byte(`<svg>
+<path ` + black + ` d="M0 0L10 0"/>
+<path style="stroke:#FF0000; fill:none;" d="M10 0L10 10"/>
+<path ` + black + ` d="M20 0L10.5 0"/>
+<path ` + black + ` d="M50 50L60 50"/>
+<path ` + black + ` d="M-5 0.3C-3 0 -1 0 -0.2 0"/>
+<path ` + black + ` d="M0 20L5 20L5 25Z"/>
+</svg>`)
+
+	out, joins := joinGapsData(svg, 1)
+	if joins != 2 {
+		t.Fatalf("joins = %d, want 2", joins)
+	}
+	paths, err := parseSVGPaths(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 4 {
+		t.Fatalf("got %d paths, want 4:\n%s", len(paths), out)
+	}
+	pls, err := flattenPathData(paths[0].D)
+	if err != nil || len(pls) != 1 {
+		t.Fatalf("joined path %q: %v", paths[0].D, err)
+	}
+	pts := pls[0].Points
+	if first, last := pts[0], pts[len(pts)-1]; first != (point{-5, 0.3}) || last != (point{20, 0}) {
+		t.Errorf("joined path runs %v to %v, want (-5,0.3) to (20,0)", first, last)
+	}
+	// The red stroke and the closed triangle touch black endpoints but are
+	// never joined
+	if paths[1].D != "M10 0L10 10" || paths[3].D != "M0 20L5 20L5 25Z" {
+		t.Errorf("unjoinable paths changed:\n%s", out)
+	}
+
+	if out, joins := joinGapsData(svg, 0.1); joins != 0 || !bytes.Equal(out, svg) {
+		t.Errorf("tiny gap made %d joins", joins)
+	}
+}
+
+func TestRotateSVG(t *testing.T) {
+	if !shouldRotate(100, 50, 100, 200, false) || shouldRotate(50, 100, 100, 200, false) || shouldRotate(80, 80, 100, 200, false) {
+		t.Error("only a landscape design should turn to fit a portrait bed")
+	}
+	if shouldRotate(60, 40, 100, 200, true) || !shouldRotate(150, 40, 100, 200, true) {
+		t.Error("a declared size that fits either way should keep its orientation")
+	}
+
+	svg := []byte(`<svg width="100" height="50"><path style="stroke:#000000" d="M10 10h20v5l-5 5C30 30 40 30 50 40S60 45 70 45Q80 40 90 45T95 48A5 5 0 0 1 90 20Z"/></svg>`)
+	out, err := rotateSVGData(svg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h, ok := parseSVGDimensions(out); !ok || w != 50 || h != 100 {
+		t.Fatalf("rotated size %gx%g, want 50x100:\n%s", w, h, out)
+	}
+	orig, _ := parseSVGPaths(svg)
+	rotated, err := parseSVGPaths(out)
+	if err != nil || len(rotated) != 1 || rotated[0].Style != orig[0].Style {
+		t.Fatalf("rotated paths %v: %v", rotated, err)
+	}
+	before, _ := flattenPathData(orig[0].D)
+	after, err := flattenPathData(rotated[0].D)
+	if err != nil || len(after) != 1 || len(after[0].Points) != len(before[0].Points) {
+		t.Fatalf("rotated path %q does not match the original: %v", rotated[0].D, err)
+	}
+	for i, p := range before[0].Points {
+		want := point{50 - p.Y, p.X}
+		if q := after[0].Points[i]; math.Abs(q.X-want.X) > 0.01 || math.Abs(q.Y-want.Y) > 0.01 {
+			t.Fatalf("point %d: %v turned to %v, want %v", i, p, q, want)
+		}
+	}
+
+	vb, err := rotateSVGData([]byte(`<svg viewBox="0 0 100 50"><path d="M0 0L100 50"/></svg>`))
+	if err != nil || !bytes.Contains(vb, []byte(`viewBox="0 0 50 100"`)) || !bytes.Contains(vb, []byte(`d="M50.000 0.000L0.000 100.000"`)) {
+		t.Errorf("viewBox rotation: %s %v", vb, err)
+	}
+}
+
+func TestOrderContours(t *testing.T) {
+	// An outer square holding a smaller square, which holds an open stroke,
+	// plus an open stroke outside both. The two squares share one element.
+	const svg = `<svg width="100" height="100">
+<path style="stroke:#000000; fill:none;" d="M0 0L100 0L100 100L0 100Z M20 20L80 20L80 80L20 80Z"/>
+<path style="stroke:#000000; fill:none;" d="M40 50L60 50"/>
+<path style="stroke:#000000; fill:none;" d="M110 0L120 10"/>
+</svg>`
+	order := func(t *testing.T, how string) []string {
+		t.Helper()
+		out, stats, err := orderContoursData([]byte(svg), how)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Closed != 2 || stats.Open != 2 || stats.MaxDepth != 2 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+		var ds []string
+		for _, m := range pathDataAttrRegex.FindAllSubmatch(out, -1) {
+			ds = append(ds, string(m[1]))
+		}
+		return ds
+	}
+
+	got := order(t, ContourOrderInsideOut)
+	want := []string{`"M40 50L60 50"`, `"M20.000 20.000L80.000 20.000L80.000 80.000L20.000 80.000Z"`, `"M0.000 0.000L100.000 0.000L100.000 100.000L0.000 100.000Z"`, `"M110 0L120 10"`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected inside-out order:\n%s", strings.Join(got, "\n"))
+	}
+	got = order(t, ContourOrderOutsideIn)
+	if len(got) != 4 || !strings.HasPrefix(got[0], `"M0.000 0.000`) || !strings.HasPrefix(got[1], `"M110`) || got[3] != `"M40 50L60 50"` {
+		t.Errorf("unexpected outside-in order:\n%s", strings.Join(got, "\n"))
+	}
+
+	if _, err := parseContourOrder("spiral"); err == nil {
+		t.Error("expected an error for an unknown order")
+	}
+}
+
+func TestCheckOverlaps(t *testing.T) {
+	// A figure eight crossing itself at (50, 50), a stroke retraced by a
+	// second path, and a square drawn alongside it that crosses nothing.
+	const svg = `<svg width="200" height="100">
+<path style="stroke:#000000; fill:none;" d="M0 0L100 100L100 0L0 100Z"/>
+<path style="stroke:#000000; fill:none;" d="M120 0L120 50L150 50"/>
+<path style="stroke:#000000; fill:none;" d="M120 50L120 0"/>
+<path style="stroke:#000000; fill:none;" d="M160 10L190 10L190 40L160 40Z"/>
+</svg>`
+	out, rep, err := checkOverlapsData([]byte(svg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != svg {
+		t.Error("the check changed the SVG without removeDuplicates")
+	}
+	if len(rep.Crossings) != 1 || math.Abs(rep.Crossings[0].X-50) > 1e-9 || math.Abs(rep.Crossings[0].Y-50) > 1e-9 {
+		t.Errorf("unexpected crossings %v", rep.Crossings)
+	}
+	if len(rep.Overlaps) != 1 || math.Abs(rep.OverlapLength-50) > 1e-9 || rep.Duplicates != 1 || rep.Removed != 0 {
+		t.Errorf("unexpected report %+v", rep)
+	}
+
+	out, rep, err = checkOverlapsData([]byte(svg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Removed != 1 {
+		t.Errorf("removed %d segments, want 1", rep.Removed)
+	}
+	if strings.Contains(string(out), `d="M120 50L120 0"`) || strings.Count(string(out), "<path") != 3 {
+		t.Errorf("the duplicate stroke was not removed:\n%s", out)
+	}
+	if !strings.Contains(string(out), `d="M120 0L120 50L150 50"`) {
+		t.Errorf("the first copy of the stroke was changed:\n%s", out)
+	}
+
+	// A partial overlap is reported but not removed
+	const partial = `<svg><path d="M0 0L10 0"/><path d="M5 0L20 0"/></svg>`
+	out, rep, err = checkOverlapsData([]byte(partial), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Overlaps) != 1 || math.Abs(rep.OverlapLength-5) > 1e-9 || rep.Removed != 0 || string(out) != partial {
+		t.Errorf("unexpected partial overlap report %+v", rep)
+	}
+}
+
+func TestFillClosedPaths(t *testing.T) {
+	svg := []byte(`<svg width="30" height="10">` +
+		`<path style="stroke:#000000; fill:none;" d="M0.5 0.5H9.5V9.5H0.5Z"/>` +
+		`<path style="stroke:#000000; fill:none;" d="M3.5 3.5H6.5V6.5H3.5Z"/>` +
+		`<path style="stroke:#000000; fill:none;" d="M12 1L18 9"/>` +
+		`<path style="stroke:#FF0000; fill:none;" d="M20.5 0.5H22.5V2.5H20.5L20.5 0.5"/>` +
+		`</svg>`)
+
+	out, stats, err := fillClosedPaths(svg, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rows 1-9 cross the outer square, and rows 4-6 are split by the hole
+	if stats.Regions != 3 || stats.Lines != 14 || stats.Colors != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if !bytes.HasPrefix(out, svg[:bytes.LastIndex(svg, []byte("</svg>"))]) {
+		t.Error("expected the existing paths kept ahead of the hatching")
+	}
+	pls, err := readSVGPolylines(append([]byte("<svg>"), out[bytes.LastIndex(svg, []byte("</svg>")):]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pls) != 14 {
+		t.Fatalf("expected 14 hatch lines, got %d", len(pls))
+	}
+	for _, pl := range pls[:12] {
+		a, b := pl.Points[0], pl.Points[1]
+		if a.Y != b.Y || a.Y < 1 || a.Y > 9 || min(a.X, b.X) < 0.5 || max(a.X, b.X) > 9.5 {
+			t.Errorf("hatch line %v leaves the square", pl.Points)
+		}
+		if mid := (a.X + b.X) / 2; a.Y > 3.5 && a.Y < 6.5 && mid > 3.5 && mid < 6.5 {
+			t.Errorf("hatch line %v crosses the hole", pl.Points)
+		}
+	}
+	if !bytes.Contains(out, []byte(`<path style="stroke:#ff0000; fill:none;" d="M20.500 1.000L22.500 1.000M22.500 2.000L20.500 2.000"/>`)) {
+		t.Errorf("expected the red square hatched back and forth in red:\n%s", out)
+	}
+
+	// Counterclockwise on the plot, with Y up, slopes up to the left in SVG
+	out, _, err = fillClosedPaths(svg, 45, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pls, _ = readSVGPolylines(append([]byte("<svg>"), out[bytes.LastIndex(svg, []byte("</svg>")):]...))
+	if len(pls) == 0 {
+		t.Fatal("expected hatching at 45°")
+	}
+	for _, pl := range pls {
+		a, b := pl.Points[0], pl.Points[1]
+		if math.Abs(math.Abs(b.X-a.X)-math.Abs(b.Y-a.Y)) > 0.01 || (b.X-a.X)*(b.Y-a.Y) > 0 {
+			t.Fatalf("expected lines rising to the right on the plot, got %v", pl.Points)
+		}
+	}
+
+	if _, _, err := parseFill(true, "", "0.01"); err == nil {
+		t.Error("expected an error for a spacing under the minimum")
+	}
+}
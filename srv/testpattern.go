@@ -0,0 +1,385 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Test pattern types for GET /test-pattern
+const (
+	PatternGrid       = "grid"       // a square grid, to check scale, squareness, and backlash
+	PatternFeedLadder = "feedladder" // zigzag rungs at rising feeds, to find the fastest clean one
+	PatternPenTest    = "pentest"    // filled squares at rising tool power, for pen pressure or laser power
+)
+
+// Test pattern limits
+const (
+	maxPatternSize     = 1000.0 // mm along either axis
+	minPatternSpacing  = 0.5    // mm between lines
+	maxPatternSteps    = 20
+	defaultPatternFeed = 1000.0 // mm/min
+	maxPatternFeed     = 100000.0
+)
+
+// patternStep is a part of a test pattern drawn with one feed and tool-on
+// command
+type patternStep struct {
+	Comment string
+	ToolOn  string
+	Feed    float64
+	Strokes [][]point
+}
+
+// patternNumber reads a numeric query parameter, def when it is empty
+func patternNumber(q url.Values, name string, def, lo, hi float64) (float64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(n >= lo && n <= hi) {
+		return 0, fmt.Errorf("%s must be a number from %g to %g", name, lo, hi)
+	}
+	return n, nil
+}
+
+// patternSteps reads the steps query parameter
+func patternSteps(q url.Values, def int) (int, error) {
+	v := q.Get("steps")
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 2 || n > maxPatternSteps {
+		return 0, fmt.Errorf("steps must be a whole number from 2 to %d", maxPatternSteps)
+	}
+	return n, nil
+}
+
+// patternTicks returns 0 and every multiple of spacing up to length, with
+// length itself last so the pattern ends on its edge
+func patternTicks(length, spacing float64) []float64 {
+	var ticks []float64
+	for i := 0; float64(i)*spacing < length-1e-9; i++ {
+		ticks = append(ticks, float64(i)*spacing)
+	}
+	return append(ticks, length)
+}
+
+// stepValue returns the i-th of steps values spread evenly from a to b
+func stepValue(a, b float64, i, steps int) float64 {
+	return a + (b-a)*float64(i)/float64(steps-1)
+}
+
+// gridPattern draws lines spacing mm apart across a width by height mm
+// rectangle, rows then columns, each line run the opposite way to the one
+// before so travel stays short and backlash shows as offset lines
+func gridPattern(width, height, spacing, feed float64, toolOn string) []patternStep {
+	step := patternStep{
+		Comment: fmt.Sprintf("grid %g x %g mm, lines %g mm apart, F%g", width, height, spacing, feed),
+		ToolOn:  toolOn,
+		Feed:    feed,
+	}
+	for i, y := range patternTicks(height, spacing) {
+		s := []point{{0, y}, {width, y}}
+		if i%2 == 1 {
+			s[0], s[1] = s[1], s[0]
+		}
+		step.Strokes = append(step.Strokes, s)
+	}
+	for i, x := range patternTicks(width, spacing) {
+		s := []point{{x, 0}, {x, height}}
+		if i%2 == 1 {
+			s[0], s[1] = s[1], s[0]
+		}
+		step.Strokes = append(step.Strokes, s)
+	}
+	return []patternStep{step}
+}
+
+// feedLadderPattern draws steps zigzag rungs width mm long and spacing mm
+// apart, the first at feed from and the last at feed to. The 90° turns of
+// each zigzag show where a feed is too fast for the machine to corner.
+func feedLadderPattern(width, spacing, from, to float64, steps int, toolOn string) []patternStep {
+	h := spacing / 2
+	var out []patternStep
+	for i := 0; i < steps; i++ {
+		feed := math.Round(stepValue(from, to, i, steps))
+		base := float64(i) * spacing
+		var s []point
+		for k, x := range patternTicks(width, h) {
+			s = append(s, point{x, base + h*float64(k%2)})
+		}
+		out = append(out, patternStep{
+			Comment: fmt.Sprintf("rung %d of %d: F%g", i+1, steps, feed),
+			ToolOn:  toolOn,
+			Feed:    feed,
+			Strokes: [][]point{s},
+		})
+	}
+	return out
+}
+
+// penTestPattern draws steps filled squares of size mm in a row, the first
+// with tool power from and the last with to, set as the S word of toolOn.
+// Each square is its outline, then a fill of lines a tenth of its size
+// apart.
+func penTestPattern(size, from, to float64, steps int, feed float64, toolOn string) []patternStep {
+	var out []patternStep
+	for i := 0; i < steps; i++ {
+		power := math.Round(stepValue(from, to, i, steps))
+		x0 := float64(i) * size * 1.5
+		outline := []point{{x0, 0}, {x0 + size, 0}, {x0 + size, size}, {x0, size}, {x0, 0}}
+		var fill []point
+		for k, y := range patternTicks(size, size/10) {
+			if k%2 == 0 {
+				fill = append(fill, point{x0, y}, point{x0 + size, y})
+			} else {
+				fill = append(fill, point{x0 + size, y}, point{x0, y})
+			}
+		}
+		on := toolOnWithPower(toolOn, power)
+		out = append(out, patternStep{
+			Comment: fmt.Sprintf("square %d of %d: %s", i+1, steps, on),
+			ToolOn:  on,
+			Feed:    feed,
+			Strokes: [][]point{outline, fill},
+		})
+	}
+	return out
+}
+
+// toolOnWithPower sets the S word of a tool-on command, adding one if it
+// has none
+func toolOnWithPower(toolOn string, power float64) string {
+	value := strconv.FormatFloat(power, 'f', -1, 64)
+	hasS := false
+	line := mapGCodeWords(toolOn, "S", func(byte, float64) string {
+		hasS = true
+		return value
+	})
+	if !hasS {
+		line = strings.TrimSpace(line + " S" + value)
+	}
+	return line
+}
+
+// parseTestPattern reads the type query parameter and that pattern's own
+// parameters, and returns its steps. The pen test's squares are sized by
+// size alone, so it refuses spacing rather than ignoring it.
+func parseTestPattern(q url.Values, toolOn string) (string, []patternStep, error) {
+	kind := q.Get("type")
+	feed, err := patternNumber(q, "feed", defaultPatternFeed, 1, maxPatternFeed)
+	if err != nil {
+		return "", nil, err
+	}
+	spacing, err := patternNumber(q, "spacing", 10, minPatternSpacing, maxPatternSize)
+	if err != nil {
+		return "", nil, err
+	}
+	switch kind {
+	case PatternGrid:
+		width, err := patternNumber(q, "width", 100, minPatternSpacing, maxPatternSize)
+		if err != nil {
+			return "", nil, err
+		}
+		height, err := patternNumber(q, "height", 100, minPatternSpacing, maxPatternSize)
+		if err != nil {
+			return "", nil, err
+		}
+		return kind, gridPattern(width, height, spacing, feed, toolOn), nil
+	case PatternFeedLadder:
+		width, err := patternNumber(q, "width", 100, minPatternSpacing, maxPatternSize)
+		if err != nil {
+			return "", nil, err
+		}
+		from, err := patternNumber(q, "feedFrom", 500, 1, maxPatternFeed)
+		if err != nil {
+			return "", nil, err
+		}
+		to, err := patternNumber(q, "feedTo", 5000, 1, maxPatternFeed)
+		if err != nil {
+			return "", nil, err
+		}
+		steps, err := patternSteps(q, 6)
+		if err != nil {
+			return "", nil, err
+		}
+		if float64(steps)*spacing > maxPatternSize {
+			return "", nil, fmt.Errorf("%d rungs %g mm apart do not fit in %g mm", steps, spacing, maxPatternSize)
+		}
+		return kind, feedLadderPattern(width, spacing, from, to, steps, toolOn), nil
+	case PatternPenTest:
+		if q.Has("spacing") {
+			return "", nil, fmt.Errorf("spacing does not apply to %q; use size", PatternPenTest)
+		}
+		size, err := patternNumber(q, "size", 10, minPatternSpacing*10, maxPatternSize)
+		if err != nil {
+			return "", nil, err
+		}
+		from, err := patternNumber(q, "powerFrom", 100, 0, math.MaxUint16)
+		if err != nil {
+			return "", nil, err
+		}
+		to, err := patternNumber(q, "powerTo", 1000, 0, math.MaxUint16)
+		if err != nil {
+			return "", nil, err
+		}
+		steps, err := patternSteps(q, 5)
+		if err != nil {
+			return "", nil, err
+		}
+		if float64(steps)*size*1.5 > maxPatternSize {
+			return "", nil, fmt.Errorf("%d squares of %g mm do not fit in %g mm", steps, size, maxPatternSize)
+		}
+		return kind, penTestPattern(size, from, to, steps, feed, toolOn), nil
+	}
+	return "", nil, fmt.Errorf("type must be %q, %q, or %q", PatternGrid, PatternFeedLadder, PatternPenTest)
+}
+
+// patternMoves renders a test pattern as G-Code the way registrationMoves
+// renders marks: the tool is raised before every travel and lowered with
+// the step's command once over the start of a stroke
+func patternMoves(kind string, steps []patternStep, toolOff string) []string {
+	lines := []string{"; test pattern: " + kind}
+	for _, st := range steps {
+		lines = append(lines, "; "+st.Comment)
+		for _, s := range st.Strokes {
+			if toolOff != "" {
+				lines = append(lines, toolOff)
+			}
+			lines = append(lines, fmt.Sprintf("G0 X%.3f Y%.3f", s[0].X, s[0].Y))
+			if st.ToolOn != "" {
+				lines = append(lines, st.ToolOn)
+			}
+			for i, p := range s[1:] {
+				line := fmt.Sprintf("G1 X%.3f Y%.3f", p.X, p.Y)
+				if i == 0 {
+					line += " F" + strconv.FormatFloat(st.Feed, 'f', -1, 64)
+				}
+				lines = append(lines, line)
+			}
+		}
+	}
+	if toolOff != "" {
+		lines = append(lines, toolOff)
+	}
+	return append(lines, "; end test pattern")
+}
+
+// testPatternProgram wraps a pattern's moves as a job's program is wrapped:
+// feeds clamped to maxFeed, then the flavor, then the machine setup. A
+// pattern with neither sets mm and absolute positioning itself, as it has
+// no svg2gcode output that would.
+func testPatternProgram(moves []string, opts JobOptions, maxFeed float64) []string {
+	lines := moves
+	if maxFeed > 0 {
+		lines, _ = clampFeedrates(lines, maxFeed)
+	}
+	switch {
+	case opts.GCodeFlavor != "":
+		lines, _ = applyGCodeFlavor(lines, jobFlavor(opts), opts.GCodeHome)
+	case !opts.MachineSetup:
+		lines = append(append([]string{}, genericSetupModes...), lines...)
+	}
+	if setup := jobMachineSetup(opts); setup != nil {
+		lines = append(append([]string{}, setup...), lines...)
+	}
+	return lines
+}
+
+// HandleTestPattern generates a calibration program without an upload.
+// type picks the pattern; toolOn, toolOff, the flavor and machine setup
+// options, and maxFeed work as they do for jobs, and header, footer,
+// precision, lineEndings, and offset as they do for downloads.
+func (s *Server) HandleTestPattern(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	toolOn := q.Get("toolOn")
+	if toolOn == "" {
+		toolOn = defaultToolOn
+	}
+	toolOff := q.Get("toolOff")
+	if toolOff == "" {
+		toolOff = defaultToolOff
+	}
+	kind, steps, err := parseTestPattern(q, toolOn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flavor := strings.ToLower(q.Get("gcodeFlavor"))
+	home := q.Get("gcodeHome") == "on" || q.Get("gcodeHome") == "true"
+	if err := validateGCodeFlavor(flavor, home); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	feedUnits, err := parseFeedUnits(q.Get("feedUnits"), flavor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setupOn := q.Get("machineSetup") == "on" || q.Get("machineSetup") == "true"
+	setup, err := parseMachineSetup(setupOn, flavor, home, q.Get("setupHome"), q.Get("setupWorkOffset"), q.Get("setupAbsolute"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxFeed, err := parseMaxFeed(q.Get("maxFeed"), s.MaxFeed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := parseDownloadTransform(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if maxFeed > 0 {
+		t.Header, _ = clampFeedrates(t.Header, maxFeed)
+		t.Footer, _ = clampFeedrates(t.Footer, maxFeed)
+	}
+
+	opts := JobOptions{
+		ToolOff:         toolOff,
+		GCodeFlavor:     flavor,
+		GCodeHome:       home,
+		FeedUnits:       feedUnits,
+		MachineSetup:    setupOn,
+		SetupHome:       setup.Home,
+		SetupWorkOffset: setup.WorkOffset,
+		SetupAbsolute:   setup.Absolute,
+	}
+	data, err := t.apply(testPatternProgram(patternMoves(kind, steps, toolOff), opts, maxFeed))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Nothing else checks a pattern against the bed, so it is checked
+	// here, where it is drawn
+	if len(s.KeepOut) > 0 {
+		moves, err := parseGCodeMoves(bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if violations := checkKeepOut(moves, s.KeepOut); len(violations) > 0 {
+			msg := fmt.Sprintf("%d cutting moves enter a keep-out region (first: %s)", len(violations), violations[0])
+			if s.KeepOutFail {
+				http.Error(w, msg, http.StatusUnprocessableEntity)
+				return
+			}
+			w.Header().Set("X-Keep-Out-Violations", strconv.Itoa(len(violations)))
+		}
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "test-pattern-"+kind+".gcode"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
@@ -0,0 +1,277 @@
+package srv
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxTileGrid bounds the rows and the columns of tileGrid, since every tile
+// is traced and converted on its own
+const maxTileGrid = 8
+
+// parseTileGrid validates the tileGrid option, ROWSxCOLS such as "2x3", and
+// returns it normalized. Empty and "1x1" leave the input whole.
+func parseTileGrid(v string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return "", nil
+	}
+	rs, cs, ok := strings.Cut(v, "x")
+	rows, errR := strconv.Atoi(strings.TrimSpace(rs))
+	cols, errC := strconv.Atoi(strings.TrimSpace(cs))
+	if !ok || errR != nil || errC != nil || rows < 1 || cols < 1 || rows > maxTileGrid || cols > maxTileGrid {
+		return "", fmt.Errorf("tileGrid must be ROWSxCOLS such as 2x3, with 1 to %d of each", maxTileGrid)
+	}
+	if rows*cols == 1 {
+		return "", nil
+	}
+	return fmt.Sprintf("%dx%d", rows, cols), nil
+}
+
+// tileGridSize returns the rows and columns of a grid parseTileGrid
+// accepted, 1 and 1 when tiling is off
+func tileGridSize(grid string) (rows, cols int) {
+	if _, err := fmt.Sscanf(grid, "%dx%d", &rows, &cols); err != nil {
+		return 1, 1
+	}
+	return rows, cols
+}
+
+// imageTile is one cell of a tiled input
+type imageTile struct {
+	Row, Col int             // from 0, rows counted down from the top
+	Rect     image.Rectangle // the pixels of the whole image it covers
+	Image    string          // the cropped image, for autotrace
+	SVG      string          // its trace on the whole image's canvas
+}
+
+// Name identifies the tile in file names, counting rows from the top and
+// columns from the left, both from 1
+func (t imageTile) Name() string {
+	return fmt.Sprintf("tile_r%d_c%d", t.Row+1, t.Col+1)
+}
+
+// tileRects splits b into rows x cols rectangles, row by row from the top.
+// Neighbouring tiles differ in size by at most a pixel.
+func tileRects(b image.Rectangle, rows, cols int) []image.Rectangle {
+	rects := make([]image.Rectangle, 0, rows*cols)
+	for r := 0; r < rows; r++ {
+		y0, y1 := b.Min.Y+r*b.Dy()/rows, b.Min.Y+(r+1)*b.Dy()/rows
+		for c := 0; c < cols; c++ {
+			x0, x1 := b.Min.X+c*b.Dx()/cols, b.Min.X+(c+1)*b.Dx()/cols
+			rects = append(rects, image.Rect(x0, y0, x1, y1))
+		}
+	}
+	return rects
+}
+
+// cropTiles cuts the image at inPath into a rows x cols grid of images in
+// dir, written as PPM with transparency flattened onto bg when ppm is set,
+// as normalizeInput would, and as PNG otherwise. It returns the tiles and
+// the size of the whole image.
+func cropTiles(inPath, dir string, rows, cols int, ppm bool, bg color.RGBA) ([]imageTile, image.Rectangle, error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	defer in.Close()
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("decode image: %w", err)
+	}
+	b := img.Bounds()
+	if b.Dx() < cols || b.Dy() < rows {
+		return nil, b, fmt.Errorf("a %dx%d px image is too small for %d rows and %d columns of tiles", b.Dx(), b.Dy(), rows, cols)
+	}
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		return nil, b, fmt.Errorf("cannot crop a %T", img)
+	}
+
+	var tiles []imageTile
+	for i, rect := range tileRects(b, rows, cols) {
+		t := imageTile{Row: i / cols, Col: i % cols, Rect: rect.Sub(b.Min)}
+		ext := ".png"
+		if ppm {
+			ext = ".ppm"
+		}
+		t.Image = filepath.Join(dir, t.Name()+ext)
+		t.SVG = filepath.Join(dir, t.Name()+".svg")
+		out, err := os.Create(t.Image)
+		if err != nil {
+			return nil, b, err
+		}
+		if ppm {
+			err = encodePPM(out, sub.SubImage(rect), bg)
+		} else {
+			err = png.Encode(out, sub.SubImage(rect))
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, b, err
+		}
+		tiles = append(tiles, t)
+	}
+	return tiles, b.Sub(b.Min), nil
+}
+
+// svgHeader starts an SVG the way autotrace does
+func svgHeader(width, height int) string {
+	return fmt.Sprintf("<?xml version=\"1.0\" standalone=\"yes\"?>\n<svg width=\"%d\" height=\"%d\">\n", width, height)
+}
+
+// placeTilePaths returns the path elements of a tile's trace moved by the
+// tile's offset into the whole image, one per line. Like parseSVGPaths it
+// assumes autotrace output, with no transforms.
+func placeTilePaths(data []byte, offset image.Point) ([]byte, error) {
+	shift := func(p point) point { return point{p.X + float64(offset.X), p.Y + float64(offset.Y)} }
+	var b bytes.Buffer
+	for _, elem := range pathElementRegex.FindAll(data, -1) {
+		m := pathDataAttrRegex.FindSubmatch(elem)
+		if m == nil {
+			continue
+		}
+		d, err := transformPathData(string(m[1][1:len(m[1])-1]), shift)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(pathDataAttrRegex.ReplaceAllLiteral(elem, []byte(` d="`+d+`"`)))
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// traceTiles runs autotrace on each tile and writes the traces, moved into
+// place, to svgPath as one SVG the size of the whole image. Each tile's
+// placed trace is also kept on its own in the tile's SVG file, on the same
+// canvas, so its program lines up with the whole job's.
+func (s *Server) traceTiles(job *Job, tiles []imageTile, size image.Rectangle, relax *traceRelaxation, svgPath string) error {
+	header := svgHeader(size.Dx(), size.Dy())
+	var all bytes.Buffer
+	all.WriteString(header)
+	for _, t := range tiles {
+		job.Log.WriteString(fmt.Sprintf("--- %s: %dx%d px at %d,%d ---\n", t.Name(), t.Rect.Dx(), t.Rect.Dy(), t.Rect.Min.X, t.Rect.Min.Y))
+		raw := strings.TrimSuffix(t.SVG, ".svg") + ".raw.svg"
+		if err := s.runAutotrace(job, relax, t.Image, raw); err != nil {
+			return fmt.Errorf("%s: %w", t.Name(), err)
+		}
+		data, err := os.ReadFile(raw)
+		if err != nil {
+			return err
+		}
+		paths, err := placeTilePaths(data, t.Rect.Min)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.Name(), err)
+		}
+		if err := os.WriteFile(t.SVG, []byte(header+string(paths)+"</svg>\n"), 0644); err != nil {
+			return err
+		}
+		all.Write(paths)
+	}
+	all.WriteString("</svg>\n")
+	return os.WriteFile(svgPath, all.Bytes(), 0644)
+}
+
+// cutBounds returns the bounds of a program's cutting moves
+func cutBounds(lines []string) (bounds, bool) {
+	moves, err := parseGCodeMoves(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return bounds{}, false
+	}
+	return movesBounds(moves, true)
+}
+
+// writeTilePrograms converts each tile's trace to its own program and
+// writes them to zipPath, returning how many it wrote. A tile's SVG gets
+// the path filters, refinement, turn, and fill the whole trace got, and its
+// program goes through finishProgram like the whole job's, moved by shift,
+// the distance padding to the bed moved the whole job. Each program is on
+// the whole job's coordinates, so the tiles plotted side by side make up
+// the design. Tiles left with nothing to draw are skipped. The stages of a
+// tile's program repeat the job's, so only their warnings are logged.
+func (s *Server) writeTilePrograms(job *Job, workDir string, tiles []imageTile, dpi float64, shift point, zipPath string) (int, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	written := 0
+	for _, t := range tiles {
+		data, err := os.ReadFile(t.SVG)
+		if err != nil {
+			return written, err
+		}
+		if job.WhiteAction != WhiteActionKeep {
+			data, _ = filterWhitePathsData(data, job.WhiteAction, job.WhiteThreshold, job.Background)
+		}
+		if job.MinStrokeWidth > 0 || job.MinPathLength > 0 {
+			data, _, _ = filterSmallPathsData(data, job.MinStrokeWidth, job.MinPathLength)
+		}
+		svgPath := filepath.Join(workDir, t.Name()+".final.svg")
+		var tileLog strings.Builder
+		if job.JoinGap > 0 || job.CheckOverlaps || job.ContourOrder != "" {
+			if err := os.WriteFile(svgPath, data, 0644); err != nil {
+				return written, err
+			}
+			refinePaths(job, svgPath, &tileLog)
+			if data, err = os.ReadFile(svgPath); err != nil {
+				return written, err
+			}
+		}
+		if job.Rotated {
+			if data, err = rotateSVGData(data); err != nil {
+				return written, fmt.Errorf("%s: %w", t.Name(), err)
+			}
+		}
+		if job.Fill {
+			if data, _, err = fillClosedPaths(data, job.FillAngle, job.FillSpacing/25.4*dpi); err != nil {
+				return written, fmt.Errorf("%s: %w", t.Name(), err)
+			}
+		}
+		if err := os.WriteFile(svgPath, data, 0644); err != nil {
+			return written, err
+		}
+		if n, err := countDrawablePaths(svgPath); err != nil || n == 0 {
+			job.Log.WriteString(fmt.Sprintf("%s: nothing to draw, skipped\n", t.Name()))
+			continue
+		}
+
+		gcodePath := filepath.Join(workDir, t.Name()+".gcode")
+		if err := s.generateGCode(job, workDir, svgPath, gcodePath, dpi); err != nil {
+			return written, fmt.Errorf("%s: %w", t.Name(), err)
+		}
+		_, err = s.finishProgram(job, gcodePath, t.Name(), shift, &tileLog)
+		for _, line := range strings.Split(tileLog.String(), "\n") {
+			if strings.HasPrefix(line, "Warning: ") {
+				job.Log.WriteString(fmt.Sprintf("%s: %s\n", t.Name(), line))
+			}
+		}
+		if err != nil {
+			return written, fmt.Errorf("%s: %w", t.Name(), err)
+		}
+		lines, err := readGCodeLines(gcodePath)
+		if err != nil {
+			return written, err
+		}
+		if b, ok := cutBounds(lines); ok {
+			job.Log.WriteString(fmt.Sprintf("%s: X%.3f..%.3f Y%.3f..%.3f\n", t.Name(), b.MinX, b.MaxX, b.MinY, b.MaxY))
+		}
+		if _, _, err := addFileToZip(zw, t.Name()+".gcode", gcodePath); err != nil {
+			return written, err
+		}
+		written++
+	}
+	if err := zw.Close(); err != nil {
+		return written, err
+	}
+	return written, os.WriteFile(zipPath, buf.Bytes(), 0644)
+}
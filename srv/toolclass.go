@@ -0,0 +1,215 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxToolClasses bounds the rules in a job's toolClasses, each of which
+// costs an svg2gcode run
+const maxToolClasses = 8
+
+// toolClass gives the paths matching one stroke color or width range their
+// own tool settings, such as a laser power and feed for cutting and another
+// for scoring. Exactly one of Color or the width bounds is set.
+type toolClass struct {
+	Color    string  `json:"color,omitempty"`    // RRGGBB stroke color
+	MinWidth float64 `json:"minWidth,omitempty"` // Matches stroke widths >= MinWidth
+	MaxWidth float64 `json:"maxWidth,omitempty"` // Matches stroke widths < MaxWidth
+	ToolOn   string  `json:"toolOn"`
+	ToolOff  string  `json:"toolOff"`
+	Feed     float64 `json:"feed,omitempty"` // mm/min; 0 leaves svg2gcode's feedrate
+}
+
+// Selector returns the rule's match condition as written in toolClasses
+func (c toolClass) Selector() string {
+	switch {
+	case c.Color != "":
+		return "#" + c.Color
+	case c.MaxWidth > 0:
+		return fmt.Sprintf("width<%g", c.MaxWidth)
+	default:
+		return fmt.Sprintf("width>=%g", c.MinWidth)
+	}
+}
+
+// Rule returns the class as a toolClasses rule that parses back to it
+func (c toolClass) Rule() string {
+	s := c.Selector() + "=" + c.ToolOn + "|" + c.ToolOff
+	if c.Feed > 0 {
+		s += "|" + strconv.FormatFloat(c.Feed, 'f', -1, 64)
+	}
+	return s
+}
+
+func (c toolClass) String() string {
+	s := fmt.Sprintf("%s: on %q, off %q", c.Selector(), c.ToolOn, c.ToolOff)
+	if c.Feed > 0 {
+		s += fmt.Sprintf(", feed %g", c.Feed)
+	}
+	return s
+}
+
+func (c toolClass) matches(p svgPathElement) bool {
+	if c.Color != "" {
+		m := strokeColorRegex.FindStringSubmatch(p.Style)
+		return m != nil && strings.EqualFold(m[1], c.Color)
+	}
+	w := pathStrokeWidth(p)
+	if c.MaxWidth > 0 {
+		return w < c.MaxWidth
+	}
+	return w >= c.MinWidth
+}
+
+// parseToolClasses parses one rule per line (or per ';'), each
+// SELECTOR=TOOLON[|TOOLOFF[|FEED]]. SELECTOR is a hex stroke color such as
+// #FF0000, width>=N, or width<N with N in SVG pixels. TOOLOFF defaults to
+// the job's tool off command. For example:
+//
+//	#FF0000=M3 S1000|M5|300
+//	width<1=M3 S150|M5|1500
+func parseToolClasses(spec, defaultOff string) ([]toolClass, error) {
+	var classes []toolClass
+	for _, rule := range strings.FieldsFunc(spec, func(r rune) bool { return r == '\n' || r == ';' }) {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		// The selector ends at the first '=' that is not part of ">="
+		split := -1
+		for i := 0; i < len(rule); i++ {
+			if rule[i] == '=' && (i == 0 || rule[i-1] != '>') {
+				split = i
+				break
+			}
+		}
+		if split < 0 {
+			return nil, fmt.Errorf("toolClasses rule %q: expected SELECTOR=TOOLON|TOOLOFF|FEED", rule)
+		}
+		sel := strings.ReplaceAll(rule[:split], " ", "")
+		settings := rule[split+1:]
+		var c toolClass
+		switch {
+		case strings.HasPrefix(sel, "width>="):
+			v, err := strconv.ParseFloat(strings.TrimPrefix(sel, "width>="), 64)
+			if err != nil || v <= 0 || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("toolClasses rule %q: width>= needs a positive number", rule)
+			}
+			c.MinWidth = v
+		case strings.HasPrefix(sel, "width<"):
+			v, err := strconv.ParseFloat(strings.TrimPrefix(sel, "width<"), 64)
+			if err != nil || v <= 0 || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("toolClasses rule %q: width< needs a positive number", rule)
+			}
+			c.MaxWidth = v
+		default:
+			color, err := parseHexColor(sel)
+			if err != nil || color == "" {
+				return nil, fmt.Errorf("toolClasses rule %q: selector must be a hex color, width>=N, or width<N", rule)
+			}
+			c.Color = strings.ToUpper(color)
+		}
+
+		parts := strings.Split(settings, "|")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("toolClasses rule %q: expected at most TOOLON|TOOLOFF|FEED", rule)
+		}
+		c.ToolOn = strings.TrimSpace(parts[0])
+		c.ToolOff = defaultOff
+		if c.ToolOn == "" {
+			return nil, fmt.Errorf("toolClasses rule %q: a tool on command is required", rule)
+		}
+		if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+			c.ToolOff = strings.TrimSpace(parts[1])
+		}
+		if len(parts) > 2 && strings.TrimSpace(parts[2]) != "" {
+			feed, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+			if err != nil || feed <= 0 || math.IsInf(feed, 0) {
+				return nil, fmt.Errorf("toolClasses rule %q: feed must be a positive number of mm/min", rule)
+			}
+			c.Feed = feed
+		}
+		classes = append(classes, c)
+	}
+	if len(classes) > maxToolClasses {
+		return nil, fmt.Errorf("toolClasses has %d rules; the maximum is %d", len(classes), maxToolClasses)
+	}
+	return classes, nil
+}
+
+// splitSVGByClass returns one copy of the SVG per class, each keeping only
+// the paths whose first matching rule is that class, followed by a copy with
+// the paths no rule matched. Every copy keeps the root element, so all of
+// them scale identically. counts holds the number of paths in each copy.
+func splitSVGByClass(data []byte, classes []toolClass) (svgs [][]byte, counts []int) {
+	classOf := func(match []byte) int {
+		paths, err := parseSVGPaths(match)
+		if err != nil || len(paths) != 1 {
+			return len(classes)
+		}
+		for i, c := range classes {
+			if c.matches(paths[0]) {
+				return i
+			}
+		}
+		return len(classes)
+	}
+	counts = make([]int, len(classes)+1)
+	for i := range counts {
+		svgs = append(svgs, pathElementRegex.ReplaceAllFunc(data, func(match []byte) []byte {
+			if classOf(match) != i {
+				return []byte{}
+			}
+			counts[i]++
+			return match
+		}))
+	}
+	return svgs, counts
+}
+
+// convertToolClasses converts the paths of each tool class with that
+// class's settings and joins the programs into gcodePath, marking each group
+// with a comment. Paths no rule matches use the job's own tool commands and
+// come last.
+func (s *Server) convertToolClasses(job *Job, workDir, svgPath, gcodePath string, dpi float64) error {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return err
+	}
+	svgs, counts := splitSVGByClass(data, job.ToolClasses)
+	classes := append(append([]toolClass(nil), job.ToolClasses...), toolClass{ToolOn: job.ToolOn, ToolOff: job.ToolOff})
+
+	var program []string
+	for i, c := range classes {
+		label := c.String()
+		if i == len(job.ToolClasses) {
+			label = fmt.Sprintf("unmatched paths: on %q, off %q", c.ToolOn, c.ToolOff)
+		}
+		job.Log.WriteString(fmt.Sprintf("Group %d (%s): %d paths\n", i+1, label, counts[i]))
+		if counts[i] == 0 {
+			continue
+		}
+
+		classSVG := filepath.Join(workDir, fmt.Sprintf("class-%d.svg", i+1))
+		classGCode := filepath.Join(workDir, fmt.Sprintf("class-%d.gcode", i+1))
+		if err := os.WriteFile(classSVG, svgs[i], 0644); err != nil {
+			return err
+		}
+		if err := s.convertSVG(job, c.ToolOn, c.ToolOff, c.Feed, classSVG, classGCode, dpi); err != nil {
+			return fmt.Errorf("group %d: %w", i+1, err)
+		}
+		lines, err := readGCodeLines(classGCode)
+		if err != nil {
+			return err
+		}
+		// The previous group's program already ends with its tool off
+		program = append(program, fmt.Sprintf("; Group %d: %s", i+1, label))
+		program = append(program, lines...)
+	}
+	return writeGCodeLines(gcodePath, program)
+}
@@ -0,0 +1,89 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// signalNames are the signals a tool is likely to die of, by the names
+// operators know them by
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+// signalName returns sig as SIGKILL and the like, or as its number
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+// toolFailure records how an external tool failed
+type toolFailure struct {
+	Tool      string `json:"tool"`
+	ExitCode  *int   `json:"exitCode,omitempty"` // set when the tool exited on its own
+	Signal    string `json:"signal,omitempty"`   // set when a signal ended it, such as SIGKILL
+	OOMKilled bool   `json:"oomKilled"`          // SIGKILL, which is almost always the OOM killer
+	Transient bool   `json:"transient"`          // see isTransientToolError
+	Error     string `json:"error"`
+}
+
+// newToolFailure describes err, the failure of the tool name. A tool killed
+// by a signal has no exit code; a shell-style status above 128 is taken as
+// the signal it stands for, since the tools may be run through wrappers.
+// A tool that never started has neither.
+func newToolFailure(name string, err error) *toolFailure {
+	f := &toolFailure{Tool: name, Transient: isTransientToolError(err), Error: err.Error()}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return f
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		f.Signal = signalName(ws.Signal())
+		f.OOMKilled = ws.Signal() == syscall.SIGKILL
+		return f
+	}
+	code := exitErr.ExitCode()
+	f.ExitCode = &code
+	if code > 128 {
+		f.Signal = signalName(syscall.Signal(code - 128))
+		f.OOMKilled = syscall.Signal(code-128) == syscall.SIGKILL
+	}
+	return f
+}
+
+// String describes the failure for the job log
+func (f *toolFailure) String() string {
+	var s string
+	switch {
+	case f.ExitCode != nil && f.Signal != "":
+		s = fmt.Sprintf("%s exited with code %d (%s)", f.Tool, *f.ExitCode, f.Signal)
+	case f.ExitCode != nil:
+		s = fmt.Sprintf("%s exited with code %d", f.Tool, *f.ExitCode)
+	case f.Signal != "":
+		s = fmt.Sprintf("%s was killed by %s", f.Tool, f.Signal)
+	default:
+		s = fmt.Sprintf("%s could not be run: %s", f.Tool, f.Error)
+	}
+	switch {
+	case f.OOMKilled:
+		s += ", most likely by the out-of-memory killer"
+	case f.Transient:
+		s += ", which looks like a machine fault rather than bad input"
+	case f.ExitCode != nil:
+		s += ", which usually means it rejected its input"
+	}
+	return s
+}
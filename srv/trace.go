@@ -0,0 +1,136 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// traceRelaxation loosens autotrace settings for a retry of an empty trace
+type traceRelaxation struct {
+	ColorCount     int
+	DespeckleLevel int
+}
+
+// emptyTraceRetries are tried in order when autoRetryEmpty is set and a
+// trace comes out empty. More colors keep faint or mid-gray lines from
+// merging into the background; despeckling off keeps thin strokes that
+// would otherwise be removed as noise.
+var emptyTraceRetries = []traceRelaxation{
+	{ColorCount: 4, DespeckleLevel: 0},
+	{ColorCount: 8, DespeckleLevel: 0},
+}
+
+func (r traceRelaxation) String() string {
+	return fmt.Sprintf("-color-count %d -despeckle-level %d", r.ColorCount, r.DespeckleLevel)
+}
+
+// autotraceCommandArgs builds the autotrace command line for a job. A nil
+// relax gives the normal settings; otherwise its options come after the
+// user's extra arguments so they take precedence.
+func autotraceCommandArgs(job *Job, relax *traceRelaxation, inputPath, svgPath string) []string {
+	return append(autotraceOptions(job, relax), "-output-file", svgPath, inputPath)
+}
+
+// autotraceOptions returns the autotrace arguments other than the file
+// names, which with the input image decide the trace
+func autotraceOptions(job *Job, relax *traceRelaxation) []string {
+	args := []string{"-centerline", "-color-count", "2"}
+	if job.BackgroundColor != "" {
+		args = append(args, "-background-color", job.BackgroundColor)
+	}
+	args = append(args, job.AutotraceArgs...)
+	if relax != nil {
+		args = append(args,
+			"-color-count", strconv.Itoa(relax.ColorCount),
+			"-despeckle-level", strconv.Itoa(relax.DespeckleLevel))
+	}
+	return args
+}
+
+// countDrawablePaths counts the paths in an SVG that have path data
+func countDrawablePaths(svgPath string) (int, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return 0, err
+	}
+	paths, err := parseSVGPaths(data)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, p := range paths {
+		if len(bytes.TrimSpace([]byte(p.D))) > 0 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// strokeCount is one row of a trace's stroke color histogram
+type strokeCount struct {
+	Color string // RRGGBB, or "" for paths without a stroke color
+	Paths int
+}
+
+// strokeHistogram counts the paths in an SVG by stroke color, most common
+// first. It is for the job log only and does not change the file.
+func strokeHistogram(data []byte) (int, []strokeCount, error) {
+	paths, err := parseSVGPaths(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	counts := make(map[string]int)
+	for _, p := range paths {
+		color := ""
+		if m := strokeColorRegex.FindStringSubmatch(p.Style); m != nil {
+			color = strings.ToUpper(m[1])
+		}
+		counts[color]++
+	}
+	hist := make([]strokeCount, 0, len(counts))
+	for color, n := range counts {
+		hist = append(hist, strokeCount{color, n})
+	}
+	sort.Slice(hist, func(i, j int) bool {
+		if hist[i].Paths != hist[j].Paths {
+			return hist[i].Paths > hist[j].Paths
+		}
+		return hist[i].Color < hist[j].Color
+	})
+	return len(paths), hist, nil
+}
+
+// logTraceAnalysis records the path count and stroke color histogram of
+// the traced SVG on the job and writes them to the job log
+func logTraceAnalysis(job *Job, svgPath string) {
+	job.Log.WriteString("=== Trace analysis ===\n")
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		job.Log.WriteString(fmt.Sprintf("Warning: could not read trace: %v\n\n", err))
+		return
+	}
+	total, hist, err := strokeHistogram(data)
+	if err != nil {
+		job.Log.WriteString(fmt.Sprintf("Warning: could not analyze trace: %v\n\n", err))
+		return
+	}
+	job.TracePaths, job.TraceColors = total, hist
+	job.Log.WriteString(fmt.Sprintf("%d paths, %d stroke colors\n", total, len(hist)))
+	for _, c := range hist {
+		switch {
+		case c.Color == "":
+			job.Log.WriteString(fmt.Sprintf("  (none)   %d\n", c.Paths))
+		case job.Background == BackgroundBlack && isBackgroundAt(c.Color, defaultWhiteThreshold, BackgroundBlack):
+			job.Log.WriteString(fmt.Sprintf("  #%s  %d (near-black)\n", c.Color, c.Paths))
+		case isNearWhite(c.Color):
+			job.Log.WriteString(fmt.Sprintf("  #%s  %d (near-white)\n", c.Color, c.Paths))
+		default:
+			job.Log.WriteString(fmt.Sprintf("  #%s  %d\n", c.Color, c.Paths))
+		}
+	}
+	job.Log.WriteString("\n")
+}
@@ -0,0 +1,132 @@
+package srv
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TraceCache keeps autotrace's SVGs so an image traced again with the same
+// arguments, by a rerun or an identical upload, is not traced from scratch
+type TraceCache struct {
+	db       *sql.DB
+	cacheDir string
+
+	hits, misses atomic.Int64 // Lookup outcomes since startup
+}
+
+// NewTraceCache creates the trace cache table in db if needed, keeping the
+// SVGs in cacheDir
+func NewTraceCache(db *sql.DB, cacheDir string) (*TraceCache, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("create trace cache dir: %w", err)
+	}
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS trace_cache (
+			cache_key TEXT PRIMARY KEY,
+			input_hash TEXT NOT NULL,
+			args TEXT NOT NULL,
+			svg_filename TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("create trace_cache table: %w", err)
+	}
+	return &TraceCache{db: db, cacheDir: cacheDir}, nil
+}
+
+// Counts returns the number of cache hits and misses since startup
+func (c *TraceCache) Counts() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// Lookup returns the path of the SVG traced from an image with inputHash
+// using args, or "" if there is none
+func (c *TraceCache) Lookup(inputHash, args string) (string, error) {
+	cacheKey := MakeCacheKey(inputHash, args)
+
+	var filename string
+	err := c.db.QueryRow("SELECT svg_filename FROM trace_cache WHERE cache_key = ?", cacheKey).Scan(&filename)
+	if err == sql.ErrNoRows {
+		c.misses.Add(1)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fullPath := filepath.Join(c.cacheDir, filename)
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		c.db.Exec("DELETE FROM trace_cache WHERE cache_key = ?", cacheKey)
+		c.misses.Add(1)
+		return "", nil
+	}
+	c.hits.Add(1)
+	return fullPath, nil
+}
+
+// Store copies the SVG at svgPath into the cache as the trace of an image
+// with inputHash using args
+func (c *TraceCache) Store(inputHash, args, svgPath string) error {
+	filename := fmt.Sprintf("%s_%d.svg", inputHash[:16], time.Now().UnixNano())
+	fullPath := filepath.Join(c.cacheDir, filename)
+	if err := installFile(svgPath, fullPath); err != nil {
+		return fmt.Errorf("write cache file: %w", err)
+	}
+
+	_, err := c.db.Exec(
+		"INSERT OR REPLACE INTO trace_cache (cache_key, input_hash, args, svg_filename) VALUES (?, ?, ?, ?)",
+		MakeCacheKey(inputHash, args), inputHash, args, filename,
+	)
+	if err != nil {
+		os.Remove(fullPath)
+		return fmt.Errorf("insert cache record: %w", err)
+	}
+	return nil
+}
+
+// runAutotrace traces inputPath to svgPath, reusing a cached trace when
+// CacheTraces is on. Traces are keyed on the bytes of the image autotrace
+// would read, after any preprocessing or AI transformation, and on its
+// arguments other than the file names. A cache that fails only costs the
+// trace it would have saved, so its errors are warnings.
+func (s *Server) runAutotrace(job *Job, relax *traceRelaxation, inputPath, svgPath string) error {
+	args := autotraceCommandArgs(job, relax, inputPath, svgPath)
+	if !s.CacheTraces || s.TraceCache == nil {
+		return s.runTool(job, "autotrace", args)
+	}
+
+	inputHash, err := HashFile(inputPath)
+	if err != nil {
+		job.Log.WriteString(fmt.Sprintf("Warning: trace cache skipped: %v\n", err))
+		return s.runTool(job, "autotrace", args)
+	}
+	key := strings.Join(quoteArgs(autotraceOptions(job, relax)), " ")
+	cached, err := s.TraceCache.Lookup(inputHash, key)
+	if err != nil {
+		job.Log.WriteString(fmt.Sprintf("Warning: trace cache lookup failed: %v\n", err))
+	}
+	if cached != "" {
+		err := installFile(cached, svgPath)
+		if err == nil {
+			job.Log.WriteString(fmt.Sprintf("Trace cache hit: reused the trace of image %s with %s\n", inputHash[:16], key))
+			job.ToolFailure = nil
+			return nil
+		}
+		job.Log.WriteString(fmt.Sprintf("Warning: failed to copy cached trace: %v\n", err))
+	}
+	job.Log.WriteString(fmt.Sprintf("Trace cache miss for image %s\n", inputHash[:16]))
+
+	if err := s.runTool(job, "autotrace", args); err != nil {
+		return err
+	}
+	if err := s.TraceCache.Store(inputHash, key, svgPath); err != nil {
+		job.Log.WriteString(fmt.Sprintf("Warning: failed to cache trace: %v\n", err))
+	}
+	return nil
+}
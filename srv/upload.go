@@ -0,0 +1,147 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Upload limits. Only one image per request is processed today; the file
+// count limit is configurable so batch uploads can raise it.
+const (
+	DefaultMaxUploadFiles = 1
+	maxUploadBytes        = 50 << 20
+)
+
+// uploadError carries the HTTP status for a rejected upload
+type uploadError struct {
+	status int
+	err    error
+}
+
+func (e *uploadError) Error() string { return e.err.Error() }
+func (e *uploadError) Unwrap() error { return e.err }
+
+// validateUploadFiles checks the number of uploaded images and each image's
+// size and type before any job is created. Every bad file is reported, by
+// name, rather than stopping at the first.
+func (s *Server) validateUploadFiles(form *multipart.Form) error {
+	var files []*multipart.FileHeader
+	if form != nil {
+		files = form.File["image"]
+	}
+	if len(files) == 0 {
+		return &uploadError{http.StatusBadRequest, fmt.Errorf("no image uploaded")}
+	}
+	if s.MaxUploadFiles > 0 && len(files) > s.MaxUploadFiles {
+		return &uploadError{http.StatusBadRequest,
+			fmt.Errorf("too many files: got %d, at most %d per request", len(files), s.MaxUploadFiles)}
+	}
+
+	status := http.StatusBadRequest
+	var errs []error
+	for _, fh := range files {
+		if err := validateUploadFile(fh, s.AllowedTypes); err != nil {
+			var ue *uploadError
+			if errors.As(err, &ue) && len(errs) == 0 {
+				status = ue.status
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", fh.Filename, err))
+		}
+	}
+	if len(errs) > 0 {
+		return &uploadError{status, errors.Join(errs...)}
+	}
+	return nil
+}
+
+// validateUploadFile checks one uploaded image's size and sniffed content
+// type. A non-empty allowed list further restricts the accepted types.
+func validateUploadFile(fh *multipart.FileHeader, allowed []string) error {
+	if fh.Size == 0 {
+		return &uploadError{http.StatusBadRequest, fmt.Errorf("file is empty")}
+	}
+	if fh.Size > maxUploadBytes {
+		return &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Errorf("file is %d bytes; the maximum is %d", fh.Size, maxUploadBytes)}
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return &uploadError{http.StatusBadRequest, err}
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return &uploadError{http.StatusBadRequest, err}
+	}
+	if ct := sniffImageType(head[:n]); !strings.HasPrefix(ct, "image/") {
+		return &uploadError{http.StatusUnsupportedMediaType, fmt.Errorf("not an image (detected %s)", ct)}
+	} else if len(allowed) > 0 && !slices.Contains(allowed, ct) {
+		return &uploadError{http.StatusUnsupportedMediaType,
+			fmt.Errorf("%s images are not accepted by this server (allowed: %s)", ct, strings.Join(allowed, ", "))}
+	}
+	return nil
+}
+
+// sniffImageType returns the content type of an upload from its first
+// bytes. It is http.DetectContentType, plus the Netpbm formats and TGA that
+// autotrace reads and DetectContentType does not know.
+func sniffImageType(head []byte) string {
+	ct := http.DetectContentType(head)
+	// A TGA without an ID or color map starts as an icon or cursor does,
+	// but an icon with no images is not one
+	isIcon := ct == "image/x-icon" && !(len(head) >= 6 && head[4] == 0 && head[5] == 0)
+	if strings.HasPrefix(ct, "image/") && (ct != "image/x-icon" || isIcon) {
+		return ct
+	}
+	// Netpbm: "P1" to "P6" and whitespace
+	if len(head) >= 3 && head[0] == 'P' && head[1] >= '1' && head[1] <= '6' && strings.IndexByte(" \t\r\n", head[2]) >= 0 {
+		switch head[1] {
+		case '1', '4':
+			return "image/x-portable-bitmap"
+		case '2', '5':
+			return "image/x-portable-graymap"
+		default:
+			return "image/x-portable-pixmap"
+		}
+	}
+	// TGA has no magic number, so the header's fields must all be ones a
+	// TGA can have: a color map type of 0 with no color map spec, or 1; an
+	// image type; a size; and a pixel depth
+	if len(head) >= 18 {
+		colorMap, kind, depth := head[1], head[2], head[16]
+		noMapSpec := head[3] == 0 && head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] == 0
+		width, height := int(head[12])|int(head[13])<<8, int(head[14])|int(head[15])<<8
+		if (colorMap == 1 || colorMap == 0 && noMapSpec) &&
+			slices.Contains([]byte{1, 2, 3, 9, 10, 11}, kind) &&
+			width > 0 && height > 0 &&
+			slices.Contains([]byte{8, 15, 16, 24, 32}, depth) {
+			return "image/x-tga"
+		}
+	}
+	return ct
+}
+
+// ParseAllowedTypes parses a comma-separated list of image MIME types such
+// as "image/png,image/jpeg". Types are matched against the sniffed content
+// type, so only ones sniffImageType reports are useful.
+func ParseAllowedTypes(list string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, "image/") || strings.ContainsAny(t, " ;") {
+			return nil, fmt.Errorf("allowed type %q: expected an image MIME type such as image/png", t)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
@@ -0,0 +1,75 @@
+package srv
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// workDirPrefix marks this server's per-job scratch directories inside
+// WorkDir, so a scratch location shared with other servers (e.g. /tmp) is
+// only ever cleaned of our own files. It is derived from UploadsDir, which
+// no two servers share, so it stays the same across restarts.
+func (s *Server) workDirPrefix() string {
+	dir, err := filepath.Abs(s.UploadsDir)
+	if err != nil {
+		dir = s.UploadsDir
+	}
+	return "job-" + hashString(dir)[:8] + "-"
+}
+
+// jobWorkDir creates a fresh scratch directory for a job's intermediates
+func (s *Server) jobWorkDir(job *Job) (string, error) {
+	if err := os.MkdirAll(s.WorkDir, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(s.WorkDir, s.workDirPrefix()+job.ID+"-")
+}
+
+// cleanWorkDir removes scratch directories left behind by this server's
+// jobs that were interrupted, e.g. by a restart
+func (s *Server) cleanWorkDir() {
+	prefix := s.workDirPrefix()
+	entries, err := os.ReadDir(s.WorkDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+			if err := os.RemoveAll(filepath.Join(s.WorkDir, e.Name())); err != nil {
+				slog.Warn("clean work dir", "dir", e.Name(), "error", err)
+			}
+		}
+	}
+}
+
+// installFile copies a finished file from the work dir to its final path.
+// It writes a temporary file next to dst and renames it into place, so
+// readers never see a partial file even when the work dir is on another
+// filesystem.
+func installFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}